@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runAdd implements `memssh add`: it loads private keys the same way a
+// connection would (paste, -key, -key-env, -key-provider) and adds them to the
+// running ssh-agent, so later runs can authenticate with -agent.
+func runAdd(args []string) {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	var opts connOptions
+	opts.registerKeys(fs)
+	lifetime := fs.Duration("t", 0, "Remove the key from the agent after this long, e.g. 30m or 8h (default: until the agent exits)")
+	confirm := fs.Bool("c", false, "Ask the agent to confirm each use of the key")
+	fs.Parse(args)
+
+	if *lifetime < 0 || *lifetime%time.Second != 0 {
+		log.Fatal("-t must be a positive whole number of seconds")
+	}
+	passphrase, err := opts.passphraseSource()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ag, agentConn, err := connectAgent()
+	if err != nil {
+		log.Fatalf("Agent error: %v", err)
+	}
+	defer agentConn.Close()
+
+	type source struct {
+		label string
+		load  func() (*pemBackend, error)
+	}
+	var sources []source
+	if opts.keyEnv != "" {
+		sources = append(sources, source{"$" + opts.keyEnv, func() (*pemBackend, error) {
+			return newPEMBackendFromEnv(opts.keyEnv, passphrase)
+		}})
+	}
+	for _, uri := range opts.keyProviders {
+		sources = append(sources, source{uri, func() (*pemBackend, error) {
+			return newPEMBackendFromProvider(uri, passphrase)
+		}})
+	}
+	keys := opts.keys
+	if len(keys) == 0 && len(sources) == 0 {
+		keys = []string{""}
+	}
+	for _, key := range keys {
+		label := key
+		if label == "" || label == "-" {
+			label = "memssh"
+		}
+		sources = append(sources, source{label, func() (*pemBackend, error) {
+			return newPEMBackend(key, passphrase)
+		}})
+	}
+
+	for _, src := range sources {
+		backend, err := src.load()
+		if err != nil {
+			log.Fatalf("Private key error (%s): %v", src.label, err)
+		}
+		added := agent.AddedKey{
+			PrivateKey:       backend.key,
+			Comment:          src.label,
+			LifetimeSecs:     uint32(*lifetime / time.Second),
+			ConfirmBeforeUse: *confirm,
+		}
+		if err := ag.Add(added); err != nil {
+			log.Fatalf("Adding key to agent failed: %v", err)
+		}
+
+		fmt.Printf("Identity added: %s (%s)\n", ssh.FingerprintSHA256(backend.signer.PublicKey()), src.label)
+		if *lifetime > 0 {
+			fmt.Printf("Lifetime set to %s\n", *lifetime)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// connectAgent connects to the running ssh-agent.
+// The returned connection must stay open for as long as the agent is used.
+func connectAgent() (agent.ExtendedAgent, io.ReadWriteCloser, error) {
+	conn, err := dialAgent()
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to ssh-agent failed: %w", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// requestAgentForwarding asks the server to forward agent requests from the session.
+// A refusal is not fatal; the session simply continues without a forwarded agent.
+func requestAgentForwarding(session *ssh.Session) {
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		log.Printf("Warning: agent forwarding request failed: %v", err)
+	}
+}
+
+// agentBackend exposes the keys held by an ssh-agent as a signer backend.
+// Keys held on a FIDO2 security key get a prompt asking the user to touch the device.
+// When fingerprints is set, only the agent keys with those SHA256 fingerprints are offered.
+type agentBackend struct {
+	agent        agent.ExtendedAgent
+	fingerprints []string
+}
+
+// Signers returns the agent's current signers.
+func (b agentBackend) Signers() ([]ssh.Signer, error) {
+	signers, err := b.agent.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("listing agent keys failed: %w", err)
+	}
+	if len(b.fingerprints) > 0 {
+		signers = slices.DeleteFunc(signers, func(s ssh.Signer) bool {
+			return !slices.Contains(b.fingerprints, ssh.FingerprintSHA256(s.PublicKey()))
+		})
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("agent holds none of the keys %s", strings.Join(b.fingerprints, ", "))
+		}
+	}
+	return wrapSecurityKeySigners(signers), nil
+}
+
+// Close is a no-op; the agent connection is owned by the caller.
+func (b agentBackend) Close() error {
+	return nil
+}
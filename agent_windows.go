@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// openSSHAgentPipe is the named pipe of the Windows built-in OpenSSH agent service.
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to the agent named by SSH_AUTH_SOCK, which may be a named
+// pipe or a Unix socket (e.g. from WSL or Git for Windows). Without it, the
+// built-in OpenSSH agent pipe is tried first and PuTTY's Pageant second.
+func dialAgent() (io.ReadWriteCloser, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		pipe, pipeErr := os.OpenFile(openSSHAgentPipe, os.O_RDWR, 0)
+		if pipeErr == nil {
+			return pipe, nil
+		}
+		pageant, pageantErr := dialPageant()
+		if pageantErr == nil {
+			return pageant, nil
+		}
+		return nil, fmt.Errorf("OpenSSH agent: %v; %v", pipeErr, pageantErr)
+	}
+	if strings.HasPrefix(sock, `\\.\pipe\`) {
+		return os.OpenFile(sock, os.O_RDWR, 0)
+	}
+	return net.Dial("unix", sock)
+}
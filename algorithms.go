@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultHostKeyAlgorithms mirrors the order x/crypto/ssh offers host key
+// algorithms in when ClientConfig.HostKeyAlgorithms is unset.
+var defaultHostKeyAlgorithms = []string{
+	ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSAv01,
+	ssh.InsecureCertAlgoDSAv01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSA,
+	ssh.InsecureKeyAlgoDSA,
+	ssh.KeyAlgoED25519,
+}
+
+// resolveAlgorithms applies an OpenSSH-style algorithm list to defaults: a
+// plain list replaces them, "+list" appends to them, "-list" removes from
+// them, and "^list" moves entries to the front. Entries may use "*" and "?"
+// wildcards and must name algorithms in known. An empty spec returns nil,
+// which leaves the library defaults in place.
+func resolveAlgorithms(spec string, defaults, known []string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	op := spec[0]
+	if strings.ContainsRune("+-^", rune(op)) {
+		spec = spec[1:]
+	} else {
+		op = 0
+	}
+
+	var named []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		candidates := known
+		if op == '-' {
+			candidates = defaults
+		}
+		matched := false
+		for _, algo := range candidates {
+			if ok, err := path.Match(pattern, algo); err != nil {
+				return nil, fmt.Errorf("invalid algorithm pattern %q", pattern)
+			} else if ok {
+				matched = true
+				named = appendMissing(named, []string{algo})
+			}
+		}
+		if !matched && op != '-' {
+			return nil, fmt.Errorf("unsupported algorithm %q", pattern)
+		}
+	}
+
+	switch op {
+	case '+':
+		return appendMissing(slices.Clone(defaults), named), nil
+	case '-':
+		return slices.DeleteFunc(slices.Clone(defaults), func(algo string) bool {
+			return slices.Contains(named, algo)
+		}), nil
+	case '^':
+		return appendMissing(named, defaults), nil
+	}
+	return named, nil
+}
+
+// appendMissing appends the entries of extra not already in list.
+func appendMissing(list, extra []string) []string {
+	for _, algo := range extra {
+		if !slices.Contains(list, algo) {
+			list = append(list, algo)
+		}
+	}
+	return list
+}
+
+// hostKeyAlgorithms resolves a -host-key-algorithms value.
+func hostKeyAlgorithms(spec string) ([]string, error) {
+	known := append(ssh.SupportedAlgorithms().HostKeys, ssh.InsecureAlgorithms().HostKeys...)
+	algos, err := resolveAlgorithms(spec, defaultHostKeyAlgorithms, known)
+	if err == nil && spec != "" && len(algos) == 0 {
+		err = errors.New("no host key algorithms left")
+	}
+	return algos, err
+}
+
+// postQuantumKexAlgorithms are the hybrid post-quantum key exchanges OpenSSH
+// servers offer, in order of preference. Only those x/crypto/ssh implements
+// are used: currently mlkem768x25519-sha256, which it also offers first by
+// default; the sntrup761 variants are listed so they are picked up once it
+// implements them.
+var postQuantumKexAlgorithms = []string{
+	ssh.KeyExchangeMLKEM768X25519,
+	"sntrup761x25519-sha512",
+	"sntrup761x25519-sha512@openssh.com",
+}
+
+// kexAlgorithms returns the key exchanges to offer. By default that is the
+// library's list, which prefers post-quantum ones; with requirePQ it is only
+// the post-quantum key exchanges, so servers without one are refused.
+func kexAlgorithms(requirePQ bool) ([]string, error) {
+	if !requirePQ {
+		return nil, nil
+	}
+	supported := ssh.SupportedAlgorithms().KeyExchanges
+	var algos []string
+	for _, algo := range postQuantumKexAlgorithms {
+		if slices.Contains(supported, algo) {
+			algos = append(algos, algo)
+		}
+	}
+	if len(algos) == 0 {
+		return nil, errors.New("this build supports no post-quantum key exchange")
+	}
+	return algos, nil
+}
+
+// explainKexError rewrites a failed key exchange under -require-pq-kex into
+// a message naming the missing post-quantum support.
+func explainKexError(err error, requirePQ bool) error {
+	if requirePQ && err != nil && strings.Contains(err.Error(), "no common algorithm for key exchange") {
+		return fmt.Errorf("server does not support post-quantum key exchange (%w)", err)
+	}
+	return err
+}
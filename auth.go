@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// authMethodNames lists the methods accepted by -auth.
+var authMethodNames = []string{"agent", "pkcs11", "enclave", "key", "password", "interactive"}
+
+// errHostbasedUnsupported explains why "hostbased" cannot be used in -auth:
+// golang.org/x/crypto/ssh has no client-side hostbased method, and its
+// AuthMethod interface cannot be implemented outside that package.
+var errHostbasedUnsupported = errors.New("hostbased authentication is not supported by the SSH library memssh is built on; ask the administrators for SSH certificates instead")
+
+// authOptions collects everything needed to build the client's auth methods.
+type authOptions struct {
+	chain        []string
+	keys         []string
+	keyEnv       string
+	keyProviders []string
+	agentKeys    []string
+	passphrase   passphraseSource
+	pkcs11Module string
+	enclaveLabel string
+	issuer       certIssuer
+	ephemeralKey bool
+	certs        certPolicy
+	totp         *totpSource
+	agent        agent.ExtendedAgent
+}
+
+// authMethodsFunc returns the auth methods for logging in as user on host,
+// which only differ in what the password prompt shows. Jump hosts and the
+// destination share the same keys this way.
+type authMethodsFunc func(user, host string) []ssh.AuthMethod
+
+// defaultAuthChain derives the auth order from the individual auth flags when
+// -auth is not given. A private key is used when keys were passed explicitly
+// or when no other method was requested.
+func defaultAuthChain(haveKeys, useAgent, usePKCS11, useEnclave, password, interactive bool) []string {
+	var chain []string
+	if useAgent {
+		chain = append(chain, "agent")
+	}
+	if usePKCS11 {
+		chain = append(chain, "pkcs11")
+	}
+	if useEnclave {
+		chain = append(chain, "enclave")
+	}
+	if haveKeys || (!useAgent && !usePKCS11 && !useEnclave && !password && !interactive) {
+		chain = append(chain, "key")
+	}
+	if password {
+		chain = append(chain, "password")
+	}
+	if interactive {
+		chain = append(chain, "interactive")
+	}
+	return chain
+}
+
+// buildAuthMethods turns the auth chain into SSH auth methods in chain order.
+// The agent, pkcs11, enclave and key sources are merged into a single publickey method
+// placed where the first of them appears. Keys are loaded once, however many
+// hosts the methods are used for. The returned function releases any
+// hardware sessions opened along the way.
+func buildAuthMethods(opts authOptions) (authMethodsFunc, func(), error) {
+	var order []string
+	var backends []signerBackend
+	closeAll := func() {
+		for _, backend := range backends {
+			backend.Close()
+		}
+	}
+
+	for _, name := range opts.chain {
+		if name == "hostbased" {
+			closeAll()
+			return nil, nil, errHostbasedUnsupported
+		}
+		if !slices.Contains(authMethodNames, name) {
+			closeAll()
+			return nil, nil, fmt.Errorf("unknown auth method %q (valid: %s)", name, strings.Join(authMethodNames, ", "))
+		}
+		switch name {
+		case "agent":
+			backends = append(backends, agentBackend{agent: opts.agent, fingerprints: opts.agentKeys})
+		case "pkcs11":
+			if opts.pkcs11Module == "" {
+				closeAll()
+				return nil, nil, fmt.Errorf("auth method pkcs11 requires -pkcs11")
+			}
+			backend, err := openPKCS11(opts.pkcs11Module)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("PKCS#11: %w", err)
+			}
+			backends = append(backends, backend)
+		case "enclave":
+			label := opts.enclaveLabel
+			if label == "" {
+				label = "*"
+			}
+			backend, err := openSecureEnclave(label)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("Secure Enclave: %w", err)
+			}
+			backends = append(backends, backend)
+		case "key":
+			if opts.keyEnv != "" {
+				backend, err := newPEMBackendFromEnv(opts.keyEnv, opts.passphrase)
+				if err != nil {
+					closeAll()
+					return nil, nil, fmt.Errorf("private key: %w", err)
+				}
+				backends = append(backends, opts.withCertificates(backend))
+			}
+			for _, uri := range opts.keyProviders {
+				backend, err := newPEMBackendFromProvider(uri, opts.passphrase)
+				if err != nil {
+					closeAll()
+					return nil, nil, fmt.Errorf("key provider %s: %w", uri, err)
+				}
+				backends = append(backends, opts.withCertificates(backend))
+			}
+			keys := opts.keys
+			if opts.ephemeralKey {
+				backend, err := newEphemeralBackend()
+				if err != nil {
+					closeAll()
+					return nil, nil, fmt.Errorf("generating ephemeral key: %w", err)
+				}
+				backends = append(backends, opts.withCertificates(backend))
+			} else if len(keys) == 0 && opts.keyEnv == "" && len(opts.keyProviders) == 0 {
+				keys = []string{""}
+			}
+			for _, key := range keys {
+				backend, err := newPEMBackend(key, opts.passphrase)
+				if err != nil {
+					closeAll()
+					return nil, nil, fmt.Errorf("private key: %w", err)
+				}
+				backends = append(backends, opts.withCertificates(backend))
+			}
+		case "password", "interactive":
+			order = append(order, name)
+			continue
+		}
+		if !slices.Contains(order, "publickey") {
+			order = append(order, "publickey")
+		}
+	}
+
+	publicKey := publicKeyAuth(backends, opts.certs)
+	methodsFor := func(user, host string) []ssh.AuthMethod {
+		var methods []ssh.AuthMethod
+		for _, name := range order {
+			switch name {
+			case "publickey":
+				methods = append(methods, publicKey)
+			case "password":
+				methods = append(methods, ssh.PasswordCallback(promptPassword(user, host)))
+			case "interactive":
+				methods = append(methods, ssh.KeyboardInteractive(answerChallenges(opts.totp)))
+			}
+		}
+		return methods
+	}
+	return methodsFor, closeAll, nil
+}
+
+// withCertificates wraps a private key backend so its keys are presented with
+// a freshly issued certificate when a certificate authority is configured.
+func (opts authOptions) withCertificates(backend signerBackend) signerBackend {
+	if opts.issuer != nil {
+		return &certBackend{inner: backend, issue: opts.issuer}
+	}
+	return backend
+}
+
+// promptPassword returns a password callback that asks for the password only when
+// the server requests it. The raw input is zeroed once it has been handed to the SSH library.
+func promptPassword(user, host string) func() (string, error) {
+	return func() (string, error) {
+		pass, err := readSecret(fmt.Sprintf("%s@%s's password: ", user, host))
+		if err != nil {
+			return "", fmt.Errorf("reading password failed: %w", err)
+		}
+		defer zeroBytes(pass)
+		return string(pass), nil
+	}
+}
+
+// answerChallenges returns a keyboard-interactive callback that relays the
+// server's challenges to the terminal. Questions flagged as non-echoing
+// (passwords, OTP codes) are read without echo, and questions matching the
+// TOTP prompt are answered automatically when a TOTP source is configured.
+func answerChallenges(totp *totpSource) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if name != "" {
+			fmt.Println(name)
+		}
+		if instruction != "" {
+			fmt.Println(instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if totp.matches(question) {
+				code, err := totp.code()
+				if err != nil {
+					return nil, fmt.Errorf("generating one-time code failed: %w", err)
+				}
+				fmt.Printf("%s(filled automatically)\n", question)
+				answers[i] = code
+				continue
+			}
+			if echos[i] {
+				fmt.Print(question)
+				reader := bufio.NewReader(os.Stdin)
+				input, err := reader.ReadString('\n')
+				if err != nil {
+					return nil, fmt.Errorf("reading response failed: %w", err)
+				}
+				answers[i] = strings.TrimRight(input, "\r\n")
+				continue
+			}
+			resp, err := readSecret(question)
+			if err != nil {
+				return nil, fmt.Errorf("reading response failed: %w", err)
+			}
+			answers[i] = string(resp)
+			zeroBytes(resp)
+		}
+		return answers, nil
+	}
+}
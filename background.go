@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// backgroundEnv marks the process -f starts to go to the background. It
+// holds the path of a file the process removes once it is connected.
+const backgroundEnv = "MEMSSH_BACKGROUND"
+
+// startBackground implements -f: it runs memssh again, with the same
+// arguments, and exits once that process has connected and gone to the
+// background, or with its exit status if it fails first. Prompts for
+// passphrases or host keys still appear here, since the process only lets go
+// of the terminal once connected.
+func startBackground() {
+	ready, err := os.CreateTemp("", "memssh-ready-")
+	if err != nil {
+		log.Fatalf("Failed to go to the background: %v", err)
+	}
+	ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		os.Remove(ready.Name())
+		log.Fatalf("Failed to go to the background: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), backgroundEnv+"="+ready.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	fd := int(os.Stdin.Fd())
+	state, _ := term.GetState(fd)
+	if err := cmd.Start(); err != nil {
+		os.Remove(ready.Name())
+		log.Fatalf("Failed to go to the background: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			os.Remove(ready.Name())
+			var exitErr *exec.ExitError
+			switch {
+			case errors.As(err, &exitErr):
+				os.Exit(exitErr.ExitCode())
+			case err != nil:
+				fatalConnection("Background process failed: %v", err)
+			}
+			os.Exit(0)
+		case <-interrupt:
+			cmd.Process.Kill()
+			os.Remove(ready.Name())
+			if state != nil {
+				term.Restore(fd, state)
+			}
+			os.Exit(130)
+		case <-ticker.C:
+			if _, err := os.Stat(ready.Name()); errors.Is(err, fs.ErrNotExist) {
+				os.Exit(0)
+			}
+		}
+	}
+}
+
+// enterBackground lets the process started by startBackground go once it is
+// connected: it tells the waiting process so and lets go of the terminal.
+// Elsewhere it does nothing.
+func enterBackground() {
+	ready := os.Getenv(backgroundEnv)
+	if ready == "" {
+		return
+	}
+	os.Remove(ready)
+	if err := detachFromTerminal(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// holdConnection implements -N: it keeps conn open for its forwards until
+// interrupted, and returns the exit status. When the connection drops, it
+// reconnects with autoReconnect, or gives up.
+func holdConnection(conn *connection, autoReconnect bool) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	for {
+		select {
+		case <-stop:
+			return 0
+		case <-conn.lost:
+		}
+		log.Printf("Connection to %s lost", conn.address)
+		if !autoReconnect {
+			return exitConnectionFailed
+		}
+		if err := conn.reconnect(); err != nil {
+			log.Printf("Failed to reconnect: %v", err)
+			return exitConnectionFailed
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// printBanner returns a callback showing the banner a server sends before
+// authentication, such as a legal notice from sshd's Banner option, on w.
+// Control characters other than tabs and newlines are left out, so a server
+// cannot send escape sequences to the terminal this way.
+func printBanner(w io.Writer) ssh.BannerCallback {
+	return func(message string) error {
+		message = strings.Map(func(r rune) rune {
+			if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+				return r
+			}
+			return -1
+		}, message)
+		if message != "" && !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+		io.WriteString(w, message)
+		return nil
+	}
+}
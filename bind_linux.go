@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindToInterface returns a net.Dialer Control function that binds sockets
+// to the network interface name with SO_BINDTODEVICE, so connections leave
+// through it whatever the routing table says.
+func bindToInterface(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("binding to interface %s: %w", name, sockErr)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToInterface is unavailable outside Linux, which is the only system
+// with SO_BINDTODEVICE; use -bind-address with the interface's IP instead.
+func bindToInterface(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("-bind-interface is only supported on Linux; use -bind-address with the interface's address")
+}
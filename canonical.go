@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// errNotCanonicalized reports that none of the canonical domains gave a
+// name that resolves.
+var errNotCanonicalized = errors.New("no canonical domain gives a name that resolves")
+
+// canonicalizeHost implements OpenSSH's CanonicalizeHostname: a host name
+// with at most maxDots dots is tried with each of domains appended, and the
+// first name that resolves for network (ip, ip4 or ip6) is returned. A name
+// ending in "." is fully qualified already and only loses the dot. Addresses,
+// unix:// sockets, .onion names (lest they leak to DNS) and names with more
+// dots are returned unchanged.
+func canonicalizeHost(host string, domains []string, maxDots int, network string, timeout time.Duration) (string, error) {
+	if net.ParseIP(host) != nil || strings.HasPrefix(host, unixSocketScheme) || isOnionHost(host) {
+		return host, nil
+	}
+	if name, ok := strings.CutSuffix(host, "."); ok {
+		return name, nil
+	}
+	if strings.Count(host, ".") > maxDots {
+		return host, nil
+	}
+	for _, domain := range domains {
+		name := host + "." + strings.Trim(domain, ".")
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if _, err := net.DefaultResolver.LookupNetIP(ctx, network, name); err == nil {
+			return name, nil
+		}
+	}
+	return host, errNotCanonicalized
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castRecorder records sessions for -record as an asciinema v2 cast: a JSON
+// header with the terminal size, then one JSON array per event with the
+// seconds since the start, "o" for output or "r" for a resize, and its data.
+// `asciinema play` replays it.
+type castRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	enc     *json.Encoder
+	start   time.Time
+	width   int
+	height  int
+	partial []byte // an incomplete UTF-8 sequence at the end of the last output
+}
+
+// castHeader is the first line of an asciinema v2 cast.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// openCastRecorder creates the cast at path, replacing an existing one, for
+// a terminal of width by height; title names the session.
+func openCastRecorder(path string, width, height int, title string) (*castRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &castRecorder{file: file, enc: json.NewEncoder(file), start: time.Now(), width: width, height: height}
+	r.enc.SetEscapeHTML(false)
+	header := castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	if err := r.enc.Encode(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close finishes the cast.
+func (r *castRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.partial) > 0 {
+		r.event("o", string(r.partial))
+	}
+	r.file.Close()
+}
+
+// resize records a change of the terminal size.
+func (r *castRecorder) resize(width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if width == r.width && height == r.height {
+		return
+	}
+	r.width, r.height = width, height
+	r.event("r", strconv.Itoa(width)+"x"+strconv.Itoa(height))
+}
+
+// output records p as output. Casts hold text, so a UTF-8 sequence split
+// across writes is kept back until it is complete.
+func (r *castRecorder) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.partial, p...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	r.partial = append([]byte(nil), data[end:]...)
+	if end > 0 {
+		r.event("o", string(data[:end]))
+	}
+}
+
+// event writes one event line.
+func (r *castRecorder) event(kind, data string) {
+	elapsed := json.Number(fmt.Sprintf("%.6f", time.Since(r.start).Seconds()))
+	r.enc.Encode([]any{elapsed, kind, data})
+}
+
+// wrapOutput returns a writer passing remote output on to w and into the cast.
+func (r *castRecorder) wrapOutput(w io.Writer) io.Writer {
+	return castWriter{r: r, w: w}
+}
+
+type castWriter struct {
+	r *castRecorder
+	w io.Writer
+}
+
+func (w castWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.r.output(p[:n])
+	return n, err
+}
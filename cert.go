@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certPolicy reports the certificates offered during authentication and
+// checks how long they remain valid, which matters with short-lived
+// certificates issued per session.
+type certPolicy struct {
+	// warn is the remaining validity below which a warning is printed.
+	warn time.Duration
+	// strict drops certificates that are expired, not yet valid or within
+	// the warning window instead of only warning about them.
+	strict bool
+}
+
+// filter prints the details of every certificate among signers and returns
+// the signers that may be offered to the server.
+func (p certPolicy) filter(signers []ssh.Signer) []ssh.Signer {
+	now := time.Now()
+	var kept []ssh.Signer
+	for _, signer := range signers {
+		cert, ok := asCertificate(signer.PublicKey())
+		if !ok {
+			kept = append(kept, signer)
+			continue
+		}
+		printCertificate(cert, now)
+		if problem := p.check(cert, now); problem != "" {
+			if p.strict {
+				log.Printf("Warning: not offering certificate %s: %s", cert.KeyId, problem)
+				continue
+			}
+			log.Printf("Warning: certificate %s %s", cert.KeyId, problem)
+		}
+		kept = append(kept, signer)
+	}
+	return kept
+}
+
+// asCertificate returns pub as a certificate. Keys listed by an agent are
+// opaque, so certificates among them are recognized by type and re-parsed.
+func asCertificate(pub ssh.PublicKey) (*ssh.Certificate, bool) {
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		return cert, true
+	}
+	if !strings.Contains(pub.Type(), "-cert-v01@openssh.com") {
+		return nil, false
+	}
+	parsed, err := ssh.ParsePublicKey(pub.Marshal())
+	if err != nil {
+		return nil, false
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	return cert, ok
+}
+
+// check returns a description of the validity problem of cert at now, or ""
+// if it is comfortably valid.
+func (p certPolicy) check(cert *ssh.Certificate, now time.Time) string {
+	unix := uint64(now.Unix())
+	switch {
+	case unix < cert.ValidAfter:
+		return fmt.Sprintf("is not valid until %s", certTime(cert.ValidAfter))
+	case cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore:
+		return fmt.Sprintf("expired at %s", certTime(cert.ValidBefore))
+	case cert.ValidBefore != ssh.CertTimeInfinity && time.Unix(int64(cert.ValidBefore), 0).Sub(now) < p.warn:
+		return fmt.Sprintf("expires in %s", time.Unix(int64(cert.ValidBefore), 0).Sub(now).Round(time.Second))
+	}
+	return ""
+}
+
+// printCertificate shows the identity, principals and validity window of a
+// user certificate.
+func printCertificate(cert *ssh.Certificate, now time.Time) {
+	fmt.Printf("Certificate %s (key ID %q, serial %d, signed by %s)\n",
+		ssh.FingerprintSHA256(cert.Key), cert.KeyId, cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey))
+	principals := "(any)"
+	if len(cert.ValidPrincipals) > 0 {
+		principals = strings.Join(cert.ValidPrincipals, ", ")
+	}
+	fmt.Printf("  Principals: %s\n", principals)
+
+	validity := fmt.Sprintf("  Valid: from %s to %s", certTime(cert.ValidAfter), certTime(cert.ValidBefore))
+	if cert.ValidBefore != ssh.CertTimeInfinity && uint64(now.Unix()) < cert.ValidBefore {
+		validity += fmt.Sprintf(" (%s left)", time.Unix(int64(cert.ValidBefore), 0).Sub(now).Round(time.Second))
+	}
+	fmt.Println(validity)
+}
+
+// certTime formats a certificate timestamp, with the open-ended bounds
+// spelled out.
+func certTime(t uint64) string {
+	switch t {
+	case 0:
+		return "always"
+	case ssh.CertTimeInfinity:
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).Local().Format("2006-01-02 15:04:05 MST")
+}
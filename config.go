@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// memsshConfig is the optional JSON configuration file, stored next to
+// known_hosts.json by default.
+type memsshConfig struct {
+	// Identities maps destinations to the identity to use when no key
+	// was given on the command line. All matching entries are used, in order.
+	Identities []identityRule `json:"identities"`
+	// Profiles maps names that can be run as `memssh NAME` to command-line
+	// flags and their values, e.g. {"host": "db1", "agent-forward": true}.
+	Profiles map[string]map[string]any `json:"profiles,omitempty"`
+	// Daemon lists the profiles or destinations `memssh daemon` connects to
+	// when given none on the command line.
+	Daemon []string `json:"daemon,omitempty"`
+}
+
+// identityRule selects an identity for hosts matching a glob pattern.
+// Exactly one of Key, AgentKey and Provider is expected per rule.
+type identityRule struct {
+	Host     string `json:"host"`
+	Key      string `json:"key,omitempty"`
+	AgentKey string `json:"agent_key,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// getConfigPath returns the default location of memssh.json.
+func getConfigPath() string {
+	return filepath.Join(filepath.Dir(getKnownHostsPath()), "memssh.json")
+}
+
+// loadConfig reads the config file. A missing file yields an empty config;
+// anything else that goes wrong is reported so a typo is not silently ignored.
+func loadConfig(path string) (*memsshConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &memsshConfig{}, nil
+		}
+		return nil, err
+	}
+	var config memsshConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %w", path, err)
+	}
+	for i, rule := range config.Identities {
+		if _, err := matchHostPattern(rule.Host, ""); err != nil {
+			return nil, fmt.Errorf("%s: identities[%d]: invalid host pattern %q", path, i, rule.Host)
+		}
+	}
+	return &config, nil
+}
+
+// applyProfile sets the flags of the named profile on fs, leaving flags that
+// were given on the command line alone. Values may be strings, numbers,
+// booleans, or lists for repeatable flags; a leading "~/" is expanded.
+func (c *memsshConfig) applyProfile(fs *flag.FlagSet, name string) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown command or profile %q", name)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, option := range slices.Sorted(maps.Keys(profile)) {
+		if fs.Lookup(option) == nil {
+			return fmt.Errorf("profile %s: unknown option %q", name, option)
+		}
+		if given[option] {
+			continue
+		}
+		values, ok := profile[option].([]any)
+		if !ok {
+			values = []any{profile[option]}
+		}
+		for _, value := range values {
+			var s string
+			switch v := value.(type) {
+			case string:
+				s = expandHome(v)
+			case bool:
+				s = strconv.FormatBool(v)
+			case float64:
+				s = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				return fmt.Errorf("profile %s: unsupported value for %q", name, option)
+			}
+			if err := fs.Set(option, s); err != nil {
+				return fmt.Errorf("profile %s: %s: %w", name, option, err)
+			}
+		}
+	}
+	return nil
+}
+
+// identitiesFor returns the rules whose host pattern matches host.
+func (c *memsshConfig) identitiesFor(host string) []identityRule {
+	var rules []identityRule
+	for _, rule := range c.Identities {
+		if ok, _ := matchHostPattern(rule.Host, host); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// matchHostPattern matches a host name against a glob pattern ("*", "?" and
+// character classes), ignoring case.
+func matchHostPattern(pattern, host string) (bool, error) {
+	return path.Match(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+// expandHome replaces a leading "~/" with the user's home directory.
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return p
+}
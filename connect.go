@@ -0,0 +1,1037 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// connOptions holds the connection and authentication flags shared by every
+// command that talks to a server.
+type connOptions struct {
+	host               string
+	port               int
+	user               string
+	keys               stringList
+	keyEnv             string
+	keyProviders       stringList
+	noStore            bool
+	hashKnownHosts     bool
+	revokedHostKeys    string
+	strictHostKeys     string
+	acceptNew          bool
+	expectFingerprints stringList
+	knownHostsFallback bool
+	requireSigned      bool
+	requirePQKex       bool
+	rekeyLimit         string
+	limitRate          string
+	updateHostKeys     bool
+	fingerprintHash    string
+	hostKeyAlgorithms  string
+	jump               string
+	socks5             string
+	torProxy           string
+	connectTimeout     time.Duration
+	retries            int
+	retryDelay         time.Duration
+	ipv4Only           bool
+	ipv6Only           bool
+	bindAddress        string
+	bindInterface      string
+	tcpNoDelay         bool
+	tcpKeepAlive       bool
+	tcpKeepAliveIdle   time.Duration
+	tcpKeepAliveIntvl  time.Duration
+	tcpKeepAliveCount  int
+	tcpSendBuffer      string
+	tcpReceiveBuffer   string
+	ipQoS              string
+	keepAliveInterval  time.Duration
+	keepAliveMax       int
+	password           bool
+	useAgent           bool
+	agentKeys          stringList
+	agentForward       bool
+	remoteForwards     stringList
+	setEnv             repeatedString
+	sendEnv            stringList
+	forcePTY           bool
+	disablePTY         bool
+	logSession         string
+	logSessionInput    string
+	record             string
+	localCommand       string
+	quietBanner        bool
+	prefixTime         bool
+	prefixHost         bool
+	sudoPasswordFile   string
+	sudoPasswordEnv    string
+	sudoPasswordCmd    string
+	sudoPrompt         string
+	pkcs11Module       string
+	enclaveLabel       string
+	kbdInteractive     bool
+	passphraseFile     string
+	passphraseEnv      string
+	passphraseCmd      string
+	passphraseAttempts int
+	useKeychain        bool
+	vaultRole          string
+	vaultMount         string
+	oidcIssuer         string
+	oidcClientID       string
+	oidcCA             string
+	certWarn           time.Duration
+	certStrict         bool
+	authChain          stringList
+	totpEnv            string
+	totpCmd            string
+	totpPrompt         string
+	configPath         string
+	sshConfigPath      string
+	canonicalDomains   string
+	canonicalMaxDots   int
+	controlPath        string
+	controlPersist     time.Duration
+	sshConfig          sshConfigHost
+}
+
+// register defines the connection flags on fs.
+func (o *connOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.host, "host", "", "SSH server hostname or IP")
+	fs.IntVar(&o.port, "port", 22, "SSH server port")
+	fs.StringVar(&o.user, "user", "", "SSH username")
+	fs.StringVar(&o.jump, "jump", "", "Connect through jump hosts: comma-separated [user@]host[:port] hops, in order (optional)")
+	fs.BoolVar(&o.ipv4Only, "4", false, "Connect over IPv4 only")
+	fs.BoolVar(&o.ipv6Only, "6", false, "Connect over IPv6 only")
+	fs.StringVar(&o.bindAddress, "bind-address", "", "Local IP address to connect from, on machines with several (optional)")
+	fs.StringVar(&o.bindInterface, "bind-interface", "", "Network interface to connect through, e.g. eth1 (Linux only, optional)")
+	fs.BoolVar(&o.tcpNoDelay, "tcp-nodelay", true, "Send small packets at once (TCP_NODELAY); -tcp-nodelay=false batches them with Nagle's algorithm")
+	fs.BoolVar(&o.tcpKeepAlive, "tcp-keepalive", true, "Send TCP keepalive probes on an idle connection")
+	fs.DurationVar(&o.tcpKeepAliveIdle, "tcp-keepalive-idle", 0, "Idle time before the first TCP keepalive probe (default 15s)")
+	fs.DurationVar(&o.tcpKeepAliveIntvl, "tcp-keepalive-interval", 0, "Time between TCP keepalive probes (default 15s)")
+	fs.IntVar(&o.tcpKeepAliveCount, "tcp-keepalive-count", 0, "Unanswered TCP keepalive probes before the connection is dropped (default 9)")
+	fs.StringVar(&o.tcpSendBuffer, "tcp-send-buffer", "", "Socket send buffer size, e.g. 4M for fast links with high latency (default chosen by the system)")
+	fs.StringVar(&o.tcpReceiveBuffer, "tcp-receive-buffer", "", "Socket receive buffer size, e.g. 4M (default chosen by the system)")
+	fs.StringVar(&o.ipQoS, "ip-qos", "", "DSCP/TOS marking of outgoing packets: a class such as ef, af21 or cs1, lowdelay, throughput, or a TOS byte such as 0xb8 (optional)")
+	fs.DurationVar(&o.connectTimeout, "connect-timeout", 0, "Give up if the server has not answered the connection and key exchange within this time, e.g. 10s (default no limit)")
+	fs.IntVar(&o.retries, "retries", 0, "Retry the connection this many times if it fails for network reasons, e.g. while the server boots")
+	fs.DurationVar(&o.retryDelay, "retry-delay", time.Second, "Delay before the first retry; it doubles with each further one, up to 30s")
+	fs.DurationVar(&o.keepAliveInterval, "keepalive-interval", 0, "Send a keepalive to the server this often, e.g. 30s, to detect dead connections (default off)")
+	fs.IntVar(&o.keepAliveMax, "keepalive-max", 3, "Close the connection after this many unanswered keepalives in a row")
+	fs.StringVar(&o.controlPath, "control-path", "", "Share one connection per server through a socket at this path; %h, %p, %r and %C expand to host, port, user and a hash of them (optional)")
+	fs.DurationVar(&o.controlPersist, "control-persist", 0, "Keep the shared connection open in the background until unused for this long, e.g. 10m (requires -control-path)")
+	fs.StringVar(&o.socks5, "socks5", "", "Connect through a SOCKS5 proxy at [user[:password]@]host:port (optional)")
+	fs.StringVar(&o.torProxy, "tor-proxy", defaultTorProxy, "SOCKS5 address of the Tor client that .onion hosts are reached through, unless -socks5 is given")
+	o.registerKeys(fs)
+	fs.BoolVar(&o.noStore, "no-store", false, "Do not store new or changed host fingerprints")
+	fs.StringVar(&o.revokedHostKeys, "revoked-host-keys", "", "OpenSSH KRL or public key list of host keys to refuse (optional)")
+	fs.StringVar(&o.strictHostKeys, "strict-host-key-checking", "ask", "Host key policy: yes (known hosts only), accept-new, no, or ask")
+	fs.BoolVar(&o.acceptNew, "accept-new", false, "Trust and store keys of hosts never seen before without prompting, but refuse changed keys (same as -strict-host-key-checking accept-new)")
+	fs.Var(&o.expectFingerprints, "expect-fingerprint", "Trust a new host key without prompting only if it has this SHA256:... or MD5:... fingerprint, repeatable")
+	fs.BoolVar(&o.knownHostsFallback, "known-hosts-fallback", false, "Also trust host keys listed in OpenSSH's ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts")
+	fs.BoolVar(&o.requireSigned, "require-signed-known-hosts", false, "Refuse to connect unless known_hosts.json is signed (see `memssh hosts sign`)")
+	fs.BoolVar(&o.updateHostKeys, "update-host-keys", false, "Store host keys the server announces after login (hostkeys@openssh.com), replacing rotated ones")
+	fs.StringVar(&o.fingerprintHash, "fingerprint-hash", "sha256", "Hash used to display host key fingerprints: sha256 or md5")
+	fs.BoolVar(&o.requirePQKex, "require-pq-kex", false, "Refuse servers that do not support a post-quantum key exchange (mlkem768x25519-sha256)")
+	fs.StringVar(&o.limitRate, "limit-rate", "", "Limit the connection to this many bytes per second in each direction, e.g. 500K (K, M and G suffixes; default unlimited)")
+	fs.StringVar(&o.rekeyLimit, "rekey-limit", "default", "Renegotiate session keys after this much data in either direction, e.g. 512M (K, M and G suffixes; default depends on the cipher)")
+	fs.StringVar(&o.hostKeyAlgorithms, "host-key-algorithms", "", "Comma-separated host key algorithms to accept, in order of preference; prefix with + to add to, - to remove from, or ^ to prepend to the defaults")
+	fs.BoolVar(&o.hashKnownHosts, "hash-known-hosts", false, "Store host addresses hashed so known_hosts.json does not list the servers you use")
+	fs.BoolVar(&o.password, "password", false, "Authenticate with a password (prompted securely)")
+	fs.BoolVar(&o.useAgent, "agent", false, "Authenticate with keys held by the running ssh-agent (SSH_AUTH_SOCK)")
+	fs.Var(&o.agentKeys, "agent-key", "Only offer the agent key with this SHA256 fingerprint, repeatable (implies -agent)")
+	fs.BoolVar(&o.agentForward, "agent-forward", false, "Forward the local ssh-agent to the remote session")
+	fs.BoolVar(&o.forcePTY, "t", false, "Allocate a PTY for -cmd, for commands that need a terminal such as sudo or top")
+	fs.BoolVar(&o.disablePTY, "T", false, "Do not allocate a PTY for the interactive shell")
+	fs.Var(&o.setEnv, "setenv", "Set an environment variable in the remote session, NAME=value; repeatable (the server must accept it, see AcceptEnv)")
+	fs.Var(&o.sendEnv, "sendenv", "Pass local environment variables whose names match this pattern, e.g. 'LC_*'; repeatable or comma-separated")
+	fs.StringVar(&o.logSession, "log-session", "", "Append a typescript of the session's output to this file; %h, %r and %t expand to host, user and start time (optional)")
+	fs.StringVar(&o.logSessionInput, "log-session-input", "", "Also log keystrokes and other input to this file, with answers to password prompts left out (requires -log-session)")
+	fs.BoolVar(&o.quietBanner, "quiet-banner", false, "Do not show the banner servers may send before authentication, e.g. in scripts")
+	fs.StringVar(&o.localCommand, "local-command", "", "Command to run locally once connected and forwarding, with MEMSSH_* variables describing the connection (optional)")
+	fs.BoolVar(&o.prefixTime, "prefix-time", false, "Start each line a command or -script prints with the time it arrived")
+	fs.BoolVar(&o.prefixHost, "prefix-host", false, "Start each line a command or -script prints with the server's host name in brackets")
+	fs.StringVar(&o.sudoPasswordFile, "sudo-password-file", "", "File holding the password to answer sudo prompts in -cmd with; implies a PTY (optional)")
+	fs.StringVar(&o.sudoPasswordEnv, "sudo-password-env", "", "Environment variable holding the password to answer sudo prompts in -cmd with; implies a PTY (optional)")
+	fs.StringVar(&o.sudoPasswordCmd, "sudo-password-cmd", "", "Command printing the password to answer sudo prompts in -cmd with; implies a PTY (optional)")
+	fs.StringVar(&o.sudoPrompt, "sudo-prompt", defaultSudoPrompt, "Regular expression matching the end of the output line that asks for the sudo password")
+	fs.StringVar(&o.record, "record", "", "Record the session as an asciinema v2 cast to this file, for `asciinema play`; %h, %r and %t expand as for -log-session (optional)")
+	fs.Var(&o.remoteForwards, "R", "Forward a port on the server to this side: [bind_address:]port:host:hostport, or port 0 for one the server picks; repeatable")
+	fs.StringVar(&o.pkcs11Module, "pkcs11", "", "PKCS#11 provider library for smartcard/HSM keys (optional)")
+	fs.StringVar(&o.enclaveLabel, "secure-enclave", "", "Sign with the macOS Secure Enclave key with this keychain label, \"*\" for all (optional)")
+	fs.BoolVar(&o.kbdInteractive, "kbd-interactive", false, "Answer keyboard-interactive challenges (OTP, 2FA prompts)")
+	fs.StringVar(&o.vaultRole, "vault-sign", "", "Sign the private key with this Vault SSH role and authenticate with the certificate (optional)")
+	fs.StringVar(&o.vaultMount, "vault-mount", "ssh", "Mount path of the Vault SSH secrets engine")
+	fs.StringVar(&o.oidcIssuer, "oidc-issuer", "", "OpenID Connect issuer URL for device-flow sign-in to a certificate authority (optional)")
+	fs.StringVar(&o.oidcClientID, "oidc-client-id", "", "OAuth client ID registered for memssh with the OIDC issuer")
+	fs.StringVar(&o.oidcCA, "oidc-ca", "", "Certificate authority endpoint that signs keys for OIDC identity tokens")
+	fs.DurationVar(&o.certWarn, "cert-warn", 10*time.Minute, "Warn when a certificate used for login expires within this time")
+	fs.BoolVar(&o.certStrict, "cert-strict", false, "Refuse to offer certificates that are expired, not yet valid or within -cert-warn of expiry")
+	fs.StringVar(&o.totpEnv, "totp-env", "", "Environment variable holding a TOTP secret (base32 or otpauth:// URI) for 2FA prompts (optional)")
+	fs.StringVar(&o.totpCmd, "totp-cmd", "", "Command printing the current one-time code for 2FA prompts (optional)")
+	fs.StringVar(&o.totpPrompt, "totp-prompt", defaultTOTPPrompt, "Regular expression selecting the challenge prompts answered with the one-time code")
+	fs.StringVar(&o.configPath, "config", "", "memssh config file (default ~/.ssh/memssh.json)")
+	fs.StringVar(&o.sshConfigPath, "ssh-config", "", "OpenSSH client config to read host settings from (default ~/.ssh/config; \"none\" to skip)")
+	fs.StringVar(&o.canonicalDomains, "canonical-domains", "", "Comma-separated domains to try appending to short host names, like OpenSSH's CanonicalDomains (optional)")
+	fs.IntVar(&o.canonicalMaxDots, "canonicalize-max-dots", 1, "Only canonicalize host names with at most this many dots")
+	fs.Var(&o.authChain, "auth", "Ordered auth methods to try: agent,pkcs11,enclave,key,password,interactive (optional)")
+}
+
+// registerKeys defines the private key and passphrase flags on fs. They are
+// shared with subcommands that load keys without connecting.
+func (o *connOptions) registerKeys(fs *flag.FlagSet) {
+	fs.Var(&o.keys, "key", "SSH private key (PEM format), repeatable or comma-separated (optional)")
+	fs.StringVar(&o.keyEnv, "key-env", "", "Environment variable holding the SSH private key (PEM format) (optional)")
+	fs.Var(&o.keyProviders, "key-provider", "Fetch the private key from op://vault/item, bw://item or exec:command (optional)")
+	fs.StringVar(&o.passphraseFile, "passphrase-file", "", "Read the key passphrase from a file (optional)")
+	fs.StringVar(&o.passphraseEnv, "passphrase-env", "", "Read the key passphrase from an environment variable (optional)")
+	fs.StringVar(&o.passphraseCmd, "passphrase-cmd", "", "Read the key passphrase from a command's output (optional)")
+	fs.IntVar(&o.passphraseAttempts, "passphrase-attempts", 3, "Number of tries for a passphrase typed at the prompt")
+	fs.BoolVar(&o.useKeychain, "keychain", false, "Look up and offer to save key passphrases in the macOS Keychain")
+}
+
+// passphraseSource returns the passphrase source configured by the flags.
+func (o *connOptions) passphraseSource() (passphraseSource, error) {
+	p := passphraseSource{file: o.passphraseFile, env: o.passphraseEnv, cmd: o.passphraseCmd, keychain: o.useKeychain, attempts: o.passphraseAttempts}
+	return p, p.validate()
+}
+
+// setDestination fills in user, host and port from a "user@host[:port]"
+// argument, where an IPv6 host with a port is written "[addr]:port" and a
+// Unix socket "unix:///path". Values already given as flags take precedence.
+func (o *connOptions) setDestination(dest string) error {
+	if user, rest, ok := strings.Cut(dest, "@"); ok && !strings.HasPrefix(dest, unixSocketScheme) {
+		if o.user == "" {
+			o.user = user
+		}
+		dest = rest
+	}
+	if strings.HasPrefix(dest, unixSocketScheme) {
+		if o.host == "" {
+			o.host = dest
+		}
+		return nil
+	}
+	host := dest
+	if h, p, err := net.SplitHostPort(dest); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid port in %q", dest)
+		}
+		host = h
+		if o.port == 22 {
+			o.port = port
+		}
+	} else {
+		host = strings.Trim(dest, "[]")
+	}
+	if o.host == "" {
+		o.host = host
+	}
+	return nil
+}
+
+// sshConfigFile returns the OpenSSH client config chosen by -ssh-config, or
+// "" for none.
+func (o *connOptions) sshConfigFile() string {
+	switch o.sshConfigPath {
+	case "none":
+		return ""
+	case "":
+		return defaultSSHConfigPath()
+	}
+	path := expandHome(o.sshConfigPath)
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("SSH config error: %v", err)
+	}
+	return path
+}
+
+// sshConfigFor evaluates the OpenSSH client config chosen by -ssh-config for
+// a connection to host as user.
+func (o *connOptions) sshConfigFor(host, user string) sshConfigHost {
+	path := o.sshConfigFile()
+	if path == "" {
+		return sshConfigHost{}
+	}
+	config, err := lookupSSHConfig(path, host, user)
+	if err != nil {
+		log.Fatalf("SSH config error: %v", err)
+	}
+	return config
+}
+
+// applySSHConfig applies the OpenSSH client config entries matching the
+// destination: HostName replaces the host, and User, Port and ProxyJump fill
+// in what the command line left open. The host is then canonicalized if
+// -canonical-domains or CanonicalizeHostname ask for it, and the config
+// evaluated again for the canonical name. IdentityFile entries are kept for
+// connect, which uses them if neither flags nor memssh.json name a key.
+func (o *connOptions) applySSHConfig() {
+	config := o.sshConfigFor(o.host, o.user)
+	o.useSSHConfig(config)
+
+	mode := config.CanonicalizeHostname
+	if mode == "" && o.canonicalDomains != "" {
+		mode = "yes"
+	}
+	// As in OpenSSH, "yes" leaves names reached through a proxy to it.
+	if mode == "" || mode == "no" || mode == "yes" && (o.jump != "" || o.socks5 != "") {
+		return
+	}
+	domains := config.CanonicalDomains
+	if o.canonicalDomains != "" {
+		domains = strings.Split(o.canonicalDomains, ",")
+	}
+	maxDots := o.canonicalMaxDots
+	if maxDots == 1 && config.CanonicalizeMaxDots >= 0 {
+		maxDots = config.CanonicalizeMaxDots
+	}
+	network := strings.Replace(o.network(), "tcp", "ip", 1)
+	host, err := canonicalizeHost(o.host, domains, maxDots, network, o.connectTimeout)
+	if err != nil && config.CanonicalizeFallbackLocal == "no" {
+		log.Fatalf("Could not canonicalize host name %s: %v", o.host, err)
+	}
+	if host == o.host {
+		return
+	}
+	o.host = host
+	if path := o.sshConfigFile(); path != "" {
+		config.HostName = host
+		if config, err = lookupCanonicalSSHConfig(path, host, o.user, config); err != nil {
+			log.Fatalf("SSH config error: %v", err)
+		}
+		o.useSSHConfig(config)
+	}
+}
+
+// useSSHConfig takes the destination settings from an evaluated config.
+func (o *connOptions) useSSHConfig(config sshConfigHost) {
+	o.sshConfig = config
+	if config.HostName != "" {
+		o.host = config.HostName
+	}
+	if o.user == "" {
+		o.user = config.User
+	}
+	if o.port == 22 && config.Port != 0 {
+		o.port = config.Port
+	}
+	if o.jump == "" && config.ProxyJump != "none" {
+		o.jump = config.ProxyJump
+	}
+}
+
+// resolveJumpHost applies the OpenSSH client config to a jump host the way
+// applySSHConfig does to the destination. Hops without a user from either
+// source log in as the destination user.
+func (o *connOptions) resolveJumpHost(hop *jumpHost) {
+	config := o.sshConfigFor(hop.host, hop.user)
+	if config.HostName != "" {
+		hop.host = config.HostName
+	}
+	if hop.user == "" {
+		hop.user = config.User
+	}
+	if hop.port == 22 && config.Port != 0 {
+		hop.port = config.Port
+	}
+	if hop.user == "" {
+		hop.user = o.user
+	}
+}
+
+// applyProfile sets the flags of a profile from the memssh config file on fs.
+func (o *connOptions) applyProfile(fs *flag.FlagSet, name string) {
+	config, err := loadConfig(o.configFile())
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if err := config.applyProfile(fs, name); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// hasProfile reports whether the memssh config file defines a profile name.
+func (o *connOptions) hasProfile(name string) bool {
+	config, err := loadConfig(o.configFile())
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	_, ok := config.Profiles[name]
+	return ok
+}
+
+// configFile returns the memssh config file chosen by -config.
+func (o *connOptions) configFile() string {
+	if o.configPath == "" {
+		return getConfigPath()
+	}
+	return expandHome(o.configPath)
+}
+
+// applyConfig fills in the identities configured for the destination host
+// when none were given on the command line.
+func (o *connOptions) applyConfig() {
+	config, err := loadConfig(o.configFile())
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if len(o.keys) > 0 || o.keyEnv != "" || len(o.keyProviders) > 0 || len(o.agentKeys) > 0 {
+		return
+	}
+	for _, rule := range config.identitiesFor(o.host) {
+		switch {
+		case rule.Key != "":
+			o.keys = append(o.keys, expandHome(rule.Key))
+		case rule.AgentKey != "":
+			o.agentKeys = append(o.agentKeys, rule.AgentKey)
+		case rule.Provider != "":
+			o.keyProviders = append(o.keyProviders, rule.Provider)
+		}
+	}
+}
+
+// connection is an authenticated SSH client together with the local
+// resources (agent socket, hardware sessions) it depends on.
+type connection struct {
+	client   *ssh.Client
+	address  string
+	agent    agent.ExtendedAgent
+	session  sessionSetup
+	forwards openForwards
+	hostKeys *hostKeyUpdater
+	master   *controlMaster
+	cleanup  []func()
+
+	// remoteForwards lists the addresses the server listens on for -R,
+	// with ports it chose filled in.
+	remoteForwards []string
+
+	// certs records the expiry of certificates issued for -vault-sign or
+	// -oidc-issuer; it is nil without them.
+	certs *certExpiries
+
+	// dial (re)establishes client; link releases what it set up alongside
+	// (jump host clients, keepalives), and lost is closed when the client's
+	// connection ends.
+	dial func() error
+	link []func()
+	lost <-chan struct{}
+}
+
+// hostKeyRejectedError marks a connection attempt that failed because the
+// host key was not accepted, which retrying will not fix.
+type hostKeyRejectedError struct {
+	err error
+}
+
+func (e *hostKeyRejectedError) Error() string { return e.err.Error() }
+func (e *hostKeyRejectedError) Unwrap() error { return e.err }
+
+// closeLink shuts down the client and everything connecting it.
+func (c *connection) closeLink() {
+	if c.hostKeys != nil {
+		c.hostKeys.wait()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+	for i := len(c.link) - 1; i >= 0; i-- {
+		c.link[i]()
+	}
+	c.link = nil
+	c.master = nil
+}
+
+// Close shuts down the client and releases everything opened by connect. A
+// connection shared through -control-path is kept until the other processes
+// using it are done.
+func (c *connection) Close() {
+	if c.master != nil {
+		if n := c.master.attached(); n > 0 {
+			fmt.Fprintf(os.Stderr, "Waiting for memssh processes still sharing the connection (%d)...\n", n)
+		}
+		c.master.waitIdle(0, c.lost)
+	}
+	c.closeLink()
+	for i := len(c.cleanup) - 1; i >= 0; i-- {
+		c.cleanup[i]()
+	}
+}
+
+// connect validates the options, authenticates to the server and returns the
+// connection. Like the rest of the CLI, setup failures are fatal.
+func (o *connOptions) connect() *connection {
+	if o.host == "" {
+		log.Fatal("host and user are required")
+	}
+	o.applySSHConfig()
+	if o.user == "" {
+		log.Fatal("host and user are required")
+	}
+	if o.acceptNew {
+		if o.strictHostKeys != "ask" && o.strictHostKeys != "accept-new" {
+			log.Fatalf("-accept-new conflicts with -strict-host-key-checking %s", o.strictHostKeys)
+		}
+		o.strictHostKeys = "accept-new"
+	}
+	if !slices.Contains(strictHostKeyModes, o.strictHostKeys) {
+		log.Fatalf("Invalid -strict-host-key-checking %q (use %s)", o.strictHostKeys, strings.Join(strictHostKeyModes, ", "))
+	}
+	for _, fp := range o.expectFingerprints {
+		if !strings.HasPrefix(fp, "SHA256:") && !strings.HasPrefix(fp, "MD5:") {
+			log.Fatalf("Invalid -expect-fingerprint %q (use SHA256:... or MD5:...)", fp)
+		}
+	}
+	if o.ipv4Only && o.ipv6Only {
+		log.Fatal("-4 and -6 cannot be combined")
+	}
+	if o.tcpKeepAliveIdle < 0 || o.tcpKeepAliveIntvl < 0 || o.tcpKeepAliveCount < 0 {
+		log.Fatal("-tcp-keepalive-idle, -tcp-keepalive-interval and -tcp-keepalive-count must not be negative")
+	}
+	if o.retries < 0 || o.retryDelay <= 0 {
+		log.Fatal("-retries must not be negative and -retry-delay must be positive")
+	}
+	if o.keepAliveInterval > 0 && o.keepAliveMax < 1 {
+		log.Fatal("-keepalive-max must be at least 1")
+	}
+	if !slices.Contains(fingerprintHashes, o.fingerprintHash) {
+		log.Fatalf("Invalid -fingerprint-hash %q (use %s)", o.fingerprintHash, strings.Join(fingerprintHashes, " or "))
+	}
+	if o.controlPersist > 0 && o.controlPath == "" {
+		log.Fatal("-control-persist requires -control-path")
+	}
+	var jumps []jumpHost
+	if o.jump != "" {
+		var err error
+		if jumps, err = parseJumpHosts(o.jump); err != nil {
+			log.Fatalf("Invalid -jump: %v", err)
+		}
+	}
+	for i := range jumps {
+		o.resolveJumpHost(&jumps[i])
+	}
+
+	o.applyConfig()
+	if o.controlPath != "" {
+		if err := checkControlDir(o.controlSocket()); err != nil {
+			log.Fatalf("Invalid -control-path: %v", err)
+		}
+		if conn := o.attachControlMaster(); conn != nil {
+			return conn
+		}
+	}
+	if len(o.keys) == 0 && o.keyEnv == "" && len(o.keyProviders) == 0 && len(o.agentKeys) == 0 {
+		o.keys = o.sshConfig.identityFiles(o.host, o.user, o.port)
+	}
+	stdinKeys := 0
+	for _, key := range o.keys {
+		if key == "-" {
+			stdinKeys++
+		}
+	}
+	if stdinKeys > 1 {
+		log.Fatal("-key - may only be given once")
+	}
+
+	passphrase, err := o.passphraseSource()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	totp, err := newTOTPSource(o.totpEnv, o.totpCmd, o.totpPrompt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	haveKeys := len(o.keys) > 0 || o.keyEnv != "" || len(o.keyProviders) > 0
+	useOIDC := o.oidcIssuer != "" || o.oidcClientID != "" || o.oidcCA != ""
+	chain := []string(o.authChain)
+	if len(chain) == 0 {
+		chain = defaultAuthChain(haveKeys, o.useAgent || len(o.agentKeys) > 0, o.pkcs11Module != "", o.enclaveLabel != "", o.password, o.kbdInteractive || totp != nil)
+	}
+
+	conn := &connection{session: o.sessionSetup()}
+	if conn.session.log != nil {
+		conn.cleanup = append(conn.cleanup, conn.session.log.Close)
+	}
+	if conn.session.record != nil {
+		conn.cleanup = append(conn.cleanup, conn.session.record.Close)
+	}
+	if slices.Contains(chain, "agent") || o.agentForward {
+		var agentConn io.Closer
+		var err error
+		conn.agent, agentConn, err = connectAgent()
+		if err != nil {
+			log.Fatalf("Agent error: %v", err)
+		}
+		conn.cleanup = append(conn.cleanup, func() { agentConn.Close() })
+	}
+
+	var issuer certIssuer
+	if o.vaultRole != "" && useOIDC {
+		log.Fatal("-vault-sign and -oidc-issuer cannot be combined")
+	}
+	if o.vaultRole != "" {
+		vault, err := newVaultClient(o.vaultMount, o.vaultRole, o.user)
+		if err != nil {
+			log.Fatalf("Vault error: %v", err)
+		}
+		issuer = vault.signPublicKey
+	}
+	if useOIDC {
+		ca, err := newOIDCCA(o.oidcIssuer, o.oidcClientID, o.oidcCA, o.user)
+		if err != nil {
+			log.Fatalf("OIDC error: %v", err)
+		}
+		issuer = ca.signPublicKey
+	}
+	if issuer != nil {
+		conn.certs = &certExpiries{}
+		issuer = conn.certs.track(issuer)
+	}
+
+	auth, closeAuth, err := buildAuthMethods(authOptions{
+		chain:        chain,
+		keys:         o.keys,
+		keyEnv:       o.keyEnv,
+		keyProviders: o.keyProviders,
+		agentKeys:    o.agentKeys,
+		passphrase:   passphrase,
+		pkcs11Module: o.pkcs11Module,
+		enclaveLabel: o.enclaveLabel,
+		issuer:       issuer,
+		ephemeralKey: useOIDC && !haveKeys,
+		certs:        certPolicy{warn: o.certWarn, strict: o.certStrict},
+		totp:         totp,
+		agent:        conn.agent,
+	})
+	if err != nil {
+		log.Fatalf("Authentication setup failed: %v", err)
+	}
+	conn.cleanup = append(conn.cleanup, closeAuth)
+
+	address := o.address()
+	knownHostsPath := getKnownHostsPath()
+	hostKeyAlgos, err := hostKeyAlgorithms(o.hostKeyAlgorithms)
+	if err != nil {
+		log.Fatalf("Invalid -host-key-algorithms: %v", err)
+	}
+	kexAlgos, err := kexAlgorithms(o.requirePQKex)
+	if err != nil {
+		log.Fatalf("-require-pq-kex: %v", err)
+	}
+	rekeyThreshold, err := parseRekeyLimit(o.rekeyLimit)
+	if err != nil {
+		log.Fatalf("Invalid -rekey-limit: %v", err)
+	}
+	var remoteForwards []remoteForward
+	for _, spec := range o.remoteForwards {
+		fwd, err := parseRemoteForward(spec)
+		if err != nil {
+			log.Fatalf("Invalid -R %q: %v", spec, err)
+		}
+		remoteForwards = append(remoteForwards, fwd)
+	}
+	var rateLimit uint64
+	if o.limitRate != "" {
+		if rateLimit, err = parseSize(o.limitRate); err != nil || rateLimit == 0 {
+			log.Fatalf("Invalid -limit-rate %q: want bytes per second, e.g. 500K", o.limitRate)
+		}
+	}
+	var system systemHostKeyCheck
+	if o.knownHostsFallback {
+		if system, err = newSystemHostKeyCheck(systemKnownHostsFiles()); err != nil {
+			log.Fatalf("OpenSSH known_hosts: %v", err)
+		}
+	}
+	policy := hostKeyPolicy{
+		path:    knownHostsPath,
+		noStore: o.noStore,
+		hash:    o.hashKnownHosts,
+		strict:  o.strictHostKeys,
+		fpHash:  o.fingerprintHash,
+		expect:  o.expectFingerprints,
+		system:  system,
+	}
+	baseDial, err := o.localDial()
+	if err != nil {
+		log.Fatal(err)
+	}
+	socks5, socks5Flag := o.socks5, "-socks5"
+	firstHost := o.host
+	if len(jumps) > 0 {
+		firstHost = jumps[0].host
+	}
+	if socks5 == "" && isOnionHost(firstHost) {
+		socks5, socks5Flag = o.torProxy, "-tor-proxy"
+	}
+	if socks5 != "" {
+		proxy, err := parseSOCKS5Proxy(socks5)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", socks5Flag, err)
+		}
+		proxy.dial = baseDial
+		baseDial = proxy.Dial
+	}
+
+	// dial establishes the SSH connection itself. It is kept for reconnect,
+	// and reads known_hosts.json afresh each time so keys trusted meanwhile
+	// are known and the host key is verified again.
+	conn.address = address
+	conn.dial = func() error {
+		knownHosts := loadKnownHosts(knownHostsPath)
+		if o.requireSigned && !knownHosts.signed {
+			return fmt.Errorf("%s is not signed; run `memssh hosts sign` first", knownHostsPath)
+		}
+		if err := knownHosts.loadRevocations(o.revokedHostKeys); err != nil {
+			return fmt.Errorf("revoked host keys: %w", err)
+		}
+
+		updater := &hostKeyUpdater{address: address, policy: policy, update: o.updateHostKeys && !o.noStore}
+		checkHostKey := hostKeyCallback(address, knownHosts, policy)
+		var rejected bool
+		config := &ssh.ClientConfig{
+			User: o.user,
+			Auth: auth(o.user, o.host),
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				updater.hostKey = key
+				err := checkHostKey(hostname, remote, key)
+				rejected = err != nil
+				return err
+			},
+			HostKeyAlgorithms: hostKeyAlgos,
+			Timeout:           o.connectTimeout,
+		}
+		config.KeyExchanges = kexAlgos
+		config.RekeyThreshold = rekeyThreshold
+		if !o.quietBanner {
+			config.BannerCallback = printBanner(os.Stderr)
+		}
+
+		dial := baseDial
+		if len(jumps) > 0 {
+			var clients []*ssh.Client
+			var err error
+			dial, clients, err = dialJumpHosts(dial, jumps, auth, knownHosts, policy, *config)
+			if err != nil {
+				return explainKexError(err, o.requirePQKex)
+			}
+			for _, client := range clients {
+				conn.link = append(conn.link, func() { client.Close() })
+			}
+		}
+
+		netConn, err := dialTimeout(dialUnixSocket(dial), o.connectTimeout)("tcp", address)
+		if err != nil {
+			return err
+		}
+		if rateLimit > 0 {
+			netConn = newRateLimitedConn(netConn, rateLimit)
+		}
+		sshConn, chans, reqs, err := newClientConn(netConn, address, config)
+		if err != nil {
+			netConn.Close()
+			if rejected {
+				return &hostKeyRejectedError{err}
+			}
+			return explainKexError(err, o.requirePQKex)
+		}
+		conn.setClient(ssh.NewClient(sshConn, chans, updater.filter(sshConn, reqs)))
+		conn.hostKeys = updater
+		if o.keepAliveInterval > 0 {
+			conn.link = append(conn.link, startKeepAlive(conn.client, address, o.keepAliveInterval, o.keepAliveMax))
+		}
+
+		if o.agentForward {
+			if err := agent.ForwardToAgent(conn.client, conn.agent); err != nil {
+				return fmt.Errorf("agent forwarding setup failed: %w", err)
+			}
+		}
+
+		conn.remoteForwards = nil
+		for _, fwd := range remoteForwards {
+			listener, err := listenRemoteForward(conn.client, fwd, &conn.forwards)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				continue
+			}
+			conn.remoteForwards = append(conn.remoteForwards, listener.Addr().String())
+			conn.link = append(conn.link, func() { listener.Close() })
+		}
+
+		if o.controlPath != "" {
+			master, err := listenControlSocket(o.controlSocket(), conn.client)
+			if err != nil {
+				log.Printf("Warning: not sharing the connection: %v", err)
+			} else {
+				conn.master = master
+				conn.link = append(conn.link, master.Close)
+			}
+		}
+		return nil
+	}
+	if err := conn.dialWithRetries(o.retries, o.retryDelay); err != nil {
+		fatalConnection("Failed to connect: %v", err)
+	}
+	if os.Getenv(controlMasterEnv) != "" {
+		serveControlPersist(conn, o.controlPersist)
+	}
+	return conn
+}
+
+// setClient makes client the connection's client and arranges for lost to be
+// closed when it disconnects.
+func (c *connection) setClient(client *ssh.Client) {
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+	c.client, c.lost = client, lost
+}
+
+// controlSocket returns the expanded -control-path.
+func (o *connOptions) controlSocket() string {
+	return controlSocketPath(o.controlPath, o.host, o.port, o.user)
+}
+
+// attachControlMaster returns a connection through the master sharing the
+// connection to this server, starting one in the background first for
+// -control-persist. It returns nil if there is none, so this process
+// connects itself and becomes the master.
+func (o *connOptions) attachControlMaster() *connection {
+	path := o.controlSocket()
+	address := o.address()
+	isMaster := os.Getenv(controlMasterEnv) != ""
+	client, err := dialControlSocket(path, address, o.user)
+	switch {
+	case err == nil && isMaster:
+		// Another master started meanwhile; leave the job to it.
+		client.Close()
+		os.Exit(0)
+	case err != nil && (isMaster || o.controlPersist <= 0):
+		return nil
+	case err != nil:
+		if client, err = startControlMaster(path, address, o.user); err != nil {
+			fatalConnection("Failed to start the shared connection: %v", err)
+		}
+	case len(o.remoteForwards) > 0:
+		// Forwarded connections would arrive at the master, not here.
+		log.Printf("Warning: -R is ignored when using a connection another memssh process shares")
+	}
+
+	conn := &connection{address: address, session: o.sessionSetup()}
+	if conn.session.log != nil {
+		conn.cleanup = append(conn.cleanup, conn.session.log.Close)
+	}
+	if conn.session.record != nil {
+		conn.cleanup = append(conn.cleanup, conn.session.record.Close)
+	}
+	conn.setClient(client)
+	conn.dial = func() error {
+		client, err := dialControlSocket(path, address, o.user)
+		if err != nil {
+			return err
+		}
+		conn.setClient(client)
+		return nil
+	}
+	return conn
+}
+
+// sessionSetup returns how sessions are prepared for -agent-forward,
+// -setenv, -sendenv, -t, -T, -prefix-time, -prefix-host and
+// -sudo-password-*, opening the -log-session and -record files.
+func (o *connOptions) sessionSetup() sessionSetup {
+	if o.forcePTY && o.disablePTY {
+		log.Fatal("-t and -T cannot be combined")
+	}
+	env, err := sessionEnv(o.setEnv, o.sendEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setup := sessionSetup{agentForward: o.agentForward, env: env, forcePTY: o.forcePTY, disablePTY: o.disablePTY}
+	if o.prefixTime || o.prefixHost {
+		setup.prefix = &linePrefix{time: o.prefixTime}
+		if o.prefixHost {
+			setup.prefix.host = o.host
+		}
+	}
+	if setup.sudo, err = newSudoPassword(o.sudoPasswordFile, o.sudoPasswordEnv, o.sudoPasswordCmd, o.sudoPrompt); err != nil {
+		log.Fatal(err)
+	}
+	if setup.sudo != nil && o.disablePTY {
+		log.Fatal("-T cannot be combined with -sudo-password-file, -sudo-password-env or -sudo-password-cmd")
+	}
+	if o.logSessionInput != "" && o.logSession == "" {
+		log.Fatal("-log-session-input requires -log-session")
+	}
+	now := time.Now()
+	destination := o.address()
+	if o.user != "" {
+		destination = o.user + "@" + destination
+	}
+	if o.logSession != "" {
+		outputPath := expandSessionLogPath(o.logSession, o.host, o.user, now)
+		var inputPath string
+		if o.logSessionInput != "" {
+			inputPath = expandSessionLogPath(o.logSessionInput, o.host, o.user, now)
+		}
+		if setup.log, err = openSessionLog(outputPath, inputPath, destination); err != nil {
+			log.Fatalf("Failed to open session log: %v", err)
+		}
+	}
+	if o.record != "" {
+		width, height, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+		path := expandSessionLogPath(o.record, o.host, o.user, now)
+		if setup.record, err = openCastRecorder(path, width, height, destination); err != nil {
+			log.Fatalf("Failed to open -record file: %v", err)
+		}
+	}
+	return setup
+}
+
+// address returns the server's host:port, or its unix:// host for a server
+// listening on a Unix socket. Host keys are stored under this address.
+func (o *connOptions) address() string {
+	if strings.HasPrefix(o.host, unixSocketScheme) {
+		return o.host
+	}
+	return net.JoinHostPort(o.host, strconv.Itoa(o.port))
+}
+
+// network returns the network to dial for the -4 and -6 flags. It applies to
+// the connection leaving this machine: the one to the server, the first jump
+// host or the proxy.
+func (o *connOptions) network() string {
+	switch {
+	case o.ipv4Only:
+		return "tcp4"
+	case o.ipv6Only:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// localDial returns the dialFunc for the connection leaving this machine,
+// which honors -4, -6, -bind-address and -bind-interface. Without -4 or -6,
+// names with both IPv6 and IPv4 addresses are dialed with Happy Eyeballs.
+// Unix sockets are dialed as they are.
+func (o *connOptions) localDial() (dialFunc, error) {
+	dialer := &net.Dialer{}
+	if o.bindAddress != "" {
+		ip := net.ParseIP(o.bindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("-bind-address %q is not an IP address", o.bindAddress)
+		}
+		if o.ipv4Only && ip.To4() == nil || o.ipv6Only && ip.To4() != nil {
+			return nil, fmt.Errorf("-bind-address %s does not match the address family forced by -4 or -6", o.bindAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	var controls []func(network, address string, c syscall.RawConn) error
+	if o.bindInterface != "" {
+		control, err := bindToInterface(o.bindInterface)
+		if err != nil {
+			return nil, err
+		}
+		controls = append(controls, control)
+	}
+	sendBuffer, err := socketBufferSize("-tcp-send-buffer", o.tcpSendBuffer)
+	if err != nil {
+		return nil, err
+	}
+	receiveBuffer, err := socketBufferSize("-tcp-receive-buffer", o.tcpReceiveBuffer)
+	if err != nil {
+		return nil, err
+	}
+	tos := -1
+	if o.ipQoS != "" {
+		if tos, err = parseIPQoS(o.ipQoS); err != nil {
+			return nil, err
+		}
+	}
+	if sendBuffer > 0 || receiveBuffer > 0 || tos >= 0 {
+		controls = append(controls, socketControl(sendBuffer, receiveBuffer, tos))
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if o.tcpKeepAlive {
+		dialer.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.tcpKeepAliveIdle,
+			Interval: o.tcpKeepAliveIntvl,
+			Count:    o.tcpKeepAliveCount,
+		}
+	} else {
+		dialer.KeepAlive = -1
+	}
+
+	network := o.network()
+	return func(requested, address string) (net.Conn, error) {
+		if requested == "unix" {
+			return net.Dial("unix", address)
+		}
+		var conn net.Conn
+		var err error
+		if network == "tcp" {
+			conn, err = dialHappyEyeballs(dialer, address)
+		} else {
+			conn, err = dialer.Dial(network, address)
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok && !o.tcpNoDelay {
+			tcpConn.SetNoDelay(false)
+		}
+		return conn, err
+	}, nil
+}
+
+// socketBufferSize parses the value of a socket buffer size flag; empty
+// means the system default, returned as 0.
+func socketBufferSize(flagName, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := parseSize(value)
+	if err != nil || size == 0 || size > 1<<30 {
+		return 0, fmt.Errorf("invalid %s %q: want a size from 1 byte to 1G", flagName, value)
+	}
+	return int(size), nil
+}
+
+// takeDestination consumes a leading "user@host[:port]" positional argument,
+// if present and -host was not given, and returns the remaining arguments.
+func (o *connOptions) takeDestination(args []string) []string {
+	if o.host != "" || len(args) == 0 {
+		return args
+	}
+	if err := o.setDestination(args[0]); err != nil {
+		log.Fatal(err)
+	}
+	return args[1:]
+}
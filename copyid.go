@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// installAuthorizedKeyScript appends the key read from stdin to
+// ~/.ssh/authorized_keys unless it is already present, fixing permissions on
+// the way. It prints "exists" or "added" so the caller can report the outcome.
+const installAuthorizedKeyScript = `umask 077
+IFS= read -r key || exit 1
+mkdir -p ~/.ssh && chmod 700 ~/.ssh || exit 1
+f=~/.ssh/authorized_keys
+touch "$f" && chmod 600 "$f" || exit 1
+if grep -qxF "$key" "$f"; then echo exists; exit 0; fi
+if [ -s "$f" ] && [ -n "$(tail -c1 "$f")" ]; then echo >> "$f"; fi
+printf '%s\n' "$key" >> "$f" && echo added`
+
+// runCopyID implements `memssh copy-id`: it authenticates once (password,
+// agent or an existing key) and installs a public key in the remote
+// authorized_keys file.
+func runCopyID(args []string) {
+	fs := flag.NewFlagSet("copy-id", flag.ExitOnError)
+	var opts connOptions
+	opts.register(fs)
+	identity := fs.String("i", "", "Public key file to install (\"-\" reads from stdin)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh copy-id -i KEY.pub [flags] [user@host[:port]]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	opts.takeDestination(fs.Args())
+
+	if *identity == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	line, err := readAuthorizedKey(*identity)
+	if err != nil {
+		log.Fatalf("Public key error: %v", err)
+	}
+
+	conn := opts.connect()
+	defer conn.Close()
+
+	session, err := conn.client.NewSession()
+	if err != nil {
+		log.Fatalf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(line + "\n")
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(installAuthorizedKeyScript); err != nil {
+		log.Fatalf("Installing key failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if strings.TrimSpace(stdout.String()) == "exists" {
+		fmt.Printf("Key already present in %s@%s:~/.ssh/authorized_keys\n", opts.user, opts.host)
+		return
+	}
+	fmt.Printf("Key added to %s@%s:~/.ssh/authorized_keys\n", opts.user, opts.host)
+}
+
+// readAuthorizedKey reads and validates a public key in authorized_keys format,
+// returning it as a single normalized line.
+func readAuthorizedKey(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if len(options) > 0 {
+		line = strings.Join(options, ",") + " " + line
+	}
+	if comment != "" {
+		line += " " + comment
+	}
+	return line, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultDaemonDir returns the directory holding the sockets of
+// `memssh daemon`, ~/.ssh/memssh-daemon.
+func defaultDaemonDir() string {
+	return filepath.Join(filepath.Dir(getKnownHostsPath()), "memssh-daemon")
+}
+
+// daemonSocketPath returns the socket serving target in dir. Targets are
+// hashed, since they may contain characters file names cannot.
+func daemonSocketPath(dir, target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8]))
+}
+
+// runDaemon implements `memssh daemon`: it logs in to each target, a profile
+// from memssh.json or a [user@]host[:port] destination, and keeps the
+// connections open for `memssh exec`, reconnecting when they drop. Flags
+// apply to every target; a profile's own settings take precedence.
+func runDaemon(args []string) {
+	var opts connOptions
+	var socketDir string
+	var maxAge time.Duration
+	fs := daemonFlags(&opts, &socketDir, &maxAge)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh daemon [flags] [profile|user@host[:port]...]\n\nWithout targets, the \"daemon\" list of memssh.json is used.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	flagArgs := args[:len(args)-fs.NArg()]
+
+	config, err := loadConfig(opts.configFile())
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	targets := fs.Args()
+	if len(targets) == 0 {
+		targets = config.Daemon
+	}
+	if len(targets) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		log.Fatalf("Failed to create %s: %v", socketDir, err)
+	}
+
+	var masters []*controlMaster
+	for _, target := range targets {
+		// Each target gets its own options: the shared flags, then its
+		// profile or destination.
+		var targetOpts connOptions
+		targetFlags := daemonFlags(&targetOpts, new(string), new(time.Duration))
+		targetFlags.Parse(flagArgs)
+		if _, ok := config.Profiles[target]; ok {
+			targetOpts.applyProfile(targetFlags, target)
+		} else if err := targetOpts.setDestination(target); err != nil {
+			log.Fatalf("%s: %v", target, err)
+		}
+		targetOpts.controlPath, targetOpts.controlPersist = "", 0
+		targetOpts.logSession, targetOpts.logSessionInput, targetOpts.record = "", "", ""
+
+		conn := targetOpts.connect()
+		path := daemonSocketPath(socketDir, target)
+		master, err := listenControlSocket(path, conn.client)
+		if err != nil {
+			log.Fatalf("%s: %v", target, err)
+		}
+		masters = append(masters, master)
+		log.Printf("%s: connected to %s", target, conn.address)
+		go keepWarm(target, conn, master, maxAge)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	for _, master := range masters {
+		master.Close()
+	}
+}
+
+// daemonFlags defines the flags of `memssh daemon` on a new flag set.
+func daemonFlags(opts *connOptions, socketDir *string, maxAge *time.Duration) *flag.FlagSet {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	opts.register(fs)
+	fs.StringVar(socketDir, "socket-dir", defaultDaemonDir(), "Directory for the sockets `memssh exec` connects to")
+	fs.DurationVar(maxAge, "max-age", 0, "Log in again once a connection has been open this long and is not in use (default never); certificates from -vault-sign or -oidc-issuer are renewed before they expire regardless")
+	return fs
+}
+
+// keepWarm keeps the connection of a daemon target open: it reconnects when
+// it drops and, with maxAge, logs in again once it has been open that long
+// and nobody is using it, as it does shortly before a certificate it logged
+// in with expires. It gives up only if the host key is rejected.
+func keepWarm(target string, conn *connection, master *controlMaster, maxAge time.Duration) {
+	for {
+		var renew <-chan time.Time
+		var timer *time.Timer
+		wait := maxAge
+		if expires := conn.certs.next(); !expires.IsZero() {
+			// Waiting at least the margin keeps certificates shorter-lived
+			// than it from having the daemon log in again and again.
+			beforeExpiry := max(time.Until(expires)-certRenewMargin, certRenewMargin)
+			if wait == 0 || beforeExpiry < wait {
+				wait = beforeExpiry
+			}
+		}
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			renew = timer.C
+		}
+		select {
+		case <-conn.lost:
+			log.Printf("%s: connection lost", target)
+			for {
+				err := conn.reconnect()
+				if err == nil {
+					break
+				}
+				var rejected *hostKeyRejectedError
+				if errors.As(err, &rejected) {
+					log.Printf("%s: giving up: %v", target, err)
+					return
+				}
+				log.Printf("%s: %v", target, err)
+			}
+			master.replaceClient(conn.client)
+			log.Printf("%s: reconnected", target)
+		case <-renew:
+			master.waitIdle(0, conn.lost)
+			old, err := conn.redial()
+			if err != nil {
+				log.Printf("%s: logging in again failed: %v", target, err)
+				break
+			}
+			master.replaceClient(conn.client)
+			old.closeLink()
+			log.Printf("%s: logged in again", target)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// runExec implements `memssh exec`: it runs a command, or an interactive
+// shell without one, over a connection held by `memssh daemon`, and exits
+// with the command's exit status, or 255 if it could not be run.
+func runExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	socketDir := fs.String("socket-dir", defaultDaemonDir(), "Directory of the daemon's sockets")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh exec [flags] profile|user@host[:port] [command...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target, command := fs.Arg(0), shellJoin(fs.Args()[1:])
+
+	client, err := dialControlSocket(daemonSocketPath(*socketDir, target), target, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "memssh exec: no daemon connection to %s (is `memssh daemon` running?): %v\n", target, err)
+		os.Exit(exitConnectionFailed)
+	}
+	defer client.Close()
+
+	if command == "" {
+		err = startInteractiveShell(client, os.Stdin, sessionSetup{})
+	} else {
+		var session *ssh.Session
+		if session, err = client.NewSession(); err == nil {
+			session.Stdin = os.Stdin
+			session.Stdout = os.Stdout
+			session.Stderr = os.Stderr
+			err = session.Run(command)
+		}
+	}
+	var exitErr *ssh.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "memssh exec: %v\n", err)
+	}
+	client.Close()
+	os.Exit(exitStatus(err))
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// detachFromTerminal points stdin, stdout and stderr at /dev/null and starts
+// a new session, so the process outlives the terminal and no longer holds
+// the pipes of whoever ran it, nor receives its Ctrl-C.
+func detachFromTerminal() error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	for fd := 0; fd <= 2; fd++ {
+		if err := unix.Dup2(int(devNull.Fd()), fd); err != nil {
+			return err
+		}
+	}
+	_, err = unix.Setsid()
+	return err
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+var procFreeConsole = windows.NewLazySystemDLL("kernel32.dll").NewProc("FreeConsole")
+
+// detachFromTerminal closes stdin, stdout and stderr in favor of NUL and
+// leaves the console, so the process outlives the console window and no
+// longer holds the pipes of whoever ran it, nor receives its Ctrl-C.
+func detachFromTerminal() error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	os.Stdin.Close()
+	os.Stdout.Close()
+	os.Stderr.Close()
+	os.Stdin, os.Stdout, os.Stderr = devNull, devNull, devNull
+	log.SetOutput(devNull)
+	if r, _, err := procFreeConsole.Call(); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// exitEditFailed is the exit status of edit when the file was not written
+// back.
+const exitEditFailed = 1
+
+// remoteEdit is a remote file being edited locally, for `memssh edit`.
+type remoteEdit struct {
+	client *ssh.Client
+	sftp   *sftpClient
+	host   string // for messages
+	name   string // the remote file
+	info   fs.FileInfo
+	exists bool
+
+	// With -sudo, the file is read and replaced through sudo on the
+	// server, with password answering its prompt if it asks for one.
+	sudo     bool
+	password []byte
+}
+
+// runEdit implements `memssh edit`: it downloads a remote file to a temporary
+// file, opens it in $VISUAL or $EDITOR, and writes it back if it changed. The
+// new contents go to a temporary file beside the original, which is renamed
+// over it, so the file is never seen half written; it keeps the original's
+// mode, and its owner where the server allows. With -sudo, the file is read
+// and replaced as root: the new contents are staged in /tmp and moved into
+// place with sudo. A file that does not exist yet is created.
+func runEdit(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	var opts connOptions
+	opts.register(fs)
+	sudo := fs.Bool("sudo", false, "Read and write the file as root through sudo on the server, for files such as /etc/nginx/nginx.conf")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh edit [flags] [user@]host:REMOTE-FILE\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := opts.takeRemotePath(fs.Arg(0))
+	if name == "." {
+		log.Fatal("memssh edit needs the path of a file")
+	}
+	source, err := newSudoPassword(opts.sudoPasswordFile, opts.sudoPasswordEnv, opts.sudoPasswordCmd, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn := opts.connect()
+	client, err := newSFTPClient(conn.client)
+	if err != nil {
+		conn.Close()
+		fatalConnection("SFTP failed: %v", err)
+	}
+	e := &remoteEdit{client: conn.client, sftp: client, host: opts.host, name: name, sudo: *sudo}
+	defer zeroBytes(e.password)
+	if e.sudo {
+		if err := e.authorizeSudo(opts.user, source); err != nil {
+			log.Fatalf("sudo on %s: %v", opts.host, err)
+		}
+	}
+	status := e.run()
+	client.Close()
+	conn.Close()
+	os.Exit(status)
+}
+
+// run downloads, edits and writes back the file, and returns the exit status.
+func (e *remoteEdit) run() int {
+	info, err := e.sftp.Stat(e.name)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		log.Printf("%s:%s is not a regular file", e.host, e.name)
+		return exitEditFailed
+	case err == nil:
+		e.info, e.exists = info, true
+	case !errors.Is(err, fs.ErrNotExist) && !e.sudo:
+		log.Print(err)
+		return exitEditFailed
+	}
+	original, err := e.read()
+	if err != nil {
+		log.Print(err)
+		return exitEditFailed
+	}
+
+	// The temporary file keeps the name, so editors recognize its type.
+	dir, err := os.MkdirTemp("", "memssh-edit-")
+	if err != nil {
+		log.Print(err)
+		return exitEditFailed
+	}
+	local := filepath.Join(dir, path.Base(e.name))
+	if err := os.WriteFile(local, original, 0o600); err != nil {
+		os.RemoveAll(dir)
+		log.Print(err)
+		return exitEditFailed
+	}
+	if err := runEditor(local); err != nil {
+		os.RemoveAll(dir)
+		log.Printf("Editor failed, so %s:%s was left as it was: %v", e.host, e.name, err)
+		return exitEditFailed
+	}
+	edited, err := os.ReadFile(local)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Print(err)
+		return exitEditFailed
+	}
+	if bytes.Equal(edited, original) {
+		os.RemoveAll(dir)
+		fmt.Fprintf(os.Stderr, "No changes; %s:%s was left as it was\n", e.host, e.name)
+		return 0
+	}
+	err = e.checkUnchanged()
+	if err == nil {
+		err = e.write(edited)
+	}
+	if err != nil {
+		log.Printf("%s:%s was not written back: %v", e.host, e.name, err)
+		log.Printf("Your version is kept in %s", local)
+		return exitEditFailed
+	}
+	os.RemoveAll(dir)
+	fmt.Fprintf(os.Stderr, "Wrote %s:%s (%s)\n", e.host, e.name, formatSize(int64(len(edited))))
+	return 0
+}
+
+// runEditor opens name in $VISUAL or $EDITOR, or vi (notepad on Windows),
+// and waits for it to exit. The variables may hold arguments, such as
+// "code --wait".
+func runEditor(name string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	words := strings.Fields(editor)
+	cmd := exec.Command(words[0], append(words[1:], name)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// read returns the file's contents, or nothing for a new file.
+func (e *remoteEdit) read() ([]byte, error) {
+	if e.sudo {
+		var out bytes.Buffer
+		err := e.runSudo(`if [ -e "$1" ]; then cat -- "$1"; fi`, &out, e.name)
+		return out.Bytes(), err
+	}
+	if !e.exists {
+		return nil, nil
+	}
+	file, err := e.sftp.Open(e.name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var out bytes.Buffer
+	_, err = file.WriteTo(&out)
+	return out.Bytes(), err
+}
+
+// checkUnchanged fails if the file changed on the server while it was being
+// edited, which writing it back would undo.
+func (e *remoteEdit) checkUnchanged() error {
+	if e.sudo && !e.exists {
+		// The file may be out of the user's sight without sudo.
+		return nil
+	}
+	info, err := e.sftp.Stat(e.name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && !e.exists:
+		return nil
+	case err != nil:
+		return err
+	case !e.exists:
+		return errors.New("it was created on the server meanwhile")
+	case info.Size() != e.info.Size() || !info.ModTime().Equal(e.info.ModTime()):
+		return errors.New("it changed on the server meanwhile")
+	}
+	return nil
+}
+
+// write replaces the file with data, atomically: data goes to a temporary
+// file beside it, which gets the original's mode and owner and is renamed
+// over it.
+func (e *remoteEdit) write(data []byte) error {
+	mode, uid, gid := fs.FileMode(0o644), -1, -1
+	if e.exists {
+		mode = e.info.Mode().Perm()
+		if attrs, ok := e.info.Sys().(sftpAttributes); ok && attrs.flags&sftpAttrUIDGID != 0 {
+			uid, gid = int(attrs.uid), int(attrs.gid)
+		}
+	}
+	if e.sudo {
+		return e.writeSudo(data, mode)
+	}
+
+	temp := path.Join(path.Dir(e.name), "."+path.Base(e.name)+".memssh-"+randomSuffix())
+	if err := e.upload(temp, data); err != nil {
+		return err
+	}
+	err := e.sftp.Chmod(temp, mode)
+	if err == nil && uid >= 0 {
+		// Only root may give files away; a file of the user's own
+		// keeps its owner anyway.
+		e.sftp.Chown(temp, uid, gid)
+	}
+	if err == nil {
+		err = e.sftp.Rename(temp, e.name)
+	}
+	if err != nil {
+		e.sftp.Remove(temp)
+	}
+	return err
+}
+
+// writeSudo stages data in /tmp and moves it into place with sudo: it is
+// copied to a temporary file beside the original, given the original's mode
+// and owner, which sudo can see even where the user cannot, and renamed over
+// it. A new file gets mode.
+func (e *remoteEdit) writeSudo(data []byte, mode fs.FileMode) error {
+	staged := "/tmp/.memssh-edit-" + randomSuffix()
+	if err := e.upload(staged, data); err != nil {
+		return err
+	}
+	defer e.sftp.Remove(staged)
+
+	// stat -c is GNU's, stat -f the BSDs'.
+	const script = `set -e
+f=$1 t=$2 staged=$3
+trap 'rm -f -- "$t"' EXIT
+(umask 077 && cat -- "$staged" > "$t")
+if [ -e "$f" ]; then
+	chmod "$(stat -c %a -- "$f" 2>/dev/null || stat -f %Lp -- "$f")" "$t"
+	chown "$(stat -c %u:%g -- "$f" 2>/dev/null || stat -f %u:%g -- "$f")" "$t"
+else
+	chmod "$4" "$t"
+fi
+mv -f -- "$t" "$f"
+`
+	temp := path.Join(path.Dir(e.name), "."+path.Base(e.name)+".memssh-"+randomSuffix())
+	return e.runSudo(script, nil, e.name, temp, staged, fmt.Sprintf("%o", mode))
+}
+
+// upload creates the remote file name, readable by its owner only, with
+// data.
+func (e *remoteEdit) upload(name string, data []byte) error {
+	file, err := e.sftp.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.ReadFrom(bytes.NewReader(data))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		e.sftp.Remove(name)
+	}
+	return err
+}
+
+// authorizeSudo checks that sudo works on the server, getting the password
+// if it asks for one: from the -sudo-password-* source if there is one, or
+// else from the terminal.
+func (e *remoteEdit) authorizeSudo(user string, source *sudoPassword) error {
+	if e.runSudo("true", nil) == nil {
+		return nil
+	}
+	var err error
+	if source != nil {
+		e.password, err = source.read()
+	} else {
+		e.password, err = readSecretTo(os.Stderr, fmt.Sprintf("[sudo] password for %s@%s: ", user, e.host))
+	}
+	if err != nil {
+		return err
+	}
+	return e.runSudo("true", nil)
+}
+
+// runSudo runs script with sh as root through sudo, with args as $1 and on,
+// and its output going to stdout. Once a password is known, sudo reads it
+// from stdin; until then it must not ask for one.
+func (e *remoteEdit) runSudo(script string, stdout io.Writer, args ...string) error {
+	session, err := e.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	cmd := "sudo -n -- sh -c " + shellQuote(script) + " sh"
+	if e.password != nil {
+		cmd = "sudo -S -p '' -- sh -c " + shellQuote(script) + " sh"
+		line := append(append([]byte(nil), e.password...), '\n')
+		defer zeroBytes(line)
+		session.Stdin = bytes.NewReader(line)
+	}
+	for _, arg := range args {
+		cmd += " " + shellQuote(arg)
+	}
+	var stderr bytes.Buffer
+	session.Stdout, session.Stderr = stdout, &stderr
+	if err := session.Run(cmd); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// randomSuffix returns a random name suffix for temporary files.
+func randomSuffix() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,192 @@
+//go:build cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -framework Security -framework CoreFoundation
+#include <stdlib.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+// enclaveCopyKeys returns the Secure Enclave private keys in the keychain,
+// limited to those with the given label unless label is NULL.
+static CFArrayRef enclaveCopyKeys(const char *label, OSStatus *status) {
+	CFMutableDictionaryRef query = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(query, kSecClass, kSecClassKey);
+	CFDictionarySetValue(query, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(query, kSecAttrKeyClass, kSecAttrKeyClassPrivate);
+	CFDictionarySetValue(query, kSecReturnRef, kCFBooleanTrue);
+	CFDictionarySetValue(query, kSecMatchLimit, kSecMatchLimitAll);
+	if (label != NULL) {
+		CFStringRef s = CFStringCreateWithCString(NULL, label, kCFStringEncodingUTF8);
+		CFDictionarySetValue(query, kSecAttrLabel, s);
+		CFRelease(s);
+	}
+	CFTypeRef result = NULL;
+	*status = SecItemCopyMatching(query, &result);
+	CFRelease(query);
+	return (CFArrayRef)result;
+}
+
+// enclaveKeyAt returns a retained reference to the i-th key of keys.
+static SecKeyRef enclaveKeyAt(CFArrayRef keys, CFIndex i) {
+	SecKeyRef key = (SecKeyRef)CFArrayGetValueAtIndex(keys, i);
+	CFRetain(key);
+	return key;
+}
+
+// enclaveCopyPublicKey returns the X9.63 encoding (04 || X || Y) of the
+// public half of key.
+static CFDataRef enclaveCopyPublicKey(SecKeyRef key) {
+	SecKeyRef pub = SecKeyCopyPublicKey(key);
+	if (pub == NULL) {
+		return NULL;
+	}
+	CFDataRef data = SecKeyCopyExternalRepresentation(pub, NULL);
+	CFRelease(pub);
+	return data;
+}
+
+// enclaveSign signs a SHA-256 digest, returning a DER-encoded ECDSA
+// signature. On failure it stores the Security framework error code.
+static CFDataRef enclaveSign(SecKeyRef key, const UInt8 *digest, CFIndex len, CFIndex *code) {
+	CFDataRef in = CFDataCreate(NULL, digest, len);
+	CFErrorRef err = NULL;
+	CFDataRef sig = SecKeyCreateSignature(key, kSecKeyAlgorithmECDSASignatureDigestX962SHA256, in, &err);
+	CFRelease(in);
+	if (sig == NULL) {
+		*code = err != NULL ? CFErrorGetCode(err) : -1;
+		if (err != NULL) {
+			CFRelease(err);
+		}
+	}
+	return sig;
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errSecItemNotFound is the Security framework status for an empty query result.
+const errSecItemNotFound = -25300
+
+// enclaveBackend signs with P-256 keys generated inside the Secure Enclave.
+// The private keys cannot be exported; every signature is computed by the
+// enclave, which also enforces any Touch ID or passcode requirement set when
+// the key was created.
+type enclaveBackend struct {
+	keys    []C.SecKeyRef
+	signers []ssh.Signer
+}
+
+// openSecureEnclave loads the Secure Enclave keys with the given keychain
+// label, or every Secure Enclave key when label is "*".
+func openSecureEnclave(label string) (signerBackend, error) {
+	var cLabel *C.char
+	if label != "*" {
+		cLabel = C.CString(label)
+		defer C.free(unsafe.Pointer(cLabel))
+	}
+
+	var status C.OSStatus
+	keys := C.enclaveCopyKeys(cLabel, &status)
+	if status == errSecItemNotFound {
+		return nil, fmt.Errorf("no Secure Enclave key labelled %q", label)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("keychain query failed (OSStatus %d)", int(status))
+	}
+	defer C.CFRelease(C.CFTypeRef(keys))
+
+	b := &enclaveBackend{}
+	for i := C.CFIndex(0); i < C.CFArrayGetCount(keys); i++ {
+		key := C.enclaveKeyAt(keys, i)
+		b.keys = append(b.keys, key)
+
+		pub, err := enclavePublicKey(key)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromSigner(&enclaveKey{ref: key, pub: pub})
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.signers = append(b.signers, signer)
+	}
+	return b, nil
+}
+
+// enclavePublicKey reads the public half of a Secure Enclave key.
+func enclavePublicKey(key C.SecKeyRef) (*ecdsa.PublicKey, error) {
+	data := C.enclaveCopyPublicKey(key)
+	if data == 0 {
+		return nil, errors.New("reading Secure Enclave public key failed")
+	}
+	defer C.CFRelease(C.CFTypeRef(data))
+	raw := C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(data)), C.int(C.CFDataGetLength(data)))
+
+	// NewPublicKey checks the length and that the point is on the curve.
+	if _, err := ecdh.P256().NewPublicKey(raw); err != nil {
+		return nil, fmt.Errorf("invalid Secure Enclave public key: %w", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[1:33]),
+		Y:     new(big.Int).SetBytes(raw[33:]),
+	}, nil
+}
+
+// Signers returns one signer per Secure Enclave key.
+func (b *enclaveBackend) Signers() ([]ssh.Signer, error) {
+	return b.signers, nil
+}
+
+// Close releases the key references.
+func (b *enclaveBackend) Close() error {
+	for _, key := range b.keys {
+		C.CFRelease(C.CFTypeRef(key))
+	}
+	b.keys = nil
+	return nil
+}
+
+// enclaveKey is a crypto.Signer backed by a Secure Enclave key reference.
+type enclaveKey struct {
+	ref C.SecKeyRef
+	pub *ecdsa.PublicKey
+}
+
+// Public returns the public half of the enclave key.
+func (k *enclaveKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign asks the Secure Enclave to sign a SHA-256 digest; the result is
+// already in the ASN.1 form Go expects.
+func (k *enclaveKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != 32 {
+		return nil, fmt.Errorf("unsupported hash %v for Secure Enclave key", opts.HashFunc())
+	}
+	var code C.CFIndex
+	sig := C.enclaveSign(k.ref, (*C.UInt8)(unsafe.Pointer(&digest[0])), C.CFIndex(len(digest)), &code)
+	if sig == 0 {
+		return nil, fmt.Errorf("Secure Enclave signing failed (error %d)", int(code))
+	}
+	defer C.CFRelease(C.CFTypeRef(sig))
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(sig)), C.int(C.CFDataGetLength(sig))), nil
+}
@@ -0,0 +1,11 @@
+//go:build !darwin || !cgo
+
+package main
+
+import "errors"
+
+// openSecureEnclave is unavailable outside macOS builds with cgo, which the
+// Security framework bindings require.
+func openSecureEnclave(label string) (signerBackend, error) {
+	return nil, errors.New("Secure Enclave keys require macOS and a cgo-enabled build")
+}
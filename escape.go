@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// escapeChar starts an escape sequence when typed at the start of a line.
+const escapeChar = '~'
+
+// escapeHelp lists the escape sequences, for ~?.
+const escapeHelp = `Supported escape sequences:
+ ~.   - terminate connection
+ ~B   - send a BREAK to the remote system
+ ~^Z  - suspend memssh
+ ~#   - list forwarded connections
+ ~?   - this message
+ ~~   - send the escape character by typing it twice
+(Note that escapes are only recognized immediately after newline.)
+`
+
+// escapeReader passes keystrokes through to the remote shell, acting on the
+// escape sequences OpenSSH offers, so a hung session can be left without
+// killing the terminal: ~. ends the connection, ~B sends a BREAK, ~^Z
+// suspends memssh, ~# lists forwarded connections, ~? shows help and ~~
+// sends a single ~.
+type escapeReader struct {
+	r       io.Reader
+	conn    *connection
+	cooked  *term.State // the terminal before raw mode, restored for ~^Z
+	session atomic.Pointer[ssh.Session]
+
+	lineStart  bool
+	escaped    bool // ~ typed at the start of a line
+	pending    []byte
+	terminated atomic.Bool
+}
+
+// newEscapeReader watches r, the terminal's input, for escapes concerning
+// conn. It must be created before the terminal is put in raw mode.
+func newEscapeReader(r io.Reader, conn *connection) *escapeReader {
+	cooked, _ := term.GetState(int(os.Stdin.Fd()))
+	return &escapeReader{r: r, conn: conn, cooked: cooked, lineStart: true}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		buf := make([]byte, len(p))
+		n, err := e.r.Read(buf)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		e.pending = e.filter(buf[:n])
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// filter returns the input to send on, after acting on escape sequences.
+func (e *escapeReader) filter(in []byte) []byte {
+	var out []byte
+	for _, b := range in {
+		if e.escaped {
+			e.escaped = false
+			if e.command(b) {
+				// Another escape may follow right away, as in OpenSSH.
+				continue
+			}
+			if b != escapeChar {
+				out = append(out, escapeChar)
+			}
+		} else if b == escapeChar && e.lineStart {
+			e.escaped = true
+			continue
+		}
+		out = append(out, b)
+		e.lineStart = b == '\r' || b == '\n'
+	}
+	return out
+}
+
+// command carries out the escape sequence ending in b, reporting whether b
+// was one.
+func (e *escapeReader) command(b byte) bool {
+	switch b {
+	case '.':
+		e.terminated.Store(true)
+		e.conn.client.Close()
+	case 'B':
+		e.sendBreak()
+	case 0x1a: // Ctrl-Z
+		e.suspend()
+	case '#':
+		e.print(e.conn.forwards.describe())
+	case '?':
+		e.print(escapeHelp)
+	default:
+		return false
+	}
+	return true
+}
+
+// breakLength is how long a BREAK sent with ~B lasts, in milliseconds, as
+// with OpenSSH.
+const breakLength = 1000
+
+// sendBreak sends a BREAK to the shell's session (RFC 4335), which serial
+// console servers pass on to the line, e.g. to reach a Cisco ROM monitor.
+func (e *escapeReader) sendBreak() {
+	session := e.session.Load()
+	if session == nil {
+		return
+	}
+	ok, err := session.SendRequest("break", true, ssh.Marshal(struct{ Length uint32 }{breakLength}))
+	if err == nil && !ok {
+		e.print("The server does not support BREAK.\n")
+	}
+}
+
+// suspend stops memssh like ^Z in a local shell, with the terminal restored
+// for the shell that takes over, and puts it back in raw mode on resume.
+func (e *escapeReader) suspend() {
+	fd := int(os.Stdin.Fd())
+	raw, err := term.GetState(fd)
+	if err != nil || e.cooked == nil {
+		return
+	}
+	term.Restore(fd, e.cooked)
+	err = suspendProcess()
+	term.Restore(fd, raw)
+	if err != nil {
+		e.print(fmt.Sprintf("Cannot suspend: %v\n", err))
+	}
+}
+
+// print shows a message on the raw-mode terminal, where lines need \r\n.
+func (e *escapeReader) print(message string) {
+	fmt.Fprint(os.Stderr, "\r\n"+strings.ReplaceAll(message, "\n", "\r\n"))
+}
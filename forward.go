@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// openForwards keeps track of the forwarded connections in progress, for
+// the ~# escape.
+type openForwards struct {
+	mu    sync.Mutex
+	next  int
+	conns map[int]string
+}
+
+// add records a connection and returns its number.
+func (f *openForwards) add(description string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns == nil {
+		f.conns = make(map[int]string)
+	}
+	f.next++
+	f.conns[f.next] = description
+	return f.next
+}
+
+// remove forgets a closed connection.
+func (f *openForwards) remove(id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, id)
+}
+
+// describe lists the open connections, oldest first.
+func (f *openForwards) describe() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.conns) == 0 {
+		return "No forwarded connections are open.\n"
+	}
+	var b strings.Builder
+	b.WriteString("The following connections are open:\n")
+	for _, id := range slices.Sorted(maps.Keys(f.conns)) {
+		fmt.Fprintf(&b, "  #%d %s\n", id, f.conns[id])
+	}
+	return b.String()
+}
+
+// remoteForward is one -R forwarding: connections the server accepts on
+// listen are relayed to target, a host:port or Unix socket path reached from
+// this machine.
+type remoteForward struct {
+	listen  string
+	network string
+	target  string
+}
+
+// parseRemoteForward parses a -R value in OpenSSH's syntax,
+// [bind_address:]port:host:hostport or [bind_address:]port:/local/socket.
+// IPv6 addresses are written in brackets. Without a bind address the server
+// listens on loopback; "*" asks for all interfaces, which the server only
+// allows with GatewayPorts. Port 0 lets the server choose.
+func parseRemoteForward(spec string) (remoteForward, error) {
+	fields, err := splitForwardSpec(spec)
+	if err != nil {
+		return remoteForward{}, err
+	}
+	bind := "localhost"
+	if len(fields) == 4 || len(fields) == 3 && strings.Contains(fields[2], "/") {
+		bind, fields = fields[0], fields[1:]
+		switch bind {
+		case "", "localhost":
+			bind = "localhost"
+		case "*":
+			bind = "0.0.0.0"
+		}
+	}
+	var fwd remoteForward
+	switch {
+	case len(fields) == 2 && strings.Contains(fields[1], "/"):
+		fwd.network, fwd.target = "unix", fields[1]
+	case len(fields) == 3:
+		if _, err := strconv.ParseUint(fields[2], 10, 16); err != nil {
+			return remoteForward{}, fmt.Errorf("invalid port %q", fields[2])
+		}
+		fwd.network, fwd.target = "tcp", net.JoinHostPort(fields[1], fields[2])
+	default:
+		return remoteForward{}, errors.New("want [bind_address:]port:host:hostport or [bind_address:]port:/local/socket")
+	}
+	if _, err := strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return remoteForward{}, fmt.Errorf("invalid port %q", fields[0])
+	}
+	fwd.listen = net.JoinHostPort(bind, fields[0])
+	return fwd, nil
+}
+
+// splitForwardSpec splits a forwarding spec at colons, keeping bracketed
+// IPv6 addresses whole.
+func splitForwardSpec(spec string) ([]string, error) {
+	var fields []string
+	for {
+		if rest, ok := strings.CutPrefix(spec, "["); ok {
+			addr, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, errors.New("missing ] after IPv6 address")
+			}
+			fields = append(fields, addr)
+			if after == "" {
+				return fields, nil
+			}
+			if spec, ok = strings.CutPrefix(after, ":"); !ok {
+				return nil, fmt.Errorf("unexpected %q after IPv6 address", after)
+			}
+			continue
+		}
+		field, rest, ok := strings.Cut(spec, ":")
+		fields = append(fields, field)
+		if !ok {
+			return fields, nil
+		}
+		spec = rest
+	}
+}
+
+// listenRemoteForward asks the server to listen for fwd and relays the
+// connections it accepts, recorded in open, until the returned listener is
+// closed. A port the server picked is printed, as scripts need it to use the
+// forwarding.
+func listenRemoteForward(client *ssh.Client, fwd remoteForward, open *openForwards) (net.Listener, error) {
+	listener, err := client.Listen("tcp", fwd.listen)
+	if err != nil {
+		return nil, fmt.Errorf("remote port forwarding %s failed: %w", fwd.listen, err)
+	}
+	if _, port, _ := net.SplitHostPort(fwd.listen); port == "0" {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			fmt.Printf("Allocated port %d for remote forward to %s\n", addr.Port, fwd.target)
+		}
+	}
+	go func() {
+		for {
+			remote, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				local, err := net.Dial(fwd.network, fwd.target)
+				if err != nil {
+					log.Printf("Remote forward to %s: %v", fwd.target, err)
+					remote.Close()
+					return
+				}
+				id := open.add(fmt.Sprintf("remote forward %s -> %s from %s", listener.Addr(), fwd.target, remote.RemoteAddr()))
+				proxyConns(remote, local)
+				open.remove(id)
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// forwardStdio connects stdin and stdout to address as reached from the
+// server, for -W, and returns once the remote end closes. The end of stdin
+// is passed on as a half-close, so the remote end can still answer.
+func forwardStdio(client *ssh.Client, address string, stdin io.Reader, stdout io.Writer) error {
+	remote, err := client.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	go func() {
+		io.Copy(remote, stdin)
+		if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stdout, remote)
+	return err
+}
+
+// proxyConns copies data between a and b in both directions, passing on
+// half-closes where the connections support them, and closes both once
+// neither has more to send.
+func proxyConns(a, b net.Conn) {
+	var done sync.WaitGroup
+	done.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done.Done()
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	done.Wait()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hasGlobMeta reports whether a remote path holds the wildcards *, ? or [,
+// which get expands on the server.
+func hasGlobMeta(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// Glob returns the remote paths that match pattern, as the shell expands
+// them: each element of the path is matched with path.Match against the
+// entries of the directories matched so far, a leading dot only matches a
+// dot in the pattern, and the matches are sorted. Directories that cannot be
+// read are skipped.
+func (c *sftpClient) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	matches := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		matches = []string{"/"}
+	}
+	elems := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i, elem := range elems {
+		last := i == len(elems)-1
+		var next []string
+		for _, dir := range matches {
+			if !hasGlobMeta(elem) {
+				name := path.Join(dir, elem)
+				if last {
+					if _, err := c.Lstat(name); err != nil {
+						continue
+					}
+				}
+				next = append(next, name)
+				continue
+			}
+			list := dir
+			if list == "" {
+				list = "."
+			}
+			entries, err := c.ReadDir(list)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				name := entry.Name()
+				if strings.HasPrefix(name, ".") && !strings.HasPrefix(elem, ".") {
+					continue
+				}
+				if ok, _ := path.Match(elem, name); !ok {
+					continue
+				}
+				// Only directories, or links that may be ones, lead on.
+				if !last && !entry.IsDir() && entry.Mode()&fs.ModeSymlink == 0 {
+					continue
+				}
+				next = append(next, path.Join(dir, name))
+			}
+		}
+		matches = next
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// expandGlobs replaces the sources of get holding wildcards with the remote
+// paths glob finds for them. A pattern that matches nothing is reported with
+// fail.
+func expandGlobs(host string, sources []string, glob func(string) ([]string, error), fail func(error)) []string {
+	var expanded []string
+	for _, source := range sources {
+		if !hasGlobMeta(source) {
+			expanded = append(expanded, source)
+			continue
+		}
+		matches, err := glob(source)
+		switch {
+		case errors.Is(err, path.ErrBadPattern):
+			fail(fmt.Errorf("invalid pattern %s:%s", host, source))
+		case err != nil:
+			fail(err)
+		case len(matches) == 0:
+			fail(fmt.Errorf("no files match %s:%s", host, source))
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded
+}
+
+// glob returns the remote paths that match pattern, expanded by sh on the
+// server, since the scp protocol only names the files it sends by their base
+// names.
+func (t *scpTransfer) glob(pattern string) ([]string, error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	script := "for f in " + globQuote(pattern) + `; do if [ -e "$f" ] || [ -L "$f" ]; then printf '%s\0' "$f"; fi; done`
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	output, err := session.Output("sh -c " + shellQuote(script))
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return strings.FieldsFunc(string(output), func(r rune) bool { return r == 0 }), nil
+}
+
+// globQuote quotes name for the shell like shellQuote, but leaves its
+// wildcards to be expanded.
+func globQuote(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("*?[]!^-_./,+@%:=", r):
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString("'\n'")
+		default:
+			b.WriteString(`\`)
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// scpStyle reports whether arg is a [user@]host:path argument, as scp takes
+// them, rather than the user@host[:port] destination of the other form of
+// put and get: a path of digits is a port, and an IPv6 address has no path.
+func scpStyle(arg string) bool {
+	_, remotePath, ok := splitRemotePath(arg)
+	if !ok || strings.Contains(arg, unixSocketScheme) {
+		return false
+	}
+	if _, err := strconv.Atoi(remotePath); err == nil {
+		return false
+	}
+	return net.ParseIP(arg[strings.Index(arg, "@")+1:]) == nil
+}
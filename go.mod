@@ -3,7 +3,9 @@ module ffarkas/memssh
 go 1.24.2
 
 require (
+	github.com/miekg/pkcs11 v1.1.2
 	golang.org/x/crypto v0.40.0
-	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/term v0.33.0
 )
+
+require golang.org/x/sys v0.34.0
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// connectionAttemptDelay is the pause between starting connection attempts
+// recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dialHappyEyeballs connects to a TCP address the way RFC 8305 describes:
+// the host's IPv6 and IPv4 addresses are tried alternately, IPv6 first,
+// starting a new attempt every connectionAttemptDelay or as soon as the
+// previous one fails. The first connection to succeed is used and the other
+// attempts are abandoned, so an unreachable address family costs a quarter
+// second rather than a full TCP timeout. Addresses not of the family of
+// dialer's LocalAddr, if set, are skipped.
+func dialHappyEyeballs(dialer *net.Dialer, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	addrs := interleaveAddressFamilies(ips, dialer.LocalAddr)
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	var firstErr error
+	start := time.NewTimer(0)
+	defer start.Stop()
+	for {
+		select {
+		case <-start.C:
+			target := netip.AddrPortFrom(addrs[next], uint16(port)).String()
+			go func() {
+				conn, err := dialer.DialContext(ctx, "tcp", target)
+				results <- result{conn, err}
+			}()
+			next++
+			pending++
+			if next < len(addrs) {
+				start.Reset(connectionAttemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close connections that still complete.
+				go func() {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}()
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start.Reset(0)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// interleaveAddressFamilies orders addresses IPv6, IPv4, IPv6, ... keeping
+// the resolver's order within each family. If local is set, only addresses
+// of its family are kept.
+func interleaveAddressFamilies(ips []netip.Addr, local net.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if tcp, ok := local.(*net.TCPAddr); ok && tcp != nil {
+		if tcp.IP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+	var addrs []netip.Addr
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// hostKeysRequest is the global request OpenSSH servers send after
+	// authentication to announce all of their host keys.
+	hostKeysRequest = "hostkeys-00@openssh.com"
+	// hostKeysProveRequest asks the server to prove it holds the private
+	// halves of announced keys.
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeyUpdater keeps known_hosts.json in step with the host keys a server
+// announces, so a server that adds or rotates keys does not later trigger a
+// changed-key error. Like OpenSSH's UpdateHostKeys it only acts when the
+// session's host key was trusted through the host's own entry, and only
+// stores new keys after the server has signed them with the session ID.
+type hostKeyUpdater struct {
+	address string
+	policy  hostKeyPolicy
+	update  bool
+	// hostKey is the key the server authenticated this session with.
+	hostKey ssh.PublicKey
+	pending sync.WaitGroup
+}
+
+// filter passes global requests through to the ssh.Client, handling host key
+// announcements on the way.
+func (u *hostKeyUpdater) filter(conn ssh.Conn, in <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		announced := false
+		for req := range in {
+			if req.Type != hostKeysRequest {
+				out <- req
+				continue
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			if !announced && u.update {
+				announced = true
+				u.pending.Add(1)
+				go u.handleAnnouncement(conn, req.Payload)
+			}
+		}
+	}()
+	return out
+}
+
+// handleAnnouncement updates the host's entry from an announcement. Problems
+// are only logged, as the session itself is unaffected.
+func (u *hostKeyUpdater) handleAnnouncement(conn ssh.Conn, payload []byte) {
+	defer u.pending.Done()
+	if err := u.apply(conn, payload); err != nil {
+		log.Printf("Warning: host key update for %s skipped: %v", u.address, err)
+	}
+}
+
+// apply verifies the announced keys and rewrites the host's entry to exactly
+// the announced set.
+func (u *hostKeyUpdater) apply(conn ssh.Conn, payload []byte) error {
+	announced, err := parseAnnouncedHostKeys(payload)
+	if err != nil {
+		return err
+	}
+
+	known, err := readKnownHosts(u.policy.path)
+	if err != nil {
+		return err
+	}
+	entry, own, ok := known.entry(u.address)
+	if !ok || u.hostKey == nil || own[u.hostKey.Type()] != hostFingerprint(u.hostKey) {
+		return nil
+	}
+
+	updated := HostKeys{}
+	var unproven []ssh.PublicKey
+	for _, key := range announced {
+		fp := hostFingerprint(key)
+		if own[key.Type()] != fp {
+			unproven = append(unproven, key)
+		}
+		updated[key.Type()] = fp
+	}
+	if _, ok := updated[u.hostKey.Type()]; !ok {
+		return errors.New("server did not announce the key it authenticated with")
+	}
+	if maps.Equal(updated, own) {
+		return nil
+	}
+	if err := proveHostKeys(conn, unproven); err != nil {
+		return err
+	}
+
+	var added, removed []string
+	for keyType := range updated {
+		if own[keyType] != updated[keyType] {
+			added = append(added, keyType)
+		}
+	}
+	for keyType := range own {
+		if _, ok := updated[keyType]; !ok {
+			removed = append(removed, keyType)
+		}
+	}
+	err = updateKnownHosts(u.policy.path, func(k *KnownHosts) error {
+		if current, ok := k.Hosts[entry]; !ok || !maps.Equal(current, own) {
+			return errors.New("known_hosts.json was changed by another process")
+		}
+		k.Hosts[entry] = updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var changes []string
+	if len(added) > 0 {
+		slices.Sort(added)
+		changes = append(changes, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		slices.Sort(removed)
+		changes = append(changes, "removed "+strings.Join(removed, ", "))
+	}
+	log.Printf("Updated host keys for %s: %s", u.address, strings.Join(changes, "; "))
+	return nil
+}
+
+// wait blocks until an update in progress has finished, so it is not cut
+// short by closing the connection.
+func (u *hostKeyUpdater) wait() {
+	u.pending.Wait()
+}
+
+// parseAnnouncedHostKeys decodes the list of key blobs in a host key
+// announcement, skipping key types this client does not understand.
+func parseAnnouncedHostKeys(payload []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, fmt.Errorf("malformed host key announcement: %w", err)
+		}
+		payload = blob.Rest
+		if key, err := ssh.ParsePublicKey(blob.Key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// proveHostKeys asks the server to sign the session ID with each key and
+// verifies the signatures.
+func proveHostKeys(conn ssh.Conn, keys []ssh.PublicKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	var request []byte
+	for _, key := range keys {
+		request = append(request, ssh.Marshal(struct{ Key []byte }{key.Marshal()})...)
+	}
+	ok, reply, err := conn.SendRequest(hostKeysProveRequest, true, request)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("server refused to prove its host keys")
+	}
+
+	for _, key := range keys {
+		var blob struct {
+			Signature []byte
+			Rest      []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(reply, &blob); err != nil {
+			return fmt.Errorf("malformed host key proof: %w", err)
+		}
+		reply = blob.Rest
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+			return fmt.Errorf("malformed host key signature: %w", err)
+		}
+		signed := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, conn.SessionID(), key.Marshal()})
+		if err := key.Verify(signed, &sig); err != nil {
+			return fmt.Errorf("invalid proof for %s key %s: %w", key.Type(), ssh.FingerprintSHA256(key), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// runHosts implements `memssh hosts`: it lists, shows, removes, exports and
+// imports entries of known_hosts.json so the trust database does not have to be
+// edited by hand, for example after a server has been reinstalled, and signs
+// the file against tampering.
+func runHosts(args []string) {
+	fs := flag.NewFlagSet("hosts", flag.ExitOnError)
+	keyType := fs.String("type", "", "remove: only remove the key of this type (e.g. ssh-rsa)")
+	format := fs.String("format", "json", "export: json (known_hosts.json layout) or text (one fingerprint per line)")
+	file := fs.String("file", "", "import: OpenSSH known_hosts file to import (default ~/.ssh/known_hosts)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  memssh hosts list\n  memssh hosts show HOST[:PORT]\n  memssh hosts remove [-type TYPE] HOST[:PORT]|PATTERN\n  memssh hosts export [-format json|text]\n  memssh hosts import [-file KNOWN_HOSTS]\n  memssh hosts sign\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	path := getKnownHostsPath()
+	known, err := readKnownHosts(path)
+	if err != nil && !(action == "sign" && errors.Is(err, errKnownHostsUnsigned)) {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+
+	switch {
+	case action == "list" && fs.NArg() == 0:
+		listKnownHosts(known)
+	case action == "show" && fs.NArg() == 1:
+		showKnownHost(known, hostAddress(fs.Arg(0)))
+	case action == "remove" && fs.NArg() == 1:
+		err := updateKnownHosts(path, func(k *KnownHosts) error {
+			return removeKnownHost(k, fs.Arg(0), *keyType)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case action == "export" && fs.NArg() == 0:
+		if err := exportKnownHosts(known, *format); err != nil {
+			log.Fatal(err)
+		}
+	case action == "import" && fs.NArg() == 0:
+		if *file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				log.Fatalf("Unable to determine user home directory: %v", err)
+			}
+			*file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *file, err)
+		}
+		var imported, skipped int
+		err = updateKnownHosts(path, func(k *KnownHosts) error {
+			imported, skipped, err = importOpenSSHKnownHosts(k, data)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", *file, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Imported %d entries from %s", imported, *file)
+		if skipped > 0 {
+			fmt.Printf(", skipped %d (hashed hosts or keys conflicting with known_hosts.json)", skipped)
+		}
+		fmt.Println()
+	case action == "sign" && fs.NArg() == 0:
+		if err := signKnownHosts(path); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Signed %s; changes made outside memssh will now be detected\n", path)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// hostAddress adds the default SSH port to a host given without one. IPv6
+// addresses may be given with or without brackets.
+func hostAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "22")
+}
+
+// listKnownHosts prints every trusted host key, certificate authority and
+// revoked key in the database.
+func listKnownHosts(known KnownHosts) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range slices.Sorted(maps.Keys(known.Hosts)) {
+		printHostKeys(w, entry, known.Hosts[entry])
+	}
+	for _, ca := range known.CertAuthorities {
+		fmt.Fprintf(w, "@cert-authority %s\t%s\n", ca.Hosts, describeAuthorizedKey(ca.Key))
+	}
+	for _, entry := range known.Revoked {
+		fmt.Fprintf(w, "@revoked\t%s\n", describeAuthorizedKey(entry))
+	}
+	w.Flush()
+}
+
+// showKnownHost prints the entries that apply to address: its own entry,
+// matching pattern entries and the certificate authorities covering it.
+func showKnownHost(known KnownHosts, address string) {
+	host, _, _ := net.SplitHostPort(address)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	found := false
+	for _, entry := range slices.Sorted(maps.Keys(known.Hosts)) {
+		if entry == address || matchHashedHost(entry, address) ||
+			isHostPattern(entry) && matchAddressList(entry, address) {
+			printHostKeys(w, entry, known.Hosts[entry])
+			found = true
+		}
+	}
+	for _, ca := range known.CertAuthorities {
+		if matchHostList(ca.Hosts, host) {
+			fmt.Fprintf(w, "@cert-authority %s\t%s\n", ca.Hosts, describeAuthorizedKey(ca.Key))
+			found = true
+		}
+	}
+	w.Flush()
+	if !found {
+		fmt.Printf("%s is not trusted yet\n", address)
+	}
+}
+
+// printHostKeys writes one line per key type of a hosts entry.
+func printHostKeys(w *tabwriter.Writer, entry string, keys HostKeys) {
+	for _, keyType := range slices.Sorted(maps.Keys(keys)) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry, hostKeyTypeName(keyType), displayStoredFingerprint(keys[keyType]))
+	}
+}
+
+// hostKeyTypeName names the key type of a hosts entry for display.
+func hostKeyTypeName(keyType string) string {
+	if keyType == untypedHostKey {
+		return "(any)"
+	}
+	return keyType
+}
+
+// describeAuthorizedKey shows the type and fingerprint of an authorized_keys
+// line, or the line itself if it is a fingerprint or cannot be parsed.
+func describeAuthorizedKey(line string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line
+	}
+	return key.Type() + "\t" + ssh.FingerprintSHA256(key)
+}
+
+// removeKnownHost deletes an entry, named either exactly as stored (an address
+// or pattern list) or by a host whose own entry may be hashed. With keyType
+// set, only the key of that type is removed.
+func removeKnownHost(known *KnownHosts, name, keyType string) error {
+	entry := name
+	if _, ok := known.Hosts[entry]; !ok {
+		var found bool
+		if entry, _, found = known.entry(hostAddress(name)); !found {
+			return fmt.Errorf("no entry for %s in known_hosts.json", name)
+		}
+	}
+	if keyType == "" {
+		delete(known.Hosts, entry)
+		fmt.Printf("Removed %s\n", name)
+		return nil
+	}
+	if _, ok := known.Hosts[entry][keyType]; !ok {
+		return fmt.Errorf("no %s key stored for %s", keyType, name)
+	}
+	delete(known.Hosts[entry], keyType)
+	if len(known.Hosts[entry]) == 0 {
+		delete(known.Hosts, entry)
+	}
+	fmt.Printf("Removed %s key of %s\n", keyType, name)
+	return nil
+}
+
+// exportKnownHosts writes the database to stdout as JSON or as text lines of
+// host, key type and SHA256 fingerprint.
+func exportKnownHosts(known KnownHosts, format string) error {
+	switch format {
+	case "json":
+		// The signature is tied to this machine's keyring, so it is not exported.
+		known.HMAC = ""
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(known)
+	case "text":
+		for _, entry := range slices.Sorted(maps.Keys(known.Hosts)) {
+			keys := known.Hosts[entry]
+			for _, keyType := range slices.Sorted(maps.Keys(keys)) {
+				fmt.Printf("%s %s %s\n", entry, hostKeyTypeName(keyType), displayStoredFingerprint(keys[keyType]))
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q (use json or text)", format)
+}
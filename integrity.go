@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// knownHostsMACPrefix tags the algorithm of the HMAC field in known_hosts.json.
+const knownHostsMACPrefix = "hmac-sha256:"
+
+// errKnownHostsIntegrity is returned when a signed known_hosts.json fails
+// verification. Unlike a parse error it must never be treated as an empty
+// database, as that would hide the tampering.
+var errKnownHostsIntegrity = errors.New("known_hosts.json failed integrity check")
+
+// errKnownHostsUnsigned is returned for a known_hosts.json without an HMAC
+// although the keyring holds a signing secret for it, which is what removing
+// the HMAC to hide a change would leave.
+var errKnownHostsUnsigned = fmt.Errorf("%w: the file is not signed, but the keyring holds a signing key for it", errKnownHostsIntegrity)
+
+// errNoKeyringEntry is wrapped by keyringFind and keychainFind when there is
+// no entry for the account, as opposed to a keyring that cannot be read.
+var errNoKeyringEntry = errors.New("no keyring entry")
+
+// knownHostsKeyAccount names the keyring entry holding the signing secret of
+// the known_hosts.json at path.
+func knownHostsKeyAccount(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return "known-hosts:" + path
+}
+
+// knownHostsSecret fetches the signing secret for path from the OS keyring.
+func knownHostsSecret(path string) ([]byte, error) {
+	encoded, err := keyringFind(knownHostsKeyAccount(path))
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(encoded)
+	secret, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New("keyring entry is not a valid signing secret")
+	}
+	return secret, nil
+}
+
+// createKnownHostsSecret returns the signing secret for path, generating and
+// storing a random one in the OS keyring if there is none yet. Any other
+// error is returned, since a new secret would replace one that exists.
+func createKnownHostsSecret(path string) ([]byte, error) {
+	secret, err := knownHostsSecret(path)
+	if !errors.Is(err, errNoKeyringEntry) {
+		return secret, err
+	}
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	encoded := []byte(hex.EncodeToString(secret))
+	defer zeroBytes(encoded)
+	if err := keyringStore(knownHostsKeyAccount(path), "memssh known_hosts signing key", encoded); err != nil {
+		return nil, fmt.Errorf("saving signing key: %w", err)
+	}
+	return secret, nil
+}
+
+// mac computes the HMAC of the database contents, excluding the HMAC field.
+func (k KnownHosts) mac(secret []byte) (string, error) {
+	k.HMAC = ""
+	data, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return knownHostsMACPrefix + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// sign sets the HMAC field with the signing secret for path.
+func (k *KnownHosts) sign(path string) error {
+	secret, err := knownHostsSecret(path)
+	if err != nil {
+		return fmt.Errorf("signing known_hosts.json: %w", err)
+	}
+	defer zeroBytes(secret)
+	k.HMAC, err = k.mac(secret)
+	return err
+}
+
+// verify checks the HMAC field of a database read from path and marks it as
+// signed, so later updates are signed as well.
+func (k *KnownHosts) verify(path string) error {
+	if !strings.HasPrefix(k.HMAC, knownHostsMACPrefix) {
+		return fmt.Errorf("%w: unsupported signature %q", errKnownHostsIntegrity, k.HMAC)
+	}
+	secret, err := knownHostsSecret(path)
+	if err != nil {
+		return fmt.Errorf("%w: cannot read the signing key: %v", errKnownHostsIntegrity, err)
+	}
+	defer zeroBytes(secret)
+	want, err := k.mac(secret)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want), []byte(k.HMAC)) {
+		return fmt.Errorf("%w: the file was modified outside memssh", errKnownHostsIntegrity)
+	}
+	k.signed = true
+	return nil
+}
+
+// signKnownHosts signs known_hosts.json at path as it stands, creating the
+// signing secret if there is none yet, for `memssh hosts sign`. A file whose
+// HMAC was removed is signed again, which accepts its current contents.
+func signKnownHosts(path string) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking known_hosts: %w", err)
+	}
+	defer unlock()
+
+	hosts, err := readKnownHosts(path)
+	if err != nil && !errors.Is(err, errKnownHostsUnsigned) {
+		return fmt.Errorf("parsing known_hosts: %w", err)
+	}
+	secret, err := createKnownHostsSecret(path)
+	if err != nil {
+		return err
+	}
+	zeroBytes(secret)
+	hosts.signed = true
+	return writeKnownHosts(path, hosts)
+}
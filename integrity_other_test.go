@@ -0,0 +1,140 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSecretTool stands in for secret-tool, keeping each secret in a file of
+// the directory it is in.
+const testSecretTool = `#!/bin/sh
+dir=$(dirname "$0")
+case $1 in
+lookup) f="$dir/$(echo "$5" | cksum | cut -d' ' -f1)"; [ -f "$f" ] && exec cat "$f"; exit 1 ;;
+store) exec cat > "$dir/$(echo "$6" | cksum | cut -d' ' -f1)" ;;
+esac
+exit 2
+`
+
+// editKnownHostsJSON rewrites the known_hosts.json at path with edit applied
+// to its decoded form, as a change made outside memssh would.
+func editKnownHostsJSON(t *testing.T, path string, edit func(map[string]any)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file map[string]any
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	edit(file)
+	if data, err = json.Marshal(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownHostsSignature(t *testing.T) {
+	sign := func(t *testing.T, path string) {
+		if err := signKnownHosts(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stripHMAC := func(t *testing.T, path string) {
+		editKnownHostsJSON(t, path, func(file map[string]any) { delete(file, "hmac") })
+	}
+	tests := []struct {
+		name   string
+		steps  []func(t *testing.T, path string)
+		signed bool
+		err    error // nil, errKnownHostsUnsigned or errKnownHostsIntegrity
+	}{
+		{name: "unsigned"},
+		{name: "signed", steps: []func(*testing.T, string){sign}, signed: true},
+		{name: "HMAC removed", steps: []func(*testing.T, string){sign, stripHMAC}, err: errKnownHostsUnsigned},
+		{name: "HMAC removed and signed again", steps: []func(*testing.T, string){sign, stripHMAC, sign}, signed: true},
+		{
+			name: "entry changed",
+			steps: []func(*testing.T, string){sign, func(t *testing.T, path string) {
+				editKnownHostsJSON(t, path, func(file map[string]any) {
+					file["hosts"].(map[string]any)["example.com:22"].(map[string]any)["ssh-ed25519"] = "SHA256:attacker"
+				})
+			}},
+			err: errKnownHostsIntegrity,
+		},
+		{
+			name: "HMAC altered",
+			steps: []func(*testing.T, string){sign, func(t *testing.T, path string) {
+				editKnownHostsJSON(t, path, func(file map[string]any) { file["hmac"] = knownHostsMACPrefix + "AAAA" })
+			}},
+			err: errKnownHostsIntegrity,
+		},
+		{
+			name: "file removed and made anew",
+			steps: []func(*testing.T, string){sign, func(t *testing.T, path string) {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+				err := updateKnownHosts(path, func(k *KnownHosts) error {
+					k.Hosts = map[string]HostKeys{"example.com:22": {"ssh-ed25519": "SHA256:new"}}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}},
+			signed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keyring := filepath.Join(dir, "keyring")
+			if err := os.Mkdir(keyring, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(keyring, "secret-tool"), []byte(testSecretTool), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", keyring+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			path := filepath.Join(dir, "known_hosts.json")
+			hosts := KnownHosts{Hosts: map[string]HostKeys{"example.com:22": {"ssh-ed25519": "SHA256:trusted"}}}
+			if err := writeKnownHosts(path, hosts); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				step(t, path)
+			}
+
+			got, err := readKnownHosts(path)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				if !errors.Is(err, errKnownHostsIntegrity) {
+					t.Errorf("err = %v, which is not an integrity error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.signed != tt.signed {
+				t.Errorf("signed = %v, want %v", got.signed, tt.signed)
+			}
+			if fp := got.Hosts["example.com:22"]["ssh-ed25519"]; !strings.HasPrefix(fp, "SHA256:") {
+				t.Errorf("fingerprint = %q", fp)
+			}
+		})
+	}
+}
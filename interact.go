@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// defaultInteractTimeout bounds how long an -interact step waits for its
+// pattern, unless the script sets another timeout.
+const defaultInteractTimeout = 30 * time.Second
+
+// maxExpectBuffer bounds the output kept for matching -interact patterns.
+const maxExpectBuffer = 64 << 10
+
+// exitInteractionFailed is the exit status when an -interact script fails,
+// as when a pattern does not appear in time.
+const exitInteractionFailed = 1
+
+// interaction is an -interact script: steps run in order, each waiting for
+// a pattern in the output and then sending a response, as expect does. It
+// is written as a small YAML document:
+//
+//	timeout: 30s
+//	steps:
+//	  - expect: "login: $"
+//	    sendline: admin
+//	  - expect: "Password: $"
+//	    send_env: SWITCH_PASSWORD
+//	  - expect: "# $"
+//	    sendline: show version
+//	    timeout: 5s
+type interaction struct {
+	timeout time.Duration
+	steps   []interactStep
+}
+
+// interactStep is one step of an -interact script. Each part is optional.
+type interactStep struct {
+	line    int // where the step starts, for errors
+	expect  *regexp.Regexp
+	timeout time.Duration
+	send    string // sent as is
+	sendEnv string // an environment variable whose value is sent as a line
+	sleep   time.Duration
+}
+
+// readInteraction reads and parses the -interact script at path.
+func readInteraction(path string) (*interaction, error) {
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	return parseInteraction(data)
+}
+
+// parseInteraction parses an -interact script. It understands the subset of
+// YAML the scripts need: top-level keys, a "steps" list of mappings, plain,
+// single- and double-quoted scalars, and comments.
+func parseInteraction(data []byte) (*interaction, error) {
+	in := &interaction{timeout: defaultInteractTimeout}
+	var steps []map[string]string
+	var stepLines []int
+	inSteps := false
+	stepIndent := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", n)
+		}
+		indent := len(text) - len(trimmed)
+
+		if indent == 0 {
+			key, value, err := parseYAMLPair(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			inSteps = false
+			switch key {
+			case "steps":
+				if value != "" {
+					return nil, fmt.Errorf("line %d: steps must be a list", n)
+				}
+				inSteps = true
+			case "timeout":
+				if in.timeout, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("line %d: invalid timeout: %w", n, err)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+			}
+			continue
+		}
+		if !inSteps {
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "-"); ok && (item == "" || item[0] == ' ') {
+			steps = append(steps, map[string]string{})
+			stepLines = append(stepLines, n)
+			item = strings.TrimLeft(item, " ")
+			stepIndent = len(text) - len(item)
+			if item == "" {
+				stepIndent = -1
+				continue
+			}
+			trimmed = item
+		} else if len(steps) == 0 {
+			return nil, fmt.Errorf("line %d: expected a list item starting with \"-\"", n)
+		} else if stepIndent == -1 {
+			stepIndent = indent
+		} else if indent != stepIndent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", n)
+		}
+		key, value, err := parseYAMLPair(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		step := steps[len(steps)-1]
+		if _, dup := step[key]; dup {
+			return nil, fmt.Errorf("line %d: %s given twice", n, key)
+		}
+		step[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, fields := range steps {
+		step, err := newInteractStep(fields, in.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", stepLines[i], err)
+		}
+		step.line = stepLines[i]
+		in.steps = append(in.steps, step)
+	}
+	if len(in.steps) == 0 {
+		return nil, errors.New("no steps")
+	}
+	return in, nil
+}
+
+// newInteractStep builds a step from its keys.
+func newInteractStep(fields map[string]string, timeout time.Duration) (interactStep, error) {
+	step := interactStep{timeout: timeout}
+	sends := 0
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "expect":
+			step.expect, err = regexp.Compile(value)
+		case "timeout":
+			step.timeout, err = time.ParseDuration(value)
+		case "sleep":
+			step.sleep, err = time.ParseDuration(value)
+		case "send":
+			step.send = value
+			sends++
+		case "sendline":
+			step.send = value + "\r"
+			sends++
+		case "send_env":
+			if _, ok := os.LookupEnv(value); !ok {
+				err = fmt.Errorf("environment variable %s is not set", value)
+			}
+			step.sendEnv = value
+			sends++
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return step, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if sends > 1 {
+		return step, errors.New("only one of send, sendline and send_env may be used in a step")
+	}
+	return step, nil
+}
+
+// parseYAMLPair splits a "key: value" line and unquotes the value.
+func parseYAMLPair(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, ":")
+	if !ok || (value != "" && value[0] != ' ') {
+		return "", "", fmt.Errorf("expected \"key: value\", got %q", s)
+	}
+	value, err = parseYAMLScalar(strings.TrimLeft(value, " "))
+	return strings.TrimSpace(key), value, err
+}
+
+// parseYAMLScalar returns the value of a plain or quoted scalar. Double
+// quotes take backslash escapes such as \r, \n and \x1b; in single quotes,
+// a doubled quote stands for one.
+func parseYAMLScalar(s string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return "", errors.New("unterminated double-quoted string")
+		}
+		var err error
+		if value, err = strconv.Unquote(s[:end+1]); err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s[:end+1])
+		}
+		rest = s[end+1:]
+	case strings.HasPrefix(s, "'"):
+		var b strings.Builder
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			b.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", errors.New("unterminated single-quoted string")
+		}
+		value, rest = b.String(), s[i+1:]
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after quoted string", rest)
+	}
+	return value, nil
+}
+
+// run plays the script against a session's output and stdin.
+func (in *interaction) run(output *expectBuffer, stdin io.Writer) error {
+	for i, step := range in.steps {
+		if step.expect != nil {
+			if err := output.expect(step.expect, step.timeout); err != nil {
+				return fmt.Errorf("step %d (line %d): %w", i+1, step.line, err)
+			}
+		}
+		if step.sleep > 0 {
+			time.Sleep(step.sleep)
+		}
+		send := []byte(step.send)
+		if step.sendEnv != "" {
+			send = []byte(os.Getenv(step.sendEnv) + "\r")
+		}
+		if len(send) > 0 {
+			_, err := stdin.Write(send)
+			zeroBytes(send)
+			if err != nil {
+				return fmt.Errorf("step %d (line %d): %w", i+1, step.line, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expectBuffer keeps a session's output for -interact patterns to match.
+// Output up to the end of each match is dropped, so the next pattern only
+// sees what came after.
+type expectBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	changed chan struct{} // closed on each write, then replaced
+	ended   bool
+}
+
+func newExpectBuffer() *expectBuffer {
+	return &expectBuffer{changed: make(chan struct{})}
+}
+
+func (b *expectBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxExpectBuffer {
+		b.buf = b.buf[len(b.buf)-maxExpectBuffer:]
+	}
+	b.notify()
+	return len(p), nil
+}
+
+// end marks the output as finished, failing patterns still waiting.
+func (b *expectBuffer) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ended = true
+	b.notify()
+}
+
+func (b *expectBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// expect waits up to timeout for re to match the output.
+func (b *expectBuffer) expect(re *regexp.Regexp, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		if loc := re.FindIndex(b.buf); loc != nil {
+			b.buf = b.buf[loc[1]:]
+			b.mu.Unlock()
+			return nil
+		}
+		ended, changed := b.ended, b.changed
+		b.mu.Unlock()
+		if ended {
+			return fmt.Errorf("session ended while waiting for %q", re)
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("timed out after %s waiting for %q", timeout, re)
+		}
+	}
+}
+
+// runInteraction implements -interact: it starts cmd, or a shell if empty,
+// on a PTY, plays the script against it, and then leaves the session to the
+// user if stdin is a terminal, or waits for it to end. It returns the exit
+// status of the shell or command (see exitStatus), or exitInteractionFailed
+// if a step fails.
+func runInteraction(client *ssh.Client, cmd string, script *interaction, setup sessionSetup) int {
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fatalConnection("Failed to open stdin: %v", err)
+	}
+	output := newExpectBuffer()
+	session.Stdout = io.MultiWriter(setup.output(os.Stdout), output)
+	session.Stderr = io.MultiWriter(setup.output(os.Stderr), output)
+	restore := requestTerminal(session, setup)
+
+	if cmd != "" {
+		err = session.Start(cmd)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		restore()
+		fatalConnection("Failed to start session: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := session.Wait()
+		output.end()
+		done <- err
+	}()
+
+	if err := script.run(output, stdin); err != nil {
+		session.Close()
+		restore()
+		log.Printf("Interaction failed: %v", err)
+		return exitInteractionFailed
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		go io.Copy(stdin, setup.input(os.Stdin))
+	}
+	err = <-done
+	restore()
+	return commandStatus(err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialFunc opens a connection to address, directly or through jump hosts.
+type dialFunc func(network, address string) (net.Conn, error)
+
+// jumpHost is one hop of a -jump list.
+type jumpHost struct {
+	user string
+	host string
+	port int
+}
+
+// address returns the hop's host:port.
+func (j jumpHost) address() string {
+	return net.JoinHostPort(j.host, strconv.Itoa(j.port))
+}
+
+// parseJumpHosts parses a comma-separated list of [user@]host[:port] hops,
+// like OpenSSH's ProxyJump. The user is left empty for hops without one.
+func parseJumpHosts(spec string) ([]jumpHost, error) {
+	var hops []jumpHost
+	for _, dest := range strings.Split(spec, ",") {
+		dest = strings.TrimSpace(dest)
+		hop := connOptions{port: 22}
+		if err := hop.setDestination(dest); err != nil {
+			return nil, err
+		}
+		if hop.host == "" {
+			return nil, fmt.Errorf("missing host in jump host %q", dest)
+		}
+		hops = append(hops, jumpHost{user: hop.user, host: hop.host, port: hop.port})
+	}
+	return hops, nil
+}
+
+// dialJumpHosts connects through each hop in turn, the first with dial and
+// every later one tunneled over the previous hop, and returns a dialFunc that
+// opens connections from the last hop. Each hop's host key is checked against
+// known_hosts.json under its own address, and each hop authenticates as its
+// own user; algorithms and the connect timeout come from base. The clients
+// are returned so the caller can close them once done.
+func dialJumpHosts(dial dialFunc, hops []jumpHost, auth authMethodsFunc, known KnownHosts, policy hostKeyPolicy, base ssh.ClientConfig) (dialFunc, []*ssh.Client, error) {
+	// An expected fingerprint pins the destination, not the hops.
+	policy.expect = nil
+
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for _, hop := range hops {
+		address := hop.address()
+		config := base
+		config.User = hop.user
+		config.Auth = auth(hop.user, hop.host)
+		config.HostKeyCallback = hostKeyCallback(address, known, policy)
+		client, err := dialSSH(dial, address, &config)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("jump host %s: %w", address, err)
+		}
+		clients = append(clients, client)
+		dial = client.Dial
+	}
+	return dial, clients, nil
+}
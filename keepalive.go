@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepAliveRequest is the global request OpenSSH's ServerAliveInterval sends;
+// servers answer it, with a failure if they do not know it, which is enough
+// to show they are alive.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// startKeepAlive sends a keepalive request every interval and closes the
+// client once max requests in a row have gone unanswered, like OpenSSH's
+// ServerAliveInterval and ServerAliveCountMax. Closing the client ends any
+// session waiting on it, so a dead connection does not hang forever. The
+// returned function stops the keepalives.
+func startKeepAlive(client *ssh.Client, address string, interval time.Duration, max int) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var unanswered atomic.Int32
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if int(unanswered.Load()) >= max {
+				log.Printf("Server %s did not answer %d keepalives; closing the connection", address, max)
+				client.Close()
+				return
+			}
+			unanswered.Add(1)
+			go func() {
+				if _, _, err := client.SendRequest(keepAliveRequest, true, nil); err == nil {
+					unanswered.Store(0)
+				}
+			}()
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,71 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainSupported reports whether the macOS Keychain can be used on this platform.
+const keychainSupported = true
+
+// keychainService is the Keychain service name under which passphrases are stored.
+const keychainService = "memssh"
+
+// keychainItemNotFound is the exit status of security when there is no such
+// item (errSecItemNotFound).
+const keychainItemNotFound = 44
+
+// keychainFind looks up a stored passphrase for the given account.
+func keychainFind(account string) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", account, "-w").Output()
+	if err != nil {
+		zeroBytes(out)
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == keychainItemNotFound {
+			return nil, fmt.Errorf("%w for %s", errNoKeyringEntry, account)
+		}
+		if exit != nil {
+			return nil, fmt.Errorf("security: %w: %s", err, bytes.TrimSpace(exit.Stderr))
+		}
+		return nil, fmt.Errorf("security: %w", err)
+	}
+	return trimNewline(out), nil
+}
+
+// keychainStore saves a secret with a descriptive label for the given account,
+// replacing any previous entry. The command is fed through stdin in hex so the
+// secret never shows up in the process list.
+func keychainStore(account, label string, pass []byte) error {
+	if strings.ContainsAny(account+label, "\r\n") {
+		return fmt.Errorf("a Keychain entry cannot have a line break in its name: %q", account)
+	}
+	input := []byte(fmt.Sprintf("add-generic-password -U -s %s -a %s -l %s -X ",
+		keychainQuote(keychainService), keychainQuote(account), keychainQuote(label)))
+	encoded := make([]byte, hex.EncodedLen(len(pass)))
+	hex.Encode(encoded, pass)
+	input = append(append(input, encoded...), '\n')
+	zeroBytes(encoded)
+	defer zeroBytes(input)
+
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("security: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// keychainQuote quotes an argument for the command line of security -i, which
+// splits it at spaces outside double quotes and takes a backslash to escape
+// the next character.
+func keychainQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
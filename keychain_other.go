@@ -0,0 +1,18 @@
+//go:build !darwin
+
+package main
+
+import "errors"
+
+// keychainSupported reports whether the macOS Keychain can be used on this platform.
+const keychainSupported = false
+
+// keychainFind is unavailable outside macOS.
+func keychainFind(account string) ([]byte, error) {
+	return nil, errors.New("the macOS Keychain is only available on macOS")
+}
+
+// keychainStore is unavailable outside macOS.
+func keychainStore(account, label string, pass []byte) error {
+	return errors.New("the macOS Keychain is only available on macOS")
+}
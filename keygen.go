@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// runKeygen implements `memssh keygen`: it generates a key pair, prints the
+// public key, and writes the private key to a file or, by default, to stdout
+// only, so it can be piped straight into a secret manager.
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyType := fs.String("t", "ed25519", "Key type: ed25519, ecdsa or rsa")
+	bits := fs.Int("b", 0, "Key size: 256/384/521 for ecdsa, >= 2048 for rsa (default 256 and 3072)")
+	comment := fs.String("C", "", "Comment stored in the key")
+	out := fs.String("f", "", "Write the private key to this file and the public key to <file>.pub (default: private key to stdout)")
+	encrypt := fs.Bool("encrypt", false, "Protect the private key with a passphrase (prompted)")
+	fs.Parse(args)
+
+	key, err := generateKey(*keyType, *bits)
+	if err != nil {
+		log.Fatalf("Key generation failed: %v", err)
+	}
+
+	var pass []byte
+	if *encrypt {
+		prompts := os.Stdout
+		if *out == "" {
+			prompts = os.Stderr
+		}
+		pass, err = readNewPassphrase(prompts)
+		if err != nil {
+			log.Fatalf("Passphrase error: %v", err)
+		}
+		defer zeroBytes(pass)
+	}
+
+	var block *pem.Block
+	if pass != nil {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, *comment, pass)
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, *comment)
+	}
+	if err != nil {
+		log.Fatalf("Encoding private key failed: %v", err)
+	}
+	privatePEM := pem.EncodeToMemory(block)
+	defer zeroBytes(privatePEM)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		log.Fatalf("Encoding public key failed: %v", err)
+	}
+	authorizedKey := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(signer.PublicKey()), []byte("\n"))
+	if *comment != "" {
+		authorizedKey = append(authorizedKey, " "+*comment...)
+	}
+	authorizedKey = append(authorizedKey, '\n')
+
+	if *out == "" {
+		os.Stdout.Write(privatePEM)
+		fmt.Fprintf(os.Stderr, "%s%s\n", authorizedKey, ssh.FingerprintSHA256(signer.PublicKey()))
+		return
+	}
+
+	if err := os.WriteFile(*out, privatePEM, 0600); err != nil {
+		log.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(*out+".pub", authorizedKey, 0644); err != nil {
+		log.Fatalf("Failed to write public key: %v", err)
+	}
+	fmt.Printf("%sFingerprint: %s\n", authorizedKey, ssh.FingerprintSHA256(signer.PublicKey()))
+}
+
+// generateKey creates a private key of the given type and size.
+func generateKey(keyType string, bits int) (crypto.PrivateKey, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		curves := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[bits]
+		if !ok {
+			return nil, fmt.Errorf("invalid ECDSA key size %d", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	return nil, fmt.Errorf("unknown key type %q (use ed25519, ecdsa or rsa)", keyType)
+}
+
+// readNewPassphrase prompts for a new passphrase twice and checks both entries match.
+func readNewPassphrase(prompts io.Writer) ([]byte, error) {
+	pass, err := readSecretTo(prompts, "Enter new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := readSecretTo(prompts, "Enter same passphrase again: ")
+	if err != nil {
+		zeroBytes(pass)
+		return nil, err
+	}
+	defer zeroBytes(confirm)
+	if !bytes.Equal(pass, confirm) {
+		zeroBytes(pass)
+		return nil, errors.New("passphrases do not match")
+	}
+	if len(pass) == 0 {
+		zeroBytes(pass)
+		return nil, errors.New("empty passphrase")
+	}
+	return pass, nil
+}
@@ -0,0 +1,13 @@
+//go:build darwin
+
+package main
+
+// keyringFind reads a secret stored by keyringStore from the macOS Keychain.
+func keyringFind(account string) ([]byte, error) {
+	return keychainFind(account)
+}
+
+// keyringStore saves a secret in the macOS Keychain.
+func keyringStore(account, label string, secret []byte) error {
+	return keychainStore(account, label, secret)
+}
@@ -0,0 +1,49 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// keyringFind reads a secret stored by keyringStore from the Secret Service
+// (GNOME Keyring, KWallet) using libsecret's secret-tool.
+func keyringFind(account string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", "memssh", "account", account)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	// A missing entry fails without a message; a keyring that cannot be
+	// reached says why.
+	if err != nil || len(out) == 0 {
+		zeroBytes(out)
+		var exit *exec.ExitError
+		switch {
+		case errors.Is(err, exec.ErrNotFound):
+			return nil, errors.New("secret-tool (libsecret) is not installed")
+		case err == nil, errors.As(err, &exit) && stderr.Len() == 0:
+			return nil, fmt.Errorf("%w for %s", errNoKeyringEntry, account)
+		}
+		return nil, fmt.Errorf("secret-tool: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return trimNewline(out), nil
+}
+
+// keyringStore saves a secret in the Secret Service. secret-tool reads it
+// from stdin, so it never shows up in the process list.
+func keyringStore(account, label string, secret []byte) error {
+	cmd := exec.Command("secret-tool", "store", "--label="+label, "service", "memssh", "account", account)
+	cmd.Stdin = bytes.NewReader(secret)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return errors.New("secret-tool (libsecret) is not installed")
+		}
+		return fmt.Errorf("secret-tool: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
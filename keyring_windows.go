@@ -0,0 +1,92 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32       = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// credential mirrors the Win32 CREDENTIALW structure.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// keyringTarget names the Credential Manager entry for account.
+func keyringTarget(account string) (*uint16, error) {
+	return windows.UTF16PtrFromString("memssh:" + account)
+}
+
+// keyringFind reads a secret stored by keyringStore from the Windows
+// Credential Manager.
+func keyringFind(account string) ([]byte, error) {
+	target, err := keyringTarget(account)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return nil, fmt.Errorf("%w for %s", errNoKeyringEntry, account)
+		}
+		return nil, fmt.Errorf("reading credential for %s: %w", account, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return append([]byte(nil), blob...), nil
+}
+
+// keyringStore saves a secret in the Windows Credential Manager, replacing
+// any previous entry.
+func keyringStore(account, label string, secret []byte) error {
+	target, err := keyringTarget(account)
+	if err != nil {
+		return err
+	}
+	comment, err := windows.UTF16PtrFromString(label)
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("empty secret for %s", account)
+	}
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		Comment:            comment,
+		CredentialBlobSize: uint32(len(secret)),
+		CredentialBlob:     &secret[0],
+		Persist:            credPersistLocalMachine,
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return fmt.Errorf("storing credential for %s: %w", account, err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hashedHostPrefix marks a known_hosts.json entry whose address is stored as
+// an OpenSSH-style hash ("|1|base64(salt)|base64(HMAC-SHA1(salt, address))"),
+// so the file does not reveal which servers the user connects to.
+const hashedHostPrefix = "|1|"
+
+// untypedHostKey holds a fingerprint recorded before key types were stored.
+// It matches a key of any type and is replaced by a typed entry once the
+// host presents that key again.
+const untypedHostKey = ""
+
+// UnmarshalJSON also accepts the original file format, a flat object mapping
+// addresses to fingerprints; it is rewritten in the current format on save.
+func (k *KnownHosts) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if _, ok := fields["hosts"]; !ok {
+		*k = KnownHosts{}
+		return json.Unmarshal(data, &k.Hosts)
+	}
+	type current KnownHosts
+	return json.Unmarshal(data, (*current)(k))
+}
+
+// UnmarshalJSON accepts a single fingerprint string, as written before key
+// types were recorded, and keeps it as an untyped entry.
+func (h *HostKeys) UnmarshalJSON(data []byte) error {
+	var fingerprint string
+	if err := json.Unmarshal(data, &fingerprint); err == nil {
+		*h = HostKeys{untypedHostKey: fingerprint}
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]string)(h))
+}
+
+// trusted returns the fingerprint trusted for a keyType key, falling back to
+// an untyped entry.
+func (h HostKeys) trusted(keyType string) (fingerprint string, ok bool) {
+	if fingerprint, ok = h[keyType]; ok {
+		return fingerprint, true
+	}
+	fingerprint, ok = h[untypedHostKey]
+	return fingerprint, ok
+}
+
+// entry returns the host keys stored for address itself and the map key
+// holding them, which is the address or a hashed form of it.
+func (k KnownHosts) entry(address string) (key string, keys HostKeys, ok bool) {
+	if keys, ok := k.Hosts[address]; ok {
+		return address, keys, true
+	}
+	for key, keys := range k.Hosts {
+		if matchHashedHost(key, address) {
+			return key, keys, true
+		}
+	}
+	return "", nil, false
+}
+
+// lookup returns the host keys trusted for address: those of its own entry
+// plus those of every pattern entry covering it. The address's own entry
+// wins for a key type both define; pattern entries are applied in sorted order.
+func (k KnownHosts) lookup(address string) HostKeys {
+	_, own, _ := k.entry(address)
+	keys := maps.Clone(own)
+	for _, pattern := range slices.Sorted(maps.Keys(k.Hosts)) {
+		if !isHostPattern(pattern) || !matchAddressList(pattern, address) {
+			continue
+		}
+		if keys == nil {
+			keys = HostKeys{}
+		}
+		for keyType, fingerprint := range k.Hosts[pattern] {
+			if _, ok := keys[keyType]; !ok {
+				keys[keyType] = fingerprint
+			}
+		}
+	}
+	return keys
+}
+
+// isHostPattern reports whether a hosts entry is a comma-separated list of
+// patterns ("*.internal.corp,!bastion.internal.corp", "10.0.0.*") rather
+// than a single address.
+func isHostPattern(entry string) bool {
+	return !strings.HasPrefix(entry, hashedHostPrefix) && strings.ContainsAny(entry, "*?!,")
+}
+
+// store records the fingerprint of a keyType key for address, replacing any
+// key of that type and an untyped entry for the same fingerprint. With hash
+// set, a new entry is written with the address in hashed form.
+func (k *KnownHosts) store(address, keyType, fingerprint string, hash bool) {
+	key, keys, ok := k.entry(address)
+	if !ok {
+		key, keys = address, HostKeys{}
+		if hash {
+			key = hashHost(address)
+		}
+	}
+	if keys[untypedHostKey] == fingerprint {
+		delete(keys, untypedHostKey)
+	}
+	keys[keyType] = fingerprint
+	if k.Hosts == nil {
+		k.Hosts = map[string]HostKeys{}
+	}
+	k.Hosts[key] = keys
+}
+
+// hashHost hashes an address with a fresh random salt.
+func hashHost(address string) string {
+	salt := make([]byte, sha1.Size)
+	rand.Read(salt)
+	return hashedHostPrefix + base64.StdEncoding.EncodeToString(salt) + "|" +
+		base64.StdEncoding.EncodeToString(hostHMAC(salt, address))
+}
+
+// matchHashedHost reports whether a hashed entry was produced from address.
+func matchHashedHost(entry, address string) bool {
+	rest, ok := strings.CutPrefix(entry, hashedHostPrefix)
+	if !ok {
+		return false
+	}
+	encodedSalt, encodedHash, ok := strings.Cut(rest, "|")
+	if !ok {
+		return false
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(encodedSalt)
+	hash, err2 := base64.StdEncoding.DecodeString(encodedHash)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return hmac.Equal(hash, hostHMAC(salt, address))
+}
+
+// hostHMAC computes HMAC-SHA1 of the address keyed with the salt.
+func hostHMAC(salt []byte, address string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(address))
+	return mac.Sum(nil)
+}
+
+// authoritiesFor returns the CA keys trusted to sign host certificates for
+// the host part of address. Entries with unparsable keys are skipped with a warning.
+func (k KnownHosts) authoritiesFor(address string) []ssh.PublicKey {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	var keys []ssh.PublicKey
+	for _, ca := range k.CertAuthorities {
+		if !matchHostList(ca.Hosts, host) {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca.Key))
+		if err != nil {
+			log.Printf("Warning: ignoring cert authority for %q: %v", ca.Hosts, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// checkHostCertificate verifies a host certificate against the trusted CAs.
+// handled is false when key is not a host certificate or no CA covers the
+// address, in which case the fingerprint check applies as usual.
+func (k KnownHosts) checkHostCertificate(address string, key ssh.PublicKey) (handled bool, err error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return false, nil
+	}
+	authorities := k.authoritiesFor(address)
+	if len(authorities) == 0 {
+		return false, nil
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			for _, ca := range authorities {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	if err := checker.CheckHostKey(address, nil, cert); err != nil {
+		return true, fmt.Errorf("host certificate rejected: %w", err)
+	}
+	return true, nil
+}
+
+// matchHostList reports whether host matches a comma-separated list of patterns.
+func matchHostList(patterns, host string) bool {
+	return matchPatternList(patterns, func(pattern string) bool {
+		ok, _ := matchHostPattern(pattern, host)
+		return ok
+	})
+}
+
+// matchAddressList reports whether a host:port address matches a
+// comma-separated list of patterns. Patterns without a port match any port.
+func matchAddressList(patterns, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return matchPatternList(patterns, func(pattern string) bool {
+		if patternHost, patternPort, err := net.SplitHostPort(pattern); err == nil {
+			hostOK, _ := matchHostPattern(patternHost, host)
+			portOK, _ := matchHostPattern(patternPort, port)
+			return hostOK && portOK
+		}
+		ok, _ := matchHostPattern(pattern, host)
+		return ok
+	})
+}
+
+// matchPatternList applies match to each pattern of a comma-separated list.
+// As in OpenSSH, a negated pattern ("!host") that matches excludes the host
+// even when other patterns match.
+func matchPatternList(patterns string, match func(pattern string) bool) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			if match(negated) {
+				return false
+			}
+			continue
+		}
+		if match(pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// loadRevocations collects the revoked entries of the file and, if path is
+// set, those of a KRL or key list, for checking presented host keys.
+func (k *KnownHosts) loadRevocations(path string) error {
+	list := &revocationList{keys: map[string]bool{}, sha1: map[string]bool{}, sha256: map[string]bool{}}
+	if path != "" {
+		var err error
+		if list, err = loadRevocationList(path); err != nil {
+			return err
+		}
+	}
+	for _, entry := range k.Revoked {
+		if encoded, ok := strings.CutPrefix(entry, "SHA256:"); ok {
+			sum, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+			if err != nil {
+				return fmt.Errorf("invalid revoked fingerprint %q", entry)
+			}
+			list.sha256[string(sum)] = true
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			return fmt.Errorf("invalid revoked key %q: %w", entry, err)
+		}
+		list.keys[string(key.Marshal())] = true
+	}
+	k.revocations = list
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// krlMagic starts every OpenSSH key revocation list ("SSHKRL\n\0").
+const krlMagic = "SSHKRL\n\x00"
+
+// KRL section types, from OpenSSH's PROTOCOL.krl.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+// revocationList holds revoked keys and certificates, loaded from an OpenSSH
+// KRL (as written by `ssh-keygen -k`) or from a plain list of public keys.
+type revocationList struct {
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []krlCertificates
+}
+
+// krlCertificates revokes certificates issued by one CA (or by any CA when
+// ca is nil) by serial number or key ID.
+type krlCertificates struct {
+	ca      ssh.PublicKey
+	serials []krlSerialRange
+	bitmaps []krlSerialBitmap
+	keyIDs  map[string]bool
+}
+
+type krlSerialRange struct{ min, max uint64 }
+
+type krlSerialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+// loadRevocationList reads a KRL or a file of authorized_keys-format keys.
+func loadRevocationList(path string) (*revocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &revocationList{keys: map[string]bool{}, sha1: map[string]bool{}, sha256: map[string]bool{}}
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		if err := list.parseKRL(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return list, nil
+	}
+	for rest := bytes.TrimSpace(data); len(rest) > 0; {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		list.keys[string(key.Marshal())] = true
+		rest = next
+	}
+	return list, nil
+}
+
+// parseKRL decodes the binary KRL format. Signature sections are ignored.
+func (l *revocationList) parseKRL(data []byte) error {
+	var header struct {
+		Magic         uint64
+		FormatVersion uint32
+		Version       uint64
+		Generated     uint64
+		Flags         uint64
+		Reserved      string
+		Comment       string
+		Sections      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("invalid KRL header: %w", err)
+	}
+	if header.FormatVersion != 1 {
+		return fmt.Errorf("unsupported KRL format version %d", header.FormatVersion)
+	}
+
+	for rest := header.Sections; len(rest) > 0; {
+		var section struct {
+			Type byte
+			Data []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &section); err != nil {
+			return fmt.Errorf("invalid KRL section: %w", err)
+		}
+		rest = section.Rest
+
+		switch section.Type {
+		case krlSectionCertificates:
+			certs, err := parseKRLCertificates(section.Data)
+			if err != nil {
+				return err
+			}
+			l.certs = append(l.certs, certs)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			target := map[byte]map[string]bool{
+				krlSectionExplicitKey:       l.keys,
+				krlSectionFingerprintSHA1:   l.sha1,
+				krlSectionFingerprintSHA256: l.sha256,
+			}[section.Type]
+			values, err := readKRLStrings(section.Data)
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				target[string(v)] = true
+			}
+		case krlSectionSignature:
+		default:
+			return fmt.Errorf("unknown KRL section type %d", section.Type)
+		}
+	}
+	return nil
+}
+
+// parseKRLCertificates decodes a certificate section and its subsections.
+func parseKRLCertificates(data []byte) (krlCertificates, error) {
+	var section struct {
+		CAKey    []byte
+		Reserved string
+		Rest     []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &section); err != nil {
+		return krlCertificates{}, fmt.Errorf("invalid KRL certificate section: %w", err)
+	}
+	certs := krlCertificates{keyIDs: map[string]bool{}}
+	if len(section.CAKey) > 0 {
+		ca, err := ssh.ParsePublicKey(section.CAKey)
+		if err != nil {
+			return certs, fmt.Errorf("invalid CA key in KRL: %w", err)
+		}
+		certs.ca = ca
+	}
+
+	for rest := section.Rest; len(rest) > 0; {
+		var sub struct {
+			Type byte
+			Data []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &sub); err != nil {
+			return certs, fmt.Errorf("invalid KRL certificate subsection: %w", err)
+		}
+		rest = sub.Rest
+
+		switch sub.Type {
+		case krlCertSerialList:
+			if len(sub.Data)%8 != 0 {
+				return certs, errors.New("invalid KRL serial list")
+			}
+			for i := 0; i < len(sub.Data); i += 8 {
+				serial := binary.BigEndian.Uint64(sub.Data[i:])
+				certs.serials = append(certs.serials, krlSerialRange{serial, serial})
+			}
+		case krlCertSerialRange:
+			var r struct{ Min, Max uint64 }
+			if err := ssh.Unmarshal(sub.Data, &r); err != nil {
+				return certs, fmt.Errorf("invalid KRL serial range: %w", err)
+			}
+			certs.serials = append(certs.serials, krlSerialRange{r.Min, r.Max})
+		case krlCertSerialBitmap:
+			var b struct {
+				Offset uint64
+				Bitmap *big.Int
+			}
+			if err := ssh.Unmarshal(sub.Data, &b); err != nil {
+				return certs, fmt.Errorf("invalid KRL serial bitmap: %w", err)
+			}
+			certs.bitmaps = append(certs.bitmaps, krlSerialBitmap{b.Offset, b.Bitmap})
+		case krlCertKeyID:
+			ids, err := readKRLStrings(sub.Data)
+			if err != nil {
+				return certs, err
+			}
+			for _, id := range ids {
+				certs.keyIDs[string(id)] = true
+			}
+		default:
+			return certs, fmt.Errorf("unknown KRL certificate subsection type %d", sub.Type)
+		}
+	}
+	return certs, nil
+}
+
+// readKRLStrings splits a run of SSH wire-format strings.
+func readKRLStrings(data []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(data) > 0 {
+		var s struct {
+			Value []byte
+			Rest  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid KRL entry: %w", err)
+		}
+		values = append(values, s.Value)
+		data = s.Rest
+	}
+	return values, nil
+}
+
+// isRevoked reports whether key, or for a certificate its key, its CA or the
+// certificate itself, has been revoked.
+func (l *revocationList) isRevoked(key ssh.PublicKey) bool {
+	if l == nil {
+		return false
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if l.isRevoked(cert.Key) || l.isRevoked(cert.SignatureKey) {
+			return true
+		}
+		for _, section := range l.certs {
+			if section.revokes(cert) {
+				return true
+			}
+		}
+		return false
+	}
+
+	blob := key.Marshal()
+	sum1 := sha1.Sum(blob)
+	sum256 := sha256.Sum256(blob)
+	return l.keys[string(blob)] || l.sha1[string(sum1[:])] || l.sha256[string(sum256[:])]
+}
+
+// revokes reports whether this section revokes cert.
+func (c krlCertificates) revokes(cert *ssh.Certificate) bool {
+	if c.ca != nil && !bytes.Equal(c.ca.Marshal(), cert.SignatureKey.Marshal()) {
+		return false
+	}
+	if c.keyIDs[cert.KeyId] {
+		return true
+	}
+	for _, r := range c.serials {
+		if cert.Serial >= r.min && cert.Serial <= r.max {
+			return true
+		}
+	}
+	for _, b := range c.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) && b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
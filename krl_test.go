@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys revoked by testdata/keys.krl and testdata/certs.krl, which were
+// written by ssh-keygen -k: key1, given as a key, and key3 by their SHA-256
+// fingerprints, and key2 by its SHA-1 one; certs.krl revokes certificates of ca with serial
+// 5, 100-200, 1000, 1002, 1005, 1009, 1011, 1013, 1016, 1018, 1020, 1023 or
+// 1030, or with the key ID revoked-id.
+const (
+	testKRLCA   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILBPyJo78CPEZmyKXb+ZgGaskGIAjGsP54YW1pKAK1cU ca"
+	testKRLKey1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFtZvC6knwZuoizVN9mn6dge88BZqI7Yju+UQU5/U9n0 key1"
+	testKRLKey2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKUZtlPGtf7Du4s0mhx5KZ/SookKv9uwi9SEzlJOY/8Z key2"
+	testKRLKey3 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHcry/x4fURStDQfELa6+cOAGHE61/Fpbr+lwT9PdBXi key3"
+	testKRLKey4 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEcDdWpnAEF81kVmzcdFv7wZvt8XkZNlnoHMKmg0X/8d key4"
+)
+
+func parseTestKey(t *testing.T, line string) ssh.PublicKey {
+	t.Helper()
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testCert returns a certificate for key issued by ca. It is not signed,
+// which revocation does not look at.
+func testCert(key, ca ssh.PublicKey, serial uint64, keyID string) *ssh.Certificate {
+	return &ssh.Certificate{Key: key, SignatureKey: ca, Serial: serial, KeyId: keyID, CertType: ssh.UserCert}
+}
+
+func TestRevocationListFromSSHKeygen(t *testing.T) {
+	keys, err := loadRevocationList(filepath.Join("testdata", "keys.krl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := loadRevocationList(filepath.Join("testdata", "certs.krl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := parseTestKey(t, testKRLCA)
+	other := newTestKey(t)
+	key1, key4 := parseTestKey(t, testKRLKey1), parseTestKey(t, testKRLKey4)
+
+	tests := []struct {
+		name string
+		list *revocationList
+		key  ssh.PublicKey
+		want bool
+	}{
+		{"key given as such", keys, key1, true},
+		{"sha1", keys, parseTestKey(t, testKRLKey2), true},
+		{"sha256", keys, parseTestKey(t, testKRLKey3), true},
+		{"other key", keys, key4, false},
+		{"certificate of revoked key", keys, testCert(key1, ca, 1, ""), true},
+		{"certificate by revoked CA", keys, testCert(key4, key1, 1, ""), true},
+		{"certificate of other key", keys, testCert(key4, ca, 1, ""), false},
+
+		{"serial", certs, testCert(key4, ca, 5, ""), true},
+		{"serial next to it", certs, testCert(key4, ca, 6, ""), false},
+		{"range start", certs, testCert(key4, ca, 100, ""), true},
+		{"range middle", certs, testCert(key4, ca, 150, ""), true},
+		{"range end", certs, testCert(key4, ca, 200, ""), true},
+		{"past range", certs, testCert(key4, ca, 201, ""), false},
+		{"scattered serial", certs, testCert(key4, ca, 1016, ""), true},
+		{"between scattered serials", certs, testCert(key4, ca, 1017, ""), false},
+		{"last scattered serial", certs, testCert(key4, ca, 1030, ""), true},
+		{"key ID", certs, testCert(key4, ca, 7, "revoked-id"), true},
+		{"other key ID", certs, testCert(key4, ca, 7, "revoked"), false},
+		{"serial of other CA", certs, testCert(key4, other, 5, ""), false},
+		{"key ID of other CA", certs, testCert(key4, other, 7, "revoked-id"), false},
+		{"plain key", certs, key4, false},
+		{"no list", nil, key1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.list.isRevoked(tt.key); got != tt.want {
+				t.Errorf("isRevoked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// krlString encodes s as an SSH wire-format string.
+func krlString(s []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// krlSection encodes a section or subsection of type typ.
+func krlSection(typ byte, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	return append([]byte{typ}, krlString(body)...)
+}
+
+// krlFile encodes a KRL of the given format version holding sections.
+func krlFile(version uint32, sections ...[]byte) []byte {
+	data := []byte(krlMagic)
+	data = binary.BigEndian.AppendUint32(data, version)
+	data = binary.BigEndian.AppendUint64(data, 1) // KRL version
+	data = binary.BigEndian.AppendUint64(data, 0) // generated
+	data = binary.BigEndian.AppendUint64(data, 0) // flags
+	data = append(data, krlString(nil)...)        // reserved
+	data = append(data, krlString(nil)...)        // comment
+	for _, s := range sections {
+		data = append(data, s...)
+	}
+	return data
+}
+
+func TestParseKRLSections(t *testing.T) {
+	ca := newTestKey(t)
+	revoked, kept := newTestKey(t), newTestKey(t)
+	sum := sha1.Sum(revoked.Marshal())
+	bitmap := ssh.Marshal(struct {
+		Offset uint64
+		Bitmap *big.Int
+	}{1000, big.NewInt(0b1001)}) // 1000 and 1003
+
+	tests := []struct {
+		name    string
+		data    []byte
+		revoked []ssh.PublicKey
+		kept    []ssh.PublicKey
+		err     string
+	}{
+		{
+			name:    "explicit key",
+			data:    krlFile(1, krlSection(krlSectionExplicitKey, krlString(revoked.Marshal()))),
+			revoked: []ssh.PublicKey{revoked},
+			kept:    []ssh.PublicKey{kept},
+		},
+		{
+			name:    "sha1",
+			data:    krlFile(1, krlSection(krlSectionFingerprintSHA1, krlString(sum[:]))),
+			revoked: []ssh.PublicKey{revoked},
+			kept:    []ssh.PublicKey{kept},
+		},
+		{
+			name: "serial list",
+			data: krlFile(1, krlSection(krlSectionCertificates, krlString(ca.Marshal()), krlString(nil),
+				krlSection(krlCertSerialList, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 3), 9)))),
+			revoked: []ssh.PublicKey{testCert(kept, ca, 3, ""), testCert(kept, ca, 9, "")},
+			kept:    []ssh.PublicKey{testCert(kept, ca, 4, ""), testCert(kept, revoked, 3, "")},
+		},
+		{
+			name: "serial bitmap",
+			data: krlFile(1, krlSection(krlSectionCertificates, krlString(ca.Marshal()), krlString(nil),
+				krlSection(krlCertSerialBitmap, bitmap))),
+			revoked: []ssh.PublicKey{testCert(kept, ca, 1000, ""), testCert(kept, ca, 1003, "")},
+			kept:    []ssh.PublicKey{testCert(kept, ca, 999, ""), testCert(kept, ca, 1001, ""), testCert(kept, ca, 1004, "")},
+		},
+		{
+			name: "any CA",
+			data: krlFile(1, krlSection(krlSectionCertificates, krlString(nil), krlString(nil),
+				krlSection(krlCertKeyID, krlString([]byte("gone"))))),
+			revoked: []ssh.PublicKey{testCert(kept, ca, 1, "gone"), testCert(kept, revoked, 1, "gone")},
+			kept:    []ssh.PublicKey{testCert(kept, ca, 1, "here")},
+		},
+		{
+			name:    "signature ignored",
+			data:    krlFile(1, krlSection(krlSectionSignature, krlString([]byte("sig")))),
+			revoked: nil,
+			kept:    []ssh.PublicKey{kept},
+		},
+		{name: "format version", data: krlFile(2), err: "unsupported KRL format version 2"},
+		{name: "unknown section", data: krlFile(1, krlSection(9)), err: "unknown KRL section type 9"},
+		{
+			name: "unknown subsection",
+			data: krlFile(1, krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(0x30))),
+			err:  "unknown KRL certificate subsection type 48",
+		},
+		{
+			name: "odd serial list",
+			data: krlFile(1, krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialList, []byte{1, 2, 3}))),
+			err:  "invalid KRL serial list",
+		},
+		{name: "truncated section", data: krlFile(1, []byte{krlSectionExplicitKey, 0, 0}), err: "invalid KRL section"},
+		{name: "truncated entry", data: krlFile(1, krlSection(krlSectionExplicitKey, []byte{0, 0, 0, 9, 1})), err: "invalid KRL entry"},
+		{name: "truncated header", data: []byte(krlMagic + "\x00\x00"), err: "invalid KRL header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "krl")
+			if err := os.WriteFile(name, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			list, err := loadRevocationList(name)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range tt.revoked {
+				if !list.isRevoked(key) {
+					t.Errorf("revoked[%d] is not revoked", i)
+				}
+			}
+			for i, key := range tt.kept {
+				if list.isRevoked(key) {
+					t.Errorf("kept[%d] is revoked", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRevocationListOfKeys(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(name, []byte(testKRLKey1+"\n\n"+testKRLKey2+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := loadRevocationList(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{{testKRLKey1, true}, {testKRLKey2, true}, {testKRLKey3, false}} {
+		if got := list.isRevoked(parseTestKey(t, tt.key)); got != tt.want {
+			t.Errorf("isRevoked(%s) = %v, want %v", tt.key[len(tt.key)-4:], got, tt.want)
+		}
+	}
+}
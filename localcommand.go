@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runLocalCommand implements -local-command: once conn is up, with its
+// forwards listening, it runs the command locally and waits for it, as
+// OpenSSH's LocalCommand does. The command learns about the connection from
+// the environment:
+//
+//	MEMSSH_HOST             the server's host name, as given
+//	MEMSSH_PORT             its port
+//	MEMSSH_USER             the remote user
+//	MEMSSH_ADDRESS          the address connected to
+//	MEMSSH_REMOTE_FORWARDS  the addresses the server listens on for -R,
+//	                        space separated, with chosen ports filled in
+//
+// A failing command is reported but leaves the connection in use.
+func (o *connOptions) runLocalCommand(conn *connection) {
+	if o.localCommand == "" {
+		return
+	}
+	cmd := shellCommand(o.localCommand)
+	cmd.Env = append(os.Environ(),
+		"MEMSSH_HOST="+o.host,
+		"MEMSSH_PORT="+strconv.Itoa(o.port),
+		"MEMSSH_USER="+o.user,
+		"MEMSSH_ADDRESS="+conn.address,
+		"MEMSSH_REMOTE_FORWARDS="+strings.Join(conn.remoteForwards, " "),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Warning: -local-command failed: %v", err)
+	}
+}
@@ -1,281 +1,857 @@
-package main
-
-import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
-	"errors"
-	"flag"
-	"fmt"
-	"io/fs"
-	"log"
-	"net"
-	"os"
-	"path/filepath"
-	"strings"
-	"syscall"
-
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
-)
-
-// KnownHosts maps SSH server addresses to their trusted public key fingerprints.
-type KnownHosts map[string]string
-
-func main() {
-	// Define and parse command-line flags
-	host := flag.String("host", "", "SSH server hostname or IP")
-	port := flag.Int("port", 22, "SSH server port")
-	user := flag.String("user", "", "SSH username")
-	key := flag.String("key", "", "SSH private key (PEM format) (optional)")
-	cmd := flag.String("cmd", "", "Command to run on remote server (optional)")
-	noStore := flag.Bool("no-store", false, "Do not store new or changed host fingerprints")
-	flag.Parse()
-
-	if *host == "" || *user == "" {
-		flag.Usage()
-		log.Fatal("host and user are required")
-	}
-
-	privateKey := getPrivateKey(*key)
-	defer zeroBytes(privateKey)
-
-	signer, err := parsePrivateKey(privateKey)
-	if err != nil {
-		log.Fatalf("Private key error: %v", err)
-	}
-
-	address := fmt.Sprintf("%s:%d", *host, *port)
-	knownHostsPath := getKnownHostsPath()
-	knownHosts := loadKnownHosts(knownHostsPath)
-
-	config := &ssh.ClientConfig{
-		User:            *user,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: hostKeyCallback(address, knownHosts, knownHostsPath, *noStore),
-	}
-
-	client, err := ssh.Dial("tcp", address, config)
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
-	}
-	defer client.Close()
-
-	if *cmd == "" {
-		startInteractiveShell(client)
-	} else {
-		runCommand(client, *cmd)
-	}
-}
-
-// getPrivateKey loads a private key from a file path or inline input.
-// If the `pathOrInline` is empty, it prompts the user for multiline pasted key input.
-func getPrivateKey(pathOrInline string) []byte {
-	if pathOrInline == "" {
-		fmt.Print("Paste your private key (end with an empty line):\n")
-		data, err := readMultiLineInput()
-		if err != nil {
-			log.Fatalf("Failed to read private key: %v", err)
-		}
-		return data
-	}
-	if data, err := os.ReadFile(pathOrInline); err == nil {
-		return data
-	}
-	// Fallback: treat input as inline PEM key
-	return []byte(pathOrInline)
-}
-
-// parsePrivateKey attempts to parse an SSH signer from a PEM private key.
-// If the key is encrypted, it prompts the user for the passphrase.
-func parsePrivateKey(key []byte) (ssh.Signer, error) {
-	signer, err := ssh.ParsePrivateKey(key)
-	if err == nil {
-		return signer, nil
-	}
-	if !strings.Contains(err.Error(), "encrypted") {
-		return nil, err
-	}
-
-	fmt.Print("Enter passphrase for encrypted private key: ")
-	pass, err := term.ReadPassword(int(syscall.Stdin))
-	fmt.Println()
-	if err != nil {
-		return nil, fmt.Errorf("reading passphrase failed: %w", err)
-	}
-	defer zeroBytes(pass)
-
-	return ssh.ParsePrivateKeyWithPassphrase(key, pass)
-}
-
-// hostKeyCallback returns an ssh.HostKeyCallback that checks a known_hosts map
-// for matching fingerprints and optionally prompts to trust and save new or changed ones.
-func hostKeyCallback(address string, known KnownHosts, path string, noStore bool) ssh.HostKeyCallback {
-	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		hash := sha256.Sum256(key.Marshal())
-		fp := base64.StdEncoding.EncodeToString(hash[:])
-
-		if stored, exists := known[address]; exists {
-			if stored == fp {
-				return nil
-			}
-			fmt.Printf("\nWARNING: fingerprint for %s has changed!\nOld: %s\nNew: %s\n", address, stored, fp)
-			fmt.Print("Do you want to overwrite and trust the new fingerprint? (y/n): ")
-			if !askYesNo() {
-				return fmt.Errorf("fingerprint mismatch rejected by user")
-			}
-		} else {
-			fmt.Printf("\nNew host: %s\nFingerprint: %s\nTrust this host? (y/n): ", address, fp)
-			if !askYesNo() {
-				return fmt.Errorf("user declined to trust unknown host")
-			}
-		}
-
-		if !noStore {
-			known[address] = fp
-			saveKnownHosts(path, known)
-			fmt.Println("Host fingerprint saved.")
-		} else {
-			fmt.Println("Fingerprint not saved due to -no-store flag.")
-		}
-		return nil
-	}
-}
-
-// runCommand runs a remote command on the SSH server and prints its output.
-func runCommand(client *ssh.Client, cmd string) {
-	session, err := client.NewSession()
-	if err != nil {
-		log.Fatalf("Failed to create session: %v", err)
-	}
-	defer session.Close()
-
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
-
-	fmt.Printf("Running command: %s\n", cmd)
-	if err := session.Run(cmd); err != nil {
-		log.Fatalf("Command failed: %v", err)
-	}
-}
-
-// startInteractiveShell starts a full interactive terminal session on the remote SSH server.
-func startInteractiveShell(client *ssh.Client) {
-	session, err := client.NewSession()
-	if err != nil {
-		log.Fatalf("Failed to create session: %v", err)
-	}
-	defer session.Close()
-
-	fd := int(syscall.Stdin)
-	oldState, err := term.MakeRaw(fd)
-	if err != nil {
-		log.Fatalf("Failed to set terminal raw mode: %v", err)
-	}
-	defer term.Restore(fd, oldState)
-
-	session.Stdin = os.Stdin
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
-
-	width, height, _ := term.GetSize(fd)
-	if width == 0 || height == 0 {
-		width, height = 80, 24
-	}
-
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
-	}
-
-	if err := session.RequestPty("xterm", height, width, modes); err != nil {
-		log.Fatalf("PTY request failed: %v", err)
-	}
-
-	go handleSignals(session)
-
-	if err := session.Shell(); err != nil {
-		log.Fatalf("Failed to start shell: %v", err)
-	}
-	if err := session.Wait(); err != nil {
-		log.Fatalf("Shell exited with error: %v", err)
-	}
-}
-
-// getKnownHostsPath returns the path to the local known_hosts.json file in ~/.ssh.
-func getKnownHostsPath() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Unable to determine user home directory: %v", err)
-	}
-	sshDir := filepath.Join(homeDir, ".ssh")
-	if err := os.MkdirAll(sshDir, 0700); err != nil {
-		log.Fatalf("Failed to create .ssh directory: %v", err)
-	}
-	return filepath.Join(sshDir, "known_hosts.json")
-}
-
-// loadKnownHosts loads the known_hosts.json file into memory, or returns an empty map if not found.
-func loadKnownHosts(path string) KnownHosts {
-	file, err := os.Open(path)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return KnownHosts{}
-		}
-		log.Fatalf("Failed to open known_hosts: %v", err)
-	}
-	defer file.Close()
-
-	var hosts KnownHosts
-	if err := json.NewDecoder(file).Decode(&hosts); err != nil {
-		log.Printf("Warning: could not parse known_hosts.json: %v", err)
-		return KnownHosts{}
-	}
-	return hosts
-}
-
-// saveKnownHosts writes the updated known hosts map to known_hosts.json.
-func saveKnownHosts(path string, hosts KnownHosts) {
-	file, err := os.Create(path)
-	if err != nil {
-		log.Fatalf("Failed to write known_hosts: %v", err)
-	}
-	defer file.Close()
-
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(hosts); err != nil {
-		log.Fatalf("Failed to encode known_hosts: %v", err)
-	}
-}
-
-// askYesNo prompts the user for a yes/no answer and returns true if the answer begins with "y" or "Y".
-func askYesNo() bool {
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(input)), "y")
-}
-
-// readMultiLineInput reads lines from stdin until an empty line is encountered.
-// Used for pasting multi-line private keys.
-func readMultiLineInput() ([]byte, error) {
-	var lines []string
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			break
-		}
-		lines = append(lines, line)
-	}
-	return []byte(strings.Join(lines, "\n")), scanner.Err()
-}
-
-// zeroBytes overwrites a byte slice with zeroes to securely erase sensitive data like private keys or passphrases.
-func zeroBytes(b []byte) {
-	for i := range b {
-		b[i] = 0
-	}
-}
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// KnownHosts is the trust database kept in known_hosts.json: the public key
+// fingerprints trusted for each server address, plus certificate authorities
+// trusted to vouch for host keys.
+type KnownHosts struct {
+	Hosts           map[string]HostKeys `json:"hosts"`
+	CertAuthorities []CertAuthority     `json:"cert_authorities,omitempty"`
+	// Revoked lists host keys that must never be accepted, as SHA256
+	// fingerprints or authorized_keys-format public keys.
+	Revoked []string `json:"revoked,omitempty"`
+	// HMAC authenticates the rest of the file with a secret kept in the OS
+	// keyring once `memssh hosts sign` has been run.
+	HMAC string `json:"hmac,omitempty"`
+
+	revocations *revocationList
+	signed      bool // HMAC verified on load; updates are signed too
+}
+
+// HostKeys maps a host key type (ssh-ed25519, ecdsa-sha2-nistp256, ...) to the
+// fingerprint trusted for it, so a server can be known by one key per algorithm.
+type HostKeys map[string]string
+
+// CertAuthority trusts a CA to sign host certificates for the hosts matching
+// a comma-separated list of patterns, like an @cert-authority line in OpenSSH.
+type CertAuthority struct {
+	Hosts string `json:"hosts"`
+	Key   string `json:"key"`
+}
+
+// stringList is a flag value that can be repeated or given as a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedString is a flag value that can be repeated. Unlike stringList,
+// each value is kept whole, commas included.
+type repeatedString []string
+
+func (l *repeatedString) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedString) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// subcommands maps the first command-line argument to a handler that receives the remaining arguments.
+var subcommands = map[string]func(args []string){
+	"add":         runAdd,
+	"copy-id":     runCopyID,
+	"daemon":      runDaemon,
+	"edit":        runEdit,
+	"exec":        runExec,
+	"get":         runGet,
+	"hosts":       runHosts,
+	"keygen":      runKeygen,
+	"probe":       runProbe,
+	"put":         runPut,
+	"scan":        runScan,
+	"sync":        runSync,
+	"tail":        runTail,
+	"tar-receive": runTarReceive,
+	"tar-send":    runTarSend,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Usage = usage
+
+	// Define and parse command-line flags
+	var opts connOptions
+	opts.register(flag.CommandLine)
+	var cmds, scriptArgs repeatedString
+	flag.Var(&cmds, "cmd", "Command to run on remote server; repeat to run several in turn over the same connection (optional)")
+	scriptPath := flag.String("script", "", "Local script to copy to the server and run there, \"-\" for stdin (optional)")
+	flag.Var(&scriptArgs, "script-arg", "Argument passed to the -script, repeatable")
+	interpreter := flag.String("interpreter", "", "Remote command running the -script, e.g. bash or python3 (default from its #! line, or sh)")
+	subsystem := flag.String("subsystem", "", "Request this subsystem, e.g. netconf or sftp, with stdin and stdout connected to it (optional)")
+	interactPath := flag.String("interact", "", "YAML script of patterns to expect and responses to send, run against the shell or -cmd on a PTY (optional)")
+	noCommand := flag.Bool("N", false, "Run no shell or command; keep the connection open for its forwards until interrupted")
+	background := flag.Bool("f", false, "Go to the background once connected and authenticated (requires -N)")
+	watch := flag.Duration("watch", 0, "Run -cmd again at this interval, e.g. 5s, showing its latest output on a cleared screen like watch(1)")
+	cmdTimeout := flag.Duration("cmd-timeout", 0, "End each -cmd or -script still running after this long, e.g. 10m, and exit with 124")
+	keepGoing := flag.Bool("keep-going", false, "With several -cmd, run the remaining commands after one fails")
+	autoReconnect := flag.Bool("auto-reconnect", false, "Reconnect without asking when an interactive session's connection drops")
+	stdioForward := flag.String("W", "", "Connect stdin and stdout to host:port as reached from the server, e.g. for an OpenSSH ProxyCommand (optional)")
+
+	// A leading name that is not a subcommand selects a profile from
+	// memssh.json, or is a [user@]host[:port] destination. Arguments after
+	// the flags make up the remote command.
+	args := os.Args[1:]
+	var profile string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		profile, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if profile != "" {
+		if opts.host != "" || opts.hasProfile(profile) {
+			opts.applyProfile(flag.CommandLine, profile)
+		} else if err := opts.setDestination(profile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flag.NArg() > 0 {
+		if len(cmds) > 0 {
+			log.Fatal("Give the remote command after the destination or with -cmd, not both")
+		}
+		cmds = append(cmds, shellJoin(flag.Args()))
+	}
+
+	if opts.host == "" {
+		flag.Usage()
+		log.Fatal("host and user are required")
+	}
+
+	var script []byte
+	if *scriptPath != "" {
+		if len(cmds) > 0 || *stdioForward != "" {
+			log.Fatal("-script cannot be combined with -cmd or -W")
+		}
+		var err error
+		if script, err = readScript(*scriptPath); err != nil {
+			log.Fatalf("Failed to read script: %v", err)
+		}
+	} else if len(scriptArgs) > 0 || *interpreter != "" {
+		log.Fatal("-script-arg and -interpreter require -script")
+	}
+
+	if *noCommand && (len(cmds) > 0 || *scriptPath != "" || *stdioForward != "") {
+		log.Fatal("-N cannot be combined with -cmd, -script or -W")
+	}
+	if *subsystem != "" && (len(cmds) > 0 || *scriptPath != "" || *stdioForward != "" || *noCommand) {
+		log.Fatal("-subsystem cannot be combined with -cmd, -script, -W or -N")
+	}
+	if *cmdTimeout < 0 || (*cmdTimeout > 0 && ((len(cmds) == 0 && *scriptPath == "") || *interactPath != "" || *watch > 0)) {
+		log.Fatal("-cmd-timeout requires a positive duration and -cmd or -script, and cannot be combined with -interact or -watch")
+	}
+	if *watch < 0 || (*watch > 0 && (len(cmds) != 1 || *interactPath != "")) {
+		log.Fatal("-watch requires a positive interval and exactly one -cmd, and cannot be combined with -interact")
+	}
+	var interact *interaction
+	if *interactPath != "" {
+		if len(cmds) > 1 || *scriptPath != "" || *stdioForward != "" || *noCommand || *subsystem != "" {
+			log.Fatal("-interact cannot be combined with -script, -W, -N, -subsystem or more than one -cmd")
+		}
+		var err error
+		if interact, err = readInteraction(*interactPath); err != nil {
+			log.Fatalf("Failed to read -interact script %s: %v", *interactPath, err)
+		}
+	}
+	if *background {
+		if !*noCommand {
+			log.Fatal("-f requires -N")
+		}
+		if os.Getenv(backgroundEnv) == "" {
+			startBackground()
+		}
+	}
+
+	stdout := os.Stdout
+	if *stdioForward != "" {
+		if len(cmds) > 0 {
+			log.Fatal("-W and -cmd cannot be combined")
+		}
+		if _, _, err := net.SplitHostPort(*stdioForward); err != nil {
+			log.Fatalf("Invalid -W %q: want host:port", *stdioForward)
+		}
+	}
+	if *stdioForward != "" || *subsystem != "" {
+		// stdout carries the forwarded stream; messages go to stderr.
+		os.Stdout = os.Stderr
+	}
+
+	conn := opts.connect()
+	conn.session.timeout = *cmdTimeout
+	opts.runLocalCommand(conn)
+	enterBackground()
+
+	var status int
+	switch {
+	case *stdioForward != "":
+		if err := forwardStdio(conn.client, *stdioForward, os.Stdin, stdout); err != nil {
+			log.Printf("-W %s: %v", *stdioForward, err)
+			status = exitConnectionFailed
+		}
+	case *subsystem != "":
+		status = runSubsystem(conn.client, *subsystem, stdout, conn.session)
+	case *noCommand:
+		status = holdConnection(conn, *autoReconnect)
+	case interact != nil:
+		var cmd string
+		if len(cmds) > 0 {
+			cmd = cmds[0]
+		}
+		status = runInteraction(conn.client, cmd, interact, conn.session)
+	case *scriptPath != "":
+		status = runScript(conn.client, *scriptPath, script, *interpreter, scriptArgs, conn.session)
+	case *watch > 0:
+		status = watchCommand(conn.client, conn.address, cmds[0], *watch, conn.session)
+	case len(cmds) == 0:
+		status = interactiveShell(conn, *autoReconnect)
+	default:
+		status = runCommands(conn.client, cmds, conn.session, *keepGoing)
+	}
+	conn.Close()
+	os.Exit(status)
+}
+
+// usage prints the top-level help, including the available subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n  memssh -host HOST -user USER [flags] [--] [command [arg...]]\n  memssh <profile|user@host[:port]> [flags] [--] [command [arg...]]\n  memssh <command> [flags]\n\nCommands:\n")
+	names := slices.Sorted(maps.Keys(subcommands))
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", name)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// getPrivateKey loads a private key from a file path or inline input.
+// If the `pathOrInline` is empty, it prompts the user for multiline pasted key input;
+// "-" reads the whole of stdin, blank lines included, for keys piped from other tools.
+func getPrivateKey(pathOrInline string) []byte {
+	if pathOrInline == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read private key from stdin: %v", err)
+		}
+		reopenTerminal()
+		return data
+	}
+	if pathOrInline == "" {
+		fmt.Print("Paste your private key (end with an empty line):\n")
+		data, err := readMultiLineInput()
+		if err != nil {
+			log.Fatalf("Failed to read private key: %v", err)
+		}
+		return data
+	}
+	if data, err := os.ReadFile(pathOrInline); err == nil {
+		return data
+	}
+	// Fallback: treat input as inline PEM key
+	return []byte(pathOrInline)
+}
+
+// parseRawPrivateKey parses a PEM, OpenSSH or PuTTY private key into the
+// corresponding crypto private key. If the key is encrypted, it asks the
+// passphrase source for the passphrase.
+func parseRawPrivateKey(key []byte, passphrase passphraseSource) (any, error) {
+	if isPPK(key) {
+		return parsePPK(key, passphrase)
+	}
+	raw, err := ssh.ParseRawPrivateKey(key)
+	if err == nil {
+		return raw, nil
+	}
+	if keyType := securityKeyType(key); keyType != "" {
+		return nil, fmt.Errorf("%s keys live on a hardware security key; load it with ssh-add and connect with -agent", keyType)
+	}
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, err
+	}
+
+	err = passphrase.unlock(missing.PublicKey, func(pass []byte) error {
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(key, pass)
+		return err
+	})
+	return raw, err
+}
+
+// hostFingerprint returns the fingerprint stored in known_hosts.json for key.
+func hostFingerprint(key ssh.PublicKey) string {
+	hash := sha256.Sum256(key.Marshal())
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// fingerprintHashes lists the accepted -fingerprint-hash values.
+var fingerprintHashes = []string{"sha256", "md5"}
+
+// displayFingerprint formats the fingerprint of key the way `ssh-keygen -l -E hash` prints it.
+func displayFingerprint(key ssh.PublicKey, hash string) string {
+	if hash == "md5" {
+		return "MD5:" + ssh.FingerprintLegacyMD5(key)
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// fingerprintMatches reports whether fp, in the SHA256:... or MD5:... form
+// OpenSSH prints, is the fingerprint of key. Base64 padding is optional.
+func fingerprintMatches(key ssh.PublicKey, fp string) bool {
+	if md5, ok := strings.CutPrefix(fp, "MD5:"); ok {
+		return strings.EqualFold(md5, ssh.FingerprintLegacyMD5(key))
+	}
+	return strings.TrimRight(fp, "=") == ssh.FingerprintSHA256(key)
+}
+
+// displayStoredFingerprint converts a fingerprint from known_hosts.json to the
+// unpadded SHA256: form OpenSSH prints.
+func displayStoredFingerprint(fp string) string {
+	return "SHA256:" + strings.TrimRight(fp, "=")
+}
+
+// strictHostKeyModes lists the accepted -strict-host-key-checking values, which
+// follow OpenSSH's StrictHostKeyChecking.
+var strictHostKeyModes = []string{"yes", "accept-new", "no", "ask"}
+
+// hostKeyPolicy controls how hostKeyCallback treats unknown and changed host keys.
+type hostKeyPolicy struct {
+	path    string             // known_hosts.json location
+	noStore bool               // never write new fingerprints
+	hash    bool               // store host addresses hashed
+	strict  string             // one of strictHostKeyModes
+	fpHash  string             // one of fingerprintHashes, for display
+	expect  []string           // fingerprints a new key must have, checked instead of prompting
+	system  systemHostKeyCheck // OpenSSH known_hosts fallback, or nil
+}
+
+// hostKeyCallback returns an ssh.HostKeyCallback that checks a known_hosts map
+// for matching fingerprints. Depending on the strict mode, unknown hosts are
+// refused, trusted silently or after a prompt; a changed key is refused unless
+// the mode is "no", in which case it is reported and accepted for this session only.
+// Expected fingerprints replace the strict mode for unknown hosts, and a prompt
+// is never attempted without a terminal to answer it.
+// Host certificates signed by a trusted certificate authority are accepted without prompting.
+func hostKeyCallback(address string, known KnownHosts, policy hostKeyPolicy) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known.revocations.isRevoked(key) {
+			return fmt.Errorf("host key %s for %s is REVOKED", displayFingerprint(key, policy.fpHash), address)
+		}
+		if handled, err := known.checkHostCertificate(address, key); handled {
+			return err
+		}
+
+		fp := hostFingerprint(key)
+		shown := displayFingerprint(key, policy.fpHash)
+
+		keyType := key.Type()
+		stored := known.lookup(address)
+		if trusted, ok := stored.trusted(keyType); ok {
+			if trusted == fp {
+				if _, own, _ := known.entry(address); own[untypedHostKey] == fp && !policy.noStore {
+					err := updateKnownHosts(policy.path, func(k *KnownHosts) error {
+						k.store(address, keyType, fp, policy.hash)
+						return nil
+					})
+					if err != nil {
+						log.Printf("Warning: could not record the key type for %s: %v", address, err)
+					}
+				}
+				return nil
+			}
+			// Only the SHA-256 hash is stored, so both sides are shown in that form.
+			fmt.Printf("\nWARNING: fingerprint for %s has changed!\nOld: %s\nNew: %s\n", address, displayStoredFingerprint(trusted), ssh.FingerprintSHA256(key))
+			if policy.strict != "no" {
+				return fmt.Errorf("host key for %s has changed; if the change is expected, run `memssh hosts remove %s` and connect again", address, address)
+			}
+			fmt.Println("Continuing because -strict-host-key-checking=no; the stored fingerprint is kept.")
+			return nil
+		}
+
+		if policy.system != nil {
+			trusted, err := policy.system(hostname, remote, key)
+			if trusted {
+				return nil
+			}
+			if err != nil {
+				fmt.Printf("\nWARNING: OpenSSH known_hosts disagrees for %s: %v\n", address, err)
+				if policy.strict != "no" || errors.Is(err, errSystemHostKeyRevoked) {
+					return fmt.Errorf("host key for %s rejected by OpenSSH known_hosts: %w", address, err)
+				}
+				fmt.Println("Continuing because -strict-host-key-checking=no; the key is not saved.")
+				return nil
+			}
+		}
+
+		// A known host presenting a key of a type not seen before is treated
+		// as a new key rather than a changed one.
+		what := "host " + address
+		if len(stored) > 0 {
+			what = fmt.Sprintf("%s key for known host %s", keyType, address)
+		}
+		switch {
+		case len(policy.expect) > 0:
+			if !slices.ContainsFunc(policy.expect, func(fp string) bool { return fingerprintMatches(key, fp) }) {
+				return fmt.Errorf("%s presented %s, which is not an -expect-fingerprint value", what, shown)
+			}
+			fmt.Printf("Trusting new %s (%s), as expected.\n", what, shown)
+		case policy.strict == "yes":
+			return fmt.Errorf("no fingerprint known for %s (%s) and -strict-host-key-checking=yes", what, shown)
+		case policy.strict == "ask":
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return fmt.Errorf("no fingerprint known for %s (%s) and stdin is not a terminal to confirm it; verify the key and pass -expect-fingerprint, or use -accept-new", what, shown)
+			}
+			fmt.Printf("\nNew %s\nFingerprint: %s\n%sTrust this key? (y/n): ", what, shown, randomArt(key, policy.fpHash))
+			if !askYesNo() {
+				return fmt.Errorf("user declined to trust unknown host")
+			}
+		default:
+			fmt.Printf("Permanently trusting new %s (%s).\n", what, shown)
+		}
+
+		if !policy.noStore {
+			err := updateKnownHosts(policy.path, func(k *KnownHosts) error {
+				k.store(address, keyType, fp, policy.hash)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("saving host fingerprint failed: %w", err)
+			}
+			fmt.Println("Host fingerprint saved.")
+		} else {
+			fmt.Println("Fingerprint not saved due to -no-store flag.")
+		}
+		return nil
+	}
+}
+
+// runCommand runs a remote command on the SSH server, prints its output and
+// returns its exit status (see exitStatus). With -t, it runs on a PTY and
+// reads stdin, for commands that need a terminal, as it does with
+// -sudo-password-*, which answers sudo's password prompt.
+func runCommand(client *ssh.Client, cmd string, setup sessionSetup) int {
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+
+	session.Stdout = setup.commandOutput(os.Stdout)
+	session.Stderr = setup.commandOutput(os.Stderr)
+	var restore func()
+	switch {
+	case setup.sudo != nil:
+		// The password goes in on stdin along with the user's keystrokes.
+		// Only a terminal is passed on, since the end of piped input would
+		// close stdin before sudo asks. Without one, nobody can answer a
+		// prompt the password did not satisfy, so the command is ended.
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			fatalConnection("Failed to open stdin: %v", err)
+		}
+		responder := setup.sudo.responder(stdin)
+		defer responder.Close()
+		session.Stdout = io.MultiWriter(session.Stdout, responder)
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			go io.Copy(stdin, setup.input(os.Stdin))
+		} else {
+			responder.giveUp = func() { session.Close() }
+		}
+		restore = requestTerminal(session, setup)
+	case setup.forcePTY:
+		session.Stdin = setup.input(os.Stdin)
+		restore = requestTerminal(session, setup)
+	default:
+		restore = forwardSignals(session, nil, nil)
+	}
+
+	fmt.Printf("Running command: %s\n", cmd)
+	err = setup.run(session, cmd)
+	restore()
+	return commandStatus(err)
+}
+
+// commandStatus reports how a command ended, unless it exited normally, and
+// returns its exit status (see exitStatus).
+func commandStatus(err error) int {
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	var timeoutErr *commandTimeoutError
+	switch {
+	case err == nil, errors.As(err, &exitErr):
+	case errors.As(err, &timeoutErr):
+		log.Printf("Command timed out after %s and was ended", timeoutErr.timeout)
+	case errors.As(err, &missingErr):
+		log.Printf("Command ended without reporting an exit status")
+	default:
+		log.Printf("Command failed: %v", err)
+	}
+	return exitStatus(err)
+}
+
+// runSubsystem runs the named subsystem, connecting it to stdin and stdout,
+// until the server closes it. Subsystems speak protocols such as NETCONF or
+// SFTP, so no PTY is requested. The session package only reports exit
+// statuses of shells and commands, so a subsystem that ends yields 0.
+func runSubsystem(client *ssh.Client, name string, stdout io.Writer, setup sessionSetup) int {
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+
+	// A subsystem request does not start the session's own copying, so the
+	// streams are wired through pipes.
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	remoteStdout, err := session.StdoutPipe()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	remoteStderr, err := session.StderrPipe()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	if err := session.RequestSubsystem(name); err != nil {
+		log.Printf("The server refused the %s subsystem: %v", name, err)
+		return exitConnectionFailed
+	}
+
+	go func() {
+		io.Copy(stdin, setup.input(os.Stdin))
+		stdin.Close()
+	}()
+	stderrDone := make(chan struct{})
+	go func() {
+		io.Copy(setup.output(os.Stderr), remoteStderr)
+		close(stderrDone)
+	}()
+	_, err = io.Copy(setup.output(stdout), remoteStdout)
+	<-stderrDone
+	if err != nil {
+		log.Printf("Subsystem %s failed: %v", name, err)
+		return exitConnectionFailed
+	}
+	return 0
+}
+
+// runCommands runs each command in its own session over client, in order,
+// and returns the exit status of the first one that fails, or 0. After a
+// failure the rest are skipped unless keepGoing. With several commands, a
+// summary of their exit statuses follows.
+func runCommands(client *ssh.Client, cmds []string, setup sessionSetup, keepGoing bool) int {
+	if len(cmds) == 1 {
+		return runCommand(client, cmds[0], setup)
+	}
+	var statuses []int
+	failed := 0
+	for _, cmd := range cmds {
+		status := runCommand(client, cmd, setup)
+		statuses = append(statuses, status)
+		if status != 0 {
+			if failed == 0 {
+				failed = status
+			}
+			if !keepGoing {
+				break
+			}
+		}
+	}
+
+	fmt.Println("Command summary:")
+	for i, cmd := range cmds {
+		if i < len(statuses) {
+			fmt.Printf("  [exit %d] %s\n", statuses[i], cmd)
+		} else {
+			fmt.Printf("  [skipped] %s\n", cmd)
+		}
+	}
+	return failed
+}
+
+// startInteractiveShell starts a full interactive terminal session on the remote SSH server,
+// reading keystrokes from stdin, and returns once it ends, with the error the session ended with.
+// With -T, the shell gets no PTY and reads stdin as it is.
+func startInteractiveShell(client *ssh.Client, stdin io.Reader, setup sessionSetup) error {
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+
+	session.Stdin = setup.input(stdin)
+	session.Stdout = setup.output(os.Stdout)
+	session.Stderr = setup.output(os.Stderr)
+
+	if setup.disablePTY {
+		defer forwardSignals(session, nil, nil)()
+	} else {
+		restore := requestTerminal(session, setup)
+		defer restore()
+	}
+
+	if err := session.Shell(); err != nil {
+		fatalConnection("Failed to start shell: %v", err)
+	}
+	return session.Wait()
+}
+
+// requestTerminal requests a PTY for session, sized like the local terminal,
+// and puts the local terminal in raw mode so keystrokes reach the remote side
+// unchanged. Without a local terminal, the PTY is 80x24. It returns a function
+// that restores the local terminal and stops forwarding signals (see
+// forwardSignals). Size changes are passed on to setup.
+func requestTerminal(session *ssh.Session, setup sessionSetup) (restore func()) {
+	fd := int(os.Stdin.Fd())
+	modes := terminalModes(fd)
+	restoreTerminal := func() {}
+	var suspend func()
+	if term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Fatalf("Failed to set terminal raw mode: %v", err)
+		}
+		restoreTerminal = func() { term.Restore(fd, oldState) }
+		suspend = func() {
+			restoreTerminal()
+			if err := suspendProcess(); err == nil {
+				term.MakeRaw(fd)
+			}
+		}
+	}
+
+	width, height, _ := term.GetSize(fd)
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+
+	if err := session.RequestPty(terminalType(), height, width, modes); err != nil {
+		restoreTerminal()
+		log.Fatalf("PTY request failed: %v", err)
+	}
+
+	setup.resized(width, height)
+	stopSignals := forwardSignals(session, setup.resized, suspend)
+	return func() {
+		stopSignals()
+		restoreTerminal()
+	}
+}
+
+// getKnownHostsPath returns the path to the local known_hosts.json file in ~/.ssh.
+func getKnownHostsPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("Unable to determine user home directory: %v", err)
+	}
+	sshDir := filepath.Join(homeDir, ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		log.Fatalf("Failed to create .ssh directory: %v", err)
+	}
+	return filepath.Join(sshDir, "known_hosts.json")
+}
+
+// loadKnownHosts loads the known_hosts.json file into memory, or returns an empty map if not found.
+func loadKnownHosts(path string) KnownHosts {
+	hosts, err := readKnownHosts(path)
+	if errors.Is(err, errKnownHostsIntegrity) {
+		log.Fatalf("Refusing to use %s: %v", path, err)
+	}
+	if err != nil {
+		log.Printf("Warning: could not parse known_hosts.json: %v", err)
+		return KnownHosts{}
+	}
+	return hosts
+}
+
+// readKnownHosts is loadKnownHosts for callers that edit the file and must not
+// replace an unreadable one with an empty database. A signed file is verified
+// and an errKnownHostsIntegrity error returned if it does not match, or
+// errKnownHostsUnsigned, with the contents, if its HMAC is missing while the
+// keyring holds a signing secret for it.
+func readKnownHosts(path string) (KnownHosts, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return KnownHosts{}, nil
+		}
+		log.Fatalf("Failed to open known_hosts: %v", err)
+	}
+	defer file.Close()
+
+	var hosts KnownHosts
+	if err := json.NewDecoder(file).Decode(&hosts); err != nil {
+		return KnownHosts{}, err
+	}
+	if hosts.HMAC == "" {
+		// Stripping the HMAC must not turn a signed file into an
+		// unsigned one that is trusted as it stands.
+		if secret, err := knownHostsSecret(path); err == nil {
+			zeroBytes(secret)
+			return hosts, errKnownHostsUnsigned
+		}
+		return hosts, nil
+	}
+	if err := hosts.verify(path); err != nil {
+		return KnownHosts{}, err
+	}
+	return hosts, nil
+}
+
+// updateKnownHosts applies change to the current contents of known_hosts.json
+// and replaces the file atomically. An exclusive lock on a companion .lock file
+// serializes concurrent memssh processes, and since the file is re-read under
+// the lock, entries another process added in the meantime are kept rather
+// than overwritten. A signed file is signed again after the change. If change
+// fails, the file is left untouched.
+func updateKnownHosts(path string, change func(*KnownHosts) error) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking known_hosts: %w", err)
+	}
+	defer unlock()
+
+	hosts, err := readKnownHosts(path)
+	if err != nil {
+		return fmt.Errorf("parsing known_hosts: %w", err)
+	}
+	if err := change(&hosts); err != nil {
+		return err
+	}
+	if !hosts.signed {
+		// A file made anew in place of a signed one is signed as well, or
+		// it could not be read back.
+		if secret, err := knownHostsSecret(path); err == nil {
+			zeroBytes(secret)
+			hosts.signed = true
+		}
+	}
+	return writeKnownHosts(path, hosts)
+}
+
+// writeKnownHosts replaces known_hosts.json at path with hosts, signed if it
+// is marked signed. The caller holds the lock.
+func writeKnownHosts(path string, hosts KnownHosts) error {
+	if hosts.signed {
+		if err := hosts.sign(path); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".known_hosts-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(hosts); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encoding known_hosts: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// askYesNo prompts the user for a yes/no answer and returns true if the answer begins with "y" or "Y".
+func askYesNo() bool {
+	reader := bufio.NewReader(os.Stdin)
+	input, _ := reader.ReadString('\n')
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(input)), "y")
+}
+
+// readSecret prints a prompt and reads a line from the terminal without echoing it.
+// Callers must zero the returned bytes once they are done with them.
+func readSecret(prompt string) ([]byte, error) {
+	return readSecretTo(os.Stdout, prompt)
+}
+
+// readSecretTo is readSecret with the prompt written to w, for commands whose
+// stdout carries data.
+func readSecretTo(w io.Writer, prompt string) ([]byte, error) {
+	fmt.Fprint(w, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(w)
+	return secret, err
+}
+
+// reopenTerminal points stdin back at the controlling terminal once a piped
+// key has been read, so prompts and interactive shells keep working. Without a
+// terminal (CI jobs, cron) stdin simply stays at EOF.
+func reopenTerminal() {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	if tty, err := os.OpenFile(name, os.O_RDWR, 0); err == nil {
+		os.Stdin = tty
+	}
+}
+
+// readMultiLineInput reads lines from stdin until an empty line is encountered.
+// Used for pasting multi-line private keys.
+func readMultiLineInput() ([]byte, error) {
+	var lines []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return []byte(strings.Join(lines, "\n")), scanner.Err()
+}
+
+// zeroBytes overwrites a byte slice with zeroes to securely erase sensitive data like private keys or passphrases.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// controlMasterEnv marks the background process that -control-persist starts
+// to hold a shared connection.
+const controlMasterEnv = "MEMSSH_CONTROL_MASTER"
+
+// controlSocketPath expands a -control-path: ~ for the home directory, %h for
+// the host, %p for the port, %r for the remote user, %C for a hash of all
+// three (short enough for the socket path limit) and %% for a literal %.
+func controlSocketPath(pattern, host string, port int, user string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + strconv.Itoa(port) + "\x00" + user))
+	replacer := strings.NewReplacer("%%", "%", "%h", host, "%p", strconv.Itoa(port), "%r", user, "%C", hex.EncodeToString(sum[:8]))
+	return expandHome(replacer.Replace(pattern))
+}
+
+// dialControlSocket opens a client over the connection shared by the master
+// listening at path. The master speaks SSH over the socket with a throwaway
+// host key and no authentication: as with OpenSSH's ControlPath, the socket's
+// file permissions are what keep other users out. For the same reason, a
+// socket in a directory other users can write to is not used.
+func dialControlSocket(path, address, user string) (*ssh.Client, error) {
+	if err := checkControlDir(path); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s: %w", path, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// controlMaster shares an authenticated client with other memssh processes
+// through a Unix socket, relaying their channels and requests to it.
+type controlMaster struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	clientMu sync.RWMutex
+	client   *ssh.Client
+
+	mu      sync.Mutex
+	conns   map[ssh.Conn]struct{}
+	changed chan struct{} // signalled when a process attaches or detaches
+}
+
+// listenControlSocket starts sharing client at path. A socket left behind by
+// a master that is gone is replaced; a live one is an error, as is a
+// directory other users can write to.
+func listenControlSocket(path string, client *ssh.Client) (*controlMaster, error) {
+	if err := checkControlDir(path); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already used by another master", path)
+		}
+		os.Remove(path)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	m := &controlMaster{
+		listener: listener,
+		client:   client,
+		config:   config,
+		conns:    make(map[ssh.Conn]struct{}),
+		changed:  make(chan struct{}, 1),
+	}
+	go m.serve()
+	return m, nil
+}
+
+// Close stops sharing the connection, removes the socket and disconnects
+// the processes attached to it.
+func (m *controlMaster) Close() {
+	m.listener.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// sharedClient returns the client being shared.
+func (m *controlMaster) sharedClient() *ssh.Client {
+	m.clientMu.RLock()
+	defer m.clientMu.RUnlock()
+	return m.client
+}
+
+// replaceClient shares client from now on, once the connection it replaces
+// has been reestablished.
+func (m *controlMaster) replaceClient(client *ssh.Client) {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	m.client = client
+}
+
+// attached returns the number of processes using the connection.
+func (m *controlMaster) attached() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// track adds or removes an attached process.
+func (m *controlMaster) track(conn ssh.Conn, add bool) {
+	m.mu.Lock()
+	if add {
+		m.conns[conn] = struct{}{}
+	} else {
+		delete(m.conns, conn)
+	}
+	m.mu.Unlock()
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// waitIdle returns once no process has been attached for idle, or when lost
+// is closed because the shared connection ended.
+func (m *controlMaster) waitIdle(idle time.Duration, lost <-chan struct{}) {
+	for {
+		if m.attached() > 0 {
+			select {
+			case <-m.changed:
+			case <-lost:
+				return
+			}
+			continue
+		}
+		timer := time.NewTimer(idle)
+		select {
+		case <-m.changed:
+			timer.Stop()
+		case <-lost:
+			timer.Stop()
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// serve accepts processes until the listener is closed.
+func (m *controlMaster) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+// handle relays the requests and channels of one attached process.
+func (m *controlMaster) handle(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, m.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	m.track(conn, true)
+	defer m.track(conn, false)
+
+	go func() {
+		for req := range reqs {
+			ok, payload, err := m.sharedClient().SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, payload)
+			}
+		}
+	}()
+	for newChannel := range chans {
+		go m.relayChannel(newChannel)
+	}
+}
+
+// relayChannel opens the same channel on the shared client and copies data,
+// stderr, requests, EOF and close between the two.
+func (m *controlMaster) relayChannel(newChannel ssh.NewChannel) {
+	upstream, upstreamReqs, err := m.sharedClient().OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	local, localReqs, err := newChannel.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(upstream, local)
+		upstream.CloseWrite()
+	}()
+	go func() {
+		relayChannelRequests(upstream, localReqs)
+		upstream.Close()
+	}()
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		io.Copy(local, upstream)
+		output.Done()
+	}()
+	go func() {
+		io.Copy(local.Stderr(), upstream.Stderr())
+		output.Done()
+	}()
+	relayChannelRequests(local, upstreamReqs)
+	output.Wait()
+	local.CloseWrite()
+	local.Close()
+}
+
+// relayChannelRequests forwards requests to channel, passing replies back,
+// until reqs is closed.
+func relayChannelRequests(channel ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
+
+// startControlMaster runs memssh again in the background, with the same
+// arguments, to connect and then share the connection at path for
+// -control-persist. Prompts for passphrases or host keys still appear here,
+// since the background process only lets go of the terminal once it listens.
+// It returns a client attached to the new master; if the background process
+// fails, memssh exits with its status, its errors already printed.
+func startControlMaster(path, address, user string) (*ssh.Client, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), controlMasterEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	fd := int(os.Stdin.Fd())
+	state, _ := term.GetState(fd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			if err != nil {
+				return nil, err
+			}
+			// The master found another one already listening; use that.
+			return dialControlSocket(path, address, user)
+		case <-interrupt:
+			cmd.Process.Kill()
+			if state != nil {
+				term.Restore(fd, state)
+			}
+			os.Exit(130)
+		case <-ticker.C:
+			if client, err := dialControlSocket(path, address, user); err == nil {
+				return client, nil
+			}
+		}
+	}
+}
+
+// serveControlPersist is the life of the background master: once conn is
+// shared, it lets go of the terminal and exits after no process has used the
+// connection for idle, or when the connection ends.
+func serveControlPersist(conn *connection, idle time.Duration) {
+	if conn.master == nil {
+		os.Exit(1)
+	}
+	if err := detachFromTerminal(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	conn.master.waitIdle(idle, conn.lost)
+	conn.closeLink()
+	os.Exit(0)
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkControlDir returns an error unless the directory of the control
+// socket path belongs to this user or root and no one else can write to it.
+// Anyone who could would be able to put a socket of their own in its place.
+func checkControlDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is writable by other users; keep control sockets in a private directory such as ~/.ssh", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return fmt.Errorf("%s belongs to another user; keep control sockets in a private directory such as ~/.ssh", dir)
+	}
+	return nil
+}
+
+// listenPrivate listens on the Unix socket path, which is created accessible
+// to this user only: the umask is 077 while it is made, so there is no moment
+// at which others could connect. The umask is the process's, and files other
+// goroutines create meanwhile are only made more private.
+func listenPrivate(path string) (net.Listener, error) {
+	umask := syscall.Umask(0o077)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCheckControlDir(t *testing.T) {
+	tests := []struct {
+		mode fs.FileMode
+		ok   bool
+	}{
+		{0o700, true},
+		{0o755, true},
+		{0o750, true},
+		{0o770, false},
+		{0o757, false},
+		{0o777, false},
+		{0o777 | fs.ModeSticky, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "sockets")
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			err := checkControlDir(filepath.Join(dir, "memssh-socket"))
+			if (err == nil) != tt.ok {
+				t.Errorf("checkControlDir = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestListenPrivate(t *testing.T) {
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+	path := filepath.Join(t.TempDir(), "socket")
+	listener, err := listenPrivate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("socket created with mode %v", perm)
+	}
+	if now := syscall.Umask(0); now != 0 {
+		t.Errorf("umask left at %o", now)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// checkControlDir accepts any directory: access to Windows directories is
+// governed by ACLs, and the profile directory, where sockets normally live,
+// is private.
+func checkControlDir(path string) error {
+	return nil
+}
+
+// listenPrivate listens on the Unix socket path, whose access is inherited
+// from the directory's ACL.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// oidcCA obtains short-lived SSH user certificates from a CA service that
+// accepts OpenID Connect identity tokens. The token is acquired with the
+// OAuth 2.0 device authorization grant (RFC 8628), so the user signs in with
+// a browser on any device while memssh waits.
+//
+// The CA is expected to accept a POST of
+//
+//	{"public_key": "<authorized_keys line>", "principals": ["<user>"]}
+//
+// with the ID token as a bearer token, and to answer with
+//
+//	{"certificate": "<certificate in authorized_keys format>"}
+type oidcCA struct {
+	issuer    string
+	clientID  string
+	caURL     string
+	principal string
+	http      *http.Client
+	token     string
+}
+
+// newOIDCCA configures a CA client; no network traffic happens until the
+// first certificate is requested.
+func newOIDCCA(issuer, clientID, caURL, principal string) (*oidcCA, error) {
+	if issuer == "" || clientID == "" || caURL == "" {
+		return nil, errors.New("-oidc-issuer, -oidc-client-id and -oidc-ca must be given together")
+	}
+	return &oidcCA{
+		issuer:    strings.TrimRight(issuer, "/"),
+		clientID:  clientID,
+		caURL:     caURL,
+		principal: principal,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// signPublicKey signs in (once per run) and asks the CA for a certificate.
+func (c *oidcCA) signPublicKey(pub ssh.PublicKey) (*ssh.Certificate, error) {
+	if c.token == "" {
+		token, err := c.deviceLogin()
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"public_key": string(ssh.MarshalAuthorizedKey(pub)),
+		"principals": []string{c.principal},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.caURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	var result struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := c.do(req, &result); err != nil {
+		return nil, fmt.Errorf("CA request failed: %w", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(result.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate failed: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("CA did not return a certificate")
+	}
+	return cert, nil
+}
+
+// deviceLogin runs the device authorization flow and returns the ID token
+// (or the access token for providers that do not issue one).
+func (c *oidcCA) deviceLogin() (string, error) {
+	var discovery struct {
+		DeviceEndpoint string `json:"device_authorization_endpoint"`
+		TokenEndpoint  string `json:"token_endpoint"`
+	}
+	req, err := http.NewRequest(http.MethodGet, c.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := c.do(req, &discovery); err != nil {
+		return "", fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if discovery.DeviceEndpoint == "" || discovery.TokenEndpoint == "" {
+		return "", errors.New("OIDC provider does not support the device authorization grant")
+	}
+
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	form := url.Values{"client_id": {c.clientID}, "scope": {"openid email profile"}}
+	if err := c.do(postForm(discovery.DeviceEndpoint, form), &device); err != nil {
+		return "", fmt.Errorf("device authorization failed: %w", err)
+	}
+
+	if device.VerificationURIComplete != "" {
+		fmt.Printf("To sign in, open %s\n", device.VerificationURIComplete)
+		fmt.Printf("and confirm the code %s\n", device.UserCode)
+	} else {
+		fmt.Printf("To sign in, open %s and enter the code %s\n", device.VerificationURI, device.UserCode)
+	}
+
+	// RFC 8628 defaults: poll every 5 seconds unless told otherwise.
+	interval := 5 * time.Second
+	if device.Interval > 0 {
+		interval = time.Duration(device.Interval) * time.Second
+	}
+	expiry := 10 * time.Minute
+	if device.ExpiresIn > 0 {
+		expiry = time.Duration(device.ExpiresIn) * time.Second
+	}
+	deadline := time.Now().Add(expiry)
+	form = url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {device.DeviceCode},
+		"client_id":   {c.clientID},
+	}
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var token struct {
+			IDToken     string `json:"id_token"`
+			AccessToken string `json:"access_token"`
+			Error       string `json:"error"`
+		}
+		err := c.do(postForm(discovery.TokenEndpoint, form), &token)
+		switch {
+		case token.Error == "authorization_pending":
+			continue
+		case token.Error == "slow_down":
+			interval += 5 * time.Second
+			continue
+		case token.Error != "":
+			return "", fmt.Errorf("sign-in failed: %s", token.Error)
+		case err != nil:
+			return "", fmt.Errorf("token request failed: %w", err)
+		}
+		fmt.Println("Signed in.")
+		if token.IDToken != "" {
+			return token.IDToken, nil
+		}
+		return token.AccessToken, nil
+	}
+	return "", errors.New("sign-in timed out")
+}
+
+// postForm builds a form-encoded POST request.
+func postForm(endpoint string, form url.Values) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if req != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req
+}
+
+// do sends a request and decodes the JSON response into v. OAuth error
+// responses are decoded too, so callers can inspect their error field.
+func (c *oidcCA) do(req *http.Request, v any) error {
+	if req == nil {
+		return errors.New("invalid endpoint URL")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("parsing response failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return nil
+}
+
+// newEphemeralBackend generates a throwaway Ed25519 key that lives only for
+// this run, for use with certificates issued on the fly.
+func newEphemeralBackend() (*pemBackend, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pemBackend{key: key, signer: signer}, nil
+}
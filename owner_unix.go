@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the numeric owner and group of a local file from its
+// info.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
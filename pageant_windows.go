@@ -0,0 +1,138 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// pageantMaxMessage is the size of the shared memory block Pageant reads from.
+	pageantMaxMessage = 8192
+	// pageantCopyDataID tags WM_COPYDATA messages as agent requests.
+	pageantCopyDataID = 0x804e50ba
+	wmCopyData        = 0x004a
+)
+
+var (
+	user32          = windows.NewLazySystemDLL("user32.dll")
+	procFindWindow  = user32.NewProc("FindWindowW")
+	procSendMessage = user32.NewProc("SendMessageW")
+)
+
+// copyDataStruct mirrors the Win32 COPYDATASTRUCT passed with WM_COPYDATA.
+type copyDataStruct struct {
+	dwData uintptr
+	cbData uint32
+	lpData uintptr
+}
+
+// pageantConn speaks the ssh-agent protocol to PuTTY's Pageant. Each request
+// is copied into a named shared memory block, Pageant is signalled with
+// WM_COPYDATA, and the reply is read back from the same block.
+type pageantConn struct {
+	mu       sync.Mutex
+	hwnd     uintptr
+	response bytes.Buffer
+}
+
+// dialPageant locates a running Pageant window.
+func dialPageant() (*pageantConn, error) {
+	hwnd, err := findPageantWindow()
+	if err != nil {
+		return nil, err
+	}
+	return &pageantConn{hwnd: hwnd}, nil
+}
+
+// findPageantWindow returns the handle of Pageant's hidden message window.
+func findPageantWindow() (uintptr, error) {
+	name, _ := windows.UTF16PtrFromString("Pageant")
+	hwnd, _, _ := procFindWindow.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)))
+	if hwnd == 0 {
+		return 0, errors.New("Pageant is not running")
+	}
+	return hwnd, nil
+}
+
+// Write sends one complete agent request and buffers Pageant's reply.
+func (c *pageantConn) Write(req []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(req) > pageantMaxMessage {
+		return 0, errors.New("agent request too large for Pageant")
+	}
+	resp, err := c.query(req)
+	if err != nil {
+		return 0, err
+	}
+	c.response.Reset()
+	c.response.Write(resp)
+	return len(req), nil
+}
+
+// Read returns the buffered reply to the last request.
+func (c *pageantConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.response.Read(p)
+}
+
+// Close is a no-op; every request uses its own shared memory block.
+func (c *pageantConn) Close() error {
+	return nil
+}
+
+// query performs a single request/response exchange over shared memory.
+func (c *pageantConn) query(req []byte) ([]byte, error) {
+	mapName := fmt.Sprintf("PageantRequest%08x", windows.GetCurrentThreadId())
+	mapNamePtr, err := windows.UTF16PtrFromString(mapName)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := windows.CreateFileMapping(windows.InvalidHandle, nil, windows.PAGE_READWRITE, 0, pageantMaxMessage, mapNamePtr)
+	if err != nil {
+		return nil, fmt.Errorf("creating Pageant shared memory failed: %w", err)
+	}
+	defer windows.CloseHandle(mapping)
+
+	addr, err := windows.MapViewOfFile(mapping, windows.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mapping Pageant shared memory failed: %w", err)
+	}
+	defer windows.UnmapViewOfFile(addr)
+
+	// The view lives outside the Go heap, so the address is reinterpreted
+	// without a direct uintptr conversion.
+	view := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	shared := unsafe.Slice((*byte)(view), pageantMaxMessage)
+	copy(shared, req)
+
+	// Pageant expects the ANSI mapping name, NUL-terminated.
+	nameBytes := append([]byte(mapName), 0)
+	cds := copyDataStruct{
+		dwData: pageantCopyDataID,
+		cbData: uint32(len(nameBytes)),
+		lpData: uintptr(unsafe.Pointer(&nameBytes[0])),
+	}
+	ret, _, _ := procSendMessage.Call(c.hwnd, wmCopyData, 0, uintptr(unsafe.Pointer(&cds)))
+	if ret == 0 {
+		return nil, errors.New("Pageant refused the request")
+	}
+
+	size := binary.BigEndian.Uint32(shared[:4]) + 4
+	if size > pageantMaxMessage {
+		return nil, errors.New("invalid Pageant response size")
+	}
+	resp := make([]byte, size)
+	copy(resp, shared[:size])
+	return resp, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// passphraseSource describes where the passphrase for an encrypted private key
+// comes from. At most one of file, env and cmd is set; with none set the user
+// is prompted. With keychain set, the macOS Keychain is consulted first.
+type passphraseSource struct {
+	file     string
+	env      string
+	cmd      string
+	keychain bool
+	attempts int
+}
+
+// unlock obtains the passphrase for the key identified by pub (which may be
+// nil) and hands it to try, which attempts to decrypt the key. A stale
+// Keychain entry falls back to the regular source, and a passphrase typed at
+// the terminal is offered for saving once it works. Typed passphrases may be
+// retried up to the configured number of attempts.
+func (p passphraseSource) unlock(pub ssh.PublicKey, try func(pass []byte) error) error {
+	if p.keychain && pub != nil {
+		if pass, err := keychainFind(ssh.FingerprintSHA256(pub)); err == nil {
+			err = try(pass)
+			zeroBytes(pass)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+
+	interactive := p.file == "" && p.env == "" && p.cmd == ""
+	attempts := 1
+	if interactive && p.attempts > 1 {
+		attempts = p.attempts
+	}
+	for attempt := 1; ; attempt++ {
+		pass, err := p.read()
+		if err != nil {
+			return fmt.Errorf("reading passphrase failed: %w", err)
+		}
+		err = try(pass)
+		if err == nil {
+			if interactive {
+				p.remember(pub, pass)
+			}
+			zeroBytes(pass)
+			return nil
+		}
+		zeroBytes(pass)
+		if !isIncorrectPassphrase(err) {
+			return err
+		}
+		if attempt >= attempts {
+			if attempts > 1 {
+				return fmt.Errorf("incorrect passphrase after %d attempts", attempts)
+			}
+			return errors.New("incorrect passphrase")
+		}
+		fmt.Println("Incorrect passphrase, try again.")
+	}
+}
+
+// isIncorrectPassphrase reports whether a key parsing error means the
+// passphrase was wrong rather than the key being unusable.
+func isIncorrectPassphrase(err error) bool {
+	return errors.Is(err, x509.IncorrectPasswordError) || errors.Is(err, errIncorrectPPKPassphrase)
+}
+
+// remember offers to save a passphrase typed at the terminal in the macOS
+// Keychain once it has successfully unlocked the key.
+func (p passphraseSource) remember(pub ssh.PublicKey, pass []byte) {
+	if !p.keychain || pub == nil {
+		return
+	}
+	fmt.Print("Save passphrase in the macOS Keychain? (y/n): ")
+	if !askYesNo() {
+		return
+	}
+	if err := keychainStore(ssh.FingerprintSHA256(pub), "memssh-passphrase", pass); err != nil {
+		log.Printf("Warning: could not save passphrase: %v", err)
+		return
+	}
+	fmt.Println("Passphrase saved to Keychain.")
+}
+
+// read returns the passphrase from the configured non-interactive source,
+// falling back to a terminal prompt.
+func (p passphraseSource) read() ([]byte, error) {
+	switch {
+	case p.file != "":
+		data, err := os.ReadFile(p.file)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file failed: %w", err)
+		}
+		return trimNewline(data), nil
+	case p.env != "":
+		value, ok := os.LookupEnv(p.env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", p.env)
+		}
+		return []byte(value), nil
+	case p.cmd != "":
+		var stderr bytes.Buffer
+		c := shellCommand(p.cmd)
+		c.Stderr = &stderr
+		out, err := c.Output()
+		if err != nil {
+			zeroBytes(out)
+			return nil, fmt.Errorf("passphrase command failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return trimNewline(out), nil
+	}
+	return readSecret("Enter passphrase for encrypted private key: ")
+}
+
+// validate rejects configurations naming more than one passphrase source.
+func (p passphraseSource) validate() error {
+	set := 0
+	for _, v := range []string{p.file, p.env, p.cmd} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of -passphrase-file, -passphrase-env and -passphrase-cmd may be used")
+	}
+	if p.keychain && !keychainSupported {
+		return errors.New("-keychain is only supported on macOS")
+	}
+	return nil
+}
+
+// trimNewline strips a single trailing line ending in place, as written by
+// editors and most secret manager CLIs.
+func trimNewline(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// shellCommand runs a command line through the platform shell.
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
@@ -0,0 +1,288 @@
+//go:build cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+// digestInfoPrefixes holds the DER DigestInfo headers needed for raw CKM_RSA_PKCS signing.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// namedCurves maps the DER-encoded CKA_EC_PARAMS OIDs to supported curves.
+var namedCurves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// pkcs11Backend signs with private keys stored on a smartcard or HSM.
+type pkcs11Backend struct {
+	ctx      *pkcs11.Ctx
+	mu       sync.Mutex
+	sessions []pkcs11.SessionHandle
+	signers  []ssh.Signer
+}
+
+// openPKCS11 loads a PKCS#11 provider library, logs in to every present token
+// (prompting for the PIN when required), and collects its signing keys.
+func openPKCS11(module string) (signerBackend, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load provider %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("initializing provider failed: %w", err)
+	}
+	b := &pkcs11Backend{ctx: ctx}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("listing slots failed: %w", err)
+	}
+	for _, slot := range slots {
+		if err := b.openSlot(slot); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	if len(b.signers) == 0 {
+		b.Close()
+		return nil, errors.New("no signing keys found on any token")
+	}
+	return b, nil
+}
+
+// openSlot opens a session on a token, logs in if needed, and adds its keys.
+func (b *pkcs11Backend) openSlot(slot uint) error {
+	info, err := b.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return fmt.Errorf("reading token info failed: %w", err)
+	}
+	session, err := b.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("opening session on %q failed: %w", info.Label, err)
+	}
+	b.sessions = append(b.sessions, session)
+
+	if info.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 {
+		pin, err := readSecret(fmt.Sprintf("Enter PIN for token %q: ", strings.TrimSpace(info.Label)))
+		if err != nil {
+			return fmt.Errorf("reading PIN failed: %w", err)
+		}
+		err = b.ctx.Login(session, pkcs11.CKU_USER, string(pin))
+		zeroBytes(pin)
+		if err != nil {
+			return fmt.Errorf("token login failed: %w", err)
+		}
+	}
+
+	keys, err := b.findObjects(session, pkcs11.CKO_PRIVATE_KEY, nil)
+	if err != nil {
+		return err
+	}
+	for _, handle := range keys {
+		pub, err := b.publicKey(session, handle)
+		if err != nil {
+			return err
+		}
+		if pub == nil {
+			continue
+		}
+		signer, err := ssh.NewSignerFromSigner(&pkcs11Key{backend: b, session: session, handle: handle, pub: pub})
+		if err != nil {
+			return err
+		}
+		b.signers = append(b.signers, signer)
+	}
+	return nil
+}
+
+// findObjects returns all objects of a class, optionally restricted to a CKA_ID.
+func (b *pkcs11Backend) findObjects(session pkcs11.SessionHandle, class uint, id []byte) ([]pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+	if err := b.ctx.FindObjectsInit(session, template); err != nil {
+		return nil, fmt.Errorf("searching token failed: %w", err)
+	}
+	defer b.ctx.FindObjectsFinal(session)
+
+	var handles []pkcs11.ObjectHandle
+	for {
+		batch, _, err := b.ctx.FindObjects(session, 32)
+		if err != nil {
+			return nil, fmt.Errorf("searching token failed: %w", err)
+		}
+		if len(batch) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, batch...)
+	}
+}
+
+// publicKey reads the public half of a private key object. RSA keys carry the
+// modulus on the private object; EC points are read from the matching public
+// key object. Unsupported key types yield a nil key.
+func (b *pkcs11Backend) publicKey(session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := b.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading key attributes failed: %w", err)
+	}
+	keyType := attributeUint(attrs[0].Value)
+	id := attrs[1].Value
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := b.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading RSA key failed: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		pubs, err := b.findObjects(session, pkcs11.CKO_PUBLIC_KEY, id)
+		if err != nil || len(pubs) == 0 {
+			return nil, err
+		}
+		attrs, err := b.ctx.GetAttributeValue(session, pubs[0], []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading EC key failed: %w", err)
+		}
+		return parseECPublicKey(attrs[0].Value, attrs[1].Value)
+	}
+	return nil, nil
+}
+
+// parseECPublicKey decodes PKCS#11 CKA_EC_PARAMS and CKA_EC_POINT values.
+func parseECPublicKey(params, point []byte) (crypto.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("parsing EC parameters failed: %w", err)
+	}
+	curve, ok := namedCurves[oid.String()]
+	if !ok {
+		return nil, nil
+	}
+	var raw []byte
+	if _, err := asn1.Unmarshal(point, &raw); err != nil {
+		// Some providers return the bare point instead of a DER OCTET STRING.
+		raw = point
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("invalid EC point on token")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Signers returns the signers for every key found on the tokens.
+func (b *pkcs11Backend) Signers() ([]ssh.Signer, error) {
+	return b.signers, nil
+}
+
+// Close logs out, closes all sessions, and unloads the provider library.
+func (b *pkcs11Backend) Close() error {
+	for _, session := range b.sessions {
+		_ = b.ctx.Logout(session)
+		_ = b.ctx.CloseSession(session)
+	}
+	err := b.ctx.Finalize()
+	b.ctx.Destroy()
+	return err
+}
+
+// pkcs11Key is a crypto.Signer whose private key never leaves the token.
+type pkcs11Key struct {
+	backend *pkcs11Backend
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+// Public returns the public half of the token key.
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign asks the token to sign a digest. RSA digests are wrapped in a DigestInfo
+// structure; raw ECDSA signatures are converted to the ASN.1 form Go expects.
+func (k *pkcs11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	data := digest
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v for RSA token key", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	default:
+		return nil, errors.New("unsupported token key type")
+	}
+
+	b := k.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ctx.SignInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, k.handle); err != nil {
+		return nil, fmt.Errorf("token sign init failed: %w", err)
+	}
+	sig, err := b.ctx.Sign(k.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("token signing failed: %w", err)
+	}
+	if mechanism != pkcs11.CKM_ECDSA {
+		return sig, nil
+	}
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig[:half]),
+		new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+// attributeUint decodes a CK_ULONG attribute value, which the provider stores in native byte order.
+func attributeUint(b []byte) uint {
+	switch len(b) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	}
+	return 0
+}
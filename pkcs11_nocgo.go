@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+// openPKCS11 is unavailable without cgo, which the PKCS#11 bindings require.
+func openPKCS11(module string) (signerBackend, error) {
+	return nil, errors.New("PKCS#11 support requires a cgo-enabled build")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// ppkMagic prefixes the first line of every PuTTY private key file.
+const ppkMagic = "PuTTY-User-Key-File-"
+
+// errIncorrectPPKPassphrase is returned when the MAC of an encrypted .ppk file
+// does not verify, which almost always means a wrong passphrase.
+var errIncorrectPPKPassphrase = errors.New("ppk: incorrect passphrase or corrupted key")
+
+// ppkFile holds the fields of a PuTTY .ppk private key (format version 2 or 3).
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string
+}
+
+// isPPK reports whether key looks like a PuTTY private key file.
+func isPPK(key []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(key), []byte(ppkMagic))
+}
+
+// parsePPK parses a PuTTY private key, asking the passphrase source for the
+// passphrase when the key is encrypted.
+func parsePPK(key []byte, passphrase passphraseSource) (any, error) {
+	f, err := readPPK(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.encryption == "none" {
+		private, err := f.decrypt(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer zeroBytes(private)
+		return f.privateKey(private)
+	}
+
+	pub, _ := ssh.ParsePublicKey(f.public)
+	var private []byte
+	err = passphrase.unlock(pub, func(pass []byte) error {
+		private, err = f.decrypt(pass)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(private)
+	return f.privateKey(private)
+}
+
+// readPPK splits a .ppk file into its header fields and base64 blobs.
+func readPPK(key []byte) (*ppkFile, error) {
+	f := &ppkFile{headers: map[string]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(key))
+	readBlob := func(count string) ([]byte, error) {
+		lines, err := strconv.Atoi(count)
+		if err != nil || lines < 0 {
+			return nil, fmt.Errorf("ppk: invalid line count %q", count)
+		}
+		var encoded strings.Builder
+		for i := 0; i < lines; i++ {
+			if !scanner.Scan() {
+				return nil, errors.New("ppk: truncated key data")
+			}
+			encoded.WriteString(strings.TrimSpace(scanner.Text()))
+		}
+		return base64.StdEncoding.DecodeString(encoded.String())
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("ppk: malformed line %q", line)
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(name, ppkMagic):
+			f.version, err = strconv.Atoi(strings.TrimPrefix(name, ppkMagic))
+			f.algorithm = value
+		case name == "Encryption":
+			f.encryption = value
+		case name == "Comment":
+			f.comment = value
+		case name == "Public-Lines":
+			f.public, err = readBlob(value)
+		case name == "Private-Lines":
+			f.private, err = readBlob(value)
+		case name == "Private-MAC":
+			f.mac, err = hex.DecodeString(value)
+		default:
+			f.headers[name] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ppk: %s: %w", name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if f.version != 2 && f.version != 3 {
+		return nil, fmt.Errorf("ppk: unsupported format version %d", f.version)
+	}
+	if f.encryption != "none" && f.encryption != "aes256-cbc" {
+		return nil, fmt.Errorf("ppk: unsupported encryption %q", f.encryption)
+	}
+	if f.public == nil || f.private == nil || f.mac == nil {
+		return nil, errors.New("ppk: missing key data")
+	}
+	return f, nil
+}
+
+// decrypt derives the cipher and MAC keys from the passphrase, verifies the
+// file MAC, and returns the plaintext private blob.
+func (f *ppkFile) decrypt(pass []byte) ([]byte, error) {
+	var cipherKey, iv, macKey []byte
+	var newHash func() hash.Hash
+
+	switch f.version {
+	case 2:
+		newHash = sha1.New
+		if f.encryption != "none" {
+			cipherKey = make([]byte, 0, 40)
+			for i := uint32(0); i < 2; i++ {
+				h := sha1.New()
+				binary.Write(h, binary.BigEndian, i)
+				h.Write(pass)
+				cipherKey = h.Sum(cipherKey)
+			}
+			cipherKey = cipherKey[:32]
+			iv = make([]byte, aes.BlockSize)
+		}
+		h := sha1.New()
+		h.Write([]byte("putty-private-key-file-mac-key"))
+		h.Write(pass)
+		macKey = h.Sum(nil)
+	case 3:
+		newHash = sha256.New
+		if f.encryption != "none" {
+			derived, err := f.argon2(pass)
+			if err != nil {
+				return nil, err
+			}
+			cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+		}
+	}
+
+	private := append([]byte(nil), f.private...)
+	if cipherKey != nil {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("ppk: private blob is not block aligned")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, private)
+		zeroBytes(cipherKey)
+	}
+
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(f.algorithm), []byte(f.encryption), []byte(f.comment), f.public, private} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	if subtle.ConstantTimeCompare(mac.Sum(nil), f.mac) != 1 {
+		zeroBytes(private)
+		if f.encryption != "none" {
+			return nil, errIncorrectPPKPassphrase
+		}
+		return nil, errors.New("ppk: key file is corrupted (MAC mismatch)")
+	}
+	return private, nil
+}
+
+// argon2 runs the version 3 key derivation and returns 80 bytes of key material.
+func (f *ppkFile) argon2(pass []byte) ([]byte, error) {
+	memory, err1 := strconv.ParseUint(f.headers["Argon2-Memory"], 10, 32)
+	passes, err2 := strconv.ParseUint(f.headers["Argon2-Passes"], 10, 32)
+	parallelism, err3 := strconv.ParseUint(f.headers["Argon2-Parallelism"], 10, 8)
+	salt, err4 := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, fmt.Errorf("ppk: invalid Argon2 parameters: %w", err)
+	}
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+		return argon2.IDKey(pass, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	case "Argon2i":
+		return argon2.Key(pass, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	}
+	return nil, fmt.Errorf("ppk: unsupported key derivation %q", f.headers["Key-Derivation"])
+}
+
+// privateKey builds the private key from the public blob and decrypted private
+// blob, checking that both halves belong to the same key.
+func (f *ppkFile) privateKey(private []byte) (any, error) {
+	pub, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, fmt.Errorf("ppk: invalid public key: %w", err)
+	}
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("ppk: unsupported key type %s", f.algorithm)
+	}
+
+	var key any
+	switch pk := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		var priv struct {
+			D, P, Q, Iqmp *big.Int
+			Rest          []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, fmt.Errorf("ppk: invalid RSA private key: %w", err)
+		}
+		rsaKey := &rsa.PrivateKey{PublicKey: *pk, D: priv.D, Primes: []*big.Int{priv.P, priv.Q}}
+		if err := rsaKey.Validate(); err != nil {
+			return nil, fmt.Errorf("ppk: invalid RSA private key: %w", err)
+		}
+		rsaKey.Precompute()
+		key = rsaKey
+	case *ecdsa.PublicKey:
+		var priv struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, fmt.Errorf("ppk: invalid ECDSA private key: %w", err)
+		}
+		x, y := pk.Curve.ScalarBaseMult(priv.D.Bytes())
+		if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+			return nil, errors.New("ppk: ECDSA private key does not match public key")
+		}
+		key = &ecdsa.PrivateKey{PublicKey: *pk, D: priv.D}
+	case ed25519.PublicKey:
+		var priv struct {
+			Seed []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil || len(priv.Seed) != ed25519.SeedSize {
+			return nil, errors.New("ppk: invalid Ed25519 private key")
+		}
+		edKey := ed25519.NewKeyFromSeed(priv.Seed)
+		zeroBytes(priv.Seed)
+		if !bytes.Equal(edKey.Public().(ed25519.PublicKey), pk) {
+			return nil, errors.New("ppk: Ed25519 private key does not match public key")
+		}
+		key = edKey
+	default:
+		return nil, fmt.Errorf("ppk: unsupported key type %s", f.algorithm)
+	}
+	return key, nil
+}
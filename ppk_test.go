@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys in testdata/ppk are named after their type and format version;
+// those ending in -pw are encrypted with the passphrase "pw".
+const testPPKPassphraseEnv = "MEMSSH_TEST_PPK_PASSPHRASE"
+
+func readTestPPK(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "ppk", name+".ppk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParsePPK(t *testing.T) {
+	t.Setenv(testPPKPassphraseEnv, "pw")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"ed25519-2", "ed25519.PrivateKey"},
+		{"ed25519-2-pw", "ed25519.PrivateKey"},
+		{"ed25519-3", "ed25519.PrivateKey"},
+		{"ed25519-3-pw", "ed25519.PrivateKey"},
+		{"rsa-2", "*rsa.PrivateKey"},
+		{"rsa-2-pw", "*rsa.PrivateKey"},
+		{"rsa-3", "*rsa.PrivateKey"},
+		{"rsa-3-pw", "*rsa.PrivateKey"},
+		{"ecdsa-2", "*ecdsa.PrivateKey"},
+		{"ecdsa-2-pw", "*ecdsa.PrivateKey"},
+		{"ecdsa-3", "*ecdsa.PrivateKey"},
+		{"ecdsa-3-pw", "*ecdsa.PrivateKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readTestPPK(t, tt.name)
+			if !isPPK(data) {
+				t.Fatal("isPPK = false")
+			}
+			key, err := parsePPK(data, passphraseSource{env: testPPKPassphraseEnv})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%T", key); got != tt.want {
+				t.Fatalf("key is %s, want %s", got, tt.want)
+			}
+
+			// The key must sign for the public key in the file.
+			signer, err := ssh.NewSignerFromKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := readPPK(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := ssh.ParsePublicKey(f.public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := signer.Sign(rand.Reader, []byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pub.Verify([]byte("data"), sig); err != nil {
+				t.Errorf("signature does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestPPKIncorrectPassphrase(t *testing.T) {
+	for _, name := range []string{"ed25519-2-pw", "ed25519-3-pw", "rsa-2-pw", "ecdsa-3-pw"} {
+		t.Run(name, func(t *testing.T) {
+			f, err := readPPK(readTestPPK(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pass := range []string{"", "wrong", "pw "} {
+				if _, err := f.decrypt([]byte(pass)); !errors.Is(err, errIncorrectPPKPassphrase) {
+					t.Errorf("decrypt(%q) = %v, want %v", pass, err, errIncorrectPPKPassphrase)
+				}
+			}
+			if _, err := f.decrypt([]byte("pw")); err != nil {
+				t.Errorf("decrypt(%q) = %v", "pw", err)
+			}
+		})
+	}
+}
+
+func TestPPKTampered(t *testing.T) {
+	t.Setenv(testPPKPassphraseEnv, "pw")
+	tests := []struct {
+		name    string
+		key     string
+		old     string
+		new     string
+		wantErr string
+	}{
+		{"comment", "ed25519-2", "Comment: test key", "Comment: best key", "MAC mismatch"},
+		{"comment v3", "ed25519-3", "Comment: test key", "Comment: best key", "MAC mismatch"},
+		{"comment encrypted", "ed25519-2-pw", "Comment: test key", "Comment: best key", "incorrect passphrase"},
+		{"comment encrypted v3", "ed25519-3-pw", "Comment: test key", "Comment: best key", "incorrect passphrase"},
+		{"algorithm", "ed25519-2", ": ssh-ed25519", ": ssh-ed25520", "MAC mismatch"},
+		{"MAC", "ed25519-2", "Private-MAC: ed", "Private-MAC: ee", "MAC mismatch"},
+		{"version", "ed25519-2", "File-2", "File-4", "unsupported format version 4"},
+		{"encryption", "ed25519-2", "Encryption: none", "Encryption: aes128-cbc", `unsupported encryption "aes128-cbc"`},
+		{"no MAC", "ed25519-2", "Private-MAC", "Public-MAC", "missing key data"},
+		{"line count", "ed25519-2", "Public-Lines: 2", "Public-Lines: x", `invalid line count "x"`},
+		{"truncated", "ed25519-2", "Private-Lines: 1", "Private-Lines: 3", "truncated key data"},
+		{"malformed line", "ed25519-2", "Encryption: none", "Encryption none", "malformed line"},
+		{"key derivation", "ed25519-3-pw", "Argon2id", "Argon2d", `unsupported key derivation "Argon2d"`},
+		{"Argon2 parameter", "ed25519-3-pw", "Argon2-Passes: 2", "Argon2-Passes: two", "invalid Argon2 parameters"},
+		{"Argon2 salt", "ed25519-3-pw", "Argon2-Salt: ", "Argon2-Salt: x", "invalid Argon2 parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := string(readTestPPK(t, tt.key))
+			if !strings.Contains(data, tt.old) {
+				t.Fatalf("%s does not contain %q", tt.key, tt.old)
+			}
+			data = strings.Replace(data, tt.old, tt.new, 1)
+			_, err := parsePPK([]byte(data), passphraseSource{env: testPPKPassphraseEnv})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePPK = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// prefixTimeFormat is the timestamp -prefix-time puts before output lines:
+// RFC 3339 with milliseconds, so lines sort and parse as they are.
+const prefixTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// linePrefix is what -prefix-time and -prefix-host put before each line a
+// command prints, and `memssh tail` before the lines of each of several
+// files.
+type linePrefix struct {
+	time bool
+	host string // empty without -prefix-host
+	file string
+}
+
+// wrap returns a writer passing output on to w with each line prefixed.
+func (p *linePrefix) wrap(w io.Writer) io.Writer {
+	return &prefixWriter{prefix: p, w: w, lineStart: true}
+}
+
+// format returns the prefix for a line starting at now.
+func (p *linePrefix) format(now time.Time) string {
+	var s string
+	if p.time {
+		s = now.Format(prefixTimeFormat) + " "
+	}
+	if p.host != "" {
+		s += "[" + p.host + "] "
+	}
+	if p.file != "" {
+		s += "[" + p.file + "] "
+	}
+	return s
+}
+
+// prefixWriter prefixes the lines written to it. Partial lines are passed on
+// at once, so prompts still show; the prefix is written with a line's first
+// byte and stamped with its time.
+type prefixWriter struct {
+	mu        sync.Mutex
+	prefix    *linePrefix
+	w         io.Writer
+	lineStart bool
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out []byte
+	now := time.Now()
+	for _, b := range p {
+		if w.lineStart {
+			out = append(out, w.prefix.format(now)...)
+			w.lineStart = false
+		}
+		out = append(out, b)
+		w.lineStart = b == '\n'
+	}
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
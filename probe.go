@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// probeMethods lists the authentication methods probe can detect, in the
+// order they are reported.
+var probeMethods = []string{"publickey", "password", "keyboard-interactive", "gssapi-with-mic"}
+
+// errProbe aborts an authentication attempt once the method has been recorded.
+var errProbe = errors.New("probe only")
+
+// runProbe implements `memssh probe`: it connects without credentials and
+// reports the host key and the authentication methods the server offers for
+// the user, to help debug authentication failures.
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	opts := connOptions{tcpNoDelay: true, tcpKeepAlive: true}
+	fs.StringVar(&opts.host, "host", "", "SSH server hostname or IP")
+	fs.IntVar(&opts.port, "port", 22, "SSH server port")
+	fs.StringVar(&opts.user, "user", "", "SSH username")
+	fs.BoolVar(&opts.ipv4Only, "4", false, "Connect over IPv4 only")
+	fs.BoolVar(&opts.ipv6Only, "6", false, "Connect over IPv6 only")
+	fs.StringVar(&opts.bindAddress, "bind-address", "", "Local IP address to connect from (optional)")
+	fs.StringVar(&opts.bindInterface, "bind-interface", "", "Network interface to connect through (Linux only, optional)")
+	fs.DurationVar(&opts.connectTimeout, "connect-timeout", 0, "Give up if the server has not answered within this time, e.g. 10s (default no limit)")
+	fs.StringVar(&opts.fingerprintHash, "fingerprint-hash", "sha256", "Hash used to display the host key fingerprint: sha256 or md5")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh probe [flags] [user@host[:port]]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	opts.takeDestination(fs.Args())
+	if opts.host == "" || opts.user == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !slices.Contains(fingerprintHashes, opts.fingerprintHash) {
+		log.Fatalf("Invalid -fingerprint-hash %q (use %s)", opts.fingerprintHash, strings.Join(fingerprintHashes, " or "))
+	}
+	if opts.ipv4Only && opts.ipv6Only {
+		log.Fatal("-4 and -6 cannot be combined")
+	}
+
+	address := opts.address()
+	known := loadKnownHosts(getKnownHostsPath())
+	if err := known.loadRevocations(""); err != nil {
+		log.Fatalf("Revoked host keys: %v", err)
+	}
+
+	// Each callback only runs when the server lists its method after the
+	// initial "none" request, so the invocations reveal what is offered.
+	var offered []string
+	record := func(method string) {
+		if !slices.Contains(offered, method) {
+			offered = append(offered, method)
+		}
+	}
+	var banner string
+	config := &ssh.ClientConfig{
+		User: opts.user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				record("publickey")
+				return nil, nil
+			}),
+			ssh.PasswordCallback(func() (string, error) {
+				record("password")
+				return "", errProbe
+			}),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				record("keyboard-interactive")
+				return nil, errProbe
+			}),
+			ssh.GSSAPIWithMICAuthMethod(probeGSSAPIClient{record}, opts.host),
+		},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fmt.Printf("Host key: %s %s\n", key.Type(), displayFingerprint(key, opts.fingerprintHash))
+			if known.revocations.isRevoked(key) {
+				fmt.Println("Known hosts: REVOKED")
+				return nil
+			}
+			if handled, err := known.checkHostCertificate(address, key); handled {
+				if err != nil {
+					fmt.Printf("Known hosts: %v\n", err)
+				} else {
+					fmt.Println("Known hosts: certificate signed by a trusted CA")
+				}
+				return nil
+			}
+			stored := known.lookup(address)
+			trusted, ok := stored.trusted(key.Type())
+			switch {
+			case len(stored) == 0:
+				fmt.Println("Known hosts: not trusted yet")
+			case !ok:
+				fmt.Printf("Known hosts: no %s key trusted yet\n", key.Type())
+			case trusted == hostFingerprint(key):
+				fmt.Println("Known hosts: matches stored fingerprint")
+			default:
+				fmt.Println("Known hosts: DIFFERS from stored fingerprint")
+			}
+			return nil
+		},
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+		Timeout: opts.connectTimeout,
+	}
+
+	dial, err := opts.localDial()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := dialSSH(dialUnixSocket(dial), address, config)
+	if banner != "" {
+		fmt.Printf("Banner:\n%s\n", strings.TrimRight(banner, "\n"))
+	}
+	if err == nil {
+		client.Close()
+		fmt.Printf("Server accepted %s without credentials (\"none\" authentication)\n", opts.user)
+		return
+	}
+	if len(offered) == 0 && !strings.Contains(err.Error(), "unable to authenticate") {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+
+	fmt.Printf("Authentication methods offered for %s:\n", opts.user)
+	if len(offered) == 0 {
+		fmt.Println("  (none that memssh supports)")
+	}
+	for _, method := range probeMethods {
+		if slices.Contains(offered, method) {
+			fmt.Printf("  %s\n", method)
+		}
+	}
+}
+
+// probeGSSAPIClient records that the server offered GSSAPI authentication and
+// then aborts it before any Kerberos exchange.
+type probeGSSAPIClient struct {
+	record func(method string)
+}
+
+func (c probeGSSAPIClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	c.record("gssapi-with-mic")
+	return nil, false, errProbe
+}
+
+func (c probeGSSAPIClient) GetMIC(micField []byte) ([]byte, error) {
+	return nil, errProbe
+}
+
+func (c probeGSSAPIClient) DeleteSecContext() error {
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// progress shows how a transfer is going on a status line on stderr, when
+// that is a terminal: the file being copied, how much of it is done, its
+// throughput and the time left. With several files copied at once, the
+// oldest one is shown. It also counts what was copied for the summary.
+type progress struct {
+	enabled bool
+	start   time.Time
+
+	mu     sync.Mutex
+	active []*fileProgress
+	shown  bool // the status line is on the screen
+	files  int
+	bytes  int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileProgress is a file being copied.
+type fileProgress struct {
+	name   string
+	size   int64
+	start  time.Time
+	copied atomic.Int64
+}
+
+func newProgress() *progress {
+	p := &progress{
+		enabled: term.IsTerminal(int(os.Stderr.Fd())),
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !p.enabled {
+		close(p.done)
+		return p
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			}
+		}
+	}()
+	return p
+}
+
+// begin starts showing the file name, of size bytes.
+func (p *progress) begin(name string, size int64) *fileProgress {
+	f := &fileProgress{name: name, size: size, start: time.Now()}
+	p.mu.Lock()
+	p.active = append(p.active, f)
+	p.mu.Unlock()
+	return f
+}
+
+// end stops showing f. A file copied in full counts toward the summary, and
+// line, if any, is printed on stdout in place of the status line.
+func (p *progress) end(f *fileProgress, ok bool, line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, active := range p.active {
+		if active == f {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	if ok {
+		p.files++
+		p.bytes += f.copied.Load()
+	}
+	p.clear()
+	if line != "" {
+		fmt.Println(line)
+	}
+}
+
+// pause runs fn, which prints, with the status line out of its way.
+func (p *progress) pause(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fn()
+}
+
+// logf logs with the status line out of its way.
+func (p *progress) logf(format string, args ...any) {
+	p.pause(func() { log.Printf(format, args...) })
+}
+
+// output returns a writer to w, such as os.Stderr for the messages of a
+// remote command, that keeps the status line out of the way.
+func (p *progress) output(w io.Writer) io.Writer {
+	return pausedWriter{p, w}
+}
+
+type pausedWriter struct {
+	p *progress
+	w io.Writer
+}
+
+func (w pausedWriter) Write(b []byte) (n int, err error) {
+	w.p.pause(func() { n, err = w.w.Write(b) })
+	return n, err
+}
+
+// clear removes the status line. p.mu must be held.
+func (p *progress) clear() {
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		p.shown = false
+	}
+}
+
+// draw shows the status line for the oldest active file. p.mu must be held.
+func (p *progress) draw() {
+	if len(p.active) == 0 {
+		p.clear()
+		return
+	}
+	f := p.active[0]
+	copied := f.copied.Load()
+	elapsed := time.Since(f.start).Seconds()
+	stats := formatSize(copied) + "/" + formatSize(f.size)
+	if f.size > 0 {
+		stats = fmt.Sprintf("%3d%% %s", copied*100/f.size, stats)
+	}
+	if elapsed > 0 && copied > 0 {
+		rate := float64(copied) / elapsed
+		stats += fmt.Sprintf("  %s/s  ETA %s", formatSize(int64(rate)), formatETA(time.Duration(float64(f.size-copied)/rate*float64(time.Second))))
+	}
+	if more := len(p.active) - 1; more > 0 {
+		stats += fmt.Sprintf("  (+%d)", more)
+	}
+
+	width := 80
+	if w, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && w > 0 {
+		width = w
+	}
+	// The name gives way to the numbers, losing its start first, since the
+	// end names the file.
+	name := []rune(f.name)
+	if room := width - 1 - len(stats) - 2; len(name) > room {
+		if room < 4 {
+			name = nil
+		} else {
+			name = append([]rune("..."), name[len(name)-room+3:]...)
+		}
+	}
+	line := []rune(string(name) + "  " + stats)
+	if len(line) > width-1 {
+		line = line[:width-1]
+	}
+	fmt.Fprint(os.Stderr, "\r"+string(line)+"\x1b[K")
+	p.shown = true
+}
+
+// close stops drawing and returns the summary of what was copied, such as
+// "3 files, 1.5M in 2.1s (731.4K/s)".
+func (p *progress) close() string {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	elapsed := time.Since(p.start)
+	files := "files"
+	if p.files == 1 {
+		files = "file"
+	}
+	shown := elapsed.Round(100 * time.Millisecond)
+	if shown == 0 {
+		shown = elapsed.Round(time.Millisecond)
+	}
+	summary := fmt.Sprintf("%d %s, %s in %s", p.files, files, formatSize(p.bytes), shown)
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		summary += fmt.Sprintf(" (%s/s)", formatSize(int64(float64(p.bytes)/seconds)))
+	}
+	return summary
+}
+
+// formatETA formats a time left as m:ss, or h:mm:ss from an hour.
+func formatETA(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// reader counts what is read from r as copied.
+func (f *fileProgress) reader(r io.Reader) io.Reader {
+	return progressReader{r, f}
+}
+
+// writer counts what is written to w as copied.
+func (f *fileProgress) writer(w io.Writer) io.Writer {
+	return progressWriter{w, f}
+}
+
+type progressReader struct {
+	r io.Reader
+	f *fileProgress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.f.copied.Add(int64(n))
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	f *fileProgress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.f.copied.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// KeyProvider fetches private key material from an external secret store at
+// connect time, so the key only ever exists in memory.
+type KeyProvider interface {
+	// FetchKey returns the PEM, OpenSSH or PPK encoded private key.
+	// Callers must zero the returned bytes after use.
+	FetchKey() ([]byte, error)
+}
+
+// newKeyProvider selects a provider from a URI:
+//
+//	op://vault/item[/field]  1Password CLI (field defaults to "private key")
+//	bw://item                Bitwarden CLI (SSH key item or secure note)
+//	exec:command             any command printing the key on stdout
+func newKeyProvider(uri string) (KeyProvider, error) {
+	switch {
+	case strings.HasPrefix(uri, "op://"):
+		ref := uri
+		if strings.Count(strings.TrimPrefix(uri, "op://"), "/") == 1 {
+			ref += "/private key"
+		}
+		return onePasswordProvider{ref: ref}, nil
+	case strings.HasPrefix(uri, "bw://"):
+		return bitwardenProvider{item: strings.TrimPrefix(uri, "bw://")}, nil
+	case strings.HasPrefix(uri, "exec:"):
+		return execProvider{command: strings.TrimPrefix(uri, "exec:")}, nil
+	}
+	return nil, fmt.Errorf("unsupported key provider %q (use op://, bw:// or exec:)", uri)
+}
+
+// onePasswordProvider reads a key with `op read`, asking for OpenSSH format.
+type onePasswordProvider struct {
+	ref string
+}
+
+func (p onePasswordProvider) FetchKey() ([]byte, error) {
+	return runProvider("1Password CLI", exec.Command("op", "read", "--no-newline", p.ref+"?ssh-format=openssh"))
+}
+
+// bitwardenProvider reads a key with `bw get item`. SSH key items carry the key
+// in sshKey.privateKey; older setups keep it in the notes of a secure note.
+// The vault must already be unlocked (BW_SESSION set).
+type bitwardenProvider struct {
+	item string
+}
+
+func (p bitwardenProvider) FetchKey() ([]byte, error) {
+	out, err := runProvider("Bitwarden CLI", exec.Command("bw", "get", "item", p.item))
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(out)
+
+	var item struct {
+		Notes  string `json:"notes"`
+		SSHKey *struct {
+			PrivateKey string `json:"privateKey"`
+		} `json:"sshKey"`
+	}
+	if err := json.Unmarshal(out, &item); err != nil {
+		return nil, fmt.Errorf("parsing Bitwarden item failed: %w", err)
+	}
+	if item.SSHKey != nil && item.SSHKey.PrivateKey != "" {
+		return []byte(item.SSHKey.PrivateKey), nil
+	}
+	if item.Notes != "" {
+		return []byte(item.Notes), nil
+	}
+	return nil, errors.New("Bitwarden item has no SSH key or notes")
+}
+
+// execProvider runs an arbitrary command and uses its standard output as the key.
+type execProvider struct {
+	command string
+}
+
+func (p execProvider) FetchKey() ([]byte, error) {
+	return runProvider("key command", shellCommand(p.command))
+}
+
+// runProvider runs a provider command and returns its output, including the
+// command's stderr in the error when it fails.
+func runProvider(name string, cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		zeroBytes(out)
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
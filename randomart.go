@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	randomArtWidth  = 17
+	randomArtHeight = 9
+	// randomArtSymbols are drawn for fields visited 0..14 times, followed by
+	// the start and end markers.
+	randomArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// randomArtKeyNames maps key types to the names OpenSSH prints in the
+// randomart header.
+var randomArtKeyNames = map[string]string{
+	ssh.KeyAlgoRSA:        "RSA",
+	ssh.KeyAlgoECDSA256:   "ECDSA",
+	ssh.KeyAlgoECDSA384:   "ECDSA",
+	ssh.KeyAlgoECDSA521:   "ECDSA",
+	ssh.KeyAlgoED25519:    "ED25519",
+	ssh.KeyAlgoSKECDSA256: "ECDSA-SK",
+	ssh.KeyAlgoSKED25519:  "ED25519-SK",
+}
+
+// randomArt draws the "drunken bishop" picture of a key's fingerprint that
+// `ssh-keygen -lv` and VisualHostKey show, using the same digest as
+// displayFingerprint so both can be compared with OpenSSH output.
+func randomArt(key ssh.PublicKey, hash string) string {
+	var digest []byte
+	hashName := "SHA256"
+	if hash == "md5" {
+		sum := md5.Sum(key.Marshal())
+		digest, hashName = sum[:], "MD5"
+	} else {
+		sum := sha256.Sum256(key.Marshal())
+		digest = sum[:]
+	}
+
+	var field [randomArtWidth][randomArtHeight]int
+	last := len(randomArtSymbols) - 1
+	x, y := randomArtWidth/2, randomArtHeight/2
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			x = min(max(x+int(b&1)*2-1, 0), randomArtWidth-1)
+			y = min(max(y+int(b&2)-1, 0), randomArtHeight-1)
+			if field[x][y] < last-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = last - 1
+	field[x][y] = last
+
+	name, bits := randomArtKeyInfo(key)
+	title := fmt.Sprintf("[%s %d]", name, bits)
+	if len(title) > randomArtWidth-2 {
+		title = "[" + name + "]"
+	}
+
+	var b strings.Builder
+	b.WriteString(randomArtBorder(title))
+	for y := 0; y < randomArtHeight; y++ {
+		b.WriteByte('|')
+		for x := 0; x < randomArtWidth; x++ {
+			b.WriteByte(randomArtSymbols[min(field[x][y], last)])
+		}
+		b.WriteString("|\n")
+	}
+	b.WriteString(randomArtBorder("[" + hashName + "]"))
+	return b.String()
+}
+
+// randomArtBorder centres a label in a top or bottom border line.
+func randomArtBorder(label string) string {
+	left := (randomArtWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", randomArtWidth-left-len(label)) + "+\n"
+}
+
+// randomArtKeyInfo returns the OpenSSH name and size in bits of a key type.
+func randomArtKeyInfo(key ssh.PublicKey) (string, int) {
+	suffix := ""
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key, suffix = cert.Key, "-CERT"
+	}
+	name, ok := randomArtKeyNames[key.Type()]
+	if !ok {
+		name = strings.ToUpper(key.Type())
+	}
+
+	bits := 256
+	switch key.Type() {
+	case ssh.KeyAlgoECDSA384:
+		bits = 384
+	case ssh.KeyAlgoECDSA521:
+		bits = 521
+	case ssh.KeyAlgoRSA:
+		if crypto, ok := key.(ssh.CryptoPublicKey); ok {
+			if pub, ok := crypto.CryptoPublicKey().(*rsa.PublicKey); ok {
+				bits = pub.N.BitLen()
+			}
+		}
+	}
+	return name + suffix, bits
+}
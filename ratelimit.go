@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket paces traffic to rate bytes per second. Up to a quarter
+// second's worth of bytes may pass at once after a pause; beyond that,
+// callers wait for the bytes they have used.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	burst := float64(rate) / 4
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take uses n bytes of the allowance, sleeping for as long as that puts the
+// bucket in debt.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateLimitedConn limits a connection to a rate in each direction, for
+// -limit-rate. Writes wait before sending; reads wait after receiving, which
+// holds back the next read and so, through TCP flow control, the sender.
+type rateLimitedConn struct {
+	net.Conn
+	read, write *tokenBucket
+}
+
+func newRateLimitedConn(conn net.Conn, rate uint64) *rateLimitedConn {
+	return &rateLimitedConn{Conn: conn, read: newTokenBucket(rate), write: newTokenBucket(rate)}
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.take(n)
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	c.write.take(len(p))
+	return c.Conn.Write(p)
+}
+
+// limitReader paces reads from r to b, for -limit-rate on put and get. A nil
+// b leaves r alone.
+func limitReader(r io.Reader, b *tokenBucket) io.Reader {
+	if b == nil {
+		return r
+	}
+	return rateLimitedReader{r, b}
+}
+
+// limitWriter paces writes to w to b, as limitReader does reads.
+func limitWriter(w io.Writer, b *tokenBucket) io.Writer {
+	if b == nil {
+		return w
+	}
+	return rateLimitedWriter{w, b}
+}
+
+type rateLimitedReader struct {
+	r io.Reader
+	b *tokenBucket
+}
+
+func (r rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.b.take(n)
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	w io.Writer
+	b *tokenBucket
+}
+
+func (w rateLimitedWriter) Write(p []byte) (int, error) {
+	w.b.take(len(p))
+	return w.w.Write(p)
+}
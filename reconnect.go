@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// reconnectDelays is the backoff between reconnection attempts.
+var reconnectDelays = []time.Duration{
+	time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+	16 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second,
+}
+
+// dropped reports whether the connection itself has ended, as opposed to the
+// remote shell exiting. The client notices shortly after the session does.
+func (c *connection) dropped() bool {
+	select {
+	case <-c.lost:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// reconnect replaces a dropped connection, retrying with increasing delays.
+// The host key is verified again, and the attempt stops at once if it is
+// rejected.
+func (c *connection) reconnect() error {
+	c.closeLink()
+	var err error
+	for attempt, delay := range reconnectDelays {
+		fmt.Fprintf(os.Stderr, "Reconnecting to %s (attempt %d of %d)...\n", c.address, attempt+1, len(reconnectDelays))
+		if err = c.dial(); err == nil {
+			return nil
+		}
+		var rejected *hostKeyRejectedError
+		if errors.As(err, &rejected) {
+			return err
+		}
+		c.closeLink()
+		if attempt < len(reconnectDelays)-1 {
+			fmt.Fprintf(os.Stderr, "Reconnect failed: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
+		}
+	}
+	return err
+}
+
+// redial logs in again while the current connection stays up, so it can be
+// swapped for the new one, and returns the old one for the caller to close
+// once it has. If logging in fails, the current connection is kept.
+func (c *connection) redial() (*connection, error) {
+	old := &connection{client: c.client, hostKeys: c.hostKeys, master: c.master, link: c.link, lost: c.lost}
+	remoteForwards := c.remoteForwards
+	c.client, c.hostKeys, c.master, c.link = nil, nil, nil, nil
+	if err := c.dial(); err != nil {
+		c.closeLink()
+		c.client, c.hostKeys, c.master, c.link, c.lost = old.client, old.hostKeys, old.master, old.link, old.lost
+		c.remoteForwards = remoteForwards
+		return nil, err
+	}
+	return old, nil
+}
+
+// maxRetryDelay caps the doubling delay between -retries attempts.
+const maxRetryDelay = 30 * time.Second
+
+// dialWithRetries makes the first connection, retrying up to retries times
+// after failures that may be transient, such as a refused connection or
+// timeout while the server is still booting. The delay starts at delay and
+// doubles after each attempt, up to maxRetryDelay.
+func (c *connection) dialWithRetries(retries int, delay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := c.dial()
+		if err == nil || attempt >= retries || !transientError(err) {
+			return err
+		}
+		c.closeLink()
+		log.Printf("Connection failed: %v; retry %d of %d in %v", err, attempt+1, retries, delay)
+		time.Sleep(delay)
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// transientError reports whether a failed connection attempt is worth
+// retrying: network errors, including DNS failures and timeouts, and
+// connections the server closed or reset during the handshake. Rejected host
+// keys, failed authentication and configuration problems are not.
+func transientError(err error) bool {
+	var rejected *hostKeyRejectedError
+	if errors.As(err, &rejected) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// stdinRelay hands the local stdin to one reader at a time. A session's
+// stdin copier is left blocked in Read when the connection drops; detaching
+// it makes it give up without swallowing what is typed next.
+type stdinRelay struct {
+	chunks  chan []byte
+	mu      sync.Mutex
+	pending []byte
+}
+
+// newStdinRelay starts relaying r.
+func newStdinRelay(r io.Reader) *stdinRelay {
+	s := &stdinRelay{chunks: make(chan []byte)}
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.chunks <- buf[:n]
+			}
+			if err != nil {
+				close(s.chunks)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// reader returns a reader of the relayed input that reports EOF once detach
+// is closed. A nil detach never detaches.
+func (s *stdinRelay) reader(detach <-chan struct{}) io.Reader {
+	return relayReader{s, detach}
+}
+
+type relayReader struct {
+	relay  *stdinRelay
+	detach <-chan struct{}
+}
+
+func (r relayReader) Read(p []byte) (int, error) {
+	s := r.relay
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		select {
+		case <-r.detach:
+			return 0, io.EOF
+		default:
+		}
+		select {
+		case <-r.detach:
+			return 0, io.EOF
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.pending = chunk
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// interactiveShell runs an interactive shell on conn. If the connection drops
+// mid-session, it offers to reconnect, or with autoReconnect does so right
+// away, and starts a new shell sized to the current terminal. It returns the
+// shell's exit status. On a terminal, escape sequences such as ~. apply.
+func interactiveShell(conn *connection, autoReconnect bool) int {
+	var input io.Reader = os.Stdin
+	var escapes *escapeReader
+	if !conn.session.disablePTY && term.IsTerminal(int(os.Stdin.Fd())) {
+		escapes = newEscapeReader(os.Stdin, conn)
+		input = escapes
+	}
+	stdin := newStdinRelay(input)
+	setup := conn.session
+	if escapes != nil {
+		setup.attach = escapes.session.Store
+	}
+	for {
+		detach := make(chan struct{})
+		err := startInteractiveShell(conn.client, stdin.reader(detach), setup)
+		close(detach)
+		if err == nil {
+			return 0
+		}
+		if escapes != nil && escapes.terminated.Load() {
+			fmt.Printf("Connection to %s closed.\n", conn.address)
+			return exitConnectionFailed
+		}
+		if !conn.dropped() {
+			var exitErr *ssh.ExitError
+			if !errors.As(err, &exitErr) {
+				log.Printf("Shell exited with error: %v", err)
+			}
+			return exitStatus(err)
+		}
+		fmt.Printf("\nConnection to %s lost.\n", conn.address)
+		if !autoReconnect {
+			fmt.Print("Reconnect? (y/n): ")
+			answer, _ := bufio.NewReader(stdin.reader(nil)).ReadString('\n')
+			if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+				fatalConnection("Connection lost")
+			}
+		}
+		if err := conn.reconnect(); err != nil {
+			fatalConnection("Failed to reconnect: %v", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// minRekeyLimit is the smallest threshold x/crypto/ssh honors.
+const minRekeyLimit = 256
+
+// parseRekeyLimit parses a -rekey-limit value in the syntax of OpenSSH's
+// RekeyLimit: an amount of data with an optional K, M or G suffix, or
+// "default" for the cipher's own limit (returned as 0), optionally followed
+// by a time limit.
+//
+// x/crypto/ssh can only rekey on data volume: a client has no way to start a
+// key exchange on its own, so a time limit is refused rather than ignored.
+func parseRekeyLimit(spec string) (uint64, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 0:
+		return 0, errors.New("missing data limit")
+	case 1:
+	default:
+		if len(fields) > 2 || fields[1] != "none" {
+			return 0, fmt.Errorf("time-based rekeying (%s) is not supported; only a data limit can be set", strings.Join(fields[1:], " "))
+		}
+	}
+	if fields[0] == "default" {
+		return 0, nil
+	}
+
+	n, err := parseSize(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid data limit %q", fields[0])
+	}
+	if n < minRekeyLimit {
+		return 0, fmt.Errorf("data limit %s is below the minimum of %d bytes", fields[0], minRekeyLimit)
+	}
+	return n, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// scanAlgorithms lists the host key algorithms scan offers, one handshake per
+// entry, so that every key type the server has is returned.
+var scanAlgorithms = [][]string{
+	{ssh.KeyAlgoED25519},
+	{ssh.KeyAlgoECDSA256},
+	{ssh.KeyAlgoECDSA384},
+	{ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+// errScanned aborts a handshake once the host key has been received.
+var errScanned = errors.New("host key received")
+
+// runScan implements `memssh scan`: like ssh-keyscan, it collects the host
+// keys servers offer without authenticating and prints them in OpenSSH
+// known_hosts format or as known_hosts.json, for pre-seeding trust stores.
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	format := fs.String("format", "known_hosts", "Output format: known_hosts, json (known_hosts.json layout) or text (fingerprints)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for each connection")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh scan [flags] HOST[:PORT]...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *format != "known_hosts" && *format != "json" && *format != "text" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var found KnownHosts
+	failed := false
+	for _, host := range fs.Args() {
+		address := hostAddress(host)
+		keys, err := scanHostKeys(address, *timeout)
+		if err != nil {
+			log.Printf("%s: %v", address, err)
+			failed = true
+			continue
+		}
+		for _, key := range keys {
+			switch *format {
+			case "known_hosts":
+				fmt.Println(knownhosts.Line([]string{address}, key))
+			case "text":
+				fmt.Printf("%s %s %s\n", address, key.Type(), ssh.FingerprintSHA256(key))
+			case "json":
+				found.store(address, key.Type(), hostFingerprint(key), false)
+			}
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(found); err != nil {
+			log.Fatalf("Encoding failed: %v", err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// scanHostKeys returns every host key address offers, performing one
+// handshake per entry of scanAlgorithms.
+func scanHostKeys(address string, timeout time.Duration) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, algorithms := range scanAlgorithms {
+		key, err := fetchHostKey(address, algorithms, timeout)
+		if err != nil {
+			if strings.Contains(err.Error(), "no common algorithm") {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("server offered no supported host key")
+	}
+	return keys, nil
+}
+
+// fetchHostKey performs a key exchange restricted to the given host key
+// algorithms and returns the server's key without authenticating.
+func fetchHostKey(address string, algorithms []string, timeout time.Duration) (ssh.PublicKey, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var key ssh.PublicKey
+	config := &ssh.ClientConfig{
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errScanned
+		},
+	}
+	_, _, _, err = ssh.NewClientConn(conn, address, config)
+	if key != nil {
+		return key, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpTransfer copies files with the classic scp protocol, for servers that
+// offer scp but no SFTP subsystem. It runs `scp -t` (to) or `scp -f` (from)
+// on the server and speaks to it over the session: a line per file ("C"),
+// directory ("D") and directory end ("E"), each acknowledged with a zero
+// byte, or 1 or 2 and a message for a warning or an error.
+type scpTransfer struct {
+	client    *ssh.Client
+	host      string // for messages
+	recursive bool   // -r
+	progress  *progress
+	verify    *verifier    // -verify, or nil
+	limit     *tokenBucket // -limit-rate, or nil
+	preserve  bool         // -p; scp carries no owners
+	failed    bool
+}
+
+// scpConn is a running remote scp.
+type scpConn struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+	stderr  bytes.Buffer
+}
+
+// startSCP runs scp on the server with args.
+func (t *scpTransfer) startSCP(args string) (*scpConn, error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	c := &scpConn{session: session}
+	session.Stderr = &c.stderr
+	if c.w, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	c.r = bufio.NewReader(r)
+	if err := session.Start("scp " + args); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// close ends the remote scp and returns its error, if it failed.
+func (c *scpConn) close() error {
+	c.w.Close()
+	err := c.session.Wait()
+	c.session.Close()
+	if err != nil {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return fmt.Errorf("scp: %s", msg)
+		}
+		return fmt.Errorf("scp: %w", err)
+	}
+	return nil
+}
+
+// scpError is an error or warning the other side sent.
+type scpError struct {
+	message string
+	fatal   bool
+}
+
+func (e *scpError) Error() string { return "scp: " + e.message }
+
+// readAck reads the acknowledgement of the last line or file.
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return fmt.Errorf("scp: %s", msg)
+		}
+		return fmt.Errorf("scp: %w", err)
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		line, _ := c.r.ReadString('\n')
+		return &scpError{message: strings.TrimSuffix(line, "\n"), fatal: b == 2}
+	}
+	return fmt.Errorf("scp: unexpected acknowledgement %q", b)
+}
+
+// send writes a protocol line and waits for its acknowledgement.
+func (c *scpConn) send(format string, args ...any) error {
+	if _, err := fmt.Fprintf(c.w, format, args...); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+// fail reports err and marks the transfer failed.
+func (t *scpTransfer) fail(err error) {
+	t.progress.logf("%v", err)
+	t.failed = true
+}
+
+// put uploads sources to target, into it if it is a remote directory, which
+// it must be for several sources.
+func (t *scpTransfer) put(sources []string, target string) {
+	into := len(sources) > 1
+	if !into {
+		// The remote scp decides; asking first only names the files right.
+		into = t.remoteIsDir(target)
+	}
+	args := "-t"
+	if t.recursive {
+		args += " -r"
+	}
+	if t.preserve {
+		args += " -p"
+	}
+	if len(sources) > 1 {
+		args += " -d"
+	}
+	c, err := t.startSCP(args + " -- " + shellQuote(target))
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if err := c.readAck(); err != nil {
+		c.close()
+		t.fail(err)
+		return
+	}
+	for _, source := range sources {
+		remote := target
+		if into {
+			remote = path.Join(target, filepath.Base(source))
+		}
+		info, err := os.Stat(source)
+		switch {
+		case err != nil:
+			t.fail(err)
+			continue
+		case info.IsDir() && !t.recursive:
+			t.fail(fmt.Errorf("%s is a directory (use -r)", source))
+			continue
+		case info.IsDir():
+			err = t.putDir(c, source, remote, info)
+		default:
+			err = t.putFile(c, source, remote, info)
+		}
+		if err != nil {
+			t.fail(err)
+			var scpErr *scpError
+			if !errors.As(err, &scpErr) || scpErr.fatal {
+				break
+			}
+		}
+	}
+	if err := c.close(); err != nil {
+		t.fail(err)
+	}
+}
+
+// remoteIsDir reports whether name is a directory on the server.
+func (t *scpTransfer) remoteIsDir(name string) bool {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+	return session.Run("test -d "+shellQuote(name)) == nil
+}
+
+// putFile sends the regular file local, described by info, as remote.
+func (t *scpTransfer) putFile(c *scpConn, local, remote string, info fs.FileInfo) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := t.sendTimes(c, info); err != nil {
+		return err
+	}
+	if err := c.send("C%04o %d %s\n", info.Mode().Perm(), info.Size(), path.Base(remote)); err != nil {
+		return err
+	}
+	f := t.progress.begin(local, info.Size())
+	src := limitReader(f.reader(in), t.limit)
+	var sum hash.Hash
+	if t.verify != nil {
+		sum = t.verify.hash()
+		src = io.TeeReader(src, sum)
+	}
+	n, err := sendSCPData(c, src, info.Size())
+	if err == nil && n < info.Size() {
+		err = fmt.Errorf("%s shrank while being copied", local)
+	}
+	if err == nil && t.verify != nil {
+		err = t.verify.check(remote, sum.Sum(nil))
+	}
+	if err != nil {
+		t.progress.end(f, false, "")
+		return err
+	}
+	t.progress.end(f, true, fmt.Sprintf("%s -> %s:%s (%s%s)", local, t.host, remote, formatSize(n), t.verify.note()))
+	return nil
+}
+
+// sendSCPData sends size bytes of a file from in and waits for their
+// acknowledgement. The size is announced first, so a file that changes
+// meanwhile is sent as it was announced: cut off, or padded with zeros. It
+// returns how many bytes came from in.
+func sendSCPData(c *scpConn, in io.Reader, size int64) (int64, error) {
+	n, err := io.CopyN(c.w, in, size)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if n < size {
+		if _, err := io.CopyN(c.w, zeroReader{}, size-n); err != nil {
+			return n, err
+		}
+	}
+	if _, err := c.w.Write([]byte{0}); err != nil {
+		return n, err
+	}
+	return n, c.readAck()
+}
+
+// putDir sends the directory local, described by info, as remote. The
+// protocol has no symlinks, so symlinks to files are sent as the files;
+// symlinks to directories are skipped, since following them could loop.
+func (t *scpTransfer) putDir(c *scpConn, local, remote string, info fs.FileInfo) error {
+	if err := t.sendTimes(c, info); err != nil {
+		return err
+	}
+	if err := c.send("D%04o 0 %s\n", info.Mode().Perm(), path.Base(remote)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		t.fail(err)
+	}
+	for _, entry := range entries {
+		source := filepath.Join(local, entry.Name())
+		dest := path.Join(remote, entry.Name())
+		info, err := os.Stat(source)
+		switch {
+		case err != nil:
+			t.fail(err)
+			continue
+		case info.IsDir() && entry.Type()&fs.ModeSymlink != 0:
+			t.progress.logf("Skipping %s, a symlink to a directory", source)
+			continue
+		case info.IsDir():
+			err = t.putDir(c, source, dest, info)
+		case info.Mode().IsRegular():
+			err = t.putFile(c, source, dest, info)
+		default:
+			t.progress.logf("Skipping %s, which is not a regular file", source)
+			continue
+		}
+		if err != nil {
+			var scpErr *scpError
+			if !errors.As(err, &scpErr) || scpErr.fatal {
+				return err
+			}
+			t.fail(err)
+		}
+	}
+	return c.send("E\n")
+}
+
+// sendTimes sends the modification time of the file or directory about to
+// be sent, for -p, as its access time too.
+func (t *scpTransfer) sendTimes(c *scpConn, info fs.FileInfo) error {
+	if !t.preserve {
+		return nil
+	}
+	mtime := info.ModTime().Unix()
+	return c.send("T%d 0 %d 0\n", mtime, mtime)
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// get downloads source to target, or into it if it is a local directory;
+// several means target must be one.
+func (t *scpTransfer) get(source, target string, several bool) {
+	args := "-f"
+	if t.recursive {
+		args += " -r"
+	}
+	if t.preserve {
+		args += " -p"
+	}
+	c, err := t.startSCP(args + " -- " + shellQuote(source))
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if err := t.receive(c, source, target, several); err != nil {
+		t.fail(err)
+	}
+	if err := c.close(); err != nil && !t.failed {
+		t.fail(err)
+	}
+}
+
+// receive reads what the remote scp sends for source and writes it under
+// target.
+func (t *scpTransfer) receive(c *scpConn, source, target string, several bool) error {
+	ack := func() error {
+		_, err := c.w.Write([]byte{0})
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	var dirs, remoteDirs []string // the directories being received into
+	// With -p, the modes and times of dirs, set once they are complete,
+	// and the time sent for the next file or directory.
+	var dirModes []fs.FileMode
+	var dirTimes []time.Time
+	var mtime time.Time
+	for {
+		kind, err := c.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("scp: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch kind {
+		case 1, 2:
+			err := &scpError{message: line, fatal: kind == 2}
+			if err.fatal {
+				return err
+			}
+			t.fail(err)
+			continue
+		case 'T':
+			// Times come with -p only.
+			if mtime, err = parseSCPTimes(line); err != nil {
+				return err
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("scp: unexpected end of directory")
+			}
+			last := len(dirs) - 1
+			if t.preserve {
+				if err := preserveMode(dirs[last], dirModes[last], dirTimes[last]); err != nil {
+					t.fail(err)
+				}
+			}
+			dirs, dirModes, dirTimes = dirs[:last], dirModes[:last], dirTimes[:last]
+			remoteDirs = remoteDirs[:last]
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("scp: unexpected %q", string(kind)+line)
+		}
+
+		mode, size, name, err := parseSCPHeader(line)
+		if err != nil {
+			return err
+		}
+		times := mtime
+		mtime = time.Time{}
+		local, remote := "", source
+		if len(dirs) > 0 {
+			local = filepath.Join(dirs[len(dirs)-1], name)
+			remote = path.Join(remoteDirs[len(remoteDirs)-1], name)
+		} else if local, err = localTarget(target, name, several); err != nil {
+			return err
+		}
+
+		if kind == 'D' {
+			if info, err := os.Stat(local); err != nil || !info.IsDir() {
+				if err := os.Mkdir(local, mode); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, local)
+			dirModes, dirTimes = append(dirModes, mode), append(dirTimes, times)
+			remoteDirs = append(remoteDirs, remote)
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		if err := ack(); err != nil {
+			out.Close()
+			return err
+		}
+		f := t.progress.begin(t.host+":"+remote, size)
+		dst := limitWriter(f.writer(out), t.limit)
+		var sum hash.Hash
+		if t.verify != nil {
+			sum = t.verify.hash()
+			dst = io.MultiWriter(dst, sum)
+		}
+		_, err = io.CopyN(dst, c.r, size)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = c.readAck()
+		}
+		if err == nil {
+			err = ack()
+		}
+		if err != nil {
+			t.progress.end(f, false, "")
+			return err
+		}
+		if t.preserve {
+			if err := preserveMode(local, mode, times); err != nil {
+				t.progress.end(f, false, "")
+				t.fail(err)
+				continue
+			}
+		}
+		// A copy that does not match fails on its own, as the stream
+		// goes on.
+		if t.verify != nil {
+			if err := t.verify.check(remote, sum.Sum(nil)); err != nil {
+				t.progress.end(f, false, "")
+				t.fail(err)
+				continue
+			}
+		}
+		t.progress.end(f, true, fmt.Sprintf("%s:%s -> %s (%s%s)", t.host, remote, local, formatSize(size), t.verify.note()))
+	}
+}
+
+// parseSCPTimes parses the "mtime 0 atime 0" of a T line and returns the
+// modification time.
+func parseSCPTimes(line string) (time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return time.Time{}, fmt.Errorf("scp: malformed line %q", "T"+line)
+	}
+	mtime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("scp: bad time in %q", "T"+line)
+	}
+	return time.Unix(mtime, 0), nil
+}
+
+// parseSCPHeader parses the "mode size name" of a C or D line. Names with
+// a slash or naming . or .. are refused, so a server cannot write outside
+// the target.
+func parseSCPHeader(line string) (fs.FileMode, int64, string, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("scp: malformed line %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("scp: bad mode in %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("scp: bad size in %q", line)
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return 0, 0, "", fmt.Errorf("scp: unsafe file name %q", name)
+	}
+	return fs.FileMode(mode).Perm(), size, name, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestParseSCPHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		mode fs.FileMode
+		size int64
+		name string
+		err  bool
+	}{
+		{"0644 12 notes.txt", 0o644, 12, "notes.txt", false},
+		{"0755 0 bin", 0o755, 0, "bin", false},
+		{"0600 0 empty", 0o600, 0, "empty", false},
+		{"0644 5 name with spaces", 0o644, 5, "name with spaces", false},
+		{"0644 5 .hidden", 0o644, 5, ".hidden", false},
+		{"0644 5 ..twodots", 0o644, 5, "..twodots", false},
+		{"04755 9 setuid", 0o755, 9, "setuid", false},
+		{"0644 12345678901 big", 0o644, 12345678901, "big", false},
+		{"0644 12", 0, 0, "", true},
+		{"0644", 0, 0, "", true},
+		{"", 0, 0, "", true},
+		{"0689 1 f", 0, 0, "", true},
+		{"rw-r--r-- 1 f", 0, 0, "", true},
+		{"0644 -1 f", 0, 0, "", true},
+		{"0644 1k f", 0, 0, "", true},
+		{"0644 1 ", 0, 0, "", true},
+		{"0644 1 .", 0, 0, "", true},
+		{"0644 1 ..", 0, 0, "", true},
+		{"0644 1 ../passwd", 0, 0, "", true},
+		{"0644 1 /etc/passwd", 0, 0, "", true},
+		{"0644 1 dir/f", 0, 0, "", true},
+		{`0644 1 dir\f`, 0, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			mode, size, name, err := parseSCPHeader(tt.line)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if mode != tt.mode || size != tt.size || name != tt.name {
+				t.Errorf("got %v %d %q, want %v %d %q", mode, size, name, tt.mode, tt.size, tt.name)
+			}
+		})
+	}
+}
+
+func TestParseSCPTimes(t *testing.T) {
+	tests := []struct {
+		line string
+		want time.Time
+		err  bool
+	}{
+		{"1700000000 0 1700000100 0", time.Unix(1700000000, 0), false},
+		{"0 0 0 0", time.Unix(0, 0), false},
+		{"1700000000 123456 1700000100 0", time.Unix(1700000000, 0), false},
+		{"1700000000  0 1700000100 0", time.Unix(1700000000, 0), false},
+		{"1700000000 0 1700000100", time.Time{}, true},
+		{"1700000000 0 1700000100 0 0", time.Time{}, true},
+		{"", time.Time{}, true},
+		{"yesterday 0 1700000100 0", time.Time{}, true},
+		{"1.5 0 1700000100 0", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := parseSCPTimes(tt.line)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// runScriptTemplate saves the script read from stdin to a temporary file on
+// the server, runs it with the interpreter and arguments filled in for %s,
+// and removes it again, keeping the script's exit status. A file rather than
+// a pipe leaves the interpreter free to read the whole script first, as
+// Python does, and works the same for every interpreter.
+const runScriptTemplate = `f=$(mktemp) || exit 1
+trap 'rm -f "$f"' EXIT
+cat > "$f" || exit 1
+%s "$f"%s`
+
+// readScript reads the script for -script from path, or from stdin for "-".
+func readScript(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// scriptInterpreter returns the command line running script: interpreter if
+// given, otherwise the one named by the script's #! line, or sh.
+func scriptInterpreter(script []byte, interpreter string) string {
+	if interpreter != "" {
+		return interpreter
+	}
+	line, _, _ := bytes.Cut(script, []byte("\n"))
+	if shebang, ok := bytes.CutPrefix(line, []byte("#!")); ok {
+		if shebang = bytes.TrimSpace(shebang); len(shebang) > 0 {
+			return string(shebang)
+		}
+	}
+	return "sh"
+}
+
+// shellQuote quotes s as a single word for a POSIX shell. Words made only of
+// characters no shell treats specially are left as they are.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellSafeChars need no quoting in a shell word.
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+.,:/@%"
+
+// shellJoin builds a command line running args as separate words, for the
+// remote command given after the destination.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// runScript implements -script: it copies script, read from path, to the
+// server, runs it there with args and returns its exit status (see
+// exitStatus). The script gets no stdin of its own, since stdin carries the
+// script, as with `ssh host sh -s < script`.
+func runScript(client *ssh.Client, path string, script []byte, interpreter string, args []string, setup sessionSetup) int {
+	var quoted strings.Builder
+	for _, arg := range args {
+		quoted.WriteString(" " + shellQuote(arg))
+	}
+	command := fmt.Sprintf(runScriptTemplate, scriptInterpreter(script, interpreter), quoted.String())
+
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+
+	session.Stdin = bytes.NewReader(script)
+	session.Stdout = setup.commandOutput(os.Stdout)
+	session.Stderr = setup.commandOutput(os.Stderr)
+
+	fmt.Printf("Running script: %s\n", path)
+	stopSignals := forwardSignals(session, nil, nil)
+	err = setup.run(session, command)
+	stopSignals()
+	return commandStatus(err)
+}
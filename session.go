@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// exitConnectionFailed is memssh's exit status when it cannot connect or the
+// connection fails, as with OpenSSH, so scripts can tell it apart from the
+// remote command's own failures.
+const exitConnectionFailed = 255
+
+// exitTimedOut is the exit status when a command outlives -cmd-timeout, as
+// with timeout(1).
+const exitTimedOut = 124
+
+// commandTimeoutGrace is how long a command that timed out has to exit after
+// SIGTERM before its session is closed.
+const commandTimeoutGrace = 2 * time.Second
+
+// commandTimeoutError reports a command ended for outliving -cmd-timeout.
+type commandTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.timeout)
+}
+
+// fatalConnection logs like log.Fatalf, but exits with exitConnectionFailed.
+func fatalConnection(format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(exitConnectionFailed)
+}
+
+// exitStatus returns the exit status memssh passes on for a session that
+// ended with err: the remote command's, or exitConnectionFailed if the
+// server reported none. A command killed by a signal yields 128 plus the
+// signal number, as in a shell, and one that timed out exitTimedOut.
+func exitStatus(err error) int {
+	var exitErr *ssh.ExitError
+	var timeoutErr *commandTimeoutError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus()
+	case errors.As(err, &timeoutErr):
+		return exitTimedOut
+	}
+	return exitConnectionFailed
+}
+
+// sessionSetup is what a new session is prepared with before its shell or
+// command starts.
+type sessionSetup struct {
+	agentForward bool
+	env          []envVar
+	forcePTY     bool          // -t: a PTY for -cmd too
+	disablePTY   bool          // -T: no PTY for the shell
+	log          *sessionLog   // -log-session, or nil
+	record       *castRecorder // -record, or nil
+	sudo         *sudoPassword // -sudo-password-*, or nil
+	prefix       *linePrefix   // -prefix-time and -prefix-host, or nil
+	timeout      time.Duration // -cmd-timeout, or 0
+	// attach, if set, is given each session once prepared, for escape
+	// sequences that act on it.
+	attach func(*ssh.Session)
+}
+
+// output returns where a session's output to w goes: w, and the session log
+// with -log-session and the cast with -record.
+func (s sessionSetup) output(w io.Writer) io.Writer {
+	if s.log != nil {
+		w = s.log.wrapOutput(w)
+	}
+	if s.record != nil {
+		w = s.record.wrapOutput(w)
+	}
+	return w
+}
+
+// commandOutput returns where a command's output to w goes: as for output,
+// with each line prefixed for -prefix-time and -prefix-host.
+func (s sessionSetup) commandOutput(w io.Writer) io.Writer {
+	w = s.output(w)
+	if s.prefix != nil {
+		w = s.prefix.wrap(w)
+	}
+	return w
+}
+
+// run runs cmd on session like session.Run. With -cmd-timeout, a command
+// still running after the timeout is sent SIGTERM and, if it has not exited
+// within commandTimeoutGrace, its session is closed; run then returns a
+// commandTimeoutError.
+func (s sessionSetup) run(session *ssh.Session, cmd string) error {
+	if s.timeout <= 0 {
+		return session.Run(cmd)
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	session.Signal(ssh.SIGTERM)
+	timer.Reset(commandTimeoutGrace)
+	select {
+	case <-done:
+	case <-timer.C:
+		session.Close()
+	}
+	return &commandTimeoutError{s.timeout}
+}
+
+// resized records a change of the terminal size with -record.
+func (s sessionSetup) resized(width, height int) {
+	if s.record != nil {
+		s.record.resize(width, height)
+	}
+}
+
+// input returns what a session reads from r: r, recorded with
+// -log-session-input.
+func (s sessionSetup) input(r io.Reader) io.Reader {
+	if s.log == nil {
+		return r
+	}
+	return s.log.wrapInput(r)
+}
+
+// envVar is an environment variable passed to remote sessions. explicit
+// marks -setenv values, whose refusal by the server is worth a warning.
+type envVar struct {
+	name, value string
+	explicit    bool
+}
+
+// prepare requests agent forwarding and the environment variables for
+// session. Servers only set variables their AcceptEnv allows; like OpenSSH,
+// memssh passes over refused -sendenv variables silently.
+func (s sessionSetup) prepare(session *ssh.Session) {
+	if s.attach != nil {
+		s.attach(session)
+	}
+	if s.agentForward {
+		requestAgentForwarding(session)
+	}
+	for _, v := range s.env {
+		if err := session.Setenv(v.name, v.value); err != nil && v.explicit {
+			log.Printf("Warning: the server refused to set %s; it must be allowed by AcceptEnv in its sshd_config", v.name)
+		}
+	}
+}
+
+// sessionEnv collects the variables for remote sessions: local variables
+// whose names match a -sendenv pattern (with * and ? wildcards), then the
+// -setenv assignments, which win over a variable of the same name.
+func sessionEnv(setenv, sendenv []string) ([]envVar, error) {
+	for _, pattern := range sendenv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -sendenv pattern %q", pattern)
+		}
+	}
+	var vars []envVar
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		matches := name != "" && slices.ContainsFunc(sendenv, func(pattern string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		})
+		if matches {
+			vars = append(vars, envVar{name: name, value: value})
+		}
+	}
+	for _, assignment := range setenv {
+		name, value, ok := strings.Cut(assignment, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -setenv %q: want NAME=value", assignment)
+		}
+		vars = slices.DeleteFunc(vars, func(v envVar) bool { return v.name == name })
+		vars = append(vars, envVar{name: name, value: value, explicit: true})
+	}
+	return vars, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionLogTimeFormat is the timestamp %t expands to in -log-session paths.
+const sessionLogTimeFormat = "20060102-150405"
+
+// passwordPromptPattern matches the end of an output line asking for a
+// secret, after which the input typed up to the next newline is redacted.
+var passwordPromptPattern = regexp.MustCompile(`(?i)(password|passphrase|passcode|pin)[^\n]*:\s*$`)
+
+// maxPromptTail bounds the output kept to recognize a password prompt.
+const maxPromptTail = 256
+
+// sessionLog records a typescript of remote sessions for -log-session: all
+// output, and with -log-session-input the keystrokes sent, to a second file.
+// Input typed after a password prompt is replaced by a marker, since a
+// terminal with echo off shows nothing the typescript would need.
+type sessionLog struct {
+	mu        sync.Mutex
+	output    *os.File
+	input     *os.File // nil without -log-session-input
+	tail      []byte   // output since the last newline
+	redacting bool
+}
+
+// expandSessionLogPath expands %h, %r and %t (the time the session started,
+// as 20060102-150405) and %% in a -log-session path, and ~ for the home
+// directory.
+func expandSessionLogPath(pattern, host, user string, now time.Time) string {
+	replacer := strings.NewReplacer("%%", "%", "%h", host, "%r", user, "%t", now.Format(sessionLogTimeFormat))
+	return expandHome(replacer.Replace(pattern))
+}
+
+// openSessionLog starts logging to outputPath and, unless empty, inputPath.
+// The files are appended to, so several sessions can share one, and each
+// start is marked with a timestamped header naming destination.
+func openSessionLog(outputPath, inputPath, destination string) (*sessionLog, error) {
+	l := &sessionLog{}
+	var err error
+	if l.output, err = openLogFile(outputPath); err != nil {
+		return nil, err
+	}
+	if inputPath != "" {
+		if l.input, err = openLogFile(inputPath); err != nil {
+			l.output.Close()
+			return nil, err
+		}
+	}
+	header := fmt.Sprintf("Script started on %s [%s]\n", time.Now().Format(time.RFC3339), destination)
+	l.output.WriteString(header)
+	if l.input != nil {
+		l.input.WriteString(header)
+	}
+	return l, nil
+}
+
+// openLogFile opens path for appending, readable by the owner only.
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// Close ends the log with a timestamped footer.
+func (l *sessionLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	footer := fmt.Sprintf("\nScript done on %s\n", time.Now().Format(time.RFC3339))
+	l.output.WriteString(footer)
+	l.output.Close()
+	if l.input != nil {
+		l.input.WriteString(footer)
+		l.input.Close()
+	}
+}
+
+// wrapOutput returns a writer passing remote output on to w and into the log.
+func (l *sessionLog) wrapOutput(w io.Writer) io.Writer {
+	return logWriter{l: l, w: w}
+}
+
+// wrapInput returns a reader passing input from r on and, with
+// -log-session-input, into the input log.
+func (l *sessionLog) wrapInput(r io.Reader) io.Reader {
+	if l.input == nil {
+		return r
+	}
+	return logReader{l: l, r: r}
+}
+
+// logOutput records output and remembers its last line for redaction.
+func (l *sessionLog) logOutput(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.output.Write(p)
+	if i := strings.LastIndexAny(string(p), "\r\n"); i >= 0 {
+		l.tail = l.tail[:0]
+		p = p[i+1:]
+	}
+	l.tail = append(l.tail, p...)
+	if len(l.tail) > maxPromptTail {
+		l.tail = l.tail[len(l.tail)-maxPromptTail:]
+	}
+}
+
+// logInput records input, leaving out what answers a password prompt.
+func (l *sessionLog) logInput(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []byte
+	for _, b := range p {
+		newline := b == '\r' || b == '\n'
+		if !l.redacting && !newline && passwordPromptPattern.Match(l.tail) {
+			l.redacting = true
+			out = append(out, "[redacted]"...)
+		}
+		if newline {
+			l.redacting = false
+			l.tail = l.tail[:0]
+		}
+		if !l.redacting {
+			out = append(out, b)
+		}
+	}
+	l.input.Write(out)
+}
+
+type logWriter struct {
+	l *sessionLog
+	w io.Writer
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.l.logOutput(p[:n])
+	return n, err
+}
+
+type logReader struct {
+	l *sessionLog
+	r io.Reader
+}
+
+func (r logReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.logInput(p[:n])
+	return n, err
+}
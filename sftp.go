@@ -0,0 +1,943 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), the version OpenSSH and
+// most other servers speak.
+const sftpVersion = 3
+
+// SFTP packet types.
+const (
+	sftpInit          = 1
+	sftpVersionPacket = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpLstat         = 7
+	sftpFstat         = 8
+	sftpSetstat       = 9
+	sftpFsetstat      = 10
+	sftpOpendir       = 11
+	sftpReaddir       = 12
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRmdir         = 15
+	sftpRealpath      = 16
+	sftpStat          = 17
+	sftpRename        = 18
+	sftpReadlink      = 19
+	sftpSymlink       = 20
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpName          = 104
+	sftpAttrs         = 105
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// SFTP status codes.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpOpUnsupported    = 8
+)
+
+// SFTP open flags.
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// SFTP attribute flags.
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// sftpChunk is the size of each read and write request. 32 KiB is the
+// largest every server must accept.
+const sftpChunk = 32 << 10
+
+// sftpMinReadChunk is as far as WriteTo lowers its reads for a server that
+// caps them. Servers only cap reads a little below sftpChunk, to fit their
+// packets; anything shorter is a short read that says nothing of the cap.
+const sftpMinReadChunk = 16 << 10
+
+// sftpInflight is how many read or write requests a transfer keeps
+// outstanding, so throughput does not suffer from the round trip time.
+const sftpInflight = 64
+
+// maxSFTPPacket bounds the packets accepted from the server.
+const maxSFTPPacket = 256 << 10
+
+// errNoSFTP reports a server that refused the SFTP subsystem.
+var errNoSFTP = errors.New("the server offers no SFTP subsystem")
+
+// errSFTPClosed reports a request on a client whose connection ended.
+var errSFTPClosed = errors.New("sftp: connection closed")
+
+// sftpClient is a client for the SFTP subsystem, over a session of an
+// authenticated connection. Requests may be issued concurrently; each is
+// answered on its own channel, so transfers can keep many in flight.
+type sftpClient struct {
+	session    *ssh.Session
+	w          io.WriteCloser
+	writeMu    sync.Mutex
+	extensions map[string]string
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error // set once the connection ends
+}
+
+// sftpPacket is a response from the server, without its length.
+type sftpPacket struct {
+	typ  byte
+	data []byte // after the request id
+}
+
+// newSFTPClient starts the SFTP subsystem on client.
+func newSFTPClient(client *ssh.Client) (*sftpClient, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, errNoSFTP
+	}
+	c := &sftpClient{session: session, w: w, pending: make(map[uint32]chan sftpPacket)}
+
+	// The version exchange has no request id, so it is done before
+	// responses are dispatched by id.
+	init := binary.BigEndian.AppendUint32(nil, sftpVersion)
+	if err := c.writePacket(sftpInit, init); err != nil {
+		session.Close()
+		return nil, err
+	}
+	typ, data, err := readSFTPPacket(r)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	if typ != sftpVersionPacket || len(data) < 4 {
+		session.Close()
+		return nil, fmt.Errorf("sftp: unexpected packet type %d instead of the version", typ)
+	}
+	c.extensions = make(map[string]string)
+	rd := sftpReader{data[4:], nil}
+	for len(rd.b) > 0 && rd.err == nil {
+		name, value := rd.string(), rd.string()
+		c.extensions[name] = value
+	}
+	go c.receive(r)
+	return c, nil
+}
+
+// Close ends the subsystem.
+func (c *sftpClient) Close() error {
+	c.w.Close()
+	return c.session.Close()
+}
+
+// hasExtension reports whether the server announced extension name, such as
+// "posix-rename@openssh.com", in the given version.
+func (c *sftpClient) hasExtension(name, version string) bool {
+	v, ok := c.extensions[name]
+	return ok && v == version
+}
+
+// readSFTPPacket reads one length-prefixed packet.
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxSFTPPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// writePacket sends one packet of type typ with payload data.
+func (c *sftpClient) writePacket(typ byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = typ
+	packet = append(packet, data...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.w.Write(packet)
+	return err
+}
+
+// receive dispatches responses to the requests waiting for them, until the
+// connection ends.
+func (c *sftpClient) receive(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = fmt.Errorf("short packet of type %d", typ)
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.err = errSFTPClosed
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+// send issues a request and returns the channel its response arrives on. The
+// channel is closed without a response if the connection ends.
+func (c *sftpClient) send(typ byte, body []byte) (<-chan sftpPacket, error) {
+	ch := make(chan sftpPacket, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), id)
+	if err := c.writePacket(typ, append(data, body...)); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// call issues a request and waits for its response.
+func (c *sftpClient) call(typ byte, body []byte) (sftpPacket, error) {
+	ch, err := c.send(typ, body)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return awaitSFTP(ch)
+}
+
+// awaitSFTP waits for the response on ch.
+func awaitSFTP(ch <-chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-ch
+	if !ok {
+		return sftpPacket{}, errSFTPClosed
+	}
+	return p, nil
+}
+
+// sftpStatusError is an error status from the server.
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	return fmt.Sprintf("sftp status %d", e.code)
+}
+
+// Is lets errors.Is match fs.ErrNotExist and fs.ErrPermission.
+func (e *sftpStatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.code == sftpNoSuchFile
+	case fs.ErrPermission:
+		return e.code == sftpPermissionDenied
+	case io.EOF:
+		return e.code == sftpEOF
+	}
+	return false
+}
+
+// statusError returns the error a status response stands for, nil for OK.
+// Any other response is unexpected.
+func statusError(p sftpPacket) error {
+	if p.typ != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d", p.typ)
+	}
+	rd := sftpReader{p.data, nil}
+	code, message := rd.uint32(), rd.string()
+	if rd.err != nil {
+		return rd.err
+	}
+	if code == sftpOK {
+		return nil
+	}
+	return &sftpStatusError{code: code, message: message}
+}
+
+// pathError wraps err with the operation and remote path, as os does.
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// sftpBuilder builds request bodies.
+type sftpBuilder []byte
+
+func (b sftpBuilder) uint32(v uint32) sftpBuilder { return binary.BigEndian.AppendUint32(b, v) }
+func (b sftpBuilder) uint64(v uint64) sftpBuilder { return binary.BigEndian.AppendUint64(b, v) }
+
+func (b sftpBuilder) string(s string) sftpBuilder {
+	return append(b.uint32(uint32(len(s))), s...)
+}
+
+func (b sftpBuilder) bytes(p []byte) sftpBuilder {
+	return append(b.uint32(uint32(len(p))), p...)
+}
+
+func (b sftpBuilder) attrs(a sftpAttributes) sftpBuilder {
+	b = b.uint32(a.flags &^ sftpAttrExtended)
+	if a.flags&sftpAttrSize != 0 {
+		b = b.uint64(a.size)
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		b = b.uint32(a.uid).uint32(a.gid)
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		b = b.uint32(a.mode)
+	}
+	if a.flags&sftpAttrTimes != 0 {
+		b = b.uint32(a.atime).uint32(a.mtime)
+	}
+	return b
+}
+
+// sftpReader decodes response fields, remembering the first error.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+var errSFTPShort = errors.New("sftp: short response")
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errSFTPShort
+		r.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = errSFTPShort
+		r.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if uint32(len(r.b)) < n {
+		r.err = errSFTPShort
+		r.b = nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpReader) string() string { return string(r.bytes()) }
+
+func (r *sftpReader) attrs() sftpAttributes {
+	var a sftpAttributes
+	a.flags = r.uint32()
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		a.uid, a.gid = r.uint32(), r.uint32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		a.mode = r.uint32()
+	}
+	if a.flags&sftpAttrTimes != 0 {
+		a.atime, a.mtime = r.uint32(), r.uint32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+// sftpAttributes are a file's attributes as SFTP sends them. flags says
+// which are present.
+type sftpAttributes struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	mode         uint32 // POSIX mode, file type bits included
+	atime, mtime uint32
+}
+
+// POSIX file type bits in sftpAttributes.mode.
+const (
+	posixTypeMask = 0170000
+	posixDir      = 0040000
+	posixSymlink  = 0120000
+	posixRegular  = 0100000
+	posixFIFO     = 0010000
+	posixSocket   = 0140000
+	posixChar     = 0020000
+	posixBlock    = 0060000
+)
+
+// fileMode converts the POSIX mode to an fs.FileMode.
+func (a sftpAttributes) fileMode() fs.FileMode {
+	mode := fs.FileMode(a.mode & 0777)
+	switch a.mode & posixTypeMask {
+	case posixDir:
+		mode |= fs.ModeDir
+	case posixSymlink:
+		mode |= fs.ModeSymlink
+	case posixFIFO:
+		mode |= fs.ModeNamedPipe
+	case posixSocket:
+		mode |= fs.ModeSocket
+	case posixChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case posixBlock:
+		mode |= fs.ModeDevice
+	}
+	if a.mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if a.mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if a.mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// sftpFileInfo describes a remote file.
+type sftpFileInfo struct {
+	name  string
+	attrs sftpAttributes
+}
+
+func (fi *sftpFileInfo) Name() string       { return fi.name }
+func (fi *sftpFileInfo) Size() int64        { return int64(fi.attrs.size) }
+func (fi *sftpFileInfo) Mode() fs.FileMode  { return fi.attrs.fileMode() }
+func (fi *sftpFileInfo) ModTime() time.Time { return time.Unix(int64(fi.attrs.mtime), 0) }
+func (fi *sftpFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *sftpFileInfo) Sys() any           { return fi.attrs }
+
+// stat returns the attributes of name with op, sftpStat or sftpLstat.
+func (c *sftpClient) stat(op byte, name string) (fs.FileInfo, error) {
+	p, err := c.call(op, sftpBuilder{}.string(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if p.typ != sftpAttrs {
+		return nil, pathError("stat", name, statusError(p))
+	}
+	rd := sftpReader{p.data, nil}
+	attrs := rd.attrs()
+	if rd.err != nil {
+		return nil, pathError("stat", name, rd.err)
+	}
+	return &sftpFileInfo{name: path.Base(name), attrs: attrs}, nil
+}
+
+// Stat returns the attributes of name, following symlinks.
+func (c *sftpClient) Stat(name string) (fs.FileInfo, error) { return c.stat(sftpStat, name) }
+
+// Lstat returns the attributes of name itself.
+func (c *sftpClient) Lstat(name string) (fs.FileInfo, error) { return c.stat(sftpLstat, name) }
+
+// simple issues a request answered by a status.
+func (c *sftpClient) simple(op string, name string, typ byte, body []byte) error {
+	p, err := c.call(typ, body)
+	if err == nil {
+		err = statusError(p)
+	}
+	return pathError(op, name, err)
+}
+
+// Mkdir creates directory name with permissions perm.
+func (c *sftpClient) Mkdir(name string, perm fs.FileMode) error {
+	attrs := sftpAttributes{flags: sftpAttrPermissions, mode: uint32(perm.Perm())}
+	return c.simple("mkdir", name, sftpMkdir, sftpBuilder{}.string(name).attrs(attrs))
+}
+
+// Remove removes file name.
+func (c *sftpClient) Remove(name string) error {
+	return c.simple("remove", name, sftpRemove, sftpBuilder{}.string(name))
+}
+
+// Rmdir removes the empty directory name.
+func (c *sftpClient) Rmdir(name string) error {
+	return c.simple("rmdir", name, sftpRmdir, sftpBuilder{}.string(name))
+}
+
+// Rename renames oldname to newname, replacing newname if the server offers
+// POSIX rename semantics; plain SFTP renames fail if newname exists.
+func (c *sftpClient) Rename(oldname, newname string) error {
+	if c.hasExtension("posix-rename@openssh.com", "1") {
+		body := sftpBuilder{}.string("posix-rename@openssh.com").string(oldname).string(newname)
+		return c.simple("rename", oldname, sftpExtended, body)
+	}
+	return c.simple("rename", oldname, sftpRename, sftpBuilder{}.string(oldname).string(newname))
+}
+
+// Symlink creates newname as a symlink to oldname. OpenSSH's server takes
+// the arguments in the opposite order to the draft, and so does this,
+// since practically every server is OpenSSH's or follows it.
+func (c *sftpClient) Symlink(oldname, newname string) error {
+	return c.simple("symlink", newname, sftpSymlink, sftpBuilder{}.string(oldname).string(newname))
+}
+
+// setstat sets the attributes in attrs on name.
+func (c *sftpClient) setstat(name string, attrs sftpAttributes) error {
+	return c.simple("setstat", name, sftpSetstat, sftpBuilder{}.string(name).attrs(attrs))
+}
+
+// Chmod sets the permissions of name.
+func (c *sftpClient) Chmod(name string, mode fs.FileMode) error {
+	return c.setstat(name, sftpAttributes{flags: sftpAttrPermissions, mode: uint32(mode.Perm())})
+}
+
+// Chown sets the owner and group of name, by their numeric IDs.
+func (c *sftpClient) Chown(name string, uid, gid int) error {
+	return c.setstat(name, sftpAttributes{flags: sftpAttrUIDGID, uid: uint32(uid), gid: uint32(gid)})
+}
+
+// Chtimes sets the access and modification times of name.
+func (c *sftpClient) Chtimes(name string, atime, mtime time.Time) error {
+	return c.setstat(name, sftpAttributes{flags: sftpAttrTimes, atime: uint32(atime.Unix()), mtime: uint32(mtime.Unix())})
+}
+
+// names decodes a NAME response into its file names and attributes.
+func names(p sftpPacket) ([]sftpFileInfo, error) {
+	if p.typ != sftpName {
+		return nil, statusError(p)
+	}
+	rd := sftpReader{p.data, nil}
+	n := rd.uint32()
+	var list []sftpFileInfo
+	for i := uint32(0); i < n && rd.err == nil; i++ {
+		name := rd.string()
+		rd.string() // the long name, as ls -l would print it
+		list = append(list, sftpFileInfo{name: name, attrs: rd.attrs()})
+	}
+	return list, rd.err
+}
+
+// single returns the one name a REALPATH or READLINK response holds.
+func (c *sftpClient) single(op, name string, typ byte) (string, error) {
+	p, err := c.call(typ, sftpBuilder{}.string(name))
+	if err != nil {
+		return "", pathError(op, name, err)
+	}
+	list, err := names(p)
+	if err == nil && len(list) != 1 {
+		err = fmt.Errorf("sftp: %d names instead of one", len(list))
+	}
+	if err != nil {
+		return "", pathError(op, name, err)
+	}
+	return list[0].name, nil
+}
+
+// RealPath returns the absolute, canonical form of name; "." gives the
+// directory relative paths start from, normally the home directory.
+func (c *sftpClient) RealPath(name string) (string, error) {
+	return c.single("realpath", name, sftpRealpath)
+}
+
+// ReadLink returns the target of the symlink name.
+func (c *sftpClient) ReadLink(name string) (string, error) {
+	return c.single("readlink", name, sftpReadlink)
+}
+
+// handle opens name with typ, sftpOpen or sftpOpendir, and returns its
+// handle.
+func (c *sftpClient) handle(op, name string, typ byte, body []byte) (string, error) {
+	p, err := c.call(typ, body)
+	if err != nil {
+		return "", pathError(op, name, err)
+	}
+	if p.typ != sftpHandle {
+		return "", pathError(op, name, statusError(p))
+	}
+	rd := sftpReader{p.data, nil}
+	h := rd.string()
+	return h, pathError(op, name, rd.err)
+}
+
+// closeHandle releases a handle.
+func (c *sftpClient) closeHandle(name, h string) error {
+	return c.simple("close", name, sftpClose, sftpBuilder{}.string(h))
+}
+
+// ReadDir lists directory name, without "." and "..", in the server's
+// order.
+func (c *sftpClient) ReadDir(name string) ([]fs.FileInfo, error) {
+	h, err := c.handle("opendir", name, sftpOpendir, sftpBuilder{}.string(name))
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(name, h)
+	var list []fs.FileInfo
+	for {
+		p, err := c.call(sftpReaddir, sftpBuilder{}.string(h))
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+		entries, err := names(p)
+		if errors.Is(err, io.EOF) {
+			return list, nil
+		}
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+		for _, e := range entries {
+			if e.name != "." && e.name != ".." {
+				list = append(list, &e)
+			}
+		}
+	}
+}
+
+// sftpFile is an open remote file.
+type sftpFile struct {
+	c      *sftpClient
+	name   string
+	handle string
+	offset int64
+}
+
+// OpenFile opens name with flags, a combination of the os.O_* flags, and
+// perm for a file it creates.
+func (c *sftpClient) OpenFile(name string, flags int, perm fs.FileMode) (*sftpFile, error) {
+	var pflags uint32
+	switch flags & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags = sftpFlagRead
+	case os.O_WRONLY:
+		pflags = sftpFlagWrite
+	case os.O_RDWR:
+		pflags = sftpFlagRead | sftpFlagWrite
+	}
+	if flags&os.O_APPEND != 0 {
+		pflags |= sftpFlagAppend
+	}
+	if flags&os.O_CREATE != 0 {
+		pflags |= sftpFlagCreate
+	}
+	if flags&os.O_TRUNC != 0 {
+		pflags |= sftpFlagTrunc
+	}
+	if flags&os.O_EXCL != 0 {
+		pflags |= sftpFlagExcl
+	}
+	attrs := sftpAttributes{flags: sftpAttrPermissions, mode: uint32(perm.Perm())}
+	h, err := c.handle("open", name, sftpOpen, sftpBuilder{}.string(name).uint32(pflags).attrs(attrs))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{c: c, name: name, handle: h}, nil
+}
+
+// Open opens name for reading.
+func (c *sftpClient) Open(name string) (*sftpFile, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates name for writing.
+func (c *sftpClient) Create(name string, perm fs.FileMode) (*sftpFile, error) {
+	return c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// Close releases the file.
+func (f *sftpFile) Close() error {
+	return f.c.closeHandle(f.name, f.handle)
+}
+
+// Stat returns the attributes of the open file.
+func (f *sftpFile) Stat() (fs.FileInfo, error) {
+	p, err := f.c.call(sftpFstat, sftpBuilder{}.string(f.handle))
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+	if p.typ != sftpAttrs {
+		return nil, pathError("stat", f.name, statusError(p))
+	}
+	rd := sftpReader{p.data, nil}
+	attrs := rd.attrs()
+	return &sftpFileInfo{name: path.Base(f.name), attrs: attrs}, pathError("stat", f.name, rd.err)
+}
+
+// Seek sets the offset of the next Read or Write. Only io.SeekStart and
+// io.SeekCurrent are supported.
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	default:
+		return f.offset, fmt.Errorf("sftp: seek whence %d not supported", whence)
+	}
+	if offset < 0 {
+		return f.offset, errors.New("sftp: negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// readRequest asks for up to n bytes at off.
+func (f *sftpFile) readRequest(off int64, n int) (<-chan sftpPacket, error) {
+	return f.c.send(sftpRead, sftpBuilder{}.string(f.handle).uint64(uint64(off)).uint32(uint32(n)))
+}
+
+// readResponse returns the data of a read response, or io.EOF.
+func readResponse(p sftpPacket) ([]byte, error) {
+	if p.typ != sftpData {
+		err := statusError(p)
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		if err == nil {
+			err = errors.New("sftp: read answered without data")
+		}
+		return nil, err
+	}
+	rd := sftpReader{p.data, nil}
+	data := rd.bytes()
+	return data, rd.err
+}
+
+// Read reads up to len(p) bytes.
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	ch, err := f.readRequest(f.offset, min(len(p), sftpChunk))
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	resp, err := awaitSFTP(ch)
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	data, err := readResponse(resp)
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	n := copy(p, data)
+	f.offset += int64(n)
+	return n, nil
+}
+
+// WriteTo copies the file from the current offset to w, keeping
+// sftpInflight reads outstanding. A short read, which servers may give for
+// any request, restarts the requests after it. Two in a row of the same
+// length show that the server caps reads, so later requests ask for no more
+// than that, unless it is below sftpMinReadChunk.
+func (f *sftpFile) WriteTo(w io.Writer) (int64, error) {
+	type request struct {
+		off int64
+		ch  <-chan sftpPacket
+	}
+	var queue []request
+	var written int64
+	next := f.offset
+	chunk := sftpChunk
+	short := 0 // the length of the last read, if it was short
+	drain := func() {
+		for _, r := range queue {
+			awaitSFTP(r.ch)
+		}
+		queue = nil
+	}
+	defer drain()
+	eof := false
+	for !eof || len(queue) > 0 {
+		for !eof && len(queue) < sftpInflight {
+			ch, err := f.readRequest(next, chunk)
+			if err != nil {
+				return written, pathError("read", f.name, err)
+			}
+			queue = append(queue, request{next, ch})
+			next += int64(chunk)
+		}
+		r := queue[0]
+		queue = queue[1:]
+		resp, err := awaitSFTP(r.ch)
+		if err != nil {
+			return written, pathError("read", f.name, err)
+		}
+		data, err := readResponse(resp)
+		if err == io.EOF {
+			eof = true
+			drain()
+			break
+		}
+		if err != nil {
+			return written, pathError("read", f.name, err)
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		f.offset = r.off + int64(n)
+		if err != nil {
+			return written, err
+		}
+		if len(data) == chunk {
+			short = 0
+			continue
+		}
+		drain()
+		next = f.offset
+		if len(data) == short && short >= sftpMinReadChunk {
+			chunk = short
+		}
+		short = len(data)
+	}
+	return written, nil
+}
+
+// Write writes p at the current offset.
+func (f *sftpFile) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), sftpChunk)
+		if err := f.writeAt(p[:n], f.offset); err != nil {
+			return written, err
+		}
+		f.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (f *sftpFile) writeAt(p []byte, off int64) error {
+	resp, err := f.c.call(sftpWrite, sftpBuilder{}.string(f.handle).uint64(uint64(off)).bytes(p))
+	if err == nil {
+		err = statusError(resp)
+	}
+	return pathError("write", f.name, err)
+}
+
+// ReadFrom copies r to the file from the current offset, keeping
+// sftpInflight writes outstanding.
+func (f *sftpFile) ReadFrom(r io.Reader) (int64, error) {
+	var queue []<-chan sftpPacket
+	var firstErr error
+	check := func(ch <-chan sftpPacket) {
+		resp, err := awaitSFTP(ch)
+		if err == nil {
+			err = statusError(resp)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = pathError("write", f.name, err)
+		}
+	}
+	var read int64
+	buf := make([]byte, sftpChunk)
+	for firstErr == nil {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			body := sftpBuilder{}.string(f.handle).uint64(uint64(f.offset)).bytes(buf[:n])
+			ch, serr := f.c.send(sftpWrite, body)
+			if serr != nil {
+				firstErr = pathError("write", f.name, serr)
+				break
+			}
+			queue = append(queue, ch)
+			f.offset += int64(n)
+			read += int64(n)
+			if len(queue) >= sftpInflight {
+				check(queue[0])
+				queue = queue[1:]
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			firstErr = err
+		}
+	}
+	for _, ch := range queue {
+		check(ch)
+	}
+	return read, firstErr
+}
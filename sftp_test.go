@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"sync"
+	"testing"
+)
+
+func TestSFTPAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs sftpAttributes
+	}{
+		{"none", sftpAttributes{}},
+		{"size", sftpAttributes{flags: sftpAttrSize, size: 1 << 40}},
+		{"owner", sftpAttributes{flags: sftpAttrUIDGID, uid: 1000, gid: 100}},
+		{"mode", sftpAttributes{flags: sftpAttrPermissions, mode: posixRegular | 0o644}},
+		{"times", sftpAttributes{flags: sftpAttrTimes, atime: 1700000100, mtime: 1700000000}},
+		{"all", sftpAttributes{
+			flags: sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrTimes,
+			size:  12, uid: 1, gid: 2, mode: posixDir | 0o755, atime: 3, mtime: 4,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := sftpReader{sftpBuilder{}.attrs(tt.attrs), nil}
+			got := rd.attrs()
+			if rd.err != nil || len(rd.b) != 0 {
+				t.Fatalf("err = %v, %d bytes left", rd.err, len(rd.b))
+			}
+			if got != tt.attrs {
+				t.Errorf("got %+v, want %+v", got, tt.attrs)
+			}
+		})
+	}
+}
+
+func TestSFTPAttributesExtended(t *testing.T) {
+	data := sftpBuilder{}.uint32(sftpAttrSize | sftpAttrExtended).uint64(7).
+		uint32(2).string("a@example.com").string("1").string("b@example.com").string("").
+		string("next")
+	rd := sftpReader{data, nil}
+	if got := rd.attrs(); got.size != 7 || got.flags != sftpAttrSize|sftpAttrExtended {
+		t.Errorf("got %+v", got)
+	}
+	if next := rd.string(); rd.err != nil || next != "next" {
+		t.Errorf("after the attributes: %q, %v", next, rd.err)
+	}
+
+	rd = sftpReader{sftpBuilder{}.uint32(sftpAttrTimes).uint32(1), nil}
+	rd.attrs()
+	if rd.err != errSFTPShort {
+		t.Errorf("truncated attributes: err = %v, want %v", rd.err, errSFTPShort)
+	}
+}
+
+func TestSFTPFileMode(t *testing.T) {
+	tests := []struct {
+		mode uint32
+		want fs.FileMode
+	}{
+		{posixRegular | 0o644, 0o644},
+		{posixDir | 0o755, fs.ModeDir | 0o755},
+		{posixSymlink | 0o777, fs.ModeSymlink | 0o777},
+		{posixFIFO | 0o600, fs.ModeNamedPipe | 0o600},
+		{posixSocket | 0o700, fs.ModeSocket | 0o700},
+		{posixChar | 0o666, fs.ModeDevice | fs.ModeCharDevice | 0o666},
+		{posixBlock | 0o660, fs.ModeDevice | 0o660},
+		{posixRegular | 0o4755, fs.ModeSetuid | 0o755},
+		{posixDir | 0o2775, fs.ModeDir | fs.ModeSetgid | 0o775},
+		{posixDir | 0o1777, fs.ModeDir | fs.ModeSticky | 0o777},
+	}
+	for _, tt := range tests {
+		if got := (sftpAttributes{mode: tt.mode}).fileMode(); got != tt.want {
+			t.Errorf("fileMode(%o) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSFTPStatusError(t *testing.T) {
+	status := func(code uint32, message string) sftpPacket {
+		return sftpPacket{typ: sftpStatus, data: sftpBuilder{}.uint32(code).string(message).string("en")}
+	}
+	tests := []struct {
+		name    string
+		packet  sftpPacket
+		message string // "" for no error
+		is      error
+	}{
+		{"ok", status(sftpOK, "Success"), "", nil},
+		{"eof", status(sftpEOF, "End of file"), "End of file", io.EOF},
+		{"missing", status(sftpNoSuchFile, "No such file"), "No such file", fs.ErrNotExist},
+		{"denied", status(sftpPermissionDenied, "Permission denied"), "Permission denied", fs.ErrPermission},
+		{"no message", status(4, ""), "sftp status 4", nil},
+		{"short", sftpPacket{typ: sftpStatus, data: []byte{0, 0}}, errSFTPShort.Error(), errSFTPShort},
+		{"not a status", sftpPacket{typ: sftpData}, "sftp: unexpected packet type 103", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := statusError(tt.packet)
+			if tt.message == "" {
+				if err != nil {
+					t.Fatalf("err = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.message {
+				t.Fatalf("err = %v, want %q", err, tt.message)
+			}
+			for _, target := range []error{io.EOF, fs.ErrNotExist, fs.ErrPermission, errSFTPShort} {
+				if got := errors.Is(err, target); got != (target == tt.is) {
+					t.Errorf("errors.Is(err, %v) = %v", target, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReadSFTPPacket(t *testing.T) {
+	packet := func(length uint32, rest ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, length), rest...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		typ  byte
+		body []byte
+		err  bool
+	}{
+		{"type only", packet(1, sftpStatus), sftpStatus, []byte{}, false},
+		{"body", packet(3, sftpData, 1, 2), sftpData, []byte{1, 2}, false},
+		{"empty", packet(0, sftpData), 0, nil, true},
+		{"too long", packet(maxSFTPPacket+1, sftpData), 0, nil, true},
+		{"truncated body", packet(3, sftpData, 1), 0, nil, true},
+		{"truncated header", []byte{0, 0}, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, body, err := readSFTPPacket(bytes.NewReader(tt.data))
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if typ != tt.typ || !bytes.Equal(body, tt.body) {
+				t.Errorf("got %d %v, want %d %v", typ, body, tt.typ, tt.body)
+			}
+		})
+	}
+}
+
+// testSFTPReads serves the read requests of an sftpClient from data, with
+// reads capped at maxRead bytes if it is positive, and records the sizes
+// asked for.
+type testSFTPReads struct {
+	data    []byte
+	maxRead int
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (s *testSFTPReads) serve(r io.Reader, w io.Writer) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err != nil {
+			return
+		}
+		rd := sftpReader{data, nil}
+		id := rd.uint32()
+		reply := sftpBuilder{}.uint32(id)
+		if typ != sftpRead {
+			reply = reply.uint32(sftpOpUnsupported).string("unsupported").string("")
+			typ = sftpStatus
+		} else {
+			rd.string()
+			off, n := rd.uint64(), int(rd.uint32())
+			s.mu.Lock()
+			s.sizes = append(s.sizes, n)
+			s.mu.Unlock()
+			if s.maxRead > 0 {
+				n = min(n, s.maxRead)
+			}
+			if off >= uint64(len(s.data)) {
+				reply, typ = reply.uint32(sftpEOF).string("").string(""), sftpStatus
+			} else {
+				reply, typ = reply.bytes(s.data[off:min(off+uint64(n), uint64(len(s.data)))]), sftpData
+			}
+		}
+		if err := writeTestSFTPPacket(w, typ, reply); err != nil {
+			return
+		}
+	}
+}
+
+// writeTestSFTPPacket writes a response of type typ, with body starting at
+// the request id.
+func writeTestSFTPPacket(w io.Writer, typ byte, body []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(body)))
+	_, err := w.Write(append(append(packet, typ), body...))
+	return err
+}
+
+// newTestSFTPClient returns an sftpClient whose requests serve answers,
+// reading them from r and writing the responses to w.
+func newTestSFTPClient(t *testing.T, serve func(r io.Reader, w io.Writer)) *sftpClient {
+	requests, requestsW := io.Pipe()
+	responses, responsesW := io.Pipe()
+	c := &sftpClient{w: requestsW, pending: make(map[uint32]chan sftpPacket)}
+	go c.receive(responses)
+	go serve(requests, responsesW)
+	t.Cleanup(func() {
+		requestsW.Close()
+		responsesW.Close()
+	})
+	return c
+}
+
+// openTestSFTPFile returns a file read from s over an sftpClient.
+func openTestSFTPFile(t *testing.T, s *testSFTPReads) *sftpFile {
+	return &sftpFile{c: newTestSFTPClient(t, s.serve), name: "file", handle: "handle"}
+}
+
+func TestSFTPFileWriteTo(t *testing.T) {
+	const capped = sftpChunk - 13 // as a server fitting reads in 32 KiB packets does
+	tests := []struct {
+		name    string
+		size    int
+		offset  int64
+		maxRead int
+	}{
+		{"empty", 0, 0, 0},
+		{"one byte", 1, 0, 0},
+		{"one chunk", sftpChunk, 0, 0},
+		{"large", 3<<20 + 5, 0, 0},
+		{"from offset", 3<<20 + 5, 100_000, 0},
+		{"offset past end", 10, 20, 0},
+		{"capped", 3<<20 + 5, 0, capped},
+		{"capped from offset", 3<<20 + 5, 7, capped},
+		{"capped low", 1<<20 + 5, 0, 10000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(rand.N(256))
+			}
+			s := &testSFTPReads{data: data, maxRead: tt.maxRead}
+			f := openTestSFTPFile(t, s)
+			f.offset = tt.offset
+
+			var out bytes.Buffer
+			n, err := f.WriteTo(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := data[min(tt.offset, int64(len(data))):]
+			if n != int64(len(want)) || !bytes.Equal(out.Bytes(), want) {
+				t.Fatalf("copied %d bytes, want %d, equal %v", n, len(want), bytes.Equal(out.Bytes(), want))
+			}
+			if f.offset != tt.offset+n {
+				t.Errorf("offset = %d, want %d", f.offset, tt.offset+n)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			over := 0
+			for _, size := range s.sizes {
+				if tt.maxRead > 0 && size > tt.maxRead {
+					over++
+				}
+			}
+			switch {
+			case tt.maxRead >= sftpMinReadChunk:
+				// Two short reads of the same length establish the cap;
+				// only the requests in flight until then ask for more.
+				if over > 2*sftpInflight {
+					t.Errorf("%d of %d requests exceeded the cap", over, len(s.sizes))
+				}
+				if last := s.sizes[len(s.sizes)-1]; last != tt.maxRead {
+					t.Errorf("last request asked for %d bytes, want %d", last, tt.maxRead)
+				}
+			case tt.maxRead > 0:
+				// A cap this low is taken for short reads, and the
+				// requests stay at sftpChunk.
+				for _, size := range s.sizes {
+					if size != sftpChunk {
+						t.Fatalf("a request asked for %d bytes, want %d", size, sftpChunk)
+					}
+				}
+			}
+		})
+	}
+}
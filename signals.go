@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardSignals passes the signals memssh receives on to session until the
+// returned function is called, so they reach the remote command instead of
+// ending memssh with the command left running. forwardedSignals are sent as
+// the same remote signal; a second one of a kind closes the session, for
+// servers that ignore signal requests. With a terminal (resized not nil),
+// size changes are passed on too, and on Unix SIGTSTP calls suspend, if not
+// nil, which must restore the terminal before memssh stops.
+func forwardSignals(session *ssh.Session, resized func(width, height int), suspend func()) (stop func()) {
+	var signals []os.Signal
+	for sig := range forwardedSignals {
+		signals = append(signals, sig)
+	}
+	signals = append(signals, terminalSignals(resized != nil, suspend != nil)...)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, signals...)
+
+	done := make(chan struct{})
+	go func() {
+		received := make(map[os.Signal]bool)
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigChan:
+				remote, ok := forwardedSignals[sig]
+				switch {
+				case !ok:
+					handleTerminalSignal(sig, session, resized, suspend)
+				case received[sig]:
+					session.Close()
+				default:
+					received[sig] = true
+					_ = session.Signal(remote)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
@@ -4,26 +4,51 @@ package main
 
 import (
 	"os"
-	"os/signal"
 	"syscall"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
-// handleSignals handles SIGWINCH (resize) and SIGINT on Unix systems.
-func handleSignals(session *ssh.Session) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGWINCH, syscall.SIGINT)
-	for sig := range sigChan {
-		switch sig {
-		case syscall.SIGWINCH:
-			fd := int(syscall.Stdin)
-			if width, height, err := term.GetSize(fd); err == nil {
-				_ = session.WindowChange(height, width)
-			}
-		case syscall.SIGINT:
-			_ = session.Signal(ssh.SIGINT)
+// forwardedSignals are passed on to the remote command by forwardSignals.
+var forwardedSignals = map[os.Signal]ssh.Signal{
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGHUP:  ssh.SIGHUP,
+}
+
+// suspendProcess stops memssh, as ^Z does, and returns once it is
+// continued. It uses SIGSTOP, which cannot be caught, so the SIGTSTP handler
+// of a session does not intercept it.
+func suspendProcess() error {
+	return syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+}
+
+// terminalSignals returns the signals to handle for a session with a
+// terminal: SIGWINCH for size changes and, when memssh suspends itself,
+// SIGTSTP.
+func terminalSignals(resize, suspend bool) []os.Signal {
+	var signals []os.Signal
+	if resize {
+		signals = append(signals, syscall.SIGWINCH)
+	}
+	if suspend {
+		signals = append(signals, syscall.SIGTSTP)
+	}
+	return signals
+}
+
+// handleTerminalSignal passes a new terminal size on to session and resized
+// on SIGWINCH, and suspends memssh on SIGTSTP.
+func handleTerminalSignal(sig os.Signal, session *ssh.Session, resized func(width, height int), suspend func()) {
+	switch sig {
+	case syscall.SIGWINCH:
+		if width, height, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+			_ = session.WindowChange(height, width)
+			resized(width, height)
 		}
+	case syscall.SIGTSTP:
+		suspend()
 	}
 }
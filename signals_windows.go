@@ -3,20 +3,31 @@
 package main
 
 import (
+	"errors"
 	"os"
-	"os/signal"
 	"syscall"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// handleSignals handles SIGINT only on Windows (no SIGWINCH support).
-func handleSignals(session *ssh.Session) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-	for sig := range sigChan {
-		if sig == syscall.SIGINT {
-			_ = session.Signal(ssh.SIGINT)
-		}
-	}
+// forwardedSignals are passed on to the remote command by forwardSignals:
+// Ctrl+C, and closing the console or logging off.
+var forwardedSignals = map[os.Signal]ssh.Signal{
+	os.Interrupt:    ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+}
+
+// suspendProcess is unavailable on Windows, which has no job control.
+func suspendProcess() error {
+	return errors.New("Windows has no job control")
+}
+
+// terminalSignals returns no signals on Windows, which has no SIGWINCH or
+// SIGTSTP.
+func terminalSignals(resize, suspend bool) []os.Signal {
+	return nil
+}
+
+// handleTerminalSignal is never called on Windows.
+func handleTerminalSignal(sig os.Signal, session *ssh.Session, resized func(width, height int), suspend func()) {
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// signerBackend is a source of SSH signers for public key authentication.
+// The PEM backend parses a key held in memory; hardware backends keep the
+// private key on the device and only expose signing operations.
+type signerBackend interface {
+	Signers() ([]ssh.Signer, error)
+	Close() error
+}
+
+// pemBackend holds a signer parsed from an in-memory PEM or OpenSSH private key,
+// along with the private key itself for handing it to an agent.
+type pemBackend struct {
+	key    any
+	signer ssh.Signer
+}
+
+// newPEMBackend loads and parses a private key from a file path, inline PEM,
+// or interactive paste. The raw key bytes are zeroed as soon as they are parsed.
+func newPEMBackend(pathOrInline string, passphrase passphraseSource) (*pemBackend, error) {
+	return parsePEMBackend(getPrivateKey(pathOrInline), passphrase)
+}
+
+// newPEMBackendFromEnv parses a private key stored in an environment variable.
+// The variable is removed from the environment so child processes never see it.
+func newPEMBackendFromEnv(name string, passphrase passphraseSource) (*pemBackend, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("environment variable %s is empty or not set", name)
+	}
+	os.Unsetenv(name)
+	return parsePEMBackend([]byte(value), passphrase)
+}
+
+// newPEMBackendFromProvider fetches a private key from a secret manager and parses it.
+func newPEMBackendFromProvider(uri string, passphrase passphraseSource) (*pemBackend, error) {
+	provider, err := newKeyProvider(uri)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.FetchKey()
+	if err != nil {
+		return nil, err
+	}
+	return parsePEMBackend(key, passphrase)
+}
+
+// parsePEMBackend parses raw key bytes into a backend and zeroes them afterwards.
+func parsePEMBackend(privateKey []byte, passphrase passphraseSource) (*pemBackend, error) {
+	defer zeroBytes(privateKey)
+
+	key, err := parseRawPrivateKey(privateKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pemBackend{key: key, signer: signer}, nil
+}
+
+// Signers returns the parsed key as the only signer.
+func (b *pemBackend) Signers() ([]ssh.Signer, error) {
+	return []ssh.Signer{b.signer}, nil
+}
+
+// Close is a no-op; the parsed key is released with the backend.
+func (b *pemBackend) Close() error {
+	return nil
+}
+
+// publicKeyAuth offers the signers of all backends, in order, through a single
+// publickey method. The SSH library attempts each method type only once, so
+// separate publickey methods would never reach the later backends.
+// Certificates are reported and checked against the certificate policy.
+func publicKeyAuth(backends []signerBackend, certs certPolicy) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, backend := range backends {
+			s, err := backend.Signers()
+			if err != nil {
+				log.Printf("Warning: skipping key source: %v", err)
+				continue
+			}
+			signers = append(signers, s...)
+		}
+		return certs.filter(signers), nil
+	})
+}
+
+// certIssuer obtains a certificate for a public key from an external authority.
+type certIssuer func(pub ssh.PublicKey) (*ssh.Certificate, error)
+
+// certRenewMargin is how long before a certificate expires it is replaced:
+// certBackend has a new one issued rather than offer it, and the daemon logs
+// in again with the new one.
+const certRenewMargin = time.Minute
+
+// certBackend wraps another backend and presents each of its keys together
+// with a certificate issued at connect time.
+type certBackend struct {
+	inner   signerBackend
+	issue   certIssuer
+	signers []ssh.Signer
+	expires time.Time // when the first certificate in signers expires, or zero
+}
+
+// Signers returns certificate signers, requesting certificates on first use
+// and again once one of them is about to expire.
+func (b *certBackend) Signers() ([]ssh.Signer, error) {
+	if b.signers != nil && (b.expires.IsZero() || time.Until(b.expires) > certRenewMargin) {
+		return b.signers, nil
+	}
+	inner, err := b.inner.Signers()
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	var expires time.Time
+	for _, signer := range inner {
+		cert, err := b.issue(signer.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("certificate does not match key: %w", err)
+		}
+		signers = append(signers, certSigner)
+		if t := certExpiry(cert); !t.IsZero() && (expires.IsZero() || t.Before(expires)) {
+			expires = t
+		}
+	}
+	b.signers, b.expires = signers, expires
+	return b.signers, nil
+}
+
+// certExpiry returns when cert stops being valid, or the zero time if it
+// never does.
+func certExpiry(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+	return time.Unix(int64(min(cert.ValidBefore, math.MaxInt64)), 0)
+}
+
+// certExpiries records when the certificates of a connection's keys expire,
+// so the daemon can log in again before they do.
+type certExpiries struct {
+	mu   sync.Mutex
+	keys map[string]time.Time // by the marshaled public key
+}
+
+// track returns an issuer that issues with issue and records the expiry of
+// what it issues.
+func (e *certExpiries) track(issue certIssuer) certIssuer {
+	return func(pub ssh.PublicKey) (*ssh.Certificate, error) {
+		cert, err := issue(pub)
+		if err != nil {
+			return nil, err
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.keys == nil {
+			e.keys = make(map[string]time.Time)
+		}
+		e.keys[string(pub.Marshal())] = certExpiry(cert)
+		return cert, nil
+	}
+}
+
+// next returns when the first of the latest certificates expires, or the
+// zero time if none does or e is nil.
+func (e *certExpiries) next() time.Time {
+	if e == nil {
+		return time.Time{}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var next time.Time
+	for _, t := range e.keys {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// Close closes the wrapped backend.
+func (b *certBackend) Close() error {
+	return b.inner.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertBackendRenews(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		validBefore uint64
+		issued      int // after two logins
+	}{
+		{"valid for long", uint64(time.Now().Add(time.Hour).Unix()), 1},
+		{"never expires", ssh.CertTimeInfinity, 1},
+		{"about to expire", uint64(time.Now().Add(certRenewMargin / 2).Unix()), 2},
+		{"expired", uint64(time.Now().Add(-time.Hour).Unix()), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expiries certExpiries
+			issued := 0
+			issue := expiries.track(func(pub ssh.PublicKey) (*ssh.Certificate, error) {
+				issued++
+				return &ssh.Certificate{Key: pub, Serial: uint64(issued), CertType: ssh.UserCert, ValidBefore: tt.validBefore}, nil
+			})
+			b := &certBackend{inner: &pemBackend{key: key, signer: signer}, issue: issue}
+			for range 2 {
+				signers, err := b.Signers()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert := signers[0].PublicKey().(*ssh.Certificate)
+				if cert.Serial != uint64(issued) {
+					t.Errorf("offered certificate %d, want the latest, %d", cert.Serial, issued)
+				}
+			}
+			if issued != tt.issued {
+				t.Errorf("issued %d certificates, want %d", issued, tt.issued)
+			}
+			want := time.Unix(int64(tt.validBefore), 0)
+			if tt.validBefore == ssh.CertTimeInfinity {
+				want = time.Time{}
+			}
+			if got := expiries.next(); !got.Equal(want) {
+				t.Errorf("next expiry = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses an amount of data in bytes with an optional K, M or G
+// suffix (powers of 1024), as OpenSSH writes sizes.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	number, multiplier := s, uint64(1)
+	switch strings.ToUpper(number[len(number)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats a number of bytes briefly, with the suffixes parseSize
+// takes: 512B, 1.5K, 3.2M.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// openSSHKeyMagic prefixes every openssh-key-v1 private key blob.
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// isSecurityKeyType reports whether a key type is backed by a FIDO2 security key.
+func isSecurityKeyType(keyType string) bool {
+	return strings.HasPrefix(keyType, "sk-")
+}
+
+// securityKeyType returns the key type of an OpenSSH private key file if it
+// holds a FIDO2 (sk-*) key handle, or an empty string otherwise.
+// The public part of the file is never encrypted, so no passphrase is needed.
+func securityKeyType(key []byte) string {
+	block, _ := pem.Decode(key)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return ""
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(openSSHKeyMagic)) {
+		return ""
+	}
+	var header struct {
+		CipherName string
+		KdfName    string
+		KdfOpts    string
+		NumKeys    uint32
+		PubKey     []byte
+		Rest       []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(openSSHKeyMagic):], &header); err != nil {
+		return ""
+	}
+	pub, err := ssh.ParsePublicKey(header.PubKey)
+	if err != nil || !isSecurityKeyType(pub.Type()) {
+		return ""
+	}
+	return pub.Type()
+}
+
+// securityKeySigner wraps a signer whose key lives on a FIDO2 token and tells
+// the user to touch the device before each signature is requested.
+type securityKeySigner struct {
+	ssh.Signer
+}
+
+// Sign prompts for user presence and delegates to the wrapped signer.
+func (s securityKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	pub := s.PublicKey()
+	fmt.Printf("Confirm user presence for key %s %s\n", pub.Type(), ssh.FingerprintSHA256(pub))
+	return s.Signer.Sign(rand, data)
+}
+
+// wrapSecurityKeySigners adds a touch prompt to every signer backed by a security key.
+func wrapSecurityKeySigners(signers []ssh.Signer) []ssh.Signer {
+	for i, signer := range signers {
+		if isSecurityKeyType(signer.PublicKey().Type()) {
+			signers[i] = securityKeySigner{signer}
+		}
+	}
+	return signers
+}
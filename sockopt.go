@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ipQoSValues maps the names OpenSSH's IPQoS accepts to TOS byte values:
+// DSCP classes shifted into the upper six bits, and the old RFC 1349 types.
+var ipQoSValues = map[string]int{
+	"af11": 0x28, "af12": 0x30, "af13": 0x38,
+	"af21": 0x48, "af22": 0x50, "af23": 0x58,
+	"af31": 0x68, "af32": 0x70, "af33": 0x78,
+	"af41": 0x88, "af42": 0x90, "af43": 0x98,
+	"cs0": 0x00, "cs1": 0x20, "cs2": 0x40, "cs3": 0x60,
+	"cs4": 0x80, "cs5": 0xa0, "cs6": 0xc0, "cs7": 0xe0,
+	"ef": 0xb8, "le": 0x04,
+	"lowdelay": 0x10, "throughput": 0x08, "reliability": 0x04,
+}
+
+// parseIPQoS parses an -ip-qos value: a name from ipQoSValues or a TOS byte
+// in decimal or 0x hex.
+func parseIPQoS(spec string) (int, error) {
+	if tos, ok := ipQoSValues[strings.ToLower(spec)]; ok {
+		return tos, nil
+	}
+	tos, err := strconv.ParseUint(spec, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -ip-qos %q: want a DSCP class such as ef or af21, or a TOS value from 0 to 255", spec)
+	}
+	return int(tos), nil
+}
+
+// socketControl returns a net.Dialer Control function that sets the send
+// and receive buffer sizes (left to the system if zero) and the TOS byte
+// (left alone if negative) before the socket connects, so the buffers also
+// size the TCP window negotiated in the handshake.
+func socketControl(sendBuffer, receiveBuffer, tos int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sendBuffer > 0 {
+				if err := setSocketInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, sendBuffer); err != nil {
+					sockErr = fmt.Errorf("setting send buffer size: %w", err)
+					return
+				}
+			}
+			if receiveBuffer > 0 {
+				if err := setSocketInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, receiveBuffer); err != nil {
+					sockErr = fmt.Errorf("setting receive buffer size: %w", err)
+					return
+				}
+			}
+			if tos >= 0 {
+				if err := setTOS(fd, network == "tcp6", tos); err != nil {
+					sockErr = fmt.Errorf("setting IP QoS: %w", err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketInt sets an integer socket option.
+func setSocketInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+// setTOS marks the socket's packets with tos: the TOS byte for IPv4, the
+// traffic class for IPv6.
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
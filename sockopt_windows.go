@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setSocketInt sets an integer socket option.
+func setSocketInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+}
+
+// setTOS is unavailable on Windows, which ignores IP_TOS from applications;
+// packets are marked through Group Policy QoS rules instead.
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	return errors.New("-ip-qos is not supported on Windows; use a QoS policy instead")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// socks5Proxy dials through a SOCKS5 proxy (RFC 1928), optionally with
+// username/password authentication (RFC 1929).
+type socks5Proxy struct {
+	address  string
+	user     string
+	password string
+	dial     dialFunc // reaches the proxy itself
+}
+
+// defaultTorProxy is the SOCKS5 port of a local Tor client.
+const defaultTorProxy = "127.0.0.1:9050"
+
+// isOnionHost reports whether host is a Tor onion service, which only Tor
+// can reach and which must never be looked up in DNS.
+func isOnionHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
+
+// socks5Replies describes the proxy's CONNECT failure codes.
+var socks5Replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// parseSOCKS5Proxy parses a -socks5 value of the form
+// [user[:password]@]host:port. A user given without a password is prompted
+// for one.
+func parseSOCKS5Proxy(spec string) (*socks5Proxy, error) {
+	p := &socks5Proxy{address: spec, dial: net.Dial}
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		p.address = spec[i+1:]
+		var hasPassword bool
+		p.user, p.password, hasPassword = strings.Cut(spec[:i], ":")
+		if !hasPassword {
+			pass, err := readSecret(fmt.Sprintf("SOCKS5 password for %s@%s: ", p.user, p.address))
+			if err != nil {
+				return nil, fmt.Errorf("reading password failed: %w", err)
+			}
+			p.password = string(pass)
+			zeroBytes(pass)
+		}
+		if len(p.user) > 255 || len(p.password) > 255 {
+			return nil, errors.New("user name and password must be at most 255 bytes")
+		}
+	}
+	if _, _, err := net.SplitHostPort(p.address); err != nil {
+		return nil, fmt.Errorf("proxy address %q must be host:port", p.address)
+	}
+	return p, nil
+}
+
+// Dial connects to address through the proxy. Host names are passed to the
+// proxy unresolved, so it does the DNS lookup (needed for Tor).
+func (p *socks5Proxy) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("SOCKS5 proxy: unsupported network %s", network)
+	}
+	conn, err := p.dial("tcp", p.address)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy: %w", err)
+	}
+	if err := p.handshake(conn, address); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", p.address, err)
+	}
+	return conn, nil
+}
+
+// handshake authenticates to the proxy and asks it to connect to address.
+func (p *socks5Proxy) handshake(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(0x00) // no authentication
+	if p.user != "" {
+		method = 0x02 // username/password
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		if p.user == "" {
+			return errors.New("proxy requires authentication")
+		}
+		return errors.New("proxy does not accept username/password authentication")
+	}
+	if method == 0x02 {
+		auth := []byte{1, byte(len(p.user))}
+		auth = append(auth, p.user...)
+		auth = append(auth, byte(len(p.password)))
+		auth = append(auth, p.password...)
+		_, err := conn.Write(auth)
+		zeroBytes(auth)
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy authentication failed")
+		}
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply echoes the address the proxy bound, which is not needed.
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return fmt.Errorf("connecting to %s: %s", address, msg)
+		}
+		return fmt.Errorf("connecting to %s: error %d", address, head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", head[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
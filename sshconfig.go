@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sshConfigHost holds the settings an OpenSSH client config gives one
+// destination. Zero values mean the config does not set them.
+type sshConfigHost struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+
+	CanonicalizeHostname      string // yes, no or always
+	CanonicalDomains          []string
+	CanonicalizeMaxDots       int // -1 if not set
+	CanonicalizeFallbackLocal string
+}
+
+// maxSSHConfigDepth limits nested Include directives, like OpenSSH.
+const maxSSHConfigDepth = 16
+
+// defaultSSHConfigPath returns ~/.ssh/config.
+func defaultSSHConfigPath() string {
+	return filepath.Join(filepath.Dir(getKnownHostsPath()), "config")
+}
+
+// lookupSSHConfig evaluates the OpenSSH client config at path for a
+// connection to host as user (empty if not known yet). As in OpenSSH, the
+// first value found for a setting wins, except IdentityFile, which
+// accumulates. A missing file yields no settings.
+func lookupSSHConfig(path, host, user string) (sshConfigHost, error) {
+	s := &sshConfigState{host: host, user: user}
+	s.config.CanonicalizeMaxDots = -1
+	return s.evaluate(path)
+}
+
+// lookupCanonicalSSHConfig evaluates the config again once host has been
+// canonicalized, like OpenSSH does: settings from the first pass are kept,
+// the rest are filled in from blocks matching the canonical name, and
+// "Match canonical" blocks now apply.
+func lookupCanonicalSSHConfig(path, host, user string, first sshConfigHost) (sshConfigHost, error) {
+	s := &sshConfigState{host: host, user: user, canonical: true, config: first}
+	return s.evaluate(path)
+}
+
+// evaluate applies the config at path to the state's destination.
+func (s *sshConfigState) evaluate(path string) (sshConfigHost, error) {
+	if err := s.parseFile(path, true, 0); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return sshConfigHost{}, nil
+		}
+		return sshConfigHost{}, err
+	}
+	return s.config, nil
+}
+
+// sshConfigState is the evaluation of a config for one destination.
+type sshConfigState struct {
+	host      string // as given on the command line, or canonicalized
+	user      string
+	canonical bool // second pass, after canonicalization
+	config    sshConfigHost
+}
+
+// parseFile applies the lines of one config file. active says whether the
+// enclosing Host or Match block applies, for files read by Include.
+func (s *sshConfigState) parseFile(path string, active bool, depth int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			active = matchHostList(strings.Join(args, ","), s.host)
+		case "match":
+			if active, err = s.match(args); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			if depth >= maxSSHConfigDepth {
+				return fmt.Errorf("%s:%d: Include nested too deeply", path, line)
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(defaultSSHConfigPath()), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %w", path, line, err)
+				}
+				for _, included := range matches {
+					if err := s.parseFile(included, true, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if active && len(args) > 0 {
+				if err := s.set(keyword, args); err != nil {
+					return fmt.Errorf("%s:%d: %w", path, line, err)
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// set records a setting unless an earlier line already did. Keywords memssh
+// does not use are ignored.
+func (s *sshConfigState) set(keyword string, args []string) error {
+	c := &s.config
+	switch keyword {
+	case "hostname":
+		if c.HostName == "" {
+			c.HostName = strings.ReplaceAll(strings.ReplaceAll(args[0], "%h", s.host), "%%", "%")
+		}
+	case "user":
+		if c.User == "" {
+			c.User = args[0]
+		}
+	case "port":
+		if c.Port == 0 {
+			port, err := strconv.Atoi(args[0])
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid Port %q", args[0])
+			}
+			c.Port = port
+		}
+	case "identityfile":
+		if !slices.Contains(c.IdentityFiles, args[0]) {
+			c.IdentityFiles = append(c.IdentityFiles, args[0])
+		}
+	case "proxyjump":
+		if c.ProxyJump == "" {
+			c.ProxyJump = args[0]
+		}
+	case "canonicalizehostname":
+		if c.CanonicalizeHostname == "" {
+			value := strings.ToLower(args[0])
+			if value != "yes" && value != "no" && value != "always" {
+				return fmt.Errorf("invalid CanonicalizeHostname %q", args[0])
+			}
+			c.CanonicalizeHostname = value
+		}
+	case "canonicaldomains":
+		if c.CanonicalDomains == nil {
+			c.CanonicalDomains = args
+		}
+	case "canonicalizemaxdots":
+		if c.CanonicalizeMaxDots < 0 {
+			dots, err := strconv.Atoi(args[0])
+			if err != nil || dots < 0 {
+				return fmt.Errorf("invalid CanonicalizeMaxDots %q", args[0])
+			}
+			c.CanonicalizeMaxDots = dots
+		}
+	case "canonicalizefallbacklocal":
+		if c.CanonicalizeFallbackLocal == "" {
+			c.CanonicalizeFallbackLocal = strings.ToLower(args[0])
+		}
+	}
+	return nil
+}
+
+// match evaluates the criteria of a Match line. "canonical" matches in the
+// pass after canonicalization. A line with criteria that need features memssh
+// lacks (exec, localnetwork, tagged) never matches, even if they are negated.
+func (s *sshConfigState) match(args []string) (bool, error) {
+	result, unsupported := true, false
+	for i := 0; i < len(args); i++ {
+		criterion, negated := strings.ToLower(args[i]), false
+		if rest, ok := strings.CutPrefix(criterion, "!"); ok {
+			criterion, negated = rest, true
+		}
+		var matched bool
+		switch criterion {
+		case "all", "final":
+			matched = true
+		case "canonical":
+			matched = s.canonical
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("Match %s needs an argument", criterion)
+			}
+			i++
+			patterns := args[i]
+			switch criterion {
+			case "host":
+				matched = matchHostList(patterns, s.hostName())
+			case "originalhost":
+				matched = matchHostList(patterns, s.host)
+			case "user":
+				matched = matchHostList(patterns, s.remoteUser())
+			case "localuser":
+				matched = matchHostList(patterns, localUserName())
+			default:
+				unsupported = true
+			}
+		default:
+			return false, fmt.Errorf("unsupported Match criterion %q", args[i])
+		}
+		if matched == negated {
+			result = false
+		}
+	}
+	return result && !unsupported, nil
+}
+
+// hostName returns the host name connected to so far: HostName if set.
+func (s *sshConfigState) hostName() string {
+	if s.config.HostName != "" {
+		return s.config.HostName
+	}
+	return s.host
+}
+
+// remoteUser returns the user logged in as so far, defaulting to the local user.
+func (s *sshConfigState) remoteUser() string {
+	switch {
+	case s.user != "":
+		return s.user
+	case s.config.User != "":
+		return s.config.User
+	}
+	return localUserName()
+}
+
+// identityFiles expands the IdentityFile settings (~ and the %d, %u, %h,
+// %r, %p and %% tokens) for a connection as user to port, leaving out files
+// that do not exist, as OpenSSH does.
+func (c sshConfigHost) identityFiles(host, user string, port int) []string {
+	home, _ := os.UserHomeDir()
+	replacer := strings.NewReplacer("%%", "%", "%d", home, "%u", localUserName(), "%h", host, "%r", user, "%p", strconv.Itoa(port))
+	var files []string
+	for _, file := range c.IdentityFiles {
+		file = expandHome(replacer.Replace(file))
+		if _, err := os.Stat(file); err != nil {
+			log.Printf("Warning: IdentityFile %s from ssh config: %v", file, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// localUserName returns the name of the user running memssh.
+func localUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// splitSSHConfigLine splits a config line into its lower-cased keyword and
+// arguments. Keyword and arguments are separated by whitespace or "=", and
+// arguments may be double-quoted. Blank lines and comments yield no keyword.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if after, ok := strings.CutPrefix(rest, "="); ok {
+		rest = strings.TrimLeft(after, " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+			arg, after, ok := strings.Cut(quoted, `"`)
+			if !ok {
+				return "", nil, errors.New("unterminated quote")
+			}
+			args = append(args, arg)
+			rest = strings.TrimLeft(after, " \t")
+			continue
+		}
+		if strings.HasPrefix(rest, "#") {
+			break
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	return keyword, args, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+		err     bool
+	}{
+		{"", "", nil, false},
+		{"   ", "", nil, false},
+		{"# Host example", "", nil, false},
+		{"  # indented comment", "", nil, false},
+		{"HostName example.com", "hostname", []string{"example.com"}, false},
+		{"\tUser\talice  ", "user", []string{"alice"}, false},
+		{"Port=2222", "port", []string{"2222"}, false},
+		{"Port = 2222", "port", []string{"2222"}, false},
+		{"Port =2222", "port", []string{"2222"}, false},
+		{"Host a b  c", "host", []string{"a", "b", "c"}, false},
+		{"Host a # the a host", "host", []string{"a"}, false},
+		{"Host a#b", "host", []string{"a#b"}, false},
+		{`IdentityFile "~/My Keys/id_ed25519"`, "identityfile", []string{"~/My Keys/id_ed25519"}, false},
+		{`Match exec "test -f x" host a`, "match", []string{"exec", "test -f x", "host", "a"}, false},
+		{`User ""`, "user", []string{""}, false},
+		{"Compression", "compression", nil, false},
+		{`IdentityFile "unterminated`, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			keyword, args, err := splitSSHConfigLine(tt.line)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if keyword != tt.keyword || !slices.Equal(args, tt.args) {
+				t.Errorf("got %q %q, want %q %q", keyword, args, tt.keyword, tt.args)
+			}
+		})
+	}
+}
+
+func TestSSHConfigMatch(t *testing.T) {
+	local := localUserName()
+	tests := []struct {
+		name  string
+		state sshConfigState
+		args  []string
+		want  bool
+		err   bool
+	}{
+		{"all", sshConfigState{host: "a"}, []string{"all"}, true, false},
+		{"host", sshConfigState{host: "web1"}, []string{"host", "web*"}, true, false},
+		{"host list", sshConfigState{host: "db"}, []string{"host", "web*,db"}, true, false},
+		{"host negated pattern", sshConfigState{host: "web1"}, []string{"host", "web*,!web1"}, false, false},
+		{"host other", sshConfigState{host: "db"}, []string{"host", "web*"}, false, false},
+		{"host after HostName", sshConfigState{host: "a", config: sshConfigHost{HostName: "a.example.com"}}, []string{"host", "*.example.com"}, true, false},
+		{"originalhost", sshConfigState{host: "a", config: sshConfigHost{HostName: "a.example.com"}}, []string{"originalhost", "a"}, true, false},
+		{"user given", sshConfigState{host: "a", user: "root"}, []string{"user", "root"}, true, false},
+		{"user from config", sshConfigState{host: "a", config: sshConfigHost{User: "git"}}, []string{"user", "git"}, true, false},
+		{"user defaults to local", sshConfigState{host: "a"}, []string{"user", local}, true, false},
+		{"localuser", sshConfigState{host: "a"}, []string{"localuser", local}, true, false},
+		{"negated", sshConfigState{host: "a"}, []string{"!host", "a"}, false, false},
+		{"negated other", sshConfigState{host: "a"}, []string{"!host", "b"}, true, false},
+		{"all criteria must match", sshConfigState{host: "a", user: "root"}, []string{"host", "a", "user", "git"}, false, false},
+		{"criteria are case-insensitive", sshConfigState{host: "a"}, []string{"HOST", "a"}, true, false},
+		{"canonical first pass", sshConfigState{host: "a"}, []string{"canonical"}, false, false},
+		{"canonical second pass", sshConfigState{host: "a", canonical: true}, []string{"canonical"}, true, false},
+		{"final", sshConfigState{host: "a"}, []string{"final", "host", "a"}, true, false},
+		{"exec", sshConfigState{host: "a"}, []string{"exec", "true"}, false, false},
+		{"exec negated", sshConfigState{host: "a"}, []string{"!exec", "false"}, false, false},
+		{"localnetwork negated", sshConfigState{host: "a"}, []string{"host", "a", "!localnetwork", "10.0.0.0/8"}, false, false},
+		{"tagged negated", sshConfigState{host: "a"}, []string{"!tagged", "x"}, false, false},
+		{"missing argument", sshConfigState{host: "a"}, []string{"host"}, false, true},
+		{"unknown criterion", sshConfigState{host: "a"}, []string{"address", "10.0.0.1"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.state.match(tt.args)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHConfigMatchBlocks(t *testing.T) {
+	config := `
+Match host web* !exec "false"
+	User never
+
+Match originalhost web1
+	HostName web1.example.com
+
+Match host *.example.com user alice
+	Port 2200
+
+Match host *.example.com
+	Port 2201
+	User deploy
+
+Host *
+	User fallback
+`
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, user string
+		want       sshConfigHost
+	}{
+		{"web1", "", sshConfigHost{HostName: "web1.example.com", Port: 2201, User: "deploy"}},
+		{"web1", "alice", sshConfigHost{HostName: "web1.example.com", Port: 2200, User: "deploy"}},
+		{"db", "", sshConfigHost{User: "fallback"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.user, func(t *testing.T) {
+			s := &sshConfigState{host: tt.host, user: tt.user}
+			got, err := s.evaluate(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.HostName != tt.want.HostName || got.Port != tt.want.Port || got.User != tt.want.User {
+				t.Errorf("got HostName %q Port %d User %q, want %q %d %q",
+					got.HostName, got.Port, got.User, tt.want.HostName, tt.want.Port, tt.want.User)
+			}
+		})
+	}
+}
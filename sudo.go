@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultSudoPrompt matches the password prompts of sudo, as configured by
+// most distributions, and of su.
+const defaultSudoPrompt = `(?i)(\[sudo\] password for [^:]*|^password( for [^:]*)?):\s*$`
+
+// sudoPassword answers the password prompts of sudo in commands run with
+// -cmd, from a file, an environment variable or a command, so scripts need
+// not wrap memssh in expect. sudo reads the password from a terminal, so the
+// command gets a PTY.
+type sudoPassword struct {
+	file   string
+	env    string
+	cmd    string
+	prompt *regexp.Regexp
+}
+
+// newSudoPassword builds a source from the -sudo-password-* flags. It returns
+// nil when no source is configured.
+func newSudoPassword(file, env, cmd, prompt string) (*sudoPassword, error) {
+	set := 0
+	for _, v := range []string{file, env, cmd} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, errors.New("only one of -sudo-password-file, -sudo-password-env and -sudo-password-cmd may be used")
+	}
+	if prompt == "" {
+		prompt = defaultSudoPrompt
+	}
+	re, err := regexp.Compile(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -sudo-prompt: %w", err)
+	}
+	return &sudoPassword{file: file, env: env, cmd: cmd, prompt: re}, nil
+}
+
+// read returns the password from the configured source.
+func (s *sudoPassword) read() ([]byte, error) {
+	switch {
+	case s.file != "":
+		data, err := os.ReadFile(expandHome(s.file))
+		if err != nil {
+			return nil, fmt.Errorf("reading sudo password file failed: %w", err)
+		}
+		return trimNewline(data), nil
+	case s.env != "":
+		value, ok := os.LookupEnv(s.env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", s.env)
+		}
+		return []byte(value), nil
+	}
+	var stderr bytes.Buffer
+	c := shellCommand(s.cmd)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		zeroBytes(out)
+		return nil, fmt.Errorf("sudo password command failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return trimNewline(out), nil
+}
+
+// responder returns a writer watching a command's output for the password
+// prompt and answering it on stdin. The password is read when first asked
+// for; a prompt repeated after it was sent means it was wrong, and is left to
+// the user, or calls giveUp, if set, when there is no user to answer it.
+func (s *sudoPassword) responder(stdin io.Writer) *sudoResponder {
+	return &sudoResponder{sudo: s, stdin: stdin}
+}
+
+type sudoResponder struct {
+	sudo     *sudoPassword
+	stdin    io.Writer
+	giveUp   func()
+	mu       sync.Mutex
+	tail     []byte // output since the last newline
+	password []byte
+	answered bool
+	rejected bool
+}
+
+func (r *sudoResponder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rejected {
+		return len(p), nil
+	}
+	data := p
+	if i := strings.LastIndexAny(string(data), "\r\n"); i >= 0 {
+		r.tail = r.tail[:0]
+		data = data[i+1:]
+	}
+	r.tail = append(r.tail, data...)
+	if len(r.tail) > maxPromptTail {
+		r.tail = r.tail[len(r.tail)-maxPromptTail:]
+	}
+	if !r.sudo.prompt.Match(r.tail) {
+		return len(p), nil
+	}
+	r.tail = r.tail[:0]
+	if r.answered {
+		r.reject()
+		return len(p), nil
+	}
+	r.answered = true
+	password, err := r.sudo.read()
+	if err != nil {
+		log.Printf("Failed to read sudo password: %v", err)
+		r.reject()
+		return len(p), nil
+	}
+	r.password = password
+	line := append(append([]byte(nil), password...), '\n')
+	r.stdin.Write(line)
+	zeroBytes(line)
+	return len(p), nil
+}
+
+// reject stops answering prompts.
+func (r *sudoResponder) reject() {
+	r.rejected = true
+	if r.giveUp != nil {
+		r.giveUp()
+	}
+}
+
+// Close forgets the password and warns if it was not accepted.
+func (r *sudoResponder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zeroBytes(r.password)
+	if r.rejected && r.password != nil {
+		log.Printf("Warning: the sudo password was not accepted")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// syncer brings a directory tree up to date with another, for `memssh
+// sync`, copying only the files that differ. One side is local and the other
+// remote, reached over SFTP; copies go through the transfer, so they run
+// several at a time with progress shown.
+type syncer struct {
+	*transfer
+	upload      bool // local to remote, or else remote to local
+	localRoot   string
+	remoteRoot  string
+	deleteExtra bool      // -delete
+	dryRun      bool      // -dry-run
+	sums        *verifier // for -checksum, or nil
+
+	src, dst map[string]fs.FileInfo // the trees, by slash-separated relative path
+
+	deleted, unchanged int
+	toCopy             int   // with -dry-run
+	toCopyBytes        int64 // with -dry-run
+}
+
+// runSync implements `memssh sync`: it makes a directory on one side hold
+// what a directory on the other holds. Files are copied when their size or
+// modification time differs, or with -checksum their contents, and the copies
+// get the modification time of the originals so the next sync skips them.
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var opts connOptions
+	opts.register(fs)
+	del := fs.Bool("delete", false, "Delete files in the target that are not in the source")
+	dryRun := fs.Bool("dry-run", false, "Show what would be copied and deleted without changing anything")
+	fs.BoolVar(dryRun, "n", false, "Short for -dry-run")
+	checksum := fs.Bool("checksum", false, "Compare files of the same size by their SHA-256 digests instead of modification times")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh sync [flags] LOCAL-DIR [user@]host:REMOTE-DIR\n")
+		fmt.Fprintf(fs.Output(), "       memssh sync [flags] [user@]host:REMOTE-DIR LOCAL-DIR\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	_, _, srcRemote := splitRemotePath(fs.Arg(0))
+	_, _, dstRemote := splitRemotePath(fs.Arg(1))
+	if srcRemote == dstRemote {
+		log.Fatal("memssh sync copies between a local directory and a remote [user@]host:path one")
+	}
+	s := &syncer{upload: dstRemote, deleteExtra: *del, dryRun: *dryRun}
+	if s.upload {
+		s.localRoot, s.remoteRoot = fs.Arg(0), opts.takeRemotePath(fs.Arg(1))
+		if info, err := os.Stat(s.localRoot); err != nil {
+			log.Fatal(err)
+		} else if !info.IsDir() {
+			log.Fatalf("%s is not a directory", s.localRoot)
+		}
+	} else {
+		s.remoteRoot, s.localRoot = opts.takeRemotePath(fs.Arg(0)), fs.Arg(1)
+	}
+
+	conn := opts.connect()
+	client, err := newSFTPClient(conn.client)
+	if err != nil {
+		conn.Close()
+		fatalConnection("SFTP failed: %v", err)
+	}
+	progress := newProgress()
+	s.transfer = &transfer{sftp: client, host: opts.host, progress: progress, workers: make(chan struct{}, transferWorkers)}
+	if *checksum {
+		s.sums = &verifier{client: conn.client, host: opts.host, sftp: client}
+	}
+	s.run()
+	s.wg.Wait()
+	client.Close()
+	conn.Close()
+	summary := progress.close()
+	if s.dryRun {
+		fmt.Printf("Dry run: %d files (%s) to copy, %d to delete, %d unchanged\n", s.toCopy, formatSize(s.toCopyBytes), s.deleted, s.unchanged)
+	} else {
+		fmt.Printf("%s; %d deleted, %d unchanged\n", summary, s.deleted, s.unchanged)
+	}
+	if s.failed {
+		os.Exit(exitTransferFailed)
+	}
+}
+
+// run lists both trees and brings the target up to date.
+func (s *syncer) run() {
+	local, err := s.localTree()
+	if err != nil {
+		log.Fatal(err)
+	}
+	remote, err := s.remoteTree()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.src, s.dst = local, remote
+	if !s.upload {
+		s.src, s.dst = remote, local
+	}
+	if s.src == nil {
+		log.Fatalf("%s does not exist", s.name(!s.upload, "."))
+	}
+	if s.dst == nil {
+		s.dst = make(map[string]fs.FileInfo)
+		if !s.dryRun {
+			if err := s.mkdir("."); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Deleting first frees the space, and the names, for what is copied.
+	// A directory that could not be listed would look empty, and what the
+	// target has of it would be deleted, so errors so far rule deleting out.
+	if s.deleteExtra && s.failed {
+		s.progress.logf("Errors listing the trees; not deleting anything")
+	} else if s.deleteExtra {
+		for _, rel := range slices.Backward(slices.Sorted(maps.Keys(s.dst))) {
+			if _, ok := s.src[rel]; !ok {
+				s.remove(rel)
+			}
+		}
+	}
+	for _, rel := range slices.Sorted(maps.Keys(s.src)) {
+		s.update(rel, s.src[rel])
+	}
+}
+
+// update brings rel in the target up to date with info in the source.
+func (s *syncer) update(rel string, info fs.FileInfo) {
+	have, ok := s.dst[rel]
+	if ok && have.Mode().Type() != info.Mode().Type() {
+		s.remove(rel)
+		ok = false
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if ok {
+			return
+		}
+		if s.dryRun {
+			s.printf("Would create directory %s", s.name(s.upload, rel))
+		} else if err := s.mkdir(rel); err != nil {
+			s.fail(err)
+		}
+	case mode&fs.ModeSymlink != 0:
+		target, err := s.readLink(!s.upload, rel)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if ok {
+			if current, err := s.readLink(s.upload, rel); err == nil && current == target {
+				s.unchanged++
+				return
+			}
+			s.remove(rel)
+		}
+		if s.dryRun {
+			s.printf("Would link %s -> %s", s.name(s.upload, rel), target)
+		} else if err := s.symlink(target, rel); err != nil {
+			s.fail(err)
+		} else {
+			s.printf("%s -> %s (symlink)", s.name(s.upload, rel), target)
+		}
+	case mode.IsRegular():
+		if ok && s.same(rel, info, have) {
+			s.unchanged++
+			return
+		}
+		s.copy(rel, info)
+	default:
+		s.progress.logf("Skipping %s, which is not a regular file", s.name(!s.upload, rel))
+	}
+}
+
+// same reports whether the target's file rel, described by have, matches
+// the source's, described by info. With -checksum, a matching file whose
+// time differs gets the source's time.
+func (s *syncer) same(rel string, info, have fs.FileInfo) bool {
+	if info.Size() != have.Size() {
+		return false
+	}
+	// SFTP has whole seconds only.
+	sameTime := info.ModTime().Unix() == have.ModTime().Unix()
+	if s.sums == nil {
+		return sameTime
+	}
+	localSum, err := fileSHA256(filepath.Join(s.localRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		s.fail(err)
+		return true
+	}
+	remoteSum, err := s.sums.sum(path.Join(s.remoteRoot, rel))
+	if err != nil {
+		s.fail(fmt.Errorf("cannot compare %s: %w", s.name(true, rel), err))
+		return true
+	}
+	if !bytes.Equal(localSum, remoteSum) {
+		return false
+	}
+	if !sameTime && !s.dryRun {
+		if err := s.chtimes(rel, info.ModTime()); err != nil {
+			s.fail(err)
+		}
+	}
+	return true
+}
+
+// copy copies the source's file rel, described by info, over the target's,
+// and gives the copy the original's modification time.
+func (s *syncer) copy(rel string, info fs.FileInfo) {
+	local := filepath.Join(s.localRoot, filepath.FromSlash(rel))
+	remote := path.Join(s.remoteRoot, rel)
+	if s.dryRun {
+		s.printf("Would copy %s to %s (%s)", s.name(!s.upload, rel), s.name(s.upload, rel), formatSize(info.Size()))
+		s.toCopy++
+		s.toCopyBytes += info.Size()
+		return
+	}
+	s.spawn(func() error {
+		var err error
+		if s.upload {
+			err = s.putFile(local, remote, info)
+		} else {
+			err = s.getFile(remote, local, info)
+		}
+		if err != nil {
+			return err
+		}
+		return s.chtimes(rel, info.ModTime())
+	})
+}
+
+// remove deletes rel from the target, with everything in it if it is a
+// directory.
+func (s *syncer) remove(rel string) {
+	if s.dst[rel].IsDir() {
+		var inside []string
+		for name := range s.dst {
+			if strings.HasPrefix(name, rel+"/") {
+				inside = append(inside, name)
+			}
+		}
+		slices.Sort(inside)
+		for _, name := range slices.Backward(inside) {
+			s.remove(name)
+		}
+	}
+	name := s.name(s.upload, rel)
+	if s.dryRun {
+		s.printf("Would delete %s", name)
+	} else if err := s.removeOne(rel); err != nil {
+		s.fail(err)
+		return
+	} else {
+		s.printf("Deleted %s", name)
+	}
+	delete(s.dst, rel)
+	s.deleted++
+}
+
+// printf prints a line about the sync with the status line out of its way.
+func (s *syncer) printf(format string, args ...any) {
+	s.progress.pause(func() { fmt.Printf(format+"\n", args...) })
+}
+
+// name returns rel as shown in messages, on the remote side or locally.
+func (s *syncer) name(remote bool, rel string) string {
+	if remote {
+		return s.host + ":" + path.Join(s.remoteRoot, rel)
+	}
+	return filepath.Join(s.localRoot, filepath.FromSlash(rel))
+}
+
+// localTree lists the tree under the local root, or returns nil if there is
+// none.
+func (s *syncer) localTree() (map[string]fs.FileInfo, error) {
+	info, err := os.Stat(s.localRoot)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", s.localRoot)
+	}
+	tree := make(map[string]fs.FileInfo)
+	walkLocalTree(s.localRoot, s.fail, func(name, rel string, info fs.FileInfo) error {
+		if rel != "." {
+			tree[rel] = info
+		}
+		return nil
+	})
+	return tree, nil
+}
+
+// remoteTree lists the tree under the remote root, or returns nil if there
+// is none.
+func (s *syncer) remoteTree() (map[string]fs.FileInfo, error) {
+	info, err := s.sftp.Stat(s.remoteRoot)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", s.name(true, "."))
+	}
+	tree := make(map[string]fs.FileInfo)
+	var walk func(rel string)
+	walk = func(rel string) {
+		dir := path.Join(s.remoteRoot, rel)
+		entries, err := s.sftp.ReadDir(dir)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		for _, entry := range entries {
+			// path.Join would clean "../x" into a name outside the root.
+			if err := s.checkListedName(dir, entry.Name()); err != nil {
+				s.fail(err)
+				continue
+			}
+			name := path.Join(rel, entry.Name())
+			tree[name] = entry
+			if entry.IsDir() {
+				walk(name)
+			}
+		}
+	}
+	walk(".")
+	return tree, nil
+}
+
+// The operations below change the target, remote when uploading and local
+// otherwise.
+
+func (s *syncer) mkdir(rel string) error {
+	perm := fs.FileMode(0o755)
+	if info, ok := s.src[rel]; ok {
+		perm = info.Mode().Perm()
+	}
+	if s.upload {
+		return s.remoteMkdir(path.Join(s.remoteRoot, rel), perm)
+	}
+	return os.MkdirAll(filepath.Join(s.localRoot, filepath.FromSlash(rel)), perm)
+}
+
+func (s *syncer) removeOne(rel string) error {
+	if s.upload {
+		name := path.Join(s.remoteRoot, rel)
+		if s.dst[rel].IsDir() {
+			return s.sftp.Rmdir(name)
+		}
+		return s.sftp.Remove(name)
+	}
+	return os.Remove(filepath.Join(s.localRoot, filepath.FromSlash(rel)))
+}
+
+func (s *syncer) symlink(target, rel string) error {
+	if s.upload {
+		return s.sftp.Symlink(filepath.ToSlash(target), path.Join(s.remoteRoot, rel))
+	}
+	return os.Symlink(filepath.FromSlash(target), filepath.Join(s.localRoot, filepath.FromSlash(rel)))
+}
+
+func (s *syncer) chtimes(rel string, mtime time.Time) error {
+	if s.upload {
+		return s.sftp.Chtimes(path.Join(s.remoteRoot, rel), mtime, mtime)
+	}
+	return os.Chtimes(filepath.Join(s.localRoot, filepath.FromSlash(rel)), mtime, mtime)
+}
+
+// readLink returns the target of the symlink rel, on the remote side or
+// locally.
+func (s *syncer) readLink(remote bool, rel string) (string, error) {
+	if remote {
+		return s.sftp.ReadLink(path.Join(s.remoteRoot, rel))
+	}
+	return os.Readlink(filepath.Join(s.localRoot, filepath.FromSlash(rel)))
+}
+
+// fileSHA256 returns the SHA-256 digest of the local file name.
+func fileSHA256(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	remote := map[string]string{
+		"/r/":      "",
+		"/r/a":     "A",
+		"/r/sub/":  "",
+		"/r/sub/b": "B",
+		"/r/link":  "-> a",
+		"/escape":  "outside",
+	}
+	local := map[string]string{"old": "x", "sub/": "", "sub/old": "y"}
+	tests := []struct {
+		name        string
+		upload      bool
+		deleteExtra bool
+		dryRun      bool
+		local       map[string]string // under the local root before the sync
+		listings    map[string][]string
+		unreadable  string
+		wantLocal   map[string]string
+		wantRemote  map[string]string // under /r
+		failed      bool
+	}{
+		{
+			name:      "download",
+			local:     local,
+			wantLocal: map[string]string{"old": "x", "a": "A", "sub/": "", "sub/b": "B", "sub/old": "y", "link": "-> a"},
+		},
+		{
+			name:        "download with -delete",
+			deleteExtra: true,
+			local:       local,
+			wantLocal:   map[string]string{"a": "A", "sub/": "", "sub/b": "B", "link": "-> a"},
+		},
+		{
+			name:      "download to a new directory",
+			wantLocal: map[string]string{"a": "A", "sub/": "", "sub/b": "B", "link": "-> a"},
+		},
+		{
+			name:        "names outside the root",
+			deleteExtra: true,
+			local:       local,
+			listings:    map[string][]string{"/r": {"a", "../escape", "sub"}, "/r/sub": {"b", "../../escape", "..", "", `..\x`}},
+			wantLocal:   map[string]string{"old": "x", "a": "A", "sub/": "", "sub/b": "B", "sub/old": "y"},
+			failed:      true,
+		},
+		{
+			name:        "names outside the root, dry run",
+			deleteExtra: true,
+			dryRun:      true,
+			local:       local,
+			listings:    map[string][]string{"/r": {"a", "../escape", "sub/b"}},
+			wantLocal:   local,
+			failed:      true,
+		},
+		{
+			name:        "unreadable directory",
+			deleteExtra: true,
+			local:       local,
+			unreadable:  "/r/sub",
+			wantLocal:   map[string]string{"old": "x", "a": "A", "sub/": "", "sub/old": "y", "link": "-> a"},
+			failed:      true,
+		},
+		{
+			name:        "unreadable directory, dry run",
+			deleteExtra: true,
+			dryRun:      true,
+			local:       local,
+			unreadable:  "/r/sub",
+			wantLocal:   local,
+			failed:      true,
+		},
+		{
+			name:        "upload with -delete",
+			upload:      true,
+			deleteExtra: true,
+			local:       map[string]string{"a": "new", "new/": "", "new/c": "C", "link": "-> new/c"},
+			wantRemote:  map[string]string{"a": "new", "new/": "", "new/c": "C", "link": "-> new/c"},
+		},
+		{
+			name:        "upload, dry run",
+			upload:      true,
+			deleteExtra: true,
+			dryRun:      true,
+			local:       map[string]string{"a": "new", "new/": "", "new/c": "C"},
+			wantRemote:  map[string]string{"a": "A", "sub/": "", "sub/b": "B", "link": "-> a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSFTPServer(remote)
+			if tt.listings != nil {
+				s.listings = tt.listings
+			}
+			if tt.unreadable != "" {
+				s.unreadable[tt.unreadable] = true
+			}
+			// The local root is two levels down, so that names climbing
+			// out of it would land in the temporary directory.
+			dir := t.TempDir()
+			root := filepath.Join(dir, "work", "copy")
+			if err := os.Mkdir(filepath.Dir(root), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.local != nil {
+				writeTestTree(t, root, tt.local)
+			}
+			sync := &syncer{
+				transfer: newTestTransfer(t, s), upload: tt.upload, localRoot: root, remoteRoot: "/r",
+				deleteExtra: tt.deleteExtra, dryRun: tt.dryRun,
+			}
+			sync.run()
+			sync.wg.Wait()
+
+			if sync.failed != tt.failed {
+				t.Errorf("failed = %v, want %v", sync.failed, tt.failed)
+			}
+			if tt.wantLocal != nil {
+				want := map[string]string{"work/": "", "work/copy/": ""}
+				for name, value := range tt.wantLocal {
+					want["work/copy/"+name] = value
+				}
+				if got := readTestTree(t, dir); !maps.Equal(got, want) {
+					t.Errorf("local: got %q, want %q", got, want)
+				}
+			}
+			if tt.wantRemote != nil {
+				if got := s.tree("/r"); !maps.Equal(got, tt.wantRemote) {
+					t.Errorf("remote: got %q, want %q", got, tt.wantRemote)
+				}
+			}
+			if got := string(s.nodes["/escape"].data); got != "outside" {
+				t.Errorf("/escape holds %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errSystemHostKeyRevoked is returned by a systemHostKeyCheck for keys marked
+// @revoked in an OpenSSH known_hosts file.
+var errSystemHostKeyRevoked = errors.New("host key is revoked")
+
+// systemKnownHostsFiles returns the OpenSSH known_hosts files that exist: the
+// user's ~/.ssh/known_hosts and the system-wide /etc/ssh/ssh_known_hosts.
+func systemKnownHostsFiles() []string {
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	files = append(files, "/etc/ssh/ssh_known_hosts")
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	return existing
+}
+
+// systemHostKeyCheck consults OpenSSH's known_hosts files for a key memssh has
+// no fingerprint for. trusted reports an OpenSSH entry for this exact key;
+// err is set when OpenSSH trusts a different key of the same type for the
+// host or has revoked the key. Neither is set when OpenSSH does not know the
+// host or only knows keys of other types.
+type systemHostKeyCheck func(hostname string, remote net.Addr, key ssh.PublicKey) (trusted bool, err error)
+
+// newSystemHostKeyCheck builds a systemHostKeyCheck over the given files.
+func newSystemHostKeyCheck(files []string) (systemHostKeyCheck, error) {
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		var revoked *knownhosts.RevokedError
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.As(err, &revoked):
+			return false, fmt.Errorf("%w in %s", errSystemHostKeyRevoked, revoked.Revoked.Filename)
+		case errors.As(err, &keyErr):
+			for _, want := range keyErr.Want {
+				if want.Key.Type() == key.Type() {
+					return false, fmt.Errorf("%s:%d trusts a different %s key (%s)",
+						want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key))
+				}
+			}
+			return false, nil
+		}
+		return false, err
+	}, nil
+}
+
+// importOpenSSHKnownHosts adds the entries of an OpenSSH known_hosts file to
+// known. Host keys become address or pattern entries, @cert-authority lines
+// become certificate authorities and @revoked lines revoked keys. Hashed
+// OpenSSH hosts cannot be converted and are counted in skipped, as are keys
+// that conflict with a fingerprint memssh already trusts. Entries memssh
+// already has are not counted.
+func importOpenSSHKnownHosts(known *KnownHosts, data []byte) (imported, skipped int, err error) {
+	for len(data) > 0 {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return imported, skipped, err
+		}
+		data = rest
+
+		switch marker {
+		case "revoked":
+			line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+			if !slices.Contains(known.Revoked, line) {
+				known.Revoked = append(known.Revoked, line)
+				imported++
+			}
+			continue
+		case "cert-authority":
+			var names []string
+			for _, host := range hosts {
+				negation, name, _ := splitOpenSSHHost(host)
+				names = append(names, negation+name)
+			}
+			ca := CertAuthority{
+				Hosts: strings.Join(names, ","),
+				Key:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			}
+			if !slices.Contains(known.CertAuthorities, ca) {
+				known.CertAuthorities = append(known.CertAuthorities, ca)
+				imported++
+			}
+			continue
+		}
+
+		var entries []string
+		if slices.ContainsFunc(hosts, func(host string) bool { return strings.ContainsAny(host, "*?!") }) {
+			var patterns []string
+			for _, host := range hosts {
+				patterns = append(patterns, openSSHHostAddress(host))
+			}
+			entries = []string{strings.Join(patterns, ",")}
+		} else {
+			for _, host := range hosts {
+				if strings.HasPrefix(host, hashedHostPrefix) {
+					skipped++
+					continue
+				}
+				entries = append(entries, openSSHHostAddress(host))
+			}
+		}
+		fp := hostFingerprint(key)
+		for _, entry := range entries {
+			if stored, ok := known.Hosts[entry][key.Type()]; ok {
+				if stored != fp {
+					skipped++
+				}
+				continue
+			}
+			known.store(entry, key.Type(), fp, false)
+			imported++
+		}
+	}
+	return imported, skipped, nil
+}
+
+// openSSHHostAddress converts an OpenSSH known_hosts host or pattern to
+// memssh's host:port form.
+func openSSHHostAddress(host string) string {
+	negation, name, port := splitOpenSSHHost(host)
+	return negation + net.JoinHostPort(name, port)
+}
+
+// splitOpenSSHHost splits an OpenSSH known_hosts host or pattern, where a port
+// other than 22 is written as "[host]:port", into its "!" negation prefix,
+// host name and port.
+func splitOpenSSHHost(host string) (negation, name, port string) {
+	if pattern, ok := strings.CutPrefix(host, "!"); ok {
+		negation, host = "!", pattern
+	}
+	if bracketed, ok := strings.CutPrefix(host, "["); ok {
+		if name, port, ok := strings.Cut(bracketed, "]:"); ok {
+			return negation, name, port
+		}
+	}
+	return negation, host, "22"
+}
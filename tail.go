@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// tailKeepAlive is the -keepalive-interval of `memssh tail` when none is
+// given, so a connection that dies silently is noticed and replaced instead
+// of leaving the output stuck.
+const tailKeepAlive = 15 * time.Second
+
+// follower follows remote files over SFTP, for `memssh tail`.
+type follower struct {
+	conn     *connection
+	sftp     *sftpClient
+	host     string // for messages
+	files    []*tailedFile
+	lines    int // shown from the end of each file at the start
+	interval time.Duration
+}
+
+// tailedFile is a file being followed. Its offset survives reconnecting, so
+// following resumes where it left off.
+type tailedFile struct {
+	name   string
+	out    io.Writer
+	file   *sftpFile // nil until opened, and after the connection drops
+	offset int64
+
+	started bool // opened once, so -n has been applied
+	missing bool // could not be opened; reported once
+	gone    bool // the name no longer refers to the open file
+
+	// pending holds a partial last line, with several files, until it is
+	// complete, so lines from different files are not mixed.
+	pending []byte
+}
+
+// runTail implements `memssh tail`: it prints the last lines of remote files
+// and then follows them by name, like tail -F, checking every -interval for
+// data appended. A file that is truncated is read again from the start, and
+// one that is replaced, as log rotation does, is followed anew. If the
+// connection drops, memssh reconnects, as often as it takes, and each file
+// resumes at the offset it had reached. With several files, each line starts
+// with the name of its file in brackets.
+func runTail(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	var opts connOptions
+	opts.register(fs)
+	lines := fs.Int("n", 10, "Show this many lines from the end of each file first")
+	interval := fs.Duration("interval", time.Second, "How often to check the files for new data")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh tail [flags] [user@]host:REMOTE-FILE [REMOTE-FILE...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *lines < 0 || *interval <= 0 {
+		log.Fatal("-n must not be negative and -interval must be positive")
+	}
+	keepAlive := false
+	fs.Visit(func(f *flag.Flag) { keepAlive = keepAlive || f.Name == "keepalive-interval" })
+	if !keepAlive {
+		opts.keepAliveInterval = tailKeepAlive
+	}
+	// Further files are on the same server; they may repeat its name.
+	names := []string{opts.takeRemotePath(fs.Arg(0))}
+	for _, arg := range fs.Args()[1:] {
+		if dest, name, ok := splitRemotePath(arg); ok {
+			if host := dest[strings.Index(dest, "@")+1:]; host != opts.host {
+				log.Fatalf("memssh tail follows files on one server, not %s and %s", opts.host, host)
+			}
+			arg = name
+		}
+		names = append(names, arg)
+	}
+
+	conn := opts.connect()
+	client, err := newSFTPClient(conn.client)
+	if err != nil {
+		conn.Close()
+		fatalConnection("SFTP failed: %v", err)
+	}
+	f := &follower{conn: conn, sftp: client, host: opts.host, lines: *lines, interval: *interval}
+	for _, name := range names {
+		file := &tailedFile{name: name, out: os.Stdout}
+		prefix := &linePrefix{time: opts.prefixTime}
+		if opts.prefixHost {
+			prefix.host = opts.host
+		}
+		if len(names) > 1 {
+			prefix.file = name
+		}
+		if prefix.time || prefix.host != "" || prefix.file != "" {
+			file.out = prefix.wrap(os.Stdout)
+		}
+		f.files = append(f.files, file)
+	}
+	f.run()
+}
+
+// run follows the files until memssh is interrupted.
+func (f *follower) run() {
+	for {
+		for _, file := range f.files {
+			err := f.poll(file)
+			if err == nil {
+				continue
+			}
+			// An error the server answered with is the file's.
+			var status *sftpStatusError
+			if errors.As(err, &status) || !f.conn.dropped() {
+				f.report(file, err)
+				continue
+			}
+			f.reconnect()
+			break
+		}
+		time.Sleep(f.interval)
+	}
+}
+
+// report logs err for file once, until it can be read again.
+func (f *follower) report(file *tailedFile, err error) {
+	if file.file != nil {
+		file.file.Close()
+		file.file = nil
+	}
+	if !file.missing {
+		log.Printf("%s: %v", f.host, err)
+		file.missing = true
+	}
+}
+
+// reconnect replaces the dropped connection, trying until it succeeds or the
+// host key is rejected.
+func (f *follower) reconnect() {
+	log.Printf("Connection to %s lost", f.conn.address)
+	f.sftp.Close()
+	for _, file := range f.files {
+		file.file = nil
+	}
+	for {
+		err := f.conn.reconnect()
+		if err == nil {
+			break
+		}
+		var rejected *hostKeyRejectedError
+		if errors.As(err, &rejected) {
+			fatalConnection("Failed to reconnect: %v", err)
+		}
+		log.Printf("Failed to reconnect: %v", err)
+	}
+	client, err := newSFTPClient(f.conn.client)
+	if err != nil {
+		fatalConnection("SFTP failed: %v", err)
+	}
+	f.sftp = client
+	log.Printf("Reconnected to %s", f.conn.address)
+}
+
+// poll prints what was appended to file since the last poll, opening it
+// first if need be, and checks whether it was truncated or replaced.
+func (f *follower) poll(file *tailedFile) error {
+	if file.file == nil {
+		if err := f.open(file); err != nil {
+			return err
+		}
+	}
+	if err := f.read(file); err != nil {
+		return err
+	}
+
+	// The name is checked before the open file, which can only have grown
+	// since: if the name shows more data, it is another file.
+	info, err := f.sftp.Stat(file.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if !file.gone {
+			log.Printf("%s:%s has disappeared; waiting for it to reappear", f.host, file.name)
+			file.gone = true
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	current, err := file.file.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case file.gone, info.Size() > current.Size(), info.Size() < file.offset && current.Size() >= file.offset:
+		log.Printf("%s:%s has been replaced; following the new file", f.host, file.name)
+		f.finish(file)
+		file.file.Close()
+		file.file, file.offset, file.gone = nil, 0, false
+	case current.Size() < file.offset:
+		log.Printf("%s:%s was truncated; reading it from the start", f.host, file.name)
+		f.finish(file)
+		file.offset = 0
+		file.file.Seek(0, io.SeekStart)
+	}
+	return nil
+}
+
+// open opens file at the offset to follow it from: -n lines before its end
+// the first time, where it left off after reconnecting, or its start if it
+// appeared later.
+func (f *follower) open(file *tailedFile) error {
+	remote, err := f.sftp.Open(file.name)
+	if err != nil {
+		return err
+	}
+	info, err := remote.Stat()
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	switch {
+	case !file.started && !file.missing:
+		if file.offset, err = lastLines(remote, info.Size(), f.lines); err != nil {
+			remote.Close()
+			return err
+		}
+	case file.missing:
+		log.Printf("%s:%s has appeared; following it", f.host, file.name)
+		file.offset = 0
+	case info.Size() < file.offset:
+		log.Printf("%s:%s is shorter than before; reading it from the start", f.host, file.name)
+		file.offset = 0
+	}
+	file.file, file.started, file.missing, file.gone = remote, true, false, false
+	file.file.Seek(file.offset, io.SeekStart)
+	return nil
+}
+
+// read prints file from its offset to its end.
+func (f *follower) read(file *tailedFile) error {
+	_, err := file.file.WriteTo(tailWriter{f, file})
+	file.offset = file.file.offset
+	return err
+}
+
+// finish prints what is left of a file about to be read from the start or
+// replaced, ending a partial last line.
+func (f *follower) finish(file *tailedFile) {
+	f.read(file)
+	if len(file.pending) > 0 {
+		file.out.Write(append(file.pending, '\n'))
+		file.pending = nil
+	}
+}
+
+// tailWriter prints data read from a file: at once when it is the only one,
+// or else line by line.
+type tailWriter struct {
+	f    *follower
+	file *tailedFile
+}
+
+func (w tailWriter) Write(p []byte) (int, error) {
+	file := w.file
+	if len(w.f.files) == 1 {
+		return file.out.Write(p)
+	}
+	file.pending = append(file.pending, p...)
+	if i := bytes.LastIndexByte(file.pending, '\n'); i >= 0 {
+		if _, err := file.out.Write(file.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		file.pending = append([]byte(nil), file.pending[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// lastLines returns the offset of the last n lines of file, of size bytes,
+// reading it backwards. A newline ending the file does not start a line.
+func lastLines(file *sftpFile, size int64, n int) (int64, error) {
+	if n == 0 {
+		return size, nil
+	}
+	buf := make([]byte, sftpChunk)
+	end := size
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		block := buf[:end-start]
+		file.Seek(start, io.SeekStart)
+		if _, err := io.ReadFull(file, block); err != nil {
+			return 0, err
+		}
+		for i := len(block) - 1; i >= 0; i-- {
+			if block[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			if n--; n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
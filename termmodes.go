@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultTerminalSpeed is the line speed reported for a PTY when the local
+// terminal does not tell.
+const defaultTerminalSpeed = 38400
+
+// terminalType returns the terminal type to request a PTY for: the local
+// $TERM, so the remote programs use the same escape sequences, or xterm.
+func terminalType() string {
+	if t := os.Getenv("TERM"); t != "" {
+		return t
+	}
+	return "xterm"
+}
+
+// defaultTerminalModes are the modes sent when the local terminal settings
+// cannot be read, such as for -t without a terminal, or on Windows.
+func defaultTerminalModes() ssh.TerminalModes {
+	return ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: defaultTerminalSpeed,
+		ssh.TTY_OP_OSPEED: defaultTerminalSpeed,
+	}
+}
@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// ioctlGetTermios reads a terminal's settings.
+const ioctlGetTermios = unix.TIOCGETA
+
+// vdisable is the value of a disabled special character.
+const vdisable = 0xff
+
+// Settings the BSDs have beyond those Linux shares with them.
+var (
+	extraTermiosChars = map[uint8]int{
+		ssh.VDSUSP:  unix.VDSUSP,
+		ssh.VSTATUS: unix.VSTATUS,
+	}
+	extraTermiosInputFlags  = map[uint8]uint64{}
+	extraTermiosLocalFlags  = map[uint8]uint64{}
+	extraTermiosOutputFlags = map[uint8]uint64{}
+)
+
+// termiosSpeeds returns the line speeds in baud, which the BSDs keep as such.
+func termiosSpeeds(t *unix.Termios) (ispeed, ospeed uint32) {
+	return uint32(t.Ispeed), uint32(t.Ospeed)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// ioctlGetTermios reads a terminal's settings.
+const ioctlGetTermios = unix.TCGETS
+
+// vdisable is the value of a disabled special character.
+const vdisable = 0
+
+// Settings Linux has beyond those the BSDs share with it.
+var (
+	extraTermiosChars = map[uint8]int{
+		ssh.VSWTCH: unix.VSWTC,
+	}
+	extraTermiosInputFlags = map[uint8]uint64{
+		ssh.IUCLC: unix.IUCLC,
+		ssh.IUTF8: unix.IUTF8,
+	}
+	extraTermiosLocalFlags = map[uint8]uint64{
+		ssh.XCASE: unix.XCASE,
+	}
+	extraTermiosOutputFlags = map[uint8]uint64{
+		ssh.OLCUC: unix.OLCUC,
+	}
+)
+
+// termiosSpeeds returns the line speeds in baud. Linux keeps them as codes
+// in the control flags.
+func termiosSpeeds(t *unix.Termios) (ispeed, ospeed uint32) {
+	speed := linuxBaudRates[t.Cflag&unix.CBAUD]
+	return speed, speed
+}
+
+// linuxBaudRates maps the speed codes of Linux termios to baud.
+var linuxBaudRates = map[uint32]uint32{
+	unix.B50: 50, unix.B75: 75, unix.B110: 110, unix.B134: 134, unix.B150: 150,
+	unix.B200: 200, unix.B300: 300, unix.B600: 600, unix.B1200: 1200,
+	unix.B1800: 1800, unix.B2400: 2400, unix.B4800: 4800, unix.B9600: 9600,
+	unix.B19200: 19200, unix.B38400: 38400, unix.B57600: 57600,
+	unix.B115200: 115200, unix.B230400: 230400, unix.B460800: 460800,
+}
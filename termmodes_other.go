@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "golang.org/x/crypto/ssh"
+
+// terminalModes returns the default modes where the local terminal settings
+// are not read.
+func terminalModes(fd int) ssh.TerminalModes {
+	return defaultTerminalModes()
+}
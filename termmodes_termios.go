@@ -0,0 +1,122 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// Special characters and termios flags shared by Linux and the BSDs, by the
+// PTY mode opcode that carries them (RFC 4254, section 8).
+var (
+	termiosChars = map[uint8]int{
+		ssh.VINTR:    unix.VINTR,
+		ssh.VQUIT:    unix.VQUIT,
+		ssh.VERASE:   unix.VERASE,
+		ssh.VKILL:    unix.VKILL,
+		ssh.VEOF:     unix.VEOF,
+		ssh.VEOL:     unix.VEOL,
+		ssh.VEOL2:    unix.VEOL2,
+		ssh.VSTART:   unix.VSTART,
+		ssh.VSTOP:    unix.VSTOP,
+		ssh.VSUSP:    unix.VSUSP,
+		ssh.VREPRINT: unix.VREPRINT,
+		ssh.VWERASE:  unix.VWERASE,
+		ssh.VLNEXT:   unix.VLNEXT,
+		ssh.VDISCARD: unix.VDISCARD,
+	}
+	termiosInputFlags = map[uint8]uint64{
+		ssh.IGNPAR:  unix.IGNPAR,
+		ssh.PARMRK:  unix.PARMRK,
+		ssh.INPCK:   unix.INPCK,
+		ssh.ISTRIP:  unix.ISTRIP,
+		ssh.INLCR:   unix.INLCR,
+		ssh.IGNCR:   unix.IGNCR,
+		ssh.ICRNL:   unix.ICRNL,
+		ssh.IXON:    unix.IXON,
+		ssh.IXANY:   unix.IXANY,
+		ssh.IXOFF:   unix.IXOFF,
+		ssh.IMAXBEL: unix.IMAXBEL,
+	}
+	termiosLocalFlags = map[uint8]uint64{
+		ssh.ISIG:    unix.ISIG,
+		ssh.ICANON:  unix.ICANON,
+		ssh.ECHO:    unix.ECHO,
+		ssh.ECHOE:   unix.ECHOE,
+		ssh.ECHOK:   unix.ECHOK,
+		ssh.ECHONL:  unix.ECHONL,
+		ssh.NOFLSH:  unix.NOFLSH,
+		ssh.TOSTOP:  unix.TOSTOP,
+		ssh.IEXTEN:  unix.IEXTEN,
+		ssh.ECHOCTL: unix.ECHOCTL,
+		ssh.ECHOKE:  unix.ECHOKE,
+		ssh.PENDIN:  unix.PENDIN,
+	}
+	termiosOutputFlags = map[uint8]uint64{
+		ssh.OPOST:  unix.OPOST,
+		ssh.ONLCR:  unix.ONLCR,
+		ssh.OCRNL:  unix.OCRNL,
+		ssh.ONOCR:  unix.ONOCR,
+		ssh.ONLRET: unix.ONLRET,
+	}
+	termiosControlFlags = map[uint8]uint64{
+		ssh.PARENB: unix.PARENB,
+		ssh.PARODD: unix.PARODD,
+	}
+)
+
+// terminalModes translates the settings of the local terminal fd into the
+// modes of a PTY request, as OpenSSH does, so the remote side treats special
+// keys, flow control and line editing as the local terminal would. It must
+// be called before the terminal is put in raw mode.
+func terminalModes(fd int) ssh.TerminalModes {
+	t, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return defaultTerminalModes()
+	}
+	modes := ssh.TerminalModes{}
+	for _, chars := range []map[uint8]int{termiosChars, extraTermiosChars} {
+		for opcode, index := range chars {
+			c := uint32(t.Cc[index])
+			if c == vdisable {
+				// A disabled character is sent as 255, whatever the local
+				// value for it is.
+				c = 255
+			}
+			modes[opcode] = c
+		}
+	}
+	setFlags := func(flags uint64, tables ...map[uint8]uint64) {
+		for _, table := range tables {
+			for opcode, mask := range table {
+				modes[opcode] = 0
+				if flags&mask != 0 {
+					modes[opcode] = 1
+				}
+			}
+		}
+	}
+	setFlags(uint64(t.Iflag), termiosInputFlags, extraTermiosInputFlags)
+	setFlags(uint64(t.Lflag), termiosLocalFlags, extraTermiosLocalFlags)
+	setFlags(uint64(t.Oflag), termiosOutputFlags, extraTermiosOutputFlags)
+	setFlags(uint64(t.Cflag), termiosControlFlags)
+	// CS7 and CS8 are values of the character size field, not single bits.
+	modes[ssh.CS7], modes[ssh.CS8] = 0, 0
+	switch uint64(t.Cflag) & unix.CSIZE {
+	case unix.CS7:
+		modes[ssh.CS7] = 1
+	case unix.CS8:
+		modes[ssh.CS8] = 1
+	}
+
+	ispeed, ospeed := termiosSpeeds(t)
+	if ispeed == 0 {
+		ispeed = defaultTerminalSpeed
+	}
+	if ospeed == 0 {
+		ospeed = defaultTerminalSpeed
+	}
+	modes[ssh.TTY_OP_ISPEED], modes[ssh.TTY_OP_OSPEED] = ispeed, ospeed
+	return modes
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// timeoutError is a connection or handshake that took longer than
+// -connect-timeout. It is a net.Error, so -retries treats it like other
+// network failures.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// dialTimeout bounds dial by timeout, or returns it unchanged if timeout is
+// not positive. It works for any dialFunc, including ones that cannot be
+// cancelled such as channels through a jump host: a dial still running when
+// the timeout expires is abandoned, and its connection closed if it arrives.
+func dialTimeout(dial dialFunc, timeout time.Duration) dialFunc {
+	if timeout <= 0 {
+		return dial
+	}
+	return func(network, address string) (net.Conn, error) {
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := dial(network, address)
+			done <- result{conn, err}
+		}()
+		select {
+		case r := <-done:
+			return r.conn, r.err
+		case <-time.After(timeout):
+			go func() {
+				if r := <-done; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			return nil, &timeoutError{fmt.Sprintf("connection to %s timed out after %v", address, timeout)}
+		}
+	}
+}
+
+// dialSSH is ssh.Dial for a dialFunc: it connects to address and returns an
+// authenticated client, applying config.Timeout to the dial and the handshake.
+func dialSSH(dial dialFunc, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dialTimeout(dial, config.Timeout)("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := newClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// newClientConn runs the SSH handshake on conn like ssh.NewClientConn, but
+// closes the connection if the server has not completed the key exchange
+// within config.Timeout, which the library itself only applies to ssh.Dial's
+// TCP connect. The limit ends when the host key arrives, so neither the host
+// key prompt nor authentication prompts are cut short.
+func newClientConn(conn net.Conn, address string, config *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		return ssh.NewClientConn(conn, address, config)
+	}
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	bounded := *config
+	bounded.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		timer.Stop()
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &bounded)
+	if err != nil && expired.Load() {
+		err = &timeoutError{fmt.Sprintf("SSH handshake with %s timed out after %v", address, timeout)}
+	}
+	return sshConn, chans, reqs, err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTOTPPrompt matches the keyboard-interactive questions of common
+// two-factor setups (Google Authenticator PAM, Duo, RADIUS OTP).
+const defaultTOTPPrompt = `(?i)verification code|one-time|otp|authenticator|token code`
+
+// totpSource answers one-time password challenges without user interaction,
+// either by computing an RFC 6238 code from a shared secret or by running an
+// external generator command.
+type totpSource struct {
+	secretEnv string
+	cmd       string
+	prompt    *regexp.Regexp
+}
+
+// newTOTPSource builds a source from the -totp-* flags. It returns nil when no
+// secret or command is configured.
+func newTOTPSource(secretEnv, cmd, prompt string) (*totpSource, error) {
+	if secretEnv == "" && cmd == "" {
+		return nil, nil
+	}
+	if secretEnv != "" && cmd != "" {
+		return nil, errors.New("only one of -totp-env and -totp-cmd may be used")
+	}
+	if prompt == "" {
+		prompt = defaultTOTPPrompt
+	}
+	re, err := regexp.Compile(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -totp-prompt: %w", err)
+	}
+	return &totpSource{secretEnv: secretEnv, cmd: cmd, prompt: re}, nil
+}
+
+// matches reports whether a challenge question asks for a one-time code.
+func (t *totpSource) matches(question string) bool {
+	return t != nil && t.prompt.MatchString(question)
+}
+
+// code returns the current one-time password.
+func (t *totpSource) code() (string, error) {
+	if t.cmd != "" {
+		out, err := runProvider("TOTP command", shellCommand(t.cmd))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	value, ok := os.LookupEnv(t.secretEnv)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", t.secretEnv)
+	}
+	params, err := parseTOTPSecret(value)
+	if err != nil {
+		return "", err
+	}
+	defer zeroBytes(params.secret)
+	return params.generate(time.Now()), nil
+}
+
+// totpParams describes a TOTP generator as defined by RFC 6238.
+type totpParams struct {
+	secret  []byte
+	digits  int
+	period  int64
+	newHash func() hash.Hash
+}
+
+// parseTOTPSecret accepts either a bare base32 secret or an otpauth://totp/
+// URI as exported by authenticator apps, which may override the digits,
+// period and algorithm.
+func parseTOTPSecret(value string) (totpParams, error) {
+	params := totpParams{digits: 6, period: 30, newHash: sha1.New}
+	encoded := value
+	if strings.HasPrefix(value, "otpauth://") {
+		u, err := url.Parse(value)
+		if err != nil || u.Host != "totp" {
+			return params, errors.New("TOTP secret: expected an otpauth://totp/ URI")
+		}
+		q := u.Query()
+		encoded = q.Get("secret")
+		if d := q.Get("digits"); d != "" {
+			if params.digits, err = strconv.Atoi(d); err != nil || params.digits < 6 || params.digits > 8 {
+				return params, fmt.Errorf("TOTP secret: invalid digits %q", d)
+			}
+		}
+		if p := q.Get("period"); p != "" {
+			if params.period, err = strconv.ParseInt(p, 10, 64); err != nil || params.period <= 0 {
+				return params, fmt.Errorf("TOTP secret: invalid period %q", p)
+			}
+		}
+		switch strings.ToUpper(q.Get("algorithm")) {
+		case "", "SHA1":
+		case "SHA256":
+			params.newHash = sha256.New
+		case "SHA512":
+			params.newHash = sha512.New
+		default:
+			return params, fmt.Errorf("TOTP secret: unsupported algorithm %q", q.Get("algorithm"))
+		}
+	}
+
+	encoded = strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "=", "").Replace(encoded))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil || len(secret) == 0 {
+		return params, errors.New("TOTP secret: invalid base32 secret")
+	}
+	params.secret = secret
+	return params, nil
+}
+
+// generate computes the code for the time step containing now (RFC 4226 HOTP
+// over the RFC 6238 time counter).
+func (p totpParams) generate(now time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix()/p.period))
+	mac := hmac.New(p.newHash, p.secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < p.digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", p.digits, value%modulus)
+}
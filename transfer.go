@@ -0,0 +1,555 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exitTransferFailed is the exit status of put and get when a file could not
+// be copied.
+const exitTransferFailed = 1
+
+// transferWorkers is how many files a transfer copies at once. Each keeps
+// its own requests in flight over the one SFTP session, which helps with
+// many small files, whose copies are mostly round trips.
+const transferWorkers = 4
+
+// transfer copies files between this machine and the server over SFTP.
+type transfer struct {
+	sftp      *sftpClient
+	host      string // for messages
+	recursive bool   // -r
+	progress  *progress
+	verify    *verifier    // -verify, or nil
+	limit     *tokenBucket // -limit-rate, or nil
+	preserve  bool         // -p
+	owners    bool         // -p as root on both ends, which keeps owners too
+
+	// dirs are the copied directories whose attributes -p sets once
+	// everything in them is copied, since that changes their times.
+	dirs []preservedDir
+
+	workers chan struct{} // a token per running copy
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	failed  bool
+}
+
+// runPut implements `memssh put`: it uploads local files over SFTP.
+func runPut(args []string) {
+	runTransfer("put", "LOCAL... REMOTE", "LOCAL... [user@]host:REMOTE", args)
+}
+
+// runGet implements `memssh get`: it downloads remote files over SFTP.
+func runGet(args []string) {
+	runTransfer("get", "REMOTE... LOCAL", "[user@]host:REMOTE... LOCAL", args)
+}
+
+// runTransfer connects, starts SFTP on the connection, or scp with -scp or
+// when the server has no SFTP, and copies each source to the target, the
+// last path: into it if it is a directory, which it must be for several
+// sources, or else to it. The remote paths come after the destination, or
+// are given as scp takes them, [user@]host:path. Relative remote paths
+// start from the remote home directory, and get expands wildcards in them on
+// the server. It exits with exitTransferFailed if any file failed.
+func runTransfer(name, paths, scpPaths string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var opts connOptions
+	opts.register(fs)
+	// The connection's -limit-rate limits the files instead, leaving room
+	// for sessions sharing the connection through -control-path.
+	fs.Lookup("limit-rate").Usage = "Limit the files copied to this many bytes per second in all, e.g. 500K (K, M and G suffixes; default unlimited)"
+	recursive := fs.Bool("r", false, "Copy directories with everything in them")
+	verify := fs.String("verify", "", "Check each copied file against the original with this digest (sha256), computed on the server")
+	useSCP := fs.Bool("scp", false, "Use the scp protocol instead of SFTP (done anyway when the server refuses SFTP)")
+	preserve := fs.Bool("p", false, "Keep the modification times and modes of the originals, and their owners when running as root and logging in as root")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: memssh %s [flags] [user@host[:port]] %s\n", name, paths)
+		fmt.Fprintf(fs.Output(), "       memssh %s [flags] %s\n", name, scpPaths)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if opts.host == "" && len(rest) >= 2 && (name == "get" && scpStyle(rest[0]) || name == "put" && scpStyle(rest[len(rest)-1])) {
+		rest = opts.takeRemotePaths(name, rest)
+	} else {
+		rest = opts.takeDestination(rest)
+	}
+	if opts.host == "" || len(rest) < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sources, target := rest[:len(rest)-1], rest[len(rest)-1]
+	verifier, err := newVerifier(*verify, opts.host)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	var limit *tokenBucket
+	if opts.limitRate != "" {
+		rate, err := parseSize(opts.limitRate)
+		if err != nil || rate == 0 {
+			log.Fatalf("Invalid -limit-rate %q: want bytes per second, e.g. 500K", opts.limitRate)
+		}
+		limit = newTokenBucket(rate)
+		opts.limitRate = ""
+	}
+
+	conn := opts.connect()
+	progress := newProgress()
+	var client *sftpClient
+	if !*useSCP {
+		client, err = newSFTPClient(conn.client)
+		switch {
+		case errors.Is(err, errNoSFTP):
+			log.Printf("The server offers no SFTP; falling back to scp")
+		case err != nil:
+			conn.Close()
+			fatalConnection("SFTP failed: %v", err)
+		}
+	}
+	if verifier != nil {
+		verifier.client, verifier.sftp = conn.client, client
+	}
+	if client == nil {
+		t := &scpTransfer{client: conn.client, host: opts.host, recursive: *recursive, progress: progress, verify: verifier, limit: limit, preserve: *preserve}
+		if name == "put" {
+			t.put(sources, target)
+		} else {
+			several := len(sources) > 1 || slices.ContainsFunc(sources, hasGlobMeta)
+			for _, source := range expandGlobs(opts.host, sources, t.glob, t.fail) {
+				t.get(source, target, several)
+			}
+		}
+		conn.Close()
+		fmt.Println(progress.close())
+		if t.failed {
+			os.Exit(exitTransferFailed)
+		}
+		return
+	}
+	t := &transfer{sftp: client, host: opts.host, recursive: *recursive, progress: progress, verify: verifier, limit: limit, workers: make(chan struct{}, transferWorkers)}
+	// Numeric owners only carry over between root on both ends; anyone
+	// else can only give files to themselves.
+	t.preserve, t.owners = *preserve, *preserve && os.Geteuid() == 0 && opts.user == "root"
+	several := len(sources) > 1
+	if name == "get" {
+		several = several || slices.ContainsFunc(sources, hasGlobMeta)
+		sources = expandGlobs(opts.host, sources, t.sftp.Glob, t.fail)
+	}
+	for _, source := range sources {
+		if name == "put" {
+			t.put(source, target, several)
+		} else {
+			t.get(source, target, several)
+		}
+	}
+	t.wg.Wait()
+	t.preserveDirs(name == "put")
+	client.Close()
+	conn.Close()
+	fmt.Println(progress.close())
+	if t.failed {
+		os.Exit(exitTransferFailed)
+	}
+}
+
+// takeRemotePaths sets the destination from the [user@]host:path arguments
+// of put or get, the target of put and the sources of get, and returns the
+// arguments with the paths alone. Further sources of get are on the same
+// server; they may repeat its name or give the path alone.
+func (o *connOptions) takeRemotePaths(name string, args []string) []string {
+	paths := slices.Clone(args)
+	if name == "put" {
+		paths[len(paths)-1] = o.takeRemotePath(args[len(args)-1])
+		return paths
+	}
+	paths[0] = o.takeRemotePath(args[0])
+	for i, arg := range args[1 : len(args)-1] {
+		if !scpStyle(arg) {
+			continue
+		}
+		dest, remotePath, _ := splitRemotePath(arg)
+		if host := dest[strings.Index(dest, "@")+1:]; host != o.host {
+			log.Fatalf("memssh get copies from one server, not %s and %s", o.host, host)
+		}
+		if remotePath == "" {
+			remotePath = "."
+		}
+		paths[i+1] = remotePath
+	}
+	return paths
+}
+
+// fail reports err, which makes the transfer fail once done.
+func (t *transfer) fail(err error) {
+	t.progress.logf("%v", err)
+	t.mu.Lock()
+	t.failed = true
+	t.mu.Unlock()
+}
+
+// spawn runs copy once one of the transferWorkers is free.
+func (t *transfer) spawn(copy func() error) {
+	t.workers <- struct{}{}
+	t.wg.Add(1)
+	go func() {
+		defer func() {
+			<-t.workers
+			t.wg.Done()
+		}()
+		if err := copy(); err != nil {
+			t.fail(err)
+		}
+	}()
+}
+
+// put uploads source to target, or into it if it is a remote directory;
+// several means target must be one. A directory is copied with -r only.
+func (t *transfer) put(source, target string, several bool) {
+	info, err := os.Stat(source)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if info.IsDir() && !t.recursive {
+		t.fail(fmt.Errorf("%s is a directory (use -r)", source))
+		return
+	}
+	remote, err := t.remoteTarget(target, filepath.Base(source), several)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if info.IsDir() {
+		t.putTree(source, remote)
+		return
+	}
+	t.spawn(func() error { return t.putFile(source, remote, info) })
+}
+
+// putTree uploads the local directory root as remote. Directories are
+// created before the files in them are copied; symlinks are recreated as
+// symlinks with the same target, as archives keep them, rather than
+// followed, which could copy a tree twice or loop.
+func (t *transfer) putTree(root, remote string) {
+	walkLocalTree(root, t.fail, func(local, rel string, info fs.FileInfo) error {
+		dest := path.Join(remote, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := t.remoteMkdir(dest, mode.Perm()); err != nil {
+				t.fail(err)
+				return filepath.SkipDir
+			}
+			if t.preserve {
+				t.dirs = append(t.dirs, preservedDir{dest, info})
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(local)
+			if err == nil {
+				t.sftp.Remove(dest)
+				err = t.sftp.Symlink(filepath.ToSlash(target), dest)
+			}
+			if err != nil {
+				t.fail(err)
+			}
+		case mode.IsRegular():
+			t.spawn(func() error { return t.putFile(local, dest, info) })
+		default:
+			t.progress.logf("Skipping %s, which is not a regular file", local)
+		}
+		return nil
+	})
+}
+
+// walkLocalTree calls visit for root and everything under it, parents before
+// their contents, with each name, its path relative to root in slash form
+// ("." for root) and its information. What cannot be read is passed to fail
+// and skipped. visit may return filepath.SkipDir, or an error, which stops
+// the walk and is returned.
+func walkLocalTree(root string, fail func(error), visit func(name, rel string, info fs.FileInfo) error) error {
+	// The trailing separator makes a symlink given as root count as the
+	// directory it points to.
+	return filepath.WalkDir(root+string(filepath.Separator), func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			fail(err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			fail(err)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			fail(err)
+			return nil
+		}
+		return visit(name, filepath.ToSlash(rel), info)
+	})
+}
+
+// remoteMkdir creates directory name unless it exists.
+func (t *transfer) remoteMkdir(name string, perm fs.FileMode) error {
+	if info, err := t.sftp.Stat(name); err == nil && info.IsDir() {
+		return nil
+	}
+	return t.sftp.Mkdir(name, perm)
+}
+
+// putFile uploads the regular file local, described by info, to remote.
+func (t *transfer) putFile(local, remote string, info fs.FileInfo) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	file, err := t.sftp.Create(remote, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	f := t.progress.begin(local, info.Size())
+	src := limitReader(f.reader(in), t.limit)
+	var sum hash.Hash
+	if t.verify != nil {
+		sum = t.verify.hash()
+		src = io.TeeReader(src, sum)
+	}
+	n, err := file.ReadFrom(src)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && t.preserve {
+		err = t.preserveRemote(remote, info)
+	}
+	if err == nil && t.verify != nil {
+		err = t.verify.check(remote, sum.Sum(nil))
+	}
+	if err != nil {
+		t.progress.end(f, false, "")
+		return err
+	}
+	t.progress.end(f, true, fmt.Sprintf("%s -> %s:%s (%s%s)", local, t.host, remote, formatSize(n), t.verify.note()))
+	return nil
+}
+
+// get downloads source to target, or into it if it is a local directory;
+// several means target must be one. A directory is copied with -r only.
+func (t *transfer) get(source, target string, several bool) {
+	info, err := t.sftp.Stat(source)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if info.IsDir() && !t.recursive {
+		t.fail(fmt.Errorf("%s:%s is a directory (use -r)", t.host, source))
+		return
+	}
+	local, err := localTarget(target, path.Base(source), several)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if info.IsDir() {
+		t.getTree(source, local, info)
+		return
+	}
+	t.spawn(func() error { return t.getFile(source, local, info) })
+}
+
+// getTree downloads the remote directory dir, described by info, as local,
+// treating symlinks as putTree does.
+func (t *transfer) getTree(dir, local string, info fs.FileInfo) {
+	if existing, err := os.Stat(local); err != nil || !existing.IsDir() {
+		if err := os.Mkdir(local, info.Mode().Perm()); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+	if t.preserve {
+		t.dirs = append(t.dirs, preservedDir{local, info})
+	}
+	entries, err := t.sftp.ReadDir(dir)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	for _, entry := range entries {
+		if err := t.checkListedName(dir, entry.Name()); err != nil {
+			t.fail(err)
+			continue
+		}
+		source := path.Join(dir, entry.Name())
+		dest := filepath.Join(local, entry.Name())
+		switch mode := entry.Mode(); {
+		case mode.IsDir():
+			t.getTree(source, dest, entry)
+		case mode&fs.ModeSymlink != 0:
+			target, err := t.sftp.ReadLink(source)
+			if err == nil {
+				os.Remove(dest)
+				err = os.Symlink(filepath.FromSlash(target), dest)
+			}
+			if err != nil {
+				t.fail(err)
+			}
+		case mode.IsRegular():
+			t.spawn(func() error { return t.getFile(source, dest, entry) })
+		default:
+			t.progress.logf("Skipping %s:%s, which is not a regular file", t.host, source)
+		}
+	}
+}
+
+// checkListedName returns an error unless name, which the server listed in
+// the remote directory dir, is a plain file name. A malicious server could
+// otherwise list "../.bashrc" and have it written outside the target.
+func (t *transfer) checkListedName(dir, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return fmt.Errorf("refusing %q, listed in %s:%s, which is not a plain file name", name, t.host, dir)
+	}
+	return nil
+}
+
+// getFile downloads the regular file remote, described by info, to local.
+func (t *transfer) getFile(remote, local string, info fs.FileInfo) error {
+	file, err := t.sftp.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	f := t.progress.begin(t.host+":"+remote, info.Size())
+	dst := limitWriter(f.writer(out), t.limit)
+	var sum hash.Hash
+	if t.verify != nil {
+		sum = t.verify.hash()
+		dst = io.MultiWriter(dst, sum)
+	}
+	n, err := file.WriteTo(dst)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && t.preserve {
+		err = t.preserveLocal(local, info)
+	}
+	if err == nil && t.verify != nil {
+		err = t.verify.check(remote, sum.Sum(nil))
+	}
+	if err != nil {
+		t.progress.end(f, false, "")
+		return err
+	}
+	t.progress.end(f, true, fmt.Sprintf("%s:%s -> %s (%s%s)", t.host, remote, local, formatSize(n), t.verify.note()))
+	return nil
+}
+
+// preservedDir is a copied directory, with the info of its original.
+type preservedDir struct {
+	name string
+	info fs.FileInfo
+}
+
+// preserveDirs gives the copied directories the attributes of their
+// originals, for -p, deepest first: the remote ones for put, the local ones
+// for get.
+func (t *transfer) preserveDirs(remote bool) {
+	for i := len(t.dirs) - 1; i >= 0; i-- {
+		dir := t.dirs[i]
+		var err error
+		if remote {
+			err = t.preserveRemote(dir.name, dir.info)
+		} else {
+			err = t.preserveLocal(dir.name, dir.info)
+		}
+		if err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+// preserveRemote gives the remote copy name the mode and modification time
+// of the local original described by info, and with t.owners its owner and
+// group, in one request.
+func (t *transfer) preserveRemote(name string, info fs.FileInfo) error {
+	mtime := uint32(info.ModTime().Unix())
+	attrs := sftpAttributes{flags: sftpAttrPermissions | sftpAttrTimes, mode: uint32(info.Mode().Perm()), atime: mtime, mtime: mtime}
+	if uid, gid, ok := fileOwner(info); ok && t.owners {
+		attrs.flags |= sftpAttrUIDGID
+		attrs.uid, attrs.gid = uint32(uid), uint32(gid)
+	}
+	return t.sftp.setstat(name, attrs)
+}
+
+// preserveLocal gives the local copy name the mode and modification time of
+// the remote original described by info, and with t.owners its owner and
+// group. The owner comes first, since changing it may clear setuid bits. A
+// server that sends no times leaves those of the copy alone.
+func (t *transfer) preserveLocal(name string, info fs.FileInfo) error {
+	mtime := info.ModTime()
+	if attrs, ok := info.Sys().(sftpAttributes); ok {
+		if t.owners && attrs.flags&sftpAttrUIDGID != 0 {
+			if err := os.Lchown(name, int(attrs.uid), int(attrs.gid)); err != nil {
+				return err
+			}
+		}
+		if attrs.flags&sftpAttrTimes == 0 {
+			mtime = time.Time{}
+		}
+	}
+	return preserveMode(name, info.Mode().Perm(), mtime)
+}
+
+// preserveMode sets the mode and modification time of the local file name,
+// for -p. A zero mtime leaves the times alone.
+func preserveMode(name string, mode fs.FileMode, mtime time.Time) error {
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	if mtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(name, mtime, mtime)
+}
+
+// remoteTarget returns where a file named base goes for the remote target.
+func (t *transfer) remoteTarget(target, base string, several bool) (string, error) {
+	info, err := t.sftp.Stat(target)
+	switch {
+	case err == nil && info.IsDir():
+		return path.Join(target, base), nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	case several || strings.HasSuffix(target, "/"):
+		return "", fmt.Errorf("%s:%s is not a directory", t.host, target)
+	}
+	return target, nil
+}
+
+// localTarget returns where a file named base goes for the local target.
+func localTarget(target, base string, several bool) (string, error) {
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && info.IsDir():
+		return filepath.Join(target, base), nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	case several || strings.HasSuffix(target, string(filepath.Separator)) || strings.HasSuffix(target, "/"):
+		return "", fmt.Errorf("%s is not a directory", target)
+	}
+	return target, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testSFTPNode is a file, directory or symlink served by testSFTPServer.
+type testSFTPNode struct {
+	mode  uint32 // POSIX mode, file type bits included
+	data  []byte // a file's contents, or a symlink's target
+	mtime uint32
+}
+
+func (n *testSFTPNode) attrs() sftpAttributes {
+	return sftpAttributes{
+		flags: sftpAttrSize | sftpAttrPermissions | sftpAttrTimes,
+		size:  uint64(len(n.data)), mode: n.mode, atime: n.mtime, mtime: n.mtime,
+	}
+}
+
+// testSFTPServer serves a tree held in memory to an sftpClient, as a server
+// would the files under its root. READDIR answers with what listings holds
+// for a directory, if anything, as a malicious server might; the directories
+// in unreadable cannot be listed.
+type testSFTPServer struct {
+	nodes      map[string]*testSFTPNode // by absolute slash-separated path
+	listings   map[string][]string
+	unreadable map[string]bool
+
+	handles map[string]*testSFTPHandle
+	next    int
+}
+
+// testSFTPHandle is an open file or directory of a testSFTPServer.
+type testSFTPHandle struct {
+	name   string
+	names  []string // a directory's entries
+	listed bool     // the entries were sent
+}
+
+// newTestSFTPServer returns a server holding the root directory and tree,
+// whose values are file contents, directories if they end in a slash, or
+// symlinks if they start with "-> ".
+func newTestSFTPServer(tree map[string]string) *testSFTPServer {
+	s := &testSFTPServer{
+		nodes:      map[string]*testSFTPNode{"/": {mode: posixDir | 0o755}},
+		listings:   make(map[string][]string),
+		unreadable: make(map[string]bool),
+		handles:    make(map[string]*testSFTPHandle),
+	}
+	for name, value := range tree {
+		node := &testSFTPNode{mode: posixRegular | 0o644, data: []byte(value), mtime: 1700000000}
+		switch {
+		case strings.HasSuffix(name, "/"):
+			name, node.mode, node.data = strings.TrimSuffix(name, "/"), posixDir|0o755, nil
+		case strings.HasPrefix(value, "-> "):
+			node.mode, node.data = posixSymlink|0o777, []byte(strings.TrimPrefix(value, "-> "))
+		}
+		s.nodes[name] = node
+	}
+	return s
+}
+
+// tree returns what is under root in the form newTestSFTPServer takes, with
+// names relative to root.
+func (s *testSFTPServer) tree(root string) map[string]string {
+	tree := make(map[string]string)
+	for name, node := range s.nodes {
+		rel, ok := strings.CutPrefix(name, root+"/")
+		if !ok {
+			continue
+		}
+		switch node.mode & posixTypeMask {
+		case posixDir:
+			tree[rel+"/"] = ""
+		case posixSymlink:
+			tree[rel] = "-> " + string(node.data)
+		default:
+			tree[rel] = string(node.data)
+		}
+	}
+	return tree
+}
+
+func (s *testSFTPServer) serve(r io.Reader, w io.Writer) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err != nil {
+			return
+		}
+		rd := sftpReader{data, nil}
+		id := rd.uint32()
+		typ, reply := s.answer(typ, &rd)
+		if err := writeTestSFTPPacket(w, typ, append(sftpBuilder{}.uint32(id), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func testSFTPStatus(code uint32) (byte, sftpBuilder) {
+	return sftpStatus, sftpBuilder{}.uint32(code).string("").string("")
+}
+
+// answer returns the response to a request of type typ.
+func (s *testSFTPServer) answer(typ byte, rd *sftpReader) (byte, sftpBuilder) {
+	switch typ {
+	case sftpStat, sftpLstat:
+		name := rd.string()
+		node := s.nodes[name]
+		if typ == sftpStat && node != nil && node.mode&posixTypeMask == posixSymlink {
+			node = s.nodes[path.Join(path.Dir(name), string(node.data))]
+		}
+		if node == nil {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		return sftpAttrs, sftpBuilder{}.attrs(node.attrs())
+	case sftpFstat:
+		h := s.handles[rd.string()]
+		if h == nil || s.nodes[h.name] == nil {
+			return testSFTPStatus(sftpFailure)
+		}
+		return sftpAttrs, sftpBuilder{}.attrs(s.nodes[h.name].attrs())
+	case sftpSetstat:
+		name, attrs := rd.string(), rd.attrs()
+		node := s.nodes[name]
+		if node == nil {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		if attrs.flags&sftpAttrPermissions != 0 {
+			node.mode = node.mode&posixTypeMask | attrs.mode&0o7777
+		}
+		if attrs.flags&sftpAttrTimes != 0 {
+			node.mtime = attrs.mtime
+		}
+		return testSFTPStatus(sftpOK)
+	case sftpOpen:
+		name, flags, attrs := rd.string(), rd.uint32(), rd.attrs()
+		node := s.nodes[name]
+		if node == nil && flags&sftpFlagCreate != 0 && s.isDir(path.Dir(name)) {
+			node = &testSFTPNode{mode: posixRegular | attrs.mode&0o7777}
+			s.nodes[name] = node
+		}
+		if node == nil {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		if node.mode&posixTypeMask != posixRegular {
+			return testSFTPStatus(sftpFailure)
+		}
+		if flags&sftpFlagTrunc != 0 {
+			node.data = nil
+		}
+		return s.open(&testSFTPHandle{name: name})
+	case sftpOpendir:
+		name := rd.string()
+		if s.unreadable[name] {
+			return testSFTPStatus(sftpPermissionDenied)
+		}
+		if !s.isDir(name) {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		names, ok := s.listings[name]
+		if !ok {
+			names = s.children(name)
+		}
+		return s.open(&testSFTPHandle{name: name, names: append([]string{".", ".."}, names...)})
+	case sftpReaddir:
+		h := s.handles[rd.string()]
+		if h == nil {
+			return testSFTPStatus(sftpFailure)
+		}
+		if h.listed {
+			return testSFTPStatus(sftpEOF)
+		}
+		h.listed = true
+		reply := sftpBuilder{}.uint32(uint32(len(h.names)))
+		for _, name := range h.names {
+			node := s.nodes[path.Join(h.name, name)]
+			if node == nil {
+				node = &testSFTPNode{mode: posixRegular | 0o644}
+			}
+			reply = reply.string(name).string(name).attrs(node.attrs())
+		}
+		return sftpName, reply
+	case sftpRead:
+		h, off, n := s.handles[rd.string()], rd.uint64(), rd.uint32()
+		if h == nil || s.nodes[h.name] == nil {
+			return testSFTPStatus(sftpFailure)
+		}
+		data := s.nodes[h.name].data
+		if off >= uint64(len(data)) {
+			return testSFTPStatus(sftpEOF)
+		}
+		return sftpData, sftpBuilder{}.bytes(data[off:min(off+uint64(n), uint64(len(data)))])
+	case sftpWrite:
+		h, off, p := s.handles[rd.string()], rd.uint64(), rd.bytes()
+		if h == nil || s.nodes[h.name] == nil {
+			return testSFTPStatus(sftpFailure)
+		}
+		node := s.nodes[h.name]
+		if end := int(off) + len(p); end > len(node.data) {
+			node.data = append(node.data, make([]byte, end-len(node.data))...)
+		}
+		copy(node.data[off:], p)
+		return testSFTPStatus(sftpOK)
+	case sftpClose:
+		delete(s.handles, rd.string())
+		return testSFTPStatus(sftpOK)
+	case sftpMkdir:
+		name, attrs := rd.string(), rd.attrs()
+		if s.nodes[name] != nil || !s.isDir(path.Dir(name)) {
+			return testSFTPStatus(sftpFailure)
+		}
+		s.nodes[name] = &testSFTPNode{mode: posixDir | attrs.mode&0o7777}
+		return testSFTPStatus(sftpOK)
+	case sftpRmdir:
+		name := rd.string()
+		if !s.isDir(name) || len(s.children(name)) > 0 {
+			return testSFTPStatus(sftpFailure)
+		}
+		delete(s.nodes, name)
+		return testSFTPStatus(sftpOK)
+	case sftpRemove:
+		name := rd.string()
+		if s.nodes[name] == nil {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		if s.isDir(name) {
+			return testSFTPStatus(sftpFailure)
+		}
+		delete(s.nodes, name)
+		return testSFTPStatus(sftpOK)
+	case sftpSymlink:
+		target, name := rd.string(), rd.string()
+		if s.nodes[name] != nil || !s.isDir(path.Dir(name)) {
+			return testSFTPStatus(sftpFailure)
+		}
+		s.nodes[name] = &testSFTPNode{mode: posixSymlink | 0o777, data: []byte(target)}
+		return testSFTPStatus(sftpOK)
+	case sftpReadlink:
+		name := rd.string()
+		node := s.nodes[name]
+		if node == nil || node.mode&posixTypeMask != posixSymlink {
+			return testSFTPStatus(sftpNoSuchFile)
+		}
+		return sftpName, sftpBuilder{}.uint32(1).string(string(node.data)).string("").attrs(sftpAttributes{})
+	}
+	return testSFTPStatus(sftpOpUnsupported)
+}
+
+func (s *testSFTPServer) open(h *testSFTPHandle) (byte, sftpBuilder) {
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.handles[id] = h
+	return sftpHandle, sftpBuilder{}.string(id)
+}
+
+func (s *testSFTPServer) isDir(name string) bool {
+	node := s.nodes[name]
+	return node != nil && node.mode&posixTypeMask == posixDir
+}
+
+// children returns the names in directory dir, sorted.
+func (s *testSFTPServer) children(dir string) []string {
+	var names []string
+	for name := range s.nodes {
+		if name != "/" && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// writeTestTree creates tree, in the form newTestSFTPServer takes, under the
+// local directory root.
+func writeTestTree(t *testing.T, root string, tree map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(tree)) {
+		value := tree[name]
+		local := filepath.Join(root, filepath.FromSlash(strings.TrimSuffix(name, "/")))
+		var err error
+		switch {
+		case strings.HasSuffix(name, "/"):
+			err = os.MkdirAll(local, 0o755)
+		case strings.HasPrefix(value, "-> "):
+			err = os.Symlink(filepath.FromSlash(strings.TrimPrefix(value, "-> ")), local)
+		default:
+			err = os.WriteFile(local, []byte(value), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestTree returns what is under the local directory root, in the form
+// newTestSFTPServer takes.
+func readTestTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || name == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case entry.IsDir():
+			tree[rel+"/"] = ""
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + filepath.ToSlash(target)
+		default:
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func newTestTransfer(t *testing.T, s *testSFTPServer) *transfer {
+	return &transfer{
+		sftp: newTestSFTPClient(t, s.serve), host: "server", recursive: true,
+		progress: newProgress(), workers: make(chan struct{}, transferWorkers),
+	}
+}
+
+func TestGetTree(t *testing.T) {
+	tree := map[string]string{
+		"/r/":      "",
+		"/r/a":     "A",
+		"/r/sub/":  "",
+		"/r/sub/b": "B",
+		"/r/link":  "-> a",
+		"/escape":  "outside",
+		"/up/":     "",
+		"/up/c":    "outside",
+	}
+	copied := map[string]string{"a": "A", "sub/": "", "sub/b": "B", "link": "-> a"}
+	tests := []struct {
+		name       string
+		listings   map[string][]string
+		unreadable string
+		want       map[string]string // under the target
+		failed     bool
+	}{
+		{name: "tree", want: copied},
+		{name: "dot entries", listings: map[string][]string{"/r": {".", "..", "a"}}, want: map[string]string{"a": "A"}},
+		{name: "file outside", listings: map[string][]string{"/r": {"a", "../escape"}}, want: map[string]string{"a": "A"}, failed: true},
+		{name: "directory outside", listings: map[string][]string{"/r/sub": {"b", "../../up"}}, want: copied, failed: true},
+		{name: "symlink outside", listings: map[string][]string{"/r": {"../r/link"}}, want: map[string]string{}, failed: true},
+		{name: "slash", listings: map[string][]string{"/r": {"sub/b"}}, want: map[string]string{}, failed: true},
+		{name: "absolute", listings: map[string][]string{"/r": {"/escape"}}, want: map[string]string{}, failed: true},
+		{name: "backslash", listings: map[string][]string{"/r": {`..\escape`}}, want: map[string]string{}, failed: true},
+		{name: "empty", listings: map[string][]string{"/r": {"", "a"}}, want: map[string]string{"a": "A"}, failed: true},
+		{name: "unreadable directory", unreadable: "/r/sub", want: map[string]string{"a": "A", "sub/": "", "link": "-> a"}, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSFTPServer(tree)
+			if tt.listings != nil {
+				s.listings = tt.listings
+			}
+			if tt.unreadable != "" {
+				s.unreadable[tt.unreadable] = true
+			}
+			// The target is two levels down, so that names climbing out
+			// of it would land in the temporary directory.
+			dir := t.TempDir()
+			local := filepath.Join(dir, "work", "copy")
+			if err := os.Mkdir(filepath.Dir(local), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			tr := newTestTransfer(t, s)
+			tr.get("/r", local, false)
+			tr.wg.Wait()
+
+			if tr.failed != tt.failed {
+				t.Errorf("failed = %v, want %v", tr.failed, tt.failed)
+			}
+			want := map[string]string{"work/": "", "work/copy/": ""}
+			for name, value := range tt.want {
+				want["work/copy/"+name] = value
+			}
+			if got := readTestTree(t, dir); !maps.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPutTree(t *testing.T) {
+	tree := map[string]string{"a": "A", "empty/": "", "sub/": "", "sub/b": "B", "sub/link": "-> ../a", "dangling": "-> missing"}
+	tests := []struct {
+		name   string
+		remote map[string]string // on the server before the copy
+		target string
+		want   map[string]string // under /copy
+	}{
+		{name: "new target", target: "/copy", want: tree},
+		{name: "into a directory", remote: map[string]string{"/copy/": ""}, target: "/copy", want: map[string]string{
+			"tree/": "", "tree/a": "A", "tree/empty/": "", "tree/sub/": "", "tree/sub/b": "B", "tree/sub/link": "-> ../a", "tree/dangling": "-> missing",
+		}},
+		{name: "over a copy", remote: map[string]string{"/copy/": "", "/copy/tree/": "", "/copy/tree/a": "old and longer", "/copy/tree/sub/": "", "/copy/tree/sub/link": "-> b"}, target: "/copy", want: map[string]string{
+			"tree/": "", "tree/a": "A", "tree/empty/": "", "tree/sub/": "", "tree/sub/b": "B", "tree/sub/link": "-> ../a", "tree/dangling": "-> missing",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "tree")
+			writeTestTree(t, root, tree)
+			s := newTestSFTPServer(tt.remote)
+			tr := newTestTransfer(t, s)
+			tr.put(root, tt.target, false)
+			tr.wg.Wait()
+
+			if tr.failed {
+				t.Error("failed = true")
+			}
+			if got := s.tree("/copy"); !maps.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
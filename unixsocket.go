@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// unixSocketScheme starts a -host naming a Unix domain socket the server
+// listens on, as in unix:///run/sshd.sock, rather than a TCP host.
+const unixSocketScheme = "unix://"
+
+// unixSocketPath returns the socket path of a unix:// host.
+func unixSocketPath(host string) (string, bool) {
+	return strings.CutPrefix(host, unixSocketScheme)
+}
+
+// dialUnixSocket wraps dial so that a unix:// address opens a connection to
+// the socket: a local one, or one on the last jump host when dial goes
+// through jump hosts. Other addresses are passed through.
+func dialUnixSocket(dial dialFunc) dialFunc {
+	return func(network, address string) (net.Conn, error) {
+		if path, ok := unixSocketPath(address); ok {
+			return dial("unix", path)
+		}
+		return dial(network, address)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// vaultClient talks to the SSH secrets engine of a HashiCorp Vault server.
+// Connection settings follow the Vault CLI: VAULT_ADDR, VAULT_TOKEN (or
+// ~/.vault-token) and VAULT_NAMESPACE.
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	role      string
+	principal string
+	http      *http.Client
+}
+
+// newVaultClient configures a client for signing with the given mount and role.
+func newVaultClient(mount, role, principal string) (*vaultClient, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	if token == "" {
+		return nil, errors.New("no Vault token: set VAULT_TOKEN or run 'vault login'")
+	}
+	return &vaultClient{
+		addr:      addr,
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		mount:     strings.Trim(mount, "/"),
+		role:      role,
+		principal: principal,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// signPublicKey submits a public key to Vault and returns the signed certificate.
+func (v *vaultClient) signPublicKey(pub ssh.PublicKey) (*ssh.Certificate, error) {
+	body, err := json.Marshal(map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(pub)),
+		"valid_principals": v.principal,
+		"cert_type":        "user",
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v1/%s/sign/%s", v.addr, v.mount, v.role)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading vault response failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(data, &failure)
+		return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(failure.Errors, "; "))
+	}
+
+	var result struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("parsing vault response failed: %w", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(result.Data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("parsing signed key failed: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("vault did not return a certificate")
+	}
+	return cert, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// verifier checks copied files against their copies on the other side, for
+// -verify. Only sha256 is offered: it is what sha256sum(1) computes on nearly
+// every server.
+type verifier struct {
+	client *ssh.Client
+	host   string      // for messages
+	sftp   *sftpClient // for reading files back, or nil
+}
+
+// newVerifier returns a verifier for algorithm, which must be "sha256", or
+// nil if algorithm is empty. Its connection is set once it is up.
+func newVerifier(algorithm, host string) (*verifier, error) {
+	switch algorithm {
+	case "":
+		return nil, nil
+	case "sha256":
+		return &verifier{host: host}, nil
+	}
+	return nil, fmt.Errorf("unsupported -verify algorithm %q; only sha256 is supported", algorithm)
+}
+
+// hash returns a hash for the local copy of a file, fed as it is copied.
+func (v *verifier) hash() hash.Hash {
+	return sha256.New()
+}
+
+// note returns what is added to the size in the line listing a verified
+// file.
+func (v *verifier) note() string {
+	if v == nil {
+		return ""
+	}
+	return ", sha256 verified"
+}
+
+// check compares local, the digest of the local copy, with that of the file
+// remote on the server, and returns a checksumError if they differ. The
+// server computes its digest with sha256sum or shasum; if it cannot run
+// commands, the file is read back over SFTP instead.
+func (v *verifier) check(remote string, local []byte) error {
+	sum, err := v.sum(remote)
+	if err != nil {
+		return fmt.Errorf("cannot verify %s:%s: %w", v.host, remote, err)
+	}
+	if !bytes.Equal(sum, local) {
+		return &checksumError{name: v.host + ":" + remote, local: local, remote: sum}
+	}
+	return nil
+}
+
+// sum returns the digest of the file name on the server, from sha256sum or
+// else by reading it back.
+func (v *verifier) sum(name string) ([]byte, error) {
+	sum, err := v.remoteSum(name)
+	if err != nil && v.sftp != nil {
+		sum, err = v.readBack(name)
+	}
+	return sum, err
+}
+
+// remoteSum runs sha256sum, or shasum where there is no sha256sum, on the
+// server.
+func (v *verifier) remoteSum(name string) ([]byte, error) {
+	session, err := v.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	quoted := shellQuote(name)
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	output, err := session.Output("sha256sum -- " + quoted + " 2>/dev/null || shasum -a 256 -- " + quoted)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("sha256sum failed: %w", err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return nil, errors.New("no digest from sha256sum")
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(fields[0], `\`))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("unexpected output from sha256sum: %q", fields[0])
+	}
+	return sum, nil
+}
+
+// readBack computes the digest of name by reading it over SFTP.
+func (v *verifier) readBack(name string) ([]byte, error) {
+	file, err := v.sftp.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := file.WriteTo(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// checksumError reports a copy whose digest differs from the original's.
+type checksumError struct {
+	name          string
+	local, remote []byte
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("CHECKSUM MISMATCH for %s: sha256 %x here, %x on the server", e.name, e.local, e.remote)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// watchCommand implements -watch: it runs cmd every interval, each time in a
+// new session over the same connection, and shows its latest output on a
+// cleared screen, as watch(1) does, until interrupted. Output that is not a
+// terminal gets each run after a header line instead. It returns 0 once
+// interrupted.
+func watchCommand(client *ssh.Client, address, cmd string, interval time.Duration, setup sessionSetup) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	fd := int(os.Stdout.Fd())
+	terminal := term.IsTerminal(fd)
+	for {
+		output, err := watchRun(client, cmd, setup)
+		header := fmt.Sprintf("Every %s: %s    %s: %s", interval, cmd, address, time.Now().Format(time.DateTime))
+		if status := exitStatus(err); status != 0 {
+			header += fmt.Sprintf("    [exit %d]", status)
+		}
+		var screen bytes.Buffer
+		if terminal {
+			screen.WriteString(clearScreen)
+			// Output longer than the screen would scroll the header away.
+			if _, height, err := term.GetSize(fd); err == nil {
+				output = firstLines(output, height-2)
+			}
+		}
+		screen.WriteString(header + "\n\n")
+		screen.Write(output)
+		setup.output(os.Stdout).Write(screen.Bytes())
+
+		select {
+		case <-stop:
+			if terminal {
+				fmt.Println()
+			}
+			return 0
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchRun runs cmd once in a new session and returns what it printed.
+func watchRun(client *ssh.Client, cmd string, setup sessionSetup) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		fatalConnection("Failed to create session: %v", err)
+	}
+	defer session.Close()
+	setup.prepare(session)
+	output, err := session.CombinedOutput(cmd)
+	var exitErr *ssh.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		output = append(output, fmt.Sprintf("memssh: %v\n", err)...)
+	}
+	return output, err
+}
+
+// firstLines returns the first n lines of b.
+func firstLines(b []byte, n int) []byte {
+	if n < 1 {
+		return nil
+	}
+	for i, c := range b {
+		if c == '\n' {
+			if n--; n == 0 {
+				return b[:i+1]
+			}
+		}
+	}
+	return b
+}